@@ -0,0 +1,298 @@
+package pprofweb
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// staleTempAge is the age of leftover temporary files in roots, e.g. of
+// relabeling interrupted by a crash, after which compact removes them.
+const staleTempAge = time.Hour
+
+// adminFlags select the roots of the admin commands like the flags of the
+// server.
+var adminFlags = []cli.Flag{
+	&cli.PathFlag{
+		Name:  "profiles",
+		Value: ".",
+		Usage: "directory of the default root",
+	},
+	&cli.StringSliceFlag{
+		Name:  "root",
+		Usage: "additional root in the format of the server's --root flag",
+	},
+	&cli.StringSliceFlag{
+		Name:  "extensions",
+		Value: cli.NewStringSlice(defaultProfileExtensions...),
+		Usage: "file extensions of profiles",
+	},
+}
+
+var adminCommand = &cli.Command{
+	Name:  "admin",
+	Usage: "maintain the profile storage of a server",
+	Subcommands: []*cli.Command{
+		{
+			Name: "compact",
+			Usage: "remove orphaned runtime metrics, abandoned resumable uploads, leftover temporary files, " +
+				"and empty directories, and move unreadable profiles to the trash",
+			Flags: append([]cli.Flag{
+				&cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "only print what would be removed",
+				},
+			}, adminFlags...),
+			Action: func(context *cli.Context) error {
+				roots, err := adminRoots(context)
+				if err != nil {
+					return err
+				}
+				extensions := context.StringSlice("extensions")
+				for _, root := range roots {
+					if err := compactRoot(context.App.Writer, root, extensions, context.Bool("dry-run"), time.Now()); err != nil {
+						return fmt.Errorf("compact %s: %w", root.path, err)
+					}
+				}
+				return nil
+			},
+		},
+		{
+			Name: "reindex",
+			Usage: "rebuild the index files of the roots from their profiles, reporting profiles whose hash no longer " +
+				"matches the index, and remove the index entries and runtime metrics of missing profiles",
+			Flags: append([]cli.Flag{
+				&cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "only print what would be changed",
+				},
+			}, adminFlags...),
+			Action: func(context *cli.Context) error {
+				roots, err := adminRoots(context)
+				if err != nil {
+					return err
+				}
+				var failed int
+				for _, root := range roots {
+					n, err := reindexRoot(context.App.Writer, root, context.StringSlice("extensions"), context.Bool("dry-run"), time.Now())
+					if err != nil {
+						return fmt.Errorf("reindex %s: %w", root.path, err)
+					}
+					failed += n
+				}
+				if failed > 0 {
+					return cli.Exit(fmt.Sprintf("%d profiles can't be read and aren't indexed; pprofweb admin compact moves them to the trash", failed), 1)
+				}
+				return nil
+			},
+		},
+	},
+}
+
+// adminRoots returns the roots of the flags of an admin command.
+func adminRoots(context *cli.Context) ([]*profileRoot, error) {
+	roots := []*profileRoot{{path: context.Path("profiles")}}
+	for _, def := range context.StringSlice("root") {
+		root, err := parseProfileRoot(def, defaultValidDuration, defaultMaxLifetime)
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, root)
+	}
+	return roots, nil
+}
+
+// reindexRoot rebuilds the index file of root from its profiles, hashing
+// and parsing each. It reports the profiles whose hash doesn't match their
+// index entry although their size and modification time do, which were
+// corrupted or replaced without changing them, and removes the entries and
+// runtime metrics of missing profiles. It prints each change to w and
+// returns the number of profiles that can't be read, which it leaves out of
+// the index.
+func reindexRoot(w io.Writer, root *profileRoot, extensions []string, dryRun bool, now time.Time) (int, error) {
+	old, err := root.readIndex()
+	if err != nil {
+		fmt.Fprintf(w, "rebuild %s: %v\n", root.filePath(indexFile), err)
+		old = make(map[string]indexEntry)
+	}
+	files, err := root.listProfiles(extensions)
+	if err != nil {
+		return 0, err
+	}
+	blobs := newBlobIndex()
+	entries := make(map[string]indexEntry, len(files))
+	profiles := make(map[string]bool, len(files))
+	failed := 0
+	for _, f := range files {
+		profiles[f.path] = true
+		var e versionEntry
+		var sum string
+		err := root.fetch(context.Background(), f)
+		if err == nil {
+			e, err = (*versionIndex)(nil).lookup(f.path, f.modTime)
+		}
+		if err == nil {
+			_, err = readRuntimeMetrics(f.path)
+		}
+		if err == nil {
+			sum, err = blobs.sum(f)
+		}
+		if err != nil {
+			fmt.Fprintf(w, "skip unreadable %s: %v\n", f.path, err)
+			failed++
+			continue
+		}
+		entry := indexEntry{Size: f.size, ModTime: f.modTime, SHA256: sum, Type: e.typ, Version: e.version}
+		entries[f.name] = entry
+		previous, ok := old[f.name]
+		switch {
+		case !ok:
+			fmt.Fprintf(w, "index %s\n", f.path)
+		case previous.matches(f) && previous.SHA256 != sum:
+			fmt.Fprintf(w, "reindex %s: hash %s doesn't match the index, %s\n", f.path, sum, previous.SHA256)
+		case !previous.equal(entry):
+			fmt.Fprintf(w, "reindex %s: changed\n", f.path)
+		}
+	}
+	var missing []string
+	for name := range old {
+		if _, ok := entries[name]; !ok && !profiles[root.filePath(name)] {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	for _, name := range missing {
+		fmt.Fprintf(w, "unindex %s: missing profile\n", root.filePath(name))
+	}
+
+	if err := removeOrphans(w, root, profiles, dryRun, now); err != nil {
+		return failed, err
+	}
+	if !dryRun && (len(missing) > 0 || !sameIndex(old, entries)) {
+		if err := root.writeIndex(entries); err != nil {
+			return failed, err
+		}
+	}
+	return failed, nil
+}
+
+// compactRoot removes the files of root no profile refers to and moves the
+// profiles that can't be parsed, e.g. truncated by a crash, to the trash,
+// where they can be restored from, unless they are pinned. It prints each
+// change to w.
+func compactRoot(w io.Writer, root *profileRoot, extensions []string, dryRun bool, now time.Time) error {
+	remove := func(filePath, reason string) {
+		fmt.Fprintf(w, "remove %s: %s\n", filePath, reason)
+		if !dryRun {
+			if err := os.RemoveAll(filePath); err != nil {
+				logger.Printf("compact: %v", err)
+			}
+		}
+	}
+
+	files, err := root.listProfiles(extensions)
+	if err != nil {
+		return err
+	}
+	pins, err := root.readPins()
+	if err != nil {
+		return err
+	}
+	profiles := make(map[string]bool)
+	for _, f := range files {
+		profiles[f.path] = true
+		_, parseErr := parseProfileFile(f.path)
+		if parseErr == nil {
+			continue
+		}
+		if _, ok := pins[f.name]; ok {
+			fmt.Fprintf(w, "keep pinned %s: %v\n", f.path, parseErr)
+			continue
+		}
+		trashed := root.trashPath(f.name, now)
+		fmt.Fprintf(w, "trash %s: %v\n", f.path, parseErr)
+		if dryRun {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(trashed), 0o755); err != nil {
+			return err
+		}
+		if err := os.Rename(f.path, trashed); err != nil {
+			return err
+		}
+		if err := moveRuntimeMetrics(f.path, trashed); err != nil {
+			return err
+		}
+	}
+
+	// resumable uploads are kept in memory and can't be resumed after a
+	// restart, but a running server may still be receiving one
+	uploads, err := os.ReadDir(root.filePath(uploadsDir))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, entry := range uploads {
+		info, err := entry.Info()
+		if err == nil && now.Sub(info.ModTime()) > resumableUploadIdle {
+			remove(filepath.Join(root.filePath(uploadsDir), entry.Name()), "abandoned resumable upload")
+		}
+	}
+
+	if err := removeOrphans(w, root, profiles, dryRun, now); err != nil {
+		return err
+	}
+
+	if !dryRun {
+		// not the root itself
+		entries, err := os.ReadDir(root.path)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				removeEmptyDirs(filepath.Join(root.path, entry.Name()))
+			}
+		}
+	}
+	return nil
+}
+
+// removeOrphans removes the runtime metrics of root whose profile isn't in
+// profiles, by path, and its leftover temporary files, printing each to w.
+func removeOrphans(w io.Writer, root *profileRoot, profiles map[string]bool, dryRun bool, now time.Time) error {
+	remove := func(filePath, reason string) {
+		fmt.Fprintf(w, "remove %s: %s\n", filePath, reason)
+		if !dryRun {
+			if err := os.Remove(filePath); err != nil {
+				logger.Printf("remove orphans: %v", err)
+			}
+		}
+	}
+	return filepath.Walk(root.path, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if filePath == root.filePath(trashDir) || filePath == root.filePath(uploadsDir) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		switch {
+		case strings.HasSuffix(filePath, runtimeMetricsSuffix):
+			if !profiles[strings.TrimSuffix(filePath, runtimeMetricsSuffix)] {
+				remove(filePath, "runtime metrics of a missing profile")
+			}
+		case strings.HasSuffix(filePath, ".tmp") && now.Sub(info.ModTime()) > staleTempAge:
+			remove(filePath, "leftover temporary file")
+		}
+		return nil
+	})
+}
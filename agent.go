@@ -0,0 +1,184 @@
+package pprofweb
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+var agentCommand = &cli.Command{
+	Name:  "agent",
+	Usage: "capture profiles of a service on a schedule or on SIGUSR1 and push them to a pprofweb server",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "target",
+			Required: true,
+			Usage:    "base URL of the service serving net/http/pprof, e.g. http://localhost:6060",
+		},
+		&cli.StringFlag{
+			Name:     "server",
+			Required: true,
+			Usage:    "URL of the pprofweb server",
+		},
+		&cli.StringFlag{
+			Name:    "token",
+			EnvVars: []string{"PPROFWEB_TOKEN"},
+			Usage:   "token of the profile root",
+		},
+		&cli.StringFlag{
+			Name:  "root",
+			Usage: "name of the profile root to store the profiles in",
+		},
+		&cli.StringFlag{
+			Name:  "service",
+			Usage: "directory of the profiles in the root; the target hostname by default",
+		},
+		&cli.StringSliceFlag{
+			Name:  "profiles",
+			Value: cli.NewStringSlice("cpu", "heap", "goroutine"),
+			Usage: "profile types to capture: cpu, heap, allocs, goroutine, block, mutex, or threadcreate",
+		},
+		&cli.DurationFlag{
+			Name:  "cpu-duration",
+			Value: 30 * time.Second,
+			Usage: "duration of CPU profiles",
+		},
+		&cli.StringFlag{
+			Name:  "target-bearer",
+			Usage: "secret of the bearer token of the target, e.g. env:NAME, file:/path, vault:path#field, aws-sm:name#field, or k8s:namespace/name#key",
+		},
+		&cli.StringFlag{
+			Name:  "target-cert",
+			Usage: "secret of the client certificate (PEM) for the target, with --target-key",
+		},
+		&cli.StringFlag{
+			Name:  "target-key",
+			Usage: "secret of the key (PEM) of the client certificate for the target",
+		},
+		&cli.StringFlag{
+			Name:  "target-ca",
+			Usage: "secret of the CA certificate (PEM) verifying the target",
+		},
+		&cli.StringFlag{
+			Name:  "schedule",
+			Value: "0 * * * *",
+			Usage: "cron expression (minute hour day month weekday) of the captures",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		target, err := url.Parse(context.String("target"))
+		if err != nil {
+			return err
+		}
+		schedule, err := parseCron(context.String("schedule"))
+		if err != nil {
+			return err
+		}
+		for _, t := range context.StringSlice("profiles") {
+			if _, ok := pprofEndpoints[t]; !ok {
+				return fmt.Errorf("unknown profile type %q", t)
+			}
+		}
+		credentials := &targetCredentials{logger: logger}
+		for _, key := range []string{"bearer", "cert", "key", "ca"} {
+			if ref := context.String("target-" + key); ref != "" {
+				if _, err := credentials.setCredential(key, ref); err != nil {
+					return err
+				}
+			}
+		}
+		if err := credentials.validate(); err != nil {
+			return fmt.Errorf("target: %w", err)
+		}
+		service := context.String("service")
+		if service == "" {
+			service = target.Hostname()
+		}
+		a := &agent{
+			target:      target,
+			credentials: credentials,
+			server:      context.String("server"),
+			token:       context.String("token"),
+			root:        context.String("root"),
+			service:     service,
+			profiles:    context.StringSlice("profiles"),
+			cpuDuration: context.Duration("cpu-duration"),
+			schedule:    schedule,
+		}
+
+		signals := make(chan os.Signal, 1)
+		if len(captureSignals) > 0 {
+			signal.Notify(signals, captureSignals...)
+		}
+		a.run(signals)
+		return nil
+	},
+}
+
+// agent captures profiles of a target and pushes them to a pprofweb server.
+type agent struct {
+	target      *url.URL
+	credentials *targetCredentials
+	server      string
+	token       string
+	root        string
+	service     string
+	profiles    []string
+	cpuDuration time.Duration
+	schedule    *cronSchedule
+}
+
+func (a *agent) run(signals <-chan os.Signal) {
+	logger.Printf("agent: capturing %v of %s", a.profiles, a.target)
+	for {
+		next := a.schedule.next(time.Now())
+		var timer *time.Timer
+		var scheduled <-chan time.Time
+		if !next.IsZero() {
+			timer = time.NewTimer(time.Until(next))
+			scheduled = timer.C
+		}
+		select {
+		case <-scheduled:
+		case sig := <-signals:
+			logger.Printf("agent: capturing on %v", sig)
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+		a.captureAll(time.Now())
+	}
+}
+
+// captureAll captures and pushes all profile types. Errors are logged, so a
+// failing type doesn't prevent the others.
+func (a *agent) captureAll(now time.Time) {
+	for _, t := range a.profiles {
+		profileURL, err := a.capture(t, now)
+		if err != nil {
+			logger.Printf("agent: %s: %v", t, err)
+			continue
+		}
+		logger.Printf("agent: %s: %s", t, profileURL)
+	}
+}
+
+// capture fetches the profile type t from the target and pushes it to the
+// server. It returns the URL of the profile.
+func (a *agent) capture(t string, now time.Time) (string, error) {
+	data, err := fetchPprofProfile(a.target, a.credentials, t, a.cpuDuration)
+	if err != nil {
+		return "", err
+	}
+	name := capturedProfileName(a.service, t, now)
+	uploaded, err := pushProfile(a.server, a.token, a.root, name, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	return uploaded.URL, nil
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package pprofweb
+
+import (
+	"os"
+	"syscall"
+)
+
+// captureSignals make the agent capture profiles immediately.
+var captureSignals = []os.Signal{syscall.SIGUSR1}
@@ -0,0 +1,6 @@
+package pprofweb
+
+import "os"
+
+// captureSignals is empty: Windows has no SIGUSR1.
+var captureSignals []os.Signal
@@ -0,0 +1,162 @@
+package pprofweb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// announcement is a message shown on all pages, e.g. of planned maintenance,
+// and the maintenance mode, in which no new sessions start while the loaded
+// ones keep working, so the server can be restarted without interrupting
+// its users.
+type announcement struct {
+	Text        string `json:"text"`
+	Maintenance bool   `json:"maintenance"`
+}
+
+// announcementState is the current announcement, changed by admins with
+// PUT /api/v1/announcement.
+type announcementState struct {
+	mu      sync.RWMutex
+	current announcement
+}
+
+func (a *announcementState) get() announcement {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.current
+}
+
+func (a *announcementState) set(current announcement) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.current = current
+}
+
+// maintenanceNote is added to the banner in maintenance mode.
+const maintenanceNote = "Maintenance: new profiles can't be opened; open views keep working."
+
+// snippet returns the banner of a, or "" if there is nothing to announce.
+func (a announcement) snippet() string {
+	var lines []string
+	if a.Text != "" {
+		lines = append(lines, html.EscapeString(a.Text))
+	}
+	if a.Maintenance {
+		lines = append(lines, maintenanceNote)
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return `<div id="pprofweb-announcement" style="position:fixed;top:0;left:0;right:0;z-index:1001;` +
+		`background:#fc3;color:#000;padding:4px 8px;font:13px sans-serif;text-align:center">` +
+		strings.Join(lines, "<br>") + `</div>`
+}
+
+// announce adds the banner of the current announcement to the HTML pages
+// served by handler.
+func (s *server) announce(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		snippet := s.announcement.get().snippet()
+		if snippet == "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		aw := &announcingWriter{ResponseWriter: w}
+		handler.ServeHTTP(aw, r)
+		if aw.buffered {
+			w.Write(insertBeforeBodyEnd(aw.body.Bytes(), []byte(snippet)))
+		}
+	})
+}
+
+// announcingWriter buffers successful HTML pages to add the banner; other
+// responses, e.g. downloads and event streams, pass through.
+type announcingWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	buffered    bool
+	body        bytes.Buffer
+}
+
+func (a *announcingWriter) WriteHeader(status int) {
+	if a.wroteHeader {
+		return
+	}
+	a.wroteHeader = true
+	header := a.Header()
+	a.buffered = status == http.StatusOK &&
+		strings.HasPrefix(header.Get("Content-Type"), "text/html") &&
+		header.Get("Content-Encoding") == ""
+	if a.buffered {
+		// the body grows
+		header.Del("Content-Length")
+	}
+	a.ResponseWriter.WriteHeader(status)
+}
+
+func (a *announcingWriter) Write(p []byte) (int, error) {
+	if !a.wroteHeader {
+		if a.Header().Get("Content-Type") == "" {
+			a.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		a.WriteHeader(http.StatusOK)
+	}
+	if a.buffered {
+		return a.body.Write(p)
+	}
+	return a.ResponseWriter.Write(p)
+}
+
+// Flush implements http.Flusher for streaming responses.
+func (a *announcingWriter) Flush() {
+	if f, ok := a.ResponseWriter.(http.Flusher); ok && !a.buffered {
+		f.Flush()
+	}
+}
+
+// checkMaintenance writes a 503 response and returns false in maintenance
+// mode, which starts no new sessions.
+func (s *server) checkMaintenance(w http.ResponseWriter) bool {
+	a := s.announcement.get()
+	if !a.Maintenance {
+		return true
+	}
+	message := "pprofweb is in maintenance: new profiles can't be opened, sessions already loaded keep working"
+	if a.Text != "" {
+		message += "\n" + a.Text
+	}
+	httpErrorCode(w, message, "maintenance", http.StatusServiceUnavailable)
+	return false
+}
+
+// announcementHandler serves GET /api/v1/announcement, the current
+// announcement as JSON, and PUT to change it, for admins.
+func (s *server) announcementHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, s.announcement.get())
+	case http.MethodPut:
+		if !s.requireRole(w, r, adminRole) {
+			return
+		}
+		var a announcement
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+			http.Error(w, fmt.Sprintf("invalid announcement: %v", err), http.StatusBadRequest)
+			return
+		}
+		a.Text = strings.TrimSpace(a.Text)
+		s.announcement.set(a)
+		s.logger.Printf("%s %s set the announcement %q, maintenance %t",
+			requestID(r.Context()), s.viewerName(r), a.Text, a.Maintenance)
+		writeJSON(w, a)
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,530 @@
+package pprofweb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/pprof/driver"
+)
+
+// The defaults of New, which are also the defaults of the flags of the
+// pprofweb command.
+const (
+	defaultValidDuration          = 10 * time.Minute
+	defaultMaxLifetime            = 24 * time.Hour
+	defaultMaxUploadSize          = 256 << 20
+	defaultMaxResumableUploadSize = 16 << 30
+	defaultConverterTimeout       = 5 * time.Minute
+	defaultConverterMaxOutput     = 256 << 20
+	defaultTempMaxAge             = time.Hour
+	defaultTempMaxSize            = 1 << 30
+	defaultCacheMaxSize           = 1 << 30
+	defaultMaxUploadURLDuration   = 24 * time.Hour
+	defaultTrashRetention         = 30 * 24 * time.Hour
+	defaultMaxGuestLinkDuration   = 24 * time.Hour
+	defaultPublicURL              = "http://localhost:8080"
+	defaultGaugeInterval          = 10 * time.Second
+	defaultMaxLocalSize           = 1 << 20
+	defaultJobWorkers             = 2
+	defaultSlowRequest            = 10 * time.Second
+	defaultFetchTimeout           = 30 * time.Second
+	defaultUploadMaxExpandedSize  = 1 << 30
+	defaultUploadMaxRatio         = 100
+)
+
+// logger logs the messages of the command, and the requests and errors of
+// servers without their own logger.
+var logger = log.Default()
+
+// Metrics receives the metrics of a Server, e.g. an adapter to the metrics
+// registry of the embedding service. Names are dotted like statsd's, e.g.
+// sessions.started, and tags are key:value pairs.
+type Metrics interface {
+	Count(name string, delta int64, tags ...string)
+	Gauge(name string, value float64, tags ...string)
+	Timing(name string, d time.Duration, tags ...string)
+}
+
+// noMetrics discards metrics.
+type noMetrics struct{}
+
+func (noMetrics) Count(name string, delta int64, tags ...string)      {}
+func (noMetrics) Gauge(name string, value float64, tags ...string)    {}
+func (noMetrics) Timing(name string, d time.Duration, tags ...string) {}
+
+// User is a user authenticated by the identity hook of WithIdentity.
+type User struct {
+	Name string
+	// Role is viewer, uploader, admin, or none.
+	Role string
+}
+
+// Screener screens uploaded profiles before they are stored or parsed, e.g.
+// with a virus scanner. Screen reads the upload name of size bytes from r. It
+// rejects the upload with an error wrapping ErrRejected, whose message is
+// returned to the uploader; other errors fail the upload as the screener
+// being unavailable.
+type Screener interface {
+	Screen(ctx context.Context, name string, size int64, r io.Reader) error
+}
+
+// ErrRejected is wrapped by the errors of Screeners rejecting an upload.
+var ErrRejected = errors.New("upload rejected")
+
+// Server serves the pages and API of pprofweb, to embed in other services.
+type Server struct {
+	s *server
+}
+
+// options are the settings of New.
+type options struct {
+	config      serverConfig
+	profiles    string
+	roots       []string
+	valid       time.Duration
+	lifetime    time.Duration
+	tempDir     string
+	tempMaxAge  time.Duration
+	tempMaxSize int64
+	// cacheDir and cacheMaxSize are of the profiles of roots in buckets.
+	cacheDir     string
+	cacheMaxSize int64
+	logger       *log.Logger
+	// scrapeConfig and targetsFile are loaded once the roots are known.
+	scrapeConfig string
+	targetsFile  string
+}
+
+// Option configures a Server created by New.
+type Option func(*options) error
+
+// New returns a server of the profiles in the current directory, with the
+// defaults of the pprofweb command, configured by opts. It starts purging
+// the trash and collecting temporary files in the background.
+func New(opts ...Option) (*Server, error) {
+	o := &options{
+		config: serverConfig{
+			allowedExtensions:      defaultProfileExtensions,
+			sniffContent:           true,
+			pprofArgs:              []string{"--symbolize", "none"},
+			maxUploadSize:          defaultMaxUploadSize,
+			maxResumableUploadSize: defaultMaxResumableUploadSize,
+			maxGuestLinkDuration:   defaultMaxGuestLinkDuration,
+			publicURL:              defaultPublicURL,
+			trashRetention:         defaultTrashRetention,
+			maxUploadURLDuration:   defaultMaxUploadURLDuration,
+			maxLocalSize:           defaultMaxLocalSize,
+			slowRequest:            defaultSlowRequest,
+			fetchTimeout:           defaultFetchTimeout,
+			sizeScreen:             sizeScreener{defaultUploadMaxExpandedSize, defaultUploadMaxRatio},
+		},
+		profiles:     ".",
+		valid:        defaultValidDuration,
+		lifetime:     defaultMaxLifetime,
+		tempMaxAge:   defaultTempMaxAge,
+		tempMaxSize:  defaultTempMaxSize,
+		cacheDir:     filepath.Join(os.TempDir(), "pprofweb-cache"),
+		cacheMaxSize: defaultCacheMaxSize,
+	}
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return nil, err
+		}
+	}
+
+	config := o.config
+	config.logger = o.logger
+	if config.logger == nil {
+		config.logger = logger
+	}
+	config.defaultRoot = &profileRoot{path: o.profiles, validDuration: o.valid, maxLifetime: o.lifetime}
+	for _, def := range o.roots {
+		root, err := parseProfileRoot(def, o.valid, o.lifetime)
+		if err != nil {
+			return nil, err
+		}
+		config.roots = append(config.roots, root)
+	}
+	var err error
+	if o.targetsFile != "" {
+		config.registry, err = loadTargetRegistry(o.targetsFile, config.defaultRoot, config.roots, config.logger)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if o.scrapeConfig != "" {
+		config.scrape, err = loadScrapeConfig(o.scrapeConfig, config.defaultRoot, config.roots, config.logger)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if o.tempDir != "" {
+		config.temp, err = newTempDir(o.tempDir, o.tempMaxAge, o.tempMaxSize, config.stats, config.logger)
+		if err != nil {
+			return nil, fmt.Errorf("temp dir: %w", err)
+		}
+	}
+	err = openBucketRoots(append([]*profileRoot{config.defaultRoot}, config.roots...), o.cacheDir, o.cacheMaxSize, config.stats, config.logger)
+	if err != nil {
+		return nil, err
+	}
+	config.sandbox, err = newSandbox(defaultConverterTimeout, 0, 0, defaultConverterMaxOutput, false)
+	if err != nil {
+		return nil, err
+	}
+	if config.temp != nil {
+		config.sandbox.tempDir = config.temp.path
+	}
+	s := newServer(config)
+	var gaugeInterval time.Duration
+	if config.stats != nil {
+		gaugeInterval = defaultGaugeInterval
+	}
+	s.start(gaugeInterval)
+	return &Server{s: s}, nil
+}
+
+// Handler returns the handler of the pages and API of the server, to serve
+// at the root of a host: links are absolute.
+func (s *Server) Handler() http.Handler {
+	return s.s.serveHandler()
+}
+
+// WithProfiles serves the profiles of the directory path, the default root,
+// or of the bucket s3://bucket/prefix/ with the AWS credentials and region of
+// the environment.
+func WithProfiles(path string) Option {
+	return func(o *options) error {
+		o.profiles = path
+		return nil
+	}
+}
+
+// WithRoot adds a named root of profiles in the format of the --root flag,
+// name=path[;valid=duration][;lifetime=duration][;host=hostname][;token=secret].
+func WithRoot(def string) Option {
+	return func(o *options) error {
+		o.roots = append(o.roots, def)
+		return nil
+	}
+}
+
+// WithExpiry sets how long sessions of profiles stay loaded without activity,
+// and at most regardless of activity, 0 for no limit. Roots may override it.
+func WithExpiry(idle, lifetime time.Duration) Option {
+	return func(o *options) error {
+		if idle <= 0 || lifetime < 0 {
+			return errors.New("the idle timeout of sessions must be positive")
+		}
+		o.valid = idle
+		o.lifetime = lifetime
+		return nil
+	}
+}
+
+// WithUploads enables uploading profiles of up to maxSize bytes, the default
+// if 0.
+func WithUploads(maxSize int64) Option {
+	return func(o *options) error {
+		o.config.allowUpload = true
+		if maxSize > 0 {
+			o.config.maxUploadSize = maxSize
+		}
+		return nil
+	}
+}
+
+// WithTempDir keeps the temporary files of converters in path, removing files
+// older than maxAge and the oldest files beyond maxSize bytes. It is passed
+// to them as TMPDIR; the environment of the process isn't changed. Without
+// it, converters use the temp directory of the process, which isn't cleaned.
+func WithTempDir(path string, maxAge time.Duration, maxSize int64) Option {
+	return func(o *options) error {
+		o.tempDir, o.tempMaxAge, o.tempMaxSize = path, maxAge, maxSize
+		return nil
+	}
+}
+
+// WithProfileCache keeps the profiles downloaded from roots in buckets in
+// dir, removing the least recently used ones beyond maxSize bytes.
+func WithProfileCache(dir string, maxSize int64) Option {
+	return func(o *options) error {
+		o.cacheDir, o.cacheMaxSize = dir, maxSize
+		return nil
+	}
+}
+
+// WithPublicURL sets the URL users reach the server at, used for links in
+// emails and exports.
+func WithPublicURL(u string) Option {
+	return func(o *options) error {
+		o.config.publicURL = u
+		return nil
+	}
+}
+
+// WithLogger logs the requests and errors of the server to l instead of the
+// standard logger.
+func WithLogger(l *log.Logger) Option {
+	return func(o *options) error {
+		o.logger = l
+		return nil
+	}
+}
+
+// WithMetrics sends the metrics of the server to m, including gauges of the
+// sessions, memory, and goroutines every 10 seconds.
+func WithMetrics(m Metrics) Option {
+	return func(o *options) error {
+		o.config.stats = m
+		return nil
+	}
+}
+
+// WithMiddleware wraps the handler of the server in mw outside of its
+// authentication, first outermost, e.g. for the auth middleware of the
+// embedding service. Request ids are set before the middleware runs.
+func WithMiddleware(mw ...func(http.Handler) http.Handler) Option {
+	return func(o *options) error {
+		o.config.middleware = append(o.config.middleware, mw...)
+		return nil
+	}
+}
+
+// WithIdentity authenticates users with identify, e.g. from the headers of
+// the auth proxy or the session cookie of the embedding service. It returns
+// the user of a request, ErrInvalidCredentials to reject it, or nil to
+// continue with the built-in authentication.
+func WithIdentity(identify func(r *http.Request) (*User, error)) Option {
+	return func(o *options) error {
+		o.config.identify = func(r *http.Request) (*user, error) {
+			u, err := identify(r)
+			if u == nil || err != nil {
+				return nil, err
+			}
+			role, err := parseRole(u.Role)
+			if err != nil {
+				return nil, fmt.Errorf("user %s: %w", u.Name, err)
+			}
+			return &user{name: u.Name, role: role}, nil
+		}
+		return nil
+	}
+}
+
+// WithDriverOptions customizes the pprof driver options of each session with
+// configure, called with the name of the profile, e.g. to set Obj for a
+// custom object tool, Sym for a symbolizer, or HTTPTransport for fetching
+// symbols. The server keeps its own Flagset, Fetch, UI, and HTTPServer.
+func WithDriverOptions(configure func(profile string, opts *driver.Options)) Option {
+	return func(o *options) error {
+		o.config.driverOptions = configure
+		return nil
+	}
+}
+
+// WithBrowserMode enables /local, which opens profiles of up to maxSize bytes
+// in the browser with the WASM build in dir, see cmd/pprofweb-wasm, or the
+// build embedded by go generate if dir is empty.
+func WithBrowserMode(dir string, maxSize int64) Option {
+	return func(o *options) error {
+		if dir != "" {
+			o.config.wasm = os.DirFS(dir)
+		} else if o.config.wasm = embeddedWasm(); o.config.wasm == nil {
+			return errors.New("the browser mode isn't embedded: build with go generate or pass its directory")
+		}
+		if maxSize > 0 {
+			o.config.maxLocalSize = maxSize
+		}
+		return nil
+	}
+}
+
+// WithDefaultProfile opens ref for requests of / without a profile: a
+// profile, latest for the newest profile of the root, or a directory ending
+// with a slash for the newest profile in it.
+func WithDefaultProfile(ref string) Option {
+	return func(o *options) error {
+		o.config.defaultProfile = ref
+		return nil
+	}
+}
+
+// WithJobWorkers sets the number of jobs of /api/v1/jobs run concurrently.
+func WithJobWorkers(n int) Option {
+	return func(o *options) error {
+		if n <= 0 {
+			return fmt.Errorf("job workers must be positive")
+		}
+		o.config.jobWorkers = n
+		return nil
+	}
+}
+
+// WithQuotas limits the bytes of the profiles each root may store and the
+// sessions it may have loaded at once, unless the root sets its own; 0 is
+// unlimited.
+func WithQuotas(storage int64, sessions int) Option {
+	return func(o *options) error {
+		o.config.storageQuota = storage
+		o.config.sessionQuota = sessions
+		return nil
+	}
+}
+
+// WithSMTP enables sharing via email with POST /api/v1/share-email: guest
+// links are emailed from the address from through the SMTP server addr,
+// host:port, with PLAIN authentication if user is set.
+func WithSMTP(addr, user, password, from string) Option {
+	return func(o *options) error {
+		o.config.smtpAddr = addr
+		o.config.smtpUser = user
+		o.config.smtpPassword = password
+		o.config.mailFrom = from
+		return nil
+	}
+}
+
+// WithAuditLog appends a JSON line per access grant, guest links and shares
+// via email, and per request proxied to a target to the file path.
+func WithAuditLog(path string) Option {
+	return func(o *options) error {
+		audit, err := openAuditLog(path)
+		if err != nil {
+			return err
+		}
+		o.config.auditLog = audit
+		return nil
+	}
+}
+
+// WithAnnouncement shows text on all pages, e.g. of planned maintenance, and
+// starts in maintenance mode, which starts no new sessions, if maintenance is
+// set. Admins change both with PUT /api/v1/announcement.
+func WithAnnouncement(text string, maintenance bool) Option {
+	return func(o *options) error {
+		o.config.announcement = announcement{Text: text, Maintenance: maintenance}
+		return nil
+	}
+}
+
+// WithScrapeConfig discovers targets with the scrape_configs of the
+// Prometheus configuration file path: static_configs, file_sd_configs, and
+// kubernetes_sd_configs of pods, with relabel_configs. Targets are named by
+// their label name, else job-instance, and stored in the root of their label
+// root below the directory of their label service, else the job.
+func WithScrapeConfig(path string) Option {
+	return func(o *options) error {
+		o.scrapeConfig = path
+		return nil
+	}
+}
+
+// WithS3Events copies the profiles created in the S3 bucket into the default
+// root as soon as S3 notifies about them: at POST /api/v1/s3-events, e.g.
+// from an SNS subscription, and from the SQS queue at queueURL unless it is
+// empty. It uses the AWS credentials and region of the environment.
+func WithS3Events(bucket, queueURL string) Option {
+	return func(o *options) error {
+		events, err := newS3Events(bucket, queueURL)
+		if err != nil {
+			return err
+		}
+		o.config.s3Events = events
+		return nil
+	}
+}
+
+// WithTargetsFile stores the targets added with POST /api/v1/targets in the
+// JSON file path, so they survive restarts. They are kept in memory without
+// it.
+func WithTargetsFile(path string) Option {
+	return func(o *options) error {
+		o.targetsFile = path
+		return nil
+	}
+}
+
+// WithSlowRequest logs requests taking longer than d, with the session and
+// the pprof view they render, and counts them in the metric
+// http.slow_requests. 0 logs none; the default is 10s.
+func WithSlowRequest(d time.Duration) Option {
+	return func(o *options) error {
+		o.config.slowRequest = d
+		return nil
+	}
+}
+
+// WithRescanInterval re-scans the profile roots every d for profiles written
+// by other systems without notifications: new and changed files, by size and
+// modification time, are hashed, indexed, and published to the profile feed.
+// 0, the default, disables it.
+func WithRescanInterval(d time.Duration) Option {
+	return func(o *options) error {
+		o.config.rescanInterval = d
+		return nil
+	}
+}
+
+// WithGraphDefaults sets the defaults of the options pruning the graph view
+// of sessions, like pprof's nodecount, nodefraction, and edgefraction, so
+// huge profiles render readable graphs. Links override them with
+// ?node_count=, ?node_fraction=, and ?edge_fraction=; 0 keeps pprof's
+// default.
+func WithGraphDefaults(nodeCount int, nodeFraction, edgeFraction float64) Option {
+	return func(o *options) error {
+		if err := validateGraphOptions(nodeCount, nodeFraction, edgeFraction); err != nil {
+			return err
+		}
+		o.config.nodeCount = nodeCount
+		o.config.nodeFraction = nodeFraction
+		o.config.edgeFraction = edgeFraction
+		return nil
+	}
+}
+
+// WithFetchHosts allows opening profiles from URLs with ?url=, e.g.
+// ?url=https://api.internal/debug/pprof/heap, if their host is one of hosts:
+// a host name, host:port, or *.domain for its subdomains. Redirects must stay
+// on allowed hosts, and fetches are limited to timeout and the maximum upload
+// size, so the server isn't an open proxy. The profiles aren't stored.
+func WithFetchHosts(hosts []string, timeout time.Duration) Option {
+	return func(o *options) error {
+		parsed, err := parseFetchHosts(hosts)
+		if err != nil {
+			return err
+		}
+		o.config.fetchHosts, o.config.fetchTimeout = parsed, timeout
+		return nil
+	}
+}
+
+// WithScreener adds a screener of uploads, run before they are stored or
+// parsed, after the screening of compression bombs and the screeners added
+// before.
+func WithScreener(sc Screener) Option {
+	return func(o *options) error {
+		o.config.screeners = append(o.config.screeners, sc)
+		return nil
+	}
+}
+
+// WithUploadScreening rejects compressed uploads that decompress to more
+// than maxExpanded bytes, or to more than maxRatio times their size beyond
+// 16 MiB, as compression bombs; 0 disables a limit.
+func WithUploadScreening(maxExpanded int64, maxRatio float64) Option {
+	return func(o *options) error {
+		if maxExpanded < 0 || maxRatio < 0 {
+			return errors.New("upload screening limits must not be negative")
+		}
+		o.config.sizeScreen = sizeScreener{maxExpanded, maxRatio}
+		return nil
+	}
+}
@@ -0,0 +1,111 @@
+package pprofweb
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// errorCodeHeader carries the code of an error from the handler to the JSON
+// envelope of the response; it isn't sent.
+const errorCodeHeader = "X-Pprofweb-Error-Code"
+
+// apiErrorBody is the JSON body of the error responses of the API, e.g.
+//
+//	{"error": {"code": "not_found", "message": "unknown target", "request_id": "..."}}
+type apiErrorBody struct {
+	Error apiError `json:"error"`
+}
+
+// apiError describes a failed API request for clients to handle.
+type apiError struct {
+	// Code is stable, unlike Message: the code of the handler, or of the
+	// HTTP status.
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Details are e.g. the allowed methods or when to retry.
+	Details   map[string]interface{} `json:"details,omitempty"`
+	RequestID string                 `json:"request_id,omitempty"`
+}
+
+// statusErrorCodes are the codes of errors without a code of the handler.
+var statusErrorCodes = map[int]string{
+	http.StatusBadRequest:            "bad_request",
+	http.StatusUnauthorized:          "unauthenticated",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusConflict:              "conflict",
+	http.StatusGone:                  "gone",
+	http.StatusPreconditionFailed:    "precondition_failed",
+	http.StatusRequestEntityTooLarge: "too_large",
+	http.StatusUnsupportedMediaType:  "unsupported_media_type",
+	http.StatusUnprocessableEntity:   "invalid",
+	http.StatusTooManyRequests:       "too_many_requests",
+	http.StatusInternalServerError:   "internal",
+	http.StatusNotImplemented:        "not_implemented",
+	http.StatusBadGateway:            "bad_gateway",
+	http.StatusServiceUnavailable:    "unavailable",
+	http.StatusGatewayTimeout:        "timeout",
+	http.StatusInsufficientStorage:   "insufficient_storage",
+}
+
+// httpErrorCode is http.Error with the code of the error for the JSON
+// envelope of API responses, for errors clients handle differently than
+// others of the same status.
+func httpErrorCode(w http.ResponseWriter, message, code string, status int) {
+	w.Header().Set(errorCodeHeader, code)
+	http.Error(w, message, status)
+}
+
+// isAPIRequest reports whether the errors of r are answered with the JSON
+// envelope. The pprof endpoints of targets proxied by the server answer with
+// the errors of the targets.
+func isAPIRequest(r *http.Request) bool {
+	p := r.URL.Path
+	if !strings.HasPrefix(p, "/api/") {
+		return false
+	}
+	return !(strings.HasPrefix(p, "/api/v1/targets/") && strings.Contains(p, "/debug/pprof"))
+}
+
+// writeAPIError writes the buffered plain text error of the response as the
+// JSON envelope.
+func (e *errorPageWriter) writeAPIError(id string) {
+	body := apiError{
+		Code:      e.code,
+		Message:   strings.TrimSpace(e.body.String()),
+		RequestID: id,
+	}
+	if body.Code == "" {
+		body.Code = statusErrorCodes[e.status]
+	}
+	if body.Code == "" {
+		body.Code = "error"
+	}
+	details := make(map[string]interface{})
+	if allow := e.Header().Get("Allow"); allow != "" {
+		details["allow"] = strings.Split(strings.ReplaceAll(allow, " ", ""), ",")
+	}
+	if retry, err := strconv.Atoi(e.Header().Get("Retry-After")); err == nil {
+		details["retry_after_seconds"] = retry
+	}
+	if len(details) > 0 {
+		body.Details = details
+	}
+	var b bytes.Buffer
+	json.NewEncoder(&b).Encode(apiErrorBody{body})
+	e.ResponseWriter.Write(b.Bytes())
+}
+
+// apiErrorMessage returns the message of the body of an error response of a
+// server, the JSON envelope or the plain text of older servers.
+func apiErrorMessage(body []byte) string {
+	var envelope apiErrorBody
+	if err := json.Unmarshal(body, &envelope); err == nil && envelope.Error.Message != "" {
+		return envelope.Error.Message
+	}
+	return strings.TrimSpace(string(body))
+}
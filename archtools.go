@@ -0,0 +1,106 @@
+package pprofweb
+
+import (
+	"debug/elf"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/pprof/profile"
+)
+
+// elfArchs maps the machines of ELF binaries to GOARCH names.
+var elfArchs = map[elf.Machine]string{
+	elf.EM_X86_64:  "amd64",
+	elf.EM_386:     "386",
+	elf.EM_AARCH64: "arm64",
+	elf.EM_ARM:     "arm",
+	elf.EM_PPC64:   "ppc64",
+	elf.EM_S390:    "s390x",
+	elf.EM_RISCV:   "riscv64",
+	elf.EM_MIPS:    "mips",
+}
+
+// parseArchTools parses definitions of the object tools for binaries of an
+// architecture like "arm64=/usr/aarch64-linux-gnu/bin" or
+// "arm64=objdump:/opt/cross/bin,addr2line:/opt/cross/bin", in the format of
+// pprof's --tools.
+func parseArchTools(defs []string) (map[string]string, error) {
+	tools := make(map[string]string)
+	for _, def := range defs {
+		arch, spec := splitKeyValue(def)
+		if arch == "" || spec == "" {
+			return nil, fmt.Errorf("arch tools %q: expected arch=[toolname:]path,...", def)
+		}
+		if tools[arch] != "" {
+			spec = tools[arch] + "," + spec
+		}
+		tools[arch] = spec
+	}
+	return tools, nil
+}
+
+// binaryArch returns the GOARCH name of the ELF binary at path, or an empty
+// string if it isn't one.
+func binaryArch(path string) string {
+	f, err := elf.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	arch := elfArchs[f.Machine]
+	if arch == "ppc64" && f.ByteOrder.String() == "LittleEndian" {
+		arch = "ppc64le"
+	}
+	return arch
+}
+
+// profileArch returns the architecture of the main binary of p found in the
+// binaries search path like pprof does, by build ID or file name, or an
+// empty string if it isn't found.
+func (s *server) profileArch(p *profile.Profile) string {
+	var main *profile.Mapping
+	for _, m := range p.Mapping {
+		if m.File != "" && !strings.HasPrefix(m.File, "[") {
+			main = m
+			break
+		}
+	}
+	if main == nil {
+		return ""
+	}
+	var candidates []string
+	for _, dir := range filepath.SplitList(s.binaries) {
+		if main.BuildID != "" {
+			candidates = append(candidates, filepath.Join(dir, main.BuildID), filepath.Join(dir, main.BuildID, filepath.Base(main.File)))
+		}
+		candidates = append(candidates, filepath.Join(dir, filepath.Base(main.File)))
+	}
+	candidates = append(candidates, main.File)
+	for _, path := range candidates {
+		if arch := binaryArch(path); arch != "" {
+			return arch
+		}
+	}
+	return ""
+}
+
+// archToolArgs returns the pprof flags selecting the object tools for the
+// architecture arch, the architecture of the binary of p if empty, before
+// the default tools. It returns nil if the architecture has no tools.
+func (s *server) archToolArgs(p *profile.Profile, arch string) []string {
+	if len(s.archTools) == 0 {
+		return nil
+	}
+	if arch == "" {
+		arch = s.profileArch(p)
+	}
+	tools := s.archTools[arch]
+	if tools == "" {
+		return nil
+	}
+	if s.tools != "" {
+		tools += "," + s.tools
+	}
+	return []string{"--tools", tools}
+}
@@ -0,0 +1,68 @@
+package pprofweb
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditEvent is a line of the audit log: who granted access to what, or
+// reached which target through the server.
+type auditEvent struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id,omitempty"`
+	Actor     string    `json:"actor"`
+	// Action is guest-link, guest-link-revoke, share-email, target-proxy,
+	// target-add, or target-remove.
+	Action     string     `json:"action"`
+	Recipients []string   `json:"recipients,omitempty"`
+	Profiles   []string   `json:"profiles,omitempty"`
+	Sessions   []string   `json:"sessions,omitempty"`
+	Expires    *time.Time `json:"expires,omitempty"`
+	// Target and Path are of requests proxied to targets; Path is the URL
+	// of added targets.
+	Target string `json:"target,omitempty"`
+	Path   string `json:"path,omitempty"`
+}
+
+// auditLog appends events as JSON lines to a file.
+type auditLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// openAuditLog opens the audit log at path for appending, creating it if
+// needed.
+func openAuditLog(path string) (*auditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{file: f}, nil
+}
+
+// audit records the event of the request r in the audit log, or in the log
+// of the server without --audit-log.
+func (s *server) audit(r *http.Request, event auditEvent) {
+	event.Time = time.Now().UTC()
+	event.RequestID = requestID(r.Context())
+	if event.Actor == "" {
+		event.Actor = s.viewerName(r)
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		s.logger.Printf("%s audit: %v", event.RequestID, err)
+		return
+	}
+	if s.auditLog == nil {
+		s.logger.Printf("audit: %s", line)
+		return
+	}
+	s.auditLog.mu.Lock()
+	defer s.auditLog.mu.Unlock()
+	if _, err := s.auditLog.file.Write(append(line, '\n')); err != nil {
+		s.logger.Printf("%s audit: %v: %s", event.RequestID, err, line)
+	}
+}
@@ -0,0 +1,192 @@
+package pprofweb
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// role is what a user may do. Each role includes the permissions of the
+// roles before it.
+type role int
+
+const (
+	noRole role = iota
+	// viewerRole opens profiles and sessions.
+	viewerRole
+	// uploaderRole also uploads profiles and captures profiles of targets.
+	uploaderRole
+	// adminRole also deletes profiles, ends sessions, and uses the admin
+	// pages, e.g. /usage.
+	adminRole
+)
+
+var roleNames = map[role]string{
+	noRole:       "none",
+	viewerRole:   "viewer",
+	uploaderRole: "uploader",
+	adminRole:    "admin",
+}
+
+func (r role) String() string {
+	return roleNames[r]
+}
+
+func parseRole(s string) (role, error) {
+	for r, name := range roleNames {
+		if name == s {
+			return r, nil
+		}
+	}
+	return noRole, fmt.Errorf("unknown role %q: must be viewer, uploader, admin, or none", s)
+}
+
+// user is an authenticated user.
+type user struct {
+	name string
+	role role
+}
+
+type userKey struct{}
+
+// requestUser returns the authenticated user of the request of ctx, or nil.
+func requestUser(ctx context.Context) *user {
+	u, _ := ctx.Value(userKey{}).(*user)
+	return u
+}
+
+// requestToken returns the bearer token of r, or its basic auth password.
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	if _, password, ok := r.BasicAuth(); ok {
+		return password
+	}
+	return ""
+}
+
+// authenticate requires users to log in with basic auth if an LDAP server is
+// configured. Requests with the bearer token of a root or the admin token pass
+// without a user, so API clients like pprofweb push keep working. Guests
+// with the cookie of a guest link may only use what it shares.
+//
+// The identify hook authenticates users before LDAP: it returns the user of
+// a request, ErrInvalidCredentials to reject it, or nil to continue with the
+// built-in authentication.
+func (s *server) authenticate(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if root := s.validSignature(r); root != nil {
+			handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), signedKey{}, root)))
+			return
+		}
+		if g := s.guestRequest(r); g != nil {
+			if !s.guestAllowed(g, r) {
+				http.Error(w, "forbidden: not shared with this guest link", http.StatusForbidden)
+				return
+			}
+			handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), guestKey{}, g)))
+			return
+		}
+		if s.identify != nil {
+			u, err := s.identify(r)
+			if err == ErrInvalidCredentials {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			if err != nil {
+				s.logger.Printf("%s identify: %v", requestID(r.Context()), err)
+				http.Error(w, "authentication failed", http.StatusServiceUnavailable)
+				return
+			}
+			if u != nil {
+				if u.role == noRole {
+					http.Error(w, "forbidden: no role assigned", http.StatusForbidden)
+					return
+				}
+				handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, u)))
+				return
+			}
+		}
+		if s.ldap == nil || strings.HasPrefix(r.URL.Path, "/guest/") {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if token := requestToken(r); strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") &&
+			(s.rootToken(token) || (s.adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) == 1)) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		name, password, ok := r.BasicAuth()
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="pprofweb"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		u, err := s.ldap.authenticate(name, password)
+		if err == ErrInvalidCredentials {
+			w.Header().Set("WWW-Authenticate", `Basic realm="pprofweb"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			s.logger.Printf("%s ldap: %v", requestID(r.Context()), err)
+			http.Error(w, "authentication failed", http.StatusServiceUnavailable)
+			return
+		}
+		if u.role == noRole {
+			http.Error(w, "forbidden: no role assigned", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, u)))
+	})
+}
+
+// rootToken reports whether token is the token of a root.
+func (s *server) rootToken(token string) bool {
+	for _, root := range append([]*profileRoot{s.defaultRoot}, s.roots...) {
+		if root.token != "" && root.authorizedToken(token) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestRole returns the role of r: the role of its user, viewer for
+// guests, admin with the admin token, and uploader otherwise. Without an authentication backend
+// anybody is an uploader; with one only API clients with a root token get
+// here without a user.
+func (s *server) requestRole(r *http.Request) role {
+	if u := requestUser(r.Context()); u != nil {
+		return u.role
+	}
+	if requestGuest(r.Context()) != nil {
+		return viewerRole
+	}
+	if s.adminToken != "" && subtle.ConstantTimeCompare([]byte(requestToken(r)), []byte(s.adminToken)) == 1 {
+		return adminRole
+	}
+	return uploaderRole
+}
+
+// requireRole writes an error response if r doesn't have the role needed and
+// reports whether the request may continue. Requests without a user are asked
+// for the admin token.
+func (s *server) requireRole(w http.ResponseWriter, r *http.Request, needed role) bool {
+	if s.requestRole(r) >= needed {
+		return true
+	}
+	if requestUser(r.Context()) != nil || requestGuest(r.Context()) != nil {
+		httpErrorCode(w, fmt.Sprintf("forbidden: requires role %s", needed), "role_required", http.StatusForbidden)
+		return false
+	}
+	if s.adminToken == "" && s.ldap == nil {
+		httpErrorCode(w, "admin functions are disabled: set --admin-token", "admin_disabled", http.StatusForbidden)
+		return false
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="pprofweb admin"`)
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+	return false
+}
@@ -0,0 +1,358 @@
+package pprofweb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// baselinesFile is the file of a root recording the baselines of its
+// services as a JSON array.
+const baselinesFile = ".baselines.json"
+
+// baseline designates a stored profile as the baseline of a release of a
+// service, which diffs and gates resolve instead of hard-coded paths.
+type baseline struct {
+	// Service is the top level directory of the service in the root.
+	Service string `json:"service"`
+	Version string `json:"version"`
+	// Type is the profile type, e.g. cpu: a release has a baseline of each.
+	Type    string    `json:"type"`
+	Profile string    `json:"profile"`
+	By      string    `json:"by"`
+	Time    time.Time `json:"time"`
+	// SHA256 is the hash of the profile in responses, to download it from
+	// /api/v1/blobs/.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// baselineRequest is the JSON body of POST /api/v1/baselines.
+type baselineRequest struct {
+	Profile string `json:"profile"`
+	// Service is the top level directory of the profile by default.
+	Service string `json:"service"`
+	// Version is the version label of the profile by default.
+	Version string `json:"version"`
+}
+
+// readBaselines returns the baselines of root, which are relative to it.
+func (root *profileRoot) readBaselines() ([]baseline, error) {
+	data, err := os.ReadFile(root.filePath(baselinesFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var baselines []baseline
+	if err := json.Unmarshal(data, &baselines); err != nil {
+		return nil, fmt.Errorf("%s: %w", root.filePath(baselinesFile), err)
+	}
+	return baselines, nil
+}
+
+// updateBaselines changes the baselines of root with update and writes them
+// back if it succeeds.
+func (s *server) updateBaselines(root *profileRoot, update func([]baseline) ([]baseline, error)) error {
+	s.baselinesMu.Lock()
+	defer s.baselinesMu.Unlock()
+	baselines, err := root.readBaselines()
+	if err != nil {
+		return err
+	}
+	baselines, err = update(baselines)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(baselines, "", "  ")
+	if err != nil {
+		return err
+	}
+	filePath := root.filePath(baselinesFile)
+	if err := os.WriteFile(filePath+".tmp", data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(filePath+".tmp", filePath)
+}
+
+// sortBaselines orders baselines by service and type, and the releases of
+// each latest first.
+func sortBaselines(baselines []baseline) {
+	sort.SliceStable(baselines, func(i, j int) bool {
+		a, b := baselines[i], baselines[j]
+		if a.Service != b.Service {
+			return a.Service < b.Service
+		}
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		av, aok := parseSemver(a.Version)
+		bv, bok := parseSemver(b.Version)
+		if aok && bok {
+			return av.compare(bv) > 0
+		}
+		return a.Time.After(b.Time)
+	})
+}
+
+// findBaseline returns the baseline of root for the profiles of type typ of
+// service: of release version if it is set, else of the highest release
+// below before, or the latest designated one if before is empty.
+func findBaseline(root *profileRoot, service, typ, version, before string) (baseline, error) {
+	baselines, err := root.readBaselines()
+	if err != nil {
+		return baseline{}, err
+	}
+	var limit semver
+	if version == "" && before != "" {
+		var ok bool
+		if limit, ok = parseSemver(before); !ok {
+			return baseline{}, &statusError{http.StatusBadRequest, fmt.Sprintf("version %q is not a semantic version", before)}
+		}
+	}
+	var best *baseline
+	var bestVersion semver
+	for i, b := range baselines {
+		if b.Service != service || b.Type != typ {
+			continue
+		}
+		switch {
+		case version != "":
+			if b.Version == version {
+				return b, nil
+			}
+		case before != "":
+			v, ok := parseSemver(b.Version)
+			if !ok || len(v.pre) > 0 || v.compare(limit) >= 0 {
+				continue
+			}
+			if best == nil || v.compare(bestVersion) > 0 {
+				best, bestVersion = &baselines[i], v
+			}
+		default:
+			if best == nil || b.Time.After(best.Time) {
+				best = &baselines[i]
+			}
+		}
+	}
+	if best == nil {
+		msg := fmt.Sprintf("no baseline of %s %s profiles", service, typ)
+		switch {
+		case version != "":
+			msg = fmt.Sprintf("no baseline of %s %s profiles of %s", service, typ, version)
+		case before != "":
+			msg = fmt.Sprintf("no baseline of %s %s profiles of a release before %s", service, typ, before)
+		}
+		return baseline{}, &statusError{http.StatusNotFound, msg}
+	}
+	return *best, nil
+}
+
+// headBaseline returns the reference of the baseline to compare head, the
+// profile name of root, to: the baseline of its service and type of release
+// version, or by default of the highest release below its version label.
+func headBaseline(root *profileRoot, name string, head *profile.Profile, version string) (string, error) {
+	service := profileService(name)
+	if service == "" {
+		return "", &statusError{http.StatusBadRequest, "the head is not in the directory of a service"}
+	}
+	b, err := findBaseline(root, service, string(detectProfileType(head, name)), version, profileVersion(head))
+	if err != nil {
+		return "", err
+	}
+	return root.reference(b.Profile), nil
+}
+
+// listBaselines returns the baselines of the roots r is authorized for,
+// optionally only of the service reference serviceRef and type typ, with
+// references instead of names.
+func (s *server) listBaselines(r *http.Request, serviceRef, typ string) []baseline {
+	listed := []baseline{}
+	for _, root := range append([]*profileRoot{s.defaultRoot}, s.roots...) {
+		if !root.authorized(r) {
+			continue
+		}
+		baselines, err := root.readBaselines()
+		if err != nil {
+			s.logger.Printf("%s baselines of %s: %v", requestID(r.Context()), root.path, err)
+			continue
+		}
+		for _, b := range baselines {
+			if (serviceRef != "" && root.reference(b.Service) != serviceRef) || (typ != "" && b.Type != typ) {
+				continue
+			}
+			listed = append(listed, s.baselineResponse(root, b))
+		}
+	}
+	sortBaselines(listed)
+	return listed
+}
+
+// baselineResponse returns b of root with references and the hash of its
+// profile, unless it no longer exists.
+func (s *server) baselineResponse(root *profileRoot, b baseline) baseline {
+	if f, err := root.stat(b.Profile); err == nil && root.fetch(context.Background(), f) == nil {
+		if sum, err := s.blobs.sum(f); err == nil {
+			b.SHA256 = sum
+		}
+	}
+	b.Service, b.Profile = root.reference(b.Service), root.reference(b.Profile)
+	return b
+}
+
+// baselinesHandler serves the baselines of releases: GET /api/v1/baselines
+// lists them, optionally of ?service= and ?type=, and POST a baselineRequest
+// designates a stored profile, which requires the uploader role and replaces
+// the baseline of the same service, version, and type. DELETE
+// /api/v1/baselines?service=&type=&version= removes one, which requires the
+// admin role. POST requires JSON, so browsers can't send it from other sites
+// without CORS.
+func (s *server) baselinesHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	switch r.Method {
+	case http.MethodGet:
+		if !s.requireRole(w, r, viewerRole) {
+			return
+		}
+		writeJSON(w, s.listBaselines(r, strings.Trim(query.Get("service"), "/"), query.Get("type")))
+	case http.MethodPost:
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+			http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+			return
+		}
+		var req baselineRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if req.Profile == "" {
+			http.Error(w, "missing profile", http.StatusBadRequest)
+			return
+		}
+		root, name := s.resolveRoot(r, req.Profile)
+		if !requireAuth(w, r, root) || !s.requireRole(w, r, uploaderRole) {
+			return
+		}
+		if reservedName(name) || !hasAllowedExtension(name, s.allowedExtensions) {
+			http.Error(w, errNotProfile.Error(), http.StatusBadRequest)
+			return
+		}
+		f, err := root.stat(name)
+		if err == nil {
+			err = root.fetch(r.Context(), f)
+		}
+		if err != nil {
+			http.Error(w, "profile not found", http.StatusNotFound)
+			return
+		}
+		e, err := s.versions.lookup(f.path, f.modTime)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not parse profile: %v", err), http.StatusBadRequest)
+			return
+		}
+		b := baseline{Service: profileService(f.name), Version: e.version, Type: string(e.typ), Profile: f.name,
+			By: s.viewerName(r), Time: time.Now().UTC()}
+		if req.Service != "" {
+			_, b.Service = s.resolveRoot(r, strings.Trim(req.Service, "/"))
+		}
+		if req.Version != "" {
+			b.Version = req.Version
+		}
+		switch {
+		case b.Service == "":
+			http.Error(w, "the profile is not in the directory of a service: set service", http.StatusBadRequest)
+			return
+		case b.Version == "":
+			http.Error(w, fmt.Sprintf("the profile has no %s label: set version", versionLabel), http.StatusBadRequest)
+			return
+		case e.typ == unknownProfile:
+			http.Error(w, "the type of the profile is unknown", http.StatusBadRequest)
+			return
+		}
+		err = s.updateBaselines(root, func(baselines []baseline) ([]baseline, error) {
+			for i, o := range baselines {
+				if o.Service == b.Service && o.Version == b.Version && o.Type == b.Type {
+					baselines[i] = b
+					return baselines, nil
+				}
+			}
+			return append(baselines, b), nil
+		})
+		if err != nil {
+			s.logger.Printf("%s baseline %s: %v", requestID(r.Context()), req.Profile, err)
+			http.Error(w, "could not set baseline", http.StatusInternalServerError)
+			return
+		}
+		s.logger.Printf("%s baseline of %s %s %s is %s", requestID(r.Context()), b.Service, b.Version, b.Type, root.filePath(name))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(s.baselineResponse(root, b))
+	case http.MethodDelete:
+		serviceRef, typ, version := strings.Trim(query.Get("service"), "/"), query.Get("type"), query.Get("version")
+		if serviceRef == "" || typ == "" || version == "" {
+			http.Error(w, "service, type, and version are required", http.StatusBadRequest)
+			return
+		}
+		root, service := s.resolveRoot(r, serviceRef)
+		if !requireAuth(w, r, root) || !s.requireRole(w, r, adminRole) {
+			return
+		}
+		err := s.updateBaselines(root, func(baselines []baseline) ([]baseline, error) {
+			for i, o := range baselines {
+				if o.Service == service && o.Version == version && o.Type == typ {
+					return append(baselines[:i], baselines[i+1:]...), nil
+				}
+			}
+			return nil, os.ErrNotExist
+		})
+		switch {
+		case os.IsNotExist(err):
+			http.Error(w, "no such baseline", http.StatusNotFound)
+		case err != nil:
+			s.logger.Printf("%s remove baseline %s %s %s: %v", requestID(r.Context()), serviceRef, version, typ, err)
+			http.Error(w, "could not remove baseline", http.StatusInternalServerError)
+		default:
+			s.logger.Printf("%s removed baseline of %s %s %s", requestID(r.Context()), serviceRef, version, typ)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+	}
+}
+
+// resolveBaselineHandler serves
+// GET /api/v1/baselines/resolve?service=api&type=cpu[&version=v1.2.0|&before=v1.3.0]:
+// the baseline of release version, of the highest release below before, or
+// the latest designated one, e.g. for CI gates to download it from
+// /api/v1/blobs/ by its hash.
+func (s *server) resolveBaselineHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	serviceRef, typ := strings.Trim(query.Get("service"), "/"), query.Get("type")
+	if serviceRef == "" || typ == "" {
+		http.Error(w, "service and type are required", http.StatusBadRequest)
+		return
+	}
+	root, service := s.resolveRoot(r, serviceRef)
+	if !requireAuth(w, r, root) || !s.requireRole(w, r, viewerRole) {
+		return
+	}
+	b, err := findBaseline(root, service, typ, query.Get("version"), query.Get("before"))
+	if err != nil {
+		writeLoadError(w, r, root, err)
+		return
+	}
+	writeJSON(w, s.baselineResponse(root, b))
+}
@@ -0,0 +1,363 @@
+package pprofweb
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// bisectLog is the file of a root the conclusions of bisects are
+	// appended to as JSON lines.
+	bisectLog = ".bisect.jsonl"
+	// maxBisectResults limits the conclusions shown on the bisect page.
+	maxBisectResults = 20
+)
+
+// bisectBuild is a profile of the series of a bisect.
+type bisectBuild struct {
+	file profileFile
+	ref  string
+	// version is the version label of the profile, if any.
+	version string
+}
+
+// bisectResult is a line of bisectLog: the first bad profile of a series
+// found by a bisect.
+type bisectResult struct {
+	Time    time.Time `json:"time"`
+	Actor   string    `json:"actor"`
+	Service string    `json:"service"`
+	Type    string    `json:"type"`
+	// Good is the last good profile and Bad the first bad one.
+	Good        string `json:"good"`
+	Bad         string `json:"bad"`
+	GoodVersion string `json:"good_version,omitempty"`
+	BadVersion  string `json:"bad_version,omitempty"`
+	Note        string `json:"note,omitempty"`
+}
+
+// bisectBuilds returns the profiles of series in the order of their version
+// labels if all are semantic versions, else in the order of series.
+func (s *server) bisectBuilds(root *profileRoot, series []profileFile) []bisectBuild {
+	builds := make([]bisectBuild, 0, len(series))
+	versions := make([]semver, 0, len(series))
+	allVersioned := true
+	for _, f := range series {
+		b := bisectBuild{file: f, ref: root.reference(f.name)}
+		if err := root.fetch(context.Background(), f); err != nil {
+			s.logger.Printf("bisect %s: %v", f.path, err)
+		} else if e, err := s.versions.lookup(f.path, f.modTime); err == nil {
+			b.version = e.version
+		}
+		v, ok := parseSemver(b.version)
+		allVersioned = allVersioned && ok
+		builds = append(builds, b)
+		versions = append(versions, v)
+	}
+	if allVersioned {
+		order := make([]int, len(builds))
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(i, j int) bool { return versions[order[i]].compare(versions[order[j]]) < 0 })
+		sorted := make([]bisectBuild, len(builds))
+		for i, o := range order {
+			sorted[i] = builds[o]
+		}
+		builds = sorted
+	}
+	return builds
+}
+
+// readBisectResults returns the conclusions recorded in root for the
+// profiles of type typ of service, latest first.
+func readBisectResults(root *profileRoot, service, typ string) ([]bisectResult, error) {
+	f, err := os.Open(root.filePath(bisectLog))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var results []bisectResult
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var result bisectResult
+		if err := json.Unmarshal(scanner.Bytes(), &result); err != nil {
+			continue
+		}
+		if result.Service == service && result.Type == typ {
+			results = append(results, result)
+		}
+	}
+	for i, j := 0, len(results)-1; i < j; i, j = i+1, j-1 {
+		results[i], results[j] = results[j], results[i]
+	}
+	if len(results) > maxBisectResults {
+		results = results[:maxBisectResults]
+	}
+	return results, scanner.Err()
+}
+
+// recordBisectResult appends result to the bisectLog of root.
+func (s *server) recordBisectResult(root *profileRoot, result bisectResult) error {
+	line, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	s.bisectMu.Lock()
+	defer s.bisectMu.Unlock()
+	f, err := os.OpenFile(root.filePath(bisectLog), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// bisectHandler guides a bisect over the profiles of a service stored as
+// service/type/file, ordered like bisectBuilds, to find the first bad build:
+// GET /bisect?service=api&type=cpu&good=a.pb.gz&bad=z.pb.gz shows the
+// profile midway between the last known good and the first known bad one
+// (by default the oldest and the latest), with diffs against both, and links
+// to mark it good or bad, until they are adjacent. POST records the
+// conclusion in the root, shown on later bisects of the service.
+func (s *server) bisectHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+	serviceRef := strings.Trim(r.FormValue("service"), "/")
+	typ := r.FormValue("type")
+	if typ == "" {
+		typ = "cpu"
+	}
+	page := bisectPage{Service: serviceRef, Type: typ}
+	if serviceRef == "" {
+		if r.Method == http.MethodPost {
+			http.Error(w, "service is required", http.StatusBadRequest)
+			return
+		}
+		s.writeBisectPage(w, r, &page)
+		return
+	}
+	root, service := s.resolveRoot(r, serviceRef)
+	if !requireAuth(w, r, root) {
+		return
+	}
+	series, ok := s.serviceProfiles(w, r, root, service, typ)
+	if !ok {
+		return
+	}
+	if len(series) < 2 {
+		http.Error(w, "bisecting needs at least two profiles", http.StatusBadRequest)
+		return
+	}
+	builds := s.bisectBuilds(root, series)
+	good, bad := 0, len(builds)-1
+	for _, param := range []struct {
+		name  string
+		index *int
+	}{{"good", &good}, {"bad", &bad}} {
+		name := r.FormValue(param.name)
+		if name == "" {
+			continue
+		}
+		found := false
+		for i, b := range builds {
+			if path.Base(b.file.name) == name {
+				*param.index, found = i, true
+			}
+		}
+		if !found {
+			http.Error(w, fmt.Sprintf("%s: no profile %s in %s/%s", param.name, name, service, typ), http.StatusBadRequest)
+			return
+		}
+	}
+	if good >= bad {
+		http.Error(w, "the good profile must come before the bad one", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		if !s.requireRole(w, r, viewerRole) {
+			return
+		}
+		if bad != good+1 {
+			http.Error(w, "the bisect is not done: profiles between good and bad are untested", http.StatusBadRequest)
+			return
+		}
+		result := bisectResult{
+			Time:        time.Now().UTC(),
+			Actor:       s.viewerName(r),
+			Service:     serviceRef,
+			Type:        typ,
+			Good:        builds[good].ref,
+			Bad:         builds[bad].ref,
+			GoodVersion: builds[good].version,
+			BadVersion:  builds[bad].version,
+			Note:        r.FormValue("note"),
+		}
+		if err := s.recordBisectResult(root, result); err != nil {
+			s.logger.Printf("%s bisect %s: %v", requestID(r.Context()), root.path, err)
+			http.Error(w, "could not record the result", http.StatusInternalServerError)
+			return
+		}
+		s.logger.Printf("%s bisect %s/%s: first bad %s", requestID(r.Context()), serviceRef, typ, result.Bad)
+		http.Redirect(w, r, "/bisect?"+url.Values{"service": {serviceRef}, "type": {typ}}.Encode(), http.StatusSeeOther)
+		return
+	}
+
+	si := r.FormValue("si")
+	stepURL := func(good, bad int) string {
+		query := url.Values{
+			"service": {serviceRef},
+			"type":    {typ},
+			"good":    {path.Base(builds[good].file.name)},
+			"bad":     {path.Base(builds[bad].file.name)},
+		}
+		if si != "" {
+			query.Set("si", si)
+		}
+		return "/bisect?" + query.Encode()
+	}
+	diffURL := func(base, head int) string {
+		query := url.Values{"base": {builds[base].ref}, "head": {builds[head].ref}}
+		if si != "" {
+			query.Set("si", si)
+		}
+		return "/diff?" + query.Encode()
+	}
+	mid := (good + bad) / 2
+	for i, b := range builds {
+		row := bisectRow{Profile: b.ref, Version: b.version, URL: "/?" + url.Values{"profile": {b.ref}}.Encode()}
+		switch {
+		case i == good:
+			row.State = "last good"
+		case i == bad:
+			row.State = "first bad"
+		case i < good:
+			row.State = "good"
+		case i > bad:
+			row.State = "bad"
+		case i == mid:
+			row.State = "testing"
+		default:
+			row.State = "untested"
+		}
+		page.Builds = append(page.Builds, row)
+	}
+	page.Good, page.Bad = page.Builds[good], page.Builds[bad]
+	page.GoodName, page.BadName = path.Base(builds[good].file.name), path.Base(builds[bad].file.name)
+	page.Done = bad == good+1
+	if page.Done {
+		page.DiffURL = diffURL(good, bad)
+	} else {
+		page.Mid = page.Builds[mid]
+		page.DiffGoodURL, page.DiffBadURL = diffURL(good, mid), diffURL(mid, bad)
+		page.MidGoodURL, page.MidBadURL = stepURL(mid, bad), stepURL(good, mid)
+		for n := bad - good; n > 1; n = (n + 1) / 2 {
+			page.StepsLeft++
+		}
+	}
+	page.Results, _ = readBisectResults(root, serviceRef, typ)
+	s.writeBisectPage(w, r, &page)
+}
+
+// bisectRow is a profile of the series on the bisect page.
+type bisectRow struct {
+	Profile, Version, URL string
+	// State is good, last good, testing, untested, first bad, or bad.
+	State string
+}
+
+type bisectPage struct {
+	Service, Type     string
+	Builds            []bisectRow
+	Good, Bad, Mid    bisectRow
+	GoodName, BadName string
+	Done              bool
+	StepsLeft         int
+	DiffURL           string
+	DiffGoodURL       string
+	DiffBadURL        string
+	MidGoodURL        string
+	MidBadURL         string
+	Results           []bisectResult
+}
+
+func (s *server) writeBisectPage(w http.ResponseWriter, r *http.Request, page *bisectPage) {
+	if err := bisectTemplate.Execute(w, page); err != nil {
+		s.logger.Printf("%s bisect: %v", requestID(r.Context()), err)
+	}
+}
+
+var bisectTemplate = template.Must(template.New("bisect").Parse(`<!doctype html>
+<html>
+<head><title>pprofweb bisect {{.Service}}</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin: 1em 0; }
+td, th { border: 1px solid #ccc; padding: 2px 8px; text-align: left; }
+tr.good td { color: #282; }
+tr.bad td { color: #b22; }
+tr.testing td { font-weight: bold; background: #ffd; }
+tr.untested td { color: #888; }
+.step a { margin-right: 1em; }
+</style>
+</head>
+<body>
+<h1>Bisect{{if .Service}} {{.Service}}/{{.Type}}{{end}}</h1>
+<form method="get" action="/bisect">
+<label>Service <input name="service" value="{{.Service}}" placeholder="api"></label>
+<label>Type <input name="type" value="{{.Type}}" size="8"></label>
+<button type="submit">Start</button>
+</form>
+{{if .Builds}}
+{{if .Done}}
+<p>The first bad profile is <a href="{{.Bad.URL}}">{{.Bad.Profile}}</a>{{with .Bad.Version}} ({{.}}){{end}},
+after <a href="{{.Good.URL}}">{{.Good.Profile}}</a>{{with .Good.Version}} ({{.}}){{end}}:
+<a href="{{.DiffURL}}">what changed</a>.</p>
+<form method="post" action="/bisect">
+<input type="hidden" name="service" value="{{.Service}}">
+<input type="hidden" name="type" value="{{.Type}}">
+<input type="hidden" name="good" value="{{.GoodName}}">
+<input type="hidden" name="bad" value="{{.BadName}}">
+<label>Note <input name="note" size="60" placeholder="e.g. the regression of the JSON encoding"></label>
+<button type="submit">Record the result</button>
+</form>
+{{else}}
+<p>Is <a href="{{.Mid.URL}}">{{.Mid.Profile}}</a>{{with .Mid.Version}} ({{.}}){{end}} good or bad? Compare it with
+<a href="{{.DiffGoodURL}}">the last good profile</a> and <a href="{{.DiffBadURL}}">the first bad profile</a>.
+About {{.StepsLeft}} more steps.</p>
+<p class="step"><a href="{{.MidGoodURL}}">It is good</a> <a href="{{.MidBadURL}}">It is bad</a></p>
+{{end}}
+<table>
+<tr><th>Profile</th><th>Version</th><th>State</th></tr>
+{{range .Builds}}<tr class="{{.State}}"><td><a href="{{.URL}}">{{.Profile}}</a></td><td>{{.Version}}</td><td>{{.State}}</td></tr>
+{{end}}</table>
+{{end}}
+{{if .Results}}
+<h2>Recorded results</h2>
+<table>
+<tr><th>Time</th><th>By</th><th>Last good</th><th>First bad</th><th>Note</th></tr>
+{{range .Results}}<tr><td>{{.Time.Format "2006-01-02 15:04"}}</td><td>{{.Actor}}</td><td>{{.Good}}{{with .GoodVersion}} ({{.}}){{end}}</td><td>{{.Bad}}{{with .BadVersion}} ({{.}}){{end}}</td><td>{{.Note}}</td></tr>
+{{end}}</table>
+{{end}}
+</body>
+</html>
+`))
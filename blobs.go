@@ -0,0 +1,209 @@
+package pprofweb
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// blobSum is the hash of a file at the time it had modTime and size.
+type blobSum struct {
+	modTime time.Time
+	size    int64
+	sum     string
+}
+
+// blobIndex caches the SHA-256 hashes of the stored profiles by path, so
+// only new and changed files are hashed.
+type blobIndex struct {
+	mu   sync.Mutex
+	sums map[string]blobSum
+}
+
+func newBlobIndex() *blobIndex {
+	return &blobIndex{sums: make(map[string]blobSum)}
+}
+
+// cached returns the hash of f if it was computed since f changed.
+func (x *blobIndex) cached(f profileFile) (string, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	cached, ok := x.sums[f.path]
+	if !ok || !cached.modTime.Equal(f.modTime) || cached.size != f.size {
+		return "", false
+	}
+	return cached.sum, true
+}
+
+// sum returns the hex SHA-256 hash of the contents of f.
+func (x *blobIndex) sum(f profileFile) (string, error) {
+	if sum, ok := x.cached(f); ok {
+		return sum, nil
+	}
+
+	file, err := os.Open(f.path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	x.mu.Lock()
+	x.sums[f.path] = blobSum{modTime: f.modTime, size: f.size, sum: sum}
+	x.mu.Unlock()
+	return sum, nil
+}
+
+// add caches the hash sum of f, e.g. of an upload the client sent the hash
+// of.
+func (x *blobIndex) add(f profileFile, sum string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.sums[f.path] = blobSum{modTime: f.modTime, size: f.size, sum: sum}
+}
+
+// validBlobSum reports whether sum is a lower case hex SHA-256 hash.
+func validBlobSum(sum string) bool {
+	if len(sum) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(sum)
+	return err == nil && strings.ToLower(sum) == sum
+}
+
+// etagMatches reports whether the If-None-Match header ifNoneMatch, a list
+// of entity tags or *, matches etag. Weak tags match their strong ones.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == etag || tag == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// blobContentType returns the content type of a stored profile starting with
+// data.
+func blobContentType(data []byte) string {
+	switch {
+	case strings.HasPrefix(string(data), string(gzipMagic)):
+		return "application/gzip"
+	case strings.HasPrefix(string(data), string(zstdMagic)):
+		return "application/zstd"
+	case strings.HasPrefix(string(data), string(xzMagic)):
+		return "application/x-xz"
+	case strings.HasPrefix(string(data), string(bzip2Magic)):
+		return "application/x-bzip2"
+	case isGoroutineDump(data) || isGoroutineCount(data):
+		return "text/plain; charset=utf-8"
+	case strings.HasPrefix(string(data), string(elfMagic)):
+		return "application/x-coredump"
+	}
+	return "application/vnd.google.protobuf"
+}
+
+// blobsHandler serves GET /api/v1/blobs/{sha256}: the original bytes of a
+// stored profile of the roots the request is authorized for with this hash.
+func (s *server) blobsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+	sum := strings.TrimPrefix(r.URL.Path, "/api/v1/blobs/")
+	if !validBlobSum(sum) {
+		http.Error(w, "not a lower case hex sha256", http.StatusBadRequest)
+		return
+	}
+	etag := `"` + sum + `"`
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	// look the hash up in the index first, and only fetch the profiles of
+	// buckets that weren't hashed since they changed
+	type rootFile struct {
+		root *profileRoot
+		f    profileFile
+	}
+	var unhashed []rootFile
+	for _, root := range append([]*profileRoot{s.defaultRoot}, s.roots...) {
+		if !root.authorized(r) {
+			continue
+		}
+		files, err := root.listProfiles(s.allowedExtensions)
+		if err != nil {
+			s.logger.Printf("%s list %s: %v", requestID(r.Context()), root.path, err)
+			continue
+		}
+		for _, f := range files {
+			fileSum, ok := s.blobs.cached(f)
+			if !ok {
+				unhashed = append(unhashed, rootFile{root, f})
+				continue
+			}
+			if fileSum != sum {
+				continue
+			}
+			if err := root.fetch(r.Context(), f); err != nil {
+				s.logger.Printf("%s blob %s: %v", requestID(r.Context()), f.path, err)
+				continue
+			}
+			s.serveBlob(w, r, root, f, etag)
+			return
+		}
+	}
+	for _, rf := range unhashed {
+		if err := rf.root.fetch(r.Context(), rf.f); err != nil {
+			s.logger.Printf("%s blob %s: %v", requestID(r.Context()), rf.f.path, err)
+			continue
+		}
+		fileSum, err := s.blobs.sum(rf.f)
+		if err != nil || fileSum != sum {
+			continue
+		}
+		s.serveBlob(w, r, rf.root, rf.f, etag)
+		return
+	}
+	http.Error(w, "blob not found", http.StatusNotFound)
+}
+
+func (s *server) serveBlob(w http.ResponseWriter, r *http.Request, root *profileRoot, f profileFile, etag string) {
+	file, err := os.Open(f.path)
+	if err != nil {
+		s.logger.Printf("%s blob %s: %v", requestID(r.Context()), f.path, err)
+		http.Error(w, "could not read blob", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || !info.ModTime().Equal(f.modTime) || info.Size() != f.size {
+		// replaced since it was hashed
+		http.Error(w, "blob changed, try again", http.StatusConflict)
+		return
+	}
+	head := make([]byte, sniffLen)
+	n, _ := io.ReadFull(file, head)
+
+	cacheControl := "public, max-age=31536000, immutable"
+	if root.token != "" || s.ldap != nil {
+		cacheControl = "private, max-age=31536000, immutable"
+	}
+	w.Header().Set("Content-Type", blobContentType(head[:n]))
+	w.Header().Set("Cache-Control", cacheControl)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+strings.ReplaceAll(path.Base(f.name), `"`, "")+`"`)
+	// ServeContent handles ranges and HEAD
+	http.ServeContent(w, r, "", f.modTime, file)
+}
@@ -0,0 +1,194 @@
+package pprofweb
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// buildLabels are sample labels identifying the build of the profiled
+// program, besides versionLabel.
+var buildLabels = []string{"go_version", "revision", "vcs.revision", "vcs.time", "vcs.modified", "commit", "build"}
+
+// profileDetails describe where a profile is from: its binaries, build, and
+// how it was captured.
+type profileDetails struct {
+	Mappings []mappingDetails
+	// Build are the values of build labels, most common first.
+	Build    []labelValues
+	Comments []string
+
+	SampleTypes       []string
+	DefaultSampleType string
+	PeriodType        string
+	Period            int64
+	time              time.Time
+	duration          time.Duration
+	Samples           int
+	Locations         int
+	Functions         int
+	DropFrames        string
+	KeepFrames        string
+}
+
+// mappingDetails describe a binary or shared library mapped into the
+// profiled process.
+type mappingDetails struct {
+	File    string
+	BuildID string
+	// Range is the address range and file offset.
+	Range string
+	// Symbolized is set if the profile has function names of the mapping.
+	Symbolized bool
+}
+
+// labelValues are the values of a label with the number of samples with
+// each, most common first.
+type labelValues struct {
+	Key    string
+	Values string
+}
+
+// newProfileDetails returns the details of p. It must be called before p is
+// passed to pprof, which can modify it.
+func newProfileDetails(p *profile.Profile) *profileDetails {
+	d := &profileDetails{
+		Comments:          p.Comments,
+		DefaultSampleType: p.DefaultSampleType,
+		Period:            p.Period,
+		time:              captureTime(p),
+		duration:          time.Duration(p.DurationNanos),
+		Samples:           len(p.Sample),
+		Locations:         len(p.Location),
+		Functions:         len(p.Function),
+		DropFrames:        p.DropFrames,
+		KeepFrames:        p.KeepFrames,
+	}
+	for _, st := range p.SampleType {
+		d.SampleTypes = append(d.SampleTypes, st.Type+"/"+st.Unit)
+	}
+	if p.PeriodType != nil {
+		d.PeriodType = p.PeriodType.Type + "/" + p.PeriodType.Unit
+	}
+	for _, m := range p.Mapping {
+		d.Mappings = append(d.Mappings, mappingDetails{
+			File:       m.File,
+			BuildID:    m.BuildID,
+			Range:      fmt.Sprintf("%#x-%#x @ %#x", m.Start, m.Limit, m.Offset),
+			Symbolized: m.HasFunctions,
+		})
+	}
+
+	for _, key := range append([]string{versionLabel}, buildLabels...) {
+		counts := make(map[string]int)
+		for _, s := range p.Sample {
+			for _, v := range s.Label[key] {
+				counts[v]++
+			}
+		}
+		if len(counts) == 0 {
+			continue
+		}
+		values := make([]string, 0, len(counts))
+		for v := range counts {
+			values = append(values, v)
+		}
+		sort.Slice(values, func(i, j int) bool {
+			if counts[values[i]] != counts[values[j]] {
+				return counts[values[i]] > counts[values[j]]
+			}
+			return values[i] < values[j]
+		})
+		for i, v := range values {
+			values[i] = v + " (" + strconv.Itoa(counts[v]) + " samples)"
+		}
+		d.Build = append(d.Build, labelValues{key, strings.Join(values, ", ")})
+	}
+	return d
+}
+
+// buildInfoHandler returns the handler of the build info page of the session
+// with info, showing the mappings, build IDs, build labels, and capture
+// parameters of its profile, to tell which binary and commit it is from.
+func (s *server) buildInfoHandler(info *sessionInfo) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+			return
+		}
+		prefs, err := s.requestPrefs(r)
+		if err != nil {
+			prefs = s.displayPrefs
+		}
+		d := info.details
+		page := struct {
+			*profileDetails
+			Title, Profile, Time, Duration string
+			GoVersion                      string
+		}{
+			profileDetails: d,
+			Title:          info.profileType.title(),
+			Profile:        info.profileName,
+			Time:           prefs.timestamp(d.time),
+		}
+		if d.duration > 0 {
+			page.Duration = prefs.duration(int64(d.duration))
+		}
+		if info.runtimeMetrics != nil {
+			page.GoVersion = info.runtimeMetrics.GoVersion
+		}
+		if err := buildInfoTemplate.Execute(w, page); err != nil {
+			s.logger.Printf("%s build info: %v", requestID(r.Context()), err)
+		}
+	}
+}
+
+var buildInfoTemplate = template.Must(template.New("buildinfo").Parse(`<!doctype html>
+<html>
+<head><title>{{.Profile}} build info</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin: 1em 0; }
+td, th { border: 1px solid #ccc; padding: 2px 8px; text-align: left; }
+code { font-size: 12px; }
+</style>
+</head>
+<body>
+<h1>{{.Title}} {{.Profile}}</h1>
+<p><a href="./">Back to the profile</a></p>
+<h2>Build</h2>
+{{if or .Build .GoVersion}}<table>
+{{if .GoVersion}}<tr><th>Go version (runtime metrics)</th><td>{{.GoVersion}}</td></tr>{{end}}
+{{range .Build}}<tr><th>{{.Key}}</th><td>{{.Values}}</td></tr>
+{{end}}</table>
+{{else}}<p>The profile has no build labels like <code>version</code> or <code>vcs.revision</code>. Go programs can add them
+with <code>pprof.Do</code> from <code>runtime/debug.ReadBuildInfo</code>; the build IDs of the mappings identify the binary.</p>
+{{end}}
+<h2>Mappings</h2>
+{{if .Mappings}}<table>
+<tr><th>File</th><th>Build ID</th><th>Addresses @ offset</th><th>Symbolized</th></tr>
+{{range .Mappings}}<tr><td><code>{{.File}}</code></td><td><code>{{.BuildID}}</code></td><td><code>{{.Range}}</code></td><td>{{if .Symbolized}}yes{{else}}no{{end}}</td></tr>
+{{end}}</table>
+{{else}}<p>The profile has no mappings.</p>
+{{end}}
+<h2>Capture</h2>
+<table>
+{{if .Time}}<tr><th>Captured</th><td>{{.Time}}</td></tr>{{end}}
+{{if .Duration}}<tr><th>Duration</th><td>{{.Duration}}</td></tr>{{end}}
+{{if .PeriodType}}<tr><th>Period</th><td>{{.Period}} {{.PeriodType}}</td></tr>{{end}}
+<tr><th>Sample types</th><td>{{range $i, $t := .SampleTypes}}{{if $i}}, {{end}}{{$t}}{{end}}</td></tr>
+{{if .DefaultSampleType}}<tr><th>Default sample type</th><td>{{.DefaultSampleType}}</td></tr>{{end}}
+<tr><th>Samples / locations / functions</th><td>{{.Samples}} / {{.Locations}} / {{.Functions}}</td></tr>
+{{if .DropFrames}}<tr><th>Dropped frames</th><td><code>{{.DropFrames}}</code></td></tr>{{end}}
+{{if .KeepFrames}}<tr><th>Kept frames</th><td><code>{{.KeepFrames}}</code></td></tr>{{end}}
+{{range .Comments}}<tr><th>Comment</th><td>{{.}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
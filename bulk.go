@@ -0,0 +1,386 @@
+package pprofweb
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/pprof/profile"
+)
+
+// archiveDir is the directory of a root archived profiles are moved to.
+const archiveDir = "archive"
+
+// maxBulkProfiles limits the profiles of one bulk request.
+const maxBulkProfiles = 1000
+
+// bulkRequest is the JSON body of POST /api/v1/profiles/bulk.
+type bulkRequest struct {
+	// Action is delete, archive, or relabel, or restore or purge of the
+	// trash IDs in Profiles.
+	Action   string   `json:"action"`
+	Profiles []string `json:"profiles"`
+	// Label is key=value set on all samples by relabel; key= removes it.
+	Label string `json:"label,omitempty"`
+}
+
+// bulkResult is the outcome of a bulk action for one profile.
+type bulkResult struct {
+	Profile string `json:"profile"`
+	// Moved is the new reference of an archived or restored profile.
+	Moved string `json:"moved,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// bulkHandler applies the action of a bulkRequest to many profiles. It
+// requires the admin role and JSON, so browsers can't send it from other
+// sites without CORS.
+func (s *server) bulkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.requireRole(w, r, adminRole) {
+		return
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+	var req bulkRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(req.Profiles) == 0 || len(req.Profiles) > maxBulkProfiles {
+		http.Error(w, fmt.Sprintf("between 1 and %d profiles are required", maxBulkProfiles), http.StatusBadRequest)
+		return
+	}
+
+	var action func(root *profileRoot, name string) (string, error)
+	switch req.Action {
+	case "delete":
+		action = func(root *profileRoot, name string) (string, error) {
+			return "", s.removeProfile(r, root, name)
+		}
+	case "archive":
+		action = func(root *profileRoot, name string) (string, error) {
+			return s.archiveProfile(r, root, name)
+		}
+	case "relabel":
+		i := strings.Index(req.Label, "=")
+		if i <= 0 {
+			http.Error(w, "label must be key=value", http.StatusBadRequest)
+			return
+		}
+		key, value := req.Label[:i], req.Label[i+1:]
+		action = func(root *profileRoot, name string) (string, error) {
+			return "", s.relabelProfile(r, root, name, key, value)
+		}
+	case "restore":
+		action = func(root *profileRoot, id string) (string, error) {
+			return s.restoreProfile(r, root, id)
+		}
+	case "purge":
+		action = func(root *profileRoot, id string) (string, error) {
+			return "", s.purgeProfile(r, root, id)
+		}
+	default:
+		http.Error(w, "action must be delete, archive, relabel, restore, or purge", http.StatusBadRequest)
+		return
+	}
+
+	results := make([]bulkResult, 0, len(req.Profiles))
+	for _, ref := range req.Profiles {
+		result := bulkResult{Profile: ref}
+		root, name := s.resolveRoot(r, ref)
+		if !root.authorized(r) {
+			result.Error = "unauthorized"
+		} else if moved, err := action(root, name); err != nil {
+			result.Error = err.Error()
+			if os.IsNotExist(err) {
+				result.Error = "profile not found"
+			}
+		} else if moved != "" {
+			result.Moved = root.reference(moved)
+		}
+		results = append(results, result)
+	}
+	writeJSON(w, results)
+}
+
+// archiveProfile moves the profile name of root into its archive directory
+// and returns the new name.
+func (s *server) archiveProfile(r *http.Request, root *profileRoot, name string) (string, error) {
+	if !hasAllowedExtension(name, s.allowedExtensions) && !strings.HasSuffix(name, coreExtension) {
+		return "", errNotProfile
+	}
+	name = path.Clean(strings.TrimPrefix(name, "/"))
+	if strings.HasPrefix(name, archiveDir+"/") {
+		return "", fmt.Errorf("already archived")
+	}
+	archived := path.Join(archiveDir, name)
+	f, err := root.stat(name)
+	if err == nil {
+		err = root.fetch(r.Context(), f)
+	}
+	if err != nil {
+		return "", err
+	}
+	from, to := f.path, root.filePath(archived)
+	if _, err := root.stat(archived); err == nil {
+		return "", fmt.Errorf("%s exists", archived)
+	}
+	if err := os.MkdirAll(filepath.Dir(to), 0o755); err != nil {
+		return "", err
+	}
+	if err := os.Rename(from, to); err != nil {
+		s.logger.Printf("%s archive %s: %v", requestID(r.Context()), from, err)
+		return "", err
+	}
+	if err := root.files().save(r.Context(), archived, false); err != nil {
+		s.logger.Printf("%s archive %s: %v", requestID(r.Context()), from, err)
+		os.Rename(to, from)
+		return "", err
+	}
+	if err := root.files().discard(r.Context(), f); err != nil {
+		s.logger.Printf("%s archive %s: %v", requestID(r.Context()), from, err)
+	}
+	if err := s.movePin(root, name, archived); err != nil {
+		s.logger.Printf("%s archive %s: %v", requestID(r.Context()), from, err)
+	}
+	s.logger.Printf("%s archived %s", requestID(r.Context()), from)
+	return archived, nil
+}
+
+// relabelProfile sets the label key of all samples of the profile name of
+// root to value, or removes it if value is empty.
+func (s *server) relabelProfile(r *http.Request, root *profileRoot, name, key, value string) error {
+	if !hasAllowedExtension(name, s.allowedExtensions) {
+		return errNotProfile
+	}
+	f, err := root.stat(name)
+	if err == nil {
+		err = root.fetch(r.Context(), f)
+	}
+	if err != nil {
+		return err
+	}
+	filePath := f.path
+	p, err := parseProfileFile(filePath)
+	if err != nil {
+		return err
+	}
+	for _, sample := range p.Sample {
+		if value == "" {
+			delete(sample.Label, key)
+			continue
+		}
+		if sample.Label == nil {
+			sample.Label = make(map[string][]string)
+		}
+		sample.Label[key] = []string{value}
+	}
+	if err := replaceProfile(filePath, p); err != nil {
+		s.logger.Printf("%s relabel %s: %v", requestID(r.Context()), filePath, err)
+		return err
+	}
+	if err := root.files().save(r.Context(), name, true); err != nil {
+		s.logger.Printf("%s relabel %s: %v", requestID(r.Context()), filePath, err)
+		return err
+	}
+	s.logger.Printf("%s relabeled %s with %s=%s", requestID(r.Context()), filePath, key, value)
+	return nil
+}
+
+// replaceProfile atomically replaces the file filePath with p.
+func replaceProfile(filePath string, p *profile.Profile) error {
+	tmp := filePath + ".tmp"
+	os.Remove(tmp)
+	if err := storeProfile(tmp, p); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filePath); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// profileBrowserHandler lists the profiles of all roots the request is
+// authorized for with GET /profiles, newest first, to open them or select
+// them for bulk actions. Archived profiles are listed with ?archived=true,
+// deleted profiles with ?trash=true.
+func (s *server) profileBrowserHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+	prefs, err := s.requestPrefs(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	archived := r.URL.Query().Get("archived") == "true"
+	trash := r.URL.Query().Get("trash") == "true"
+
+	type row struct {
+		// ID is the value of the checkbox, the trash ID of deleted profiles.
+		ID, Profile, URL, Size, ModTime string
+		modTime                         int64
+	}
+	type usage struct {
+		Tenant, Storage, StorageQuota, Sessions, SessionQuota string
+		// Percent is the share of the storage quota used, for its bar.
+		Percent int64
+	}
+	var rows []row
+	var usages []usage
+	for _, root := range append([]*profileRoot{s.defaultRoot}, s.roots...) {
+		if !root.authorized(r) {
+			continue
+		}
+		q := s.quotaStatus(root)
+		u := usage{Tenant: q.Tenant, Storage: prefs.bytes(q.StorageBytes), Sessions: strconv.Itoa(q.Sessions)}
+		if q.StorageQuota > 0 {
+			u.StorageQuota = prefs.bytes(q.StorageQuota)
+			u.Percent = 100 * q.StorageBytes / q.StorageQuota
+			if u.Percent > 100 {
+				u.Percent = 100
+			}
+		}
+		if q.SessionQuota > 0 {
+			u.SessionQuota = strconv.Itoa(q.SessionQuota)
+		}
+		usages = append(usages, u)
+		if trash {
+			trashed, err := root.listTrash()
+			if err != nil {
+				s.logger.Printf("%s trash of %s: %v", requestID(r.Context()), root.path, err)
+				continue
+			}
+			for _, t := range trashed {
+				rows = append(rows, row{
+					ID:      t.ID,
+					Profile: t.Profile,
+					Size:    prefs.bytes(t.Size),
+					ModTime: prefs.timestamp(t.Deleted),
+					modTime: t.Deleted.UnixNano(),
+				})
+			}
+			continue
+		}
+		files, err := root.listProfiles(s.allowedExtensions)
+		if err != nil {
+			s.logger.Printf("%s list %s: %v", requestID(r.Context()), root.path, err)
+			continue
+		}
+		for _, f := range files {
+			if strings.HasPrefix(f.name, archiveDir+"/") != archived {
+				continue
+			}
+			ref := root.reference(f.name)
+			rows = append(rows, row{
+				ID:      ref,
+				Profile: ref,
+				URL:     "/?profile=" + url.QueryEscape(ref),
+				Size:    prefs.bytes(f.size),
+				ModTime: prefs.timestamp(f.modTime),
+				modTime: f.modTime.UnixNano(),
+			})
+		}
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		return rows[i].modTime > rows[j].modTime
+	})
+
+	// users without the admin role can't manage profiles, API clients with
+	// the admin token can
+	canManage := s.requestRole(r) >= adminRole ||
+		(requestUser(r.Context()) == nil && requestGuest(r.Context()) == nil && s.adminToken != "")
+	if err := profileBrowserTemplate.Execute(w, struct {
+		Archived  bool
+		Trash     bool
+		Profiles  []row
+		Usage     []usage
+		CanManage bool
+	}{archived && !trash, trash, rows, usages, canManage}); err != nil {
+		s.logger.Printf("%s profiles: %v", requestID(r.Context()), err)
+	}
+}
+
+var profileBrowserTemplate = template.Must(template.New("profiles").Parse(`<!doctype html>
+<html>
+<head><title>pprofweb profiles</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin: 1em 0; }
+td, th { border: 1px solid #ccc; padding: 2px 8px; text-align: left; }
+.quota { display: inline-block; width: 100px; height: 8px; background: #eee; vertical-align: middle; }
+.quota span { display: block; height: 100%; background: #4a4; }
+</style>
+</head>
+<body>
+<h1>{{if .Trash}}Deleted profiles{{else if .Archived}}Archived profiles{{else}}Profiles{{end}} ({{len .Profiles}})</h1>
+<p>{{if or .Archived .Trash}}<a href="/profiles">Show profiles</a>{{end}}
+{{if not .Archived}}<a href="/profiles?archived=true">Show archived profiles</a>{{end}}
+{{if not .Trash}}<a href="/profiles?trash=true">Show deleted profiles</a>{{end}}</p>
+<p>{{range .Usage}}<b>{{.Tenant}}</b>: {{.Storage}}{{if .StorageQuota}} of {{.StorageQuota}}
+<span class="quota" title="{{.Percent}}% of the storage quota"><span style="width:{{.Percent}}%{{if ge .Percent 90}};background:#c44{{end}}"></span></span>{{end}}
+stored, {{.Sessions}}{{if .SessionQuota}} of {{.SessionQuota}}{{end}} sessions loaded<br>
+{{end}}</p>
+{{if .CanManage}}<p>
+{{if .Trash}}<select id="action"><option value="restore">Restore</option><option value="purge">Delete permanently</option></select>
+{{else}}<select id="action"><option value="archive">Archive</option><option value="relabel">Relabel</option><option value="delete">Delete</option></select>
+<input id="label" placeholder="key=value for relabel">{{end}}
+<input id="token" type="password" placeholder="admin token" autocomplete="off">
+<button onclick="bulk()">Apply to selected</button>
+{{if not .Trash}}<button onclick="series('/goroutine-leaks')">Find goroutine leaks</button>
+<button onclick="series('/heap-growth')">Show heap growth</button>{{end}}
+<span id="result"></span>
+</p>{{end}}
+<table>
+<tr>{{if .CanManage}}<th><input type="checkbox" onclick="document.querySelectorAll('.select').forEach(function(c){c.checked=this.checked},this)"></th>{{end}}<th>Profile</th><th>Size</th><th>{{if .Trash}}Deleted{{else}}Modified{{end}}</th></tr>
+{{range .Profiles}}<tr>{{if $.CanManage}}<td><input type="checkbox" class="select" value="{{.ID}}"></td>{{end}}<td>{{if .URL}}<a href="{{.URL}}">{{.Profile}}</a>{{else}}{{.Profile}}{{end}}</td><td>{{.Size}}</td><td>{{.ModTime}}</td></tr>
+{{end}}</table>
+{{if .CanManage}}<script>
+function series(page) {
+	var query = Array.prototype.map.call(document.querySelectorAll('.select:checked'), function(c) {
+		return 'profile=' + encodeURIComponent(c.value);
+	});
+	location.href = page + '?' + query.join('&');
+}
+function bulk() {
+	var profiles = Array.prototype.map.call(document.querySelectorAll('.select:checked'), function(c) { return c.value; });
+	var action = document.getElementById('action').value;
+	if (profiles.length == 0) { return; }
+	if ((action == 'delete' || action == 'purge') && !confirm('Delete ' + profiles.length + ' profiles?')) { return; }
+	var headers = {'Content-Type': 'application/json'};
+	var token = document.getElementById('token').value;
+	if (token) { headers['Authorization'] = 'Bearer ' + token; }
+	fetch('/api/v1/profiles/bulk', {method: 'POST', headers: headers,
+		body: JSON.stringify({action: action, profiles: profiles, label: (document.getElementById('label') || {}).value})})
+	.then(function(resp) {
+		if (!resp.ok) { return resp.text().then(function(t) { throw new Error(t); }); }
+		return resp.json();
+	}).then(function(results) {
+		var failed = results.filter(function(r) { return r.error; });
+		if (failed.length == 0) { location.reload(); return; }
+		document.getElementById('result').textContent = failed.length + ' failed: ' +
+			failed.map(function(r) { return r.profile + ': ' + r.error; }).join('; ');
+	}).catch(function(err) { document.getElementById('result').textContent = err.message; });
+}
+</script>{{end}}
+</body>
+</html>
+`))
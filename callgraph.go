@@ -0,0 +1,307 @@
+package pprofweb
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/google/pprof/profile"
+)
+
+// callGraph is the graph of functions calling each other in the samples of a
+// profile, weighted like pprof's graph view.
+type callGraph struct {
+	sampleType string
+	unit       string
+	nodes      []*callGraphNode
+	edges      []*callGraphEdge
+}
+
+type callGraphNode struct {
+	name string
+	// flat is the value of the samples with the function as leaf, cum with
+	// the function anywhere on the stack.
+	flat int64
+	cum  int64
+}
+
+// callGraphEdge is a call from the node caller to callee, weighted by the
+// value of the samples with the call on their stack.
+type callGraphEdge struct {
+	caller, callee int
+	weight         int64
+}
+
+// buildCallGraph returns the call graph of the values at sampleIndex. Every
+// sample adds its value once to each function and call on its stack, so
+// recursion isn't counted twice.
+func buildCallGraph(p *profile.Profile, sampleIndex int) *callGraph {
+	g := &callGraph{
+		sampleType: p.SampleType[sampleIndex].Type,
+		unit:       p.SampleType[sampleIndex].Unit,
+	}
+	nodeIndex := make(map[string]int)
+	node := func(name string) int {
+		i, ok := nodeIndex[name]
+		if !ok {
+			i = len(g.nodes)
+			nodeIndex[name] = i
+			g.nodes = append(g.nodes, &callGraphNode{name: name})
+		}
+		return i
+	}
+	edgeIndex := make(map[[2]int]*callGraphEdge)
+
+	for _, s := range p.Sample {
+		v := s.Value[sampleIndex]
+		frames := sampleFrames(s)
+		if v == 0 || len(frames) == 0 {
+			continue
+		}
+		seenNodes := make(map[int]bool)
+		seenEdges := make(map[[2]int]bool)
+		caller := -1
+		for _, frame := range frames {
+			callee := node(frame)
+			if !seenNodes[callee] {
+				seenNodes[callee] = true
+				g.nodes[callee].cum += v
+			}
+			if caller >= 0 {
+				key := [2]int{caller, callee}
+				e, ok := edgeIndex[key]
+				if !ok {
+					e = &callGraphEdge{caller: caller, callee: callee}
+					edgeIndex[key] = e
+					g.edges = append(g.edges, e)
+				}
+				if !seenEdges[key] {
+					seenEdges[key] = true
+					e.weight += v
+				}
+			}
+			caller = callee
+		}
+		g.nodes[caller].flat += v
+	}
+	sort.SliceStable(g.edges, func(i, j int) bool {
+		return g.edges[i].weight > g.edges[j].weight
+	})
+	return g
+}
+
+// GraphML, see http://graphml.graphdrawing.org/specification.html.
+type graphML struct {
+	XMLName xml.Name     `xml:"http://graphml.graphdrawing.org/xmlns graphml"`
+	Keys    []graphMLKey `xml:"key"`
+	Graph   graphMLGraph `xml:"graph"`
+}
+
+type graphMLKey struct {
+	ID       string `xml:"id,attr"`
+	For      string `xml:"for,attr"`
+	AttrName string `xml:"attr.name,attr"`
+	AttrType string `xml:"attr.type,attr"`
+}
+
+type graphMLGraph struct {
+	ID          string           `xml:"id,attr"`
+	EdgeDefault string           `xml:"edgedefault,attr"`
+	Data        []graphMLData    `xml:"data"`
+	Nodes       []graphMLElement `xml:"node"`
+	Edges       []graphMLElement `xml:"edge"`
+}
+
+type graphMLElement struct {
+	ID     string        `xml:"id,attr,omitempty"`
+	Source string        `xml:"source,attr,omitempty"`
+	Target string        `xml:"target,attr,omitempty"`
+	Data   []graphMLData `xml:"data"`
+}
+
+type graphMLData struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+// writeGraphML writes g as GraphML with the attributes name, flat, and cum of
+// nodes and weight of edges.
+func (g *callGraph) writeGraphML(w io.Writer) error {
+	doc := graphML{
+		Keys: []graphMLKey{
+			{"sample_type", "graph", "sample_type", "string"},
+			{"unit", "graph", "unit", "string"},
+			{"name", "node", "name", "string"},
+			{"flat", "node", "flat", "long"},
+			{"cum", "node", "cum", "long"},
+			{"weight", "edge", "weight", "long"},
+		},
+		Graph: graphMLGraph{
+			ID:          "callgraph",
+			EdgeDefault: "directed",
+			Data:        []graphMLData{{"sample_type", g.sampleType}, {"unit", g.unit}},
+		},
+	}
+	for i, n := range g.nodes {
+		doc.Graph.Nodes = append(doc.Graph.Nodes, graphMLElement{
+			ID: "n" + strconv.Itoa(i),
+			Data: []graphMLData{
+				{"name", n.name},
+				{"flat", strconv.FormatInt(n.flat, 10)},
+				{"cum", strconv.FormatInt(n.cum, 10)},
+			},
+		})
+	}
+	for _, e := range g.edges {
+		doc.Graph.Edges = append(doc.Graph.Edges, graphMLElement{
+			Source: "n" + strconv.Itoa(e.caller),
+			Target: "n" + strconv.Itoa(e.callee),
+			Data:   []graphMLData{{"weight", strconv.FormatInt(e.weight, 10)}},
+		})
+	}
+	return writeXML(w, doc)
+}
+
+// GEXF, the format of Gephi, see https://gexf.net/.
+type gexf struct {
+	XMLName xml.Name  `xml:"http://gexf.net/1.3 gexf"`
+	Version string    `xml:"version,attr"`
+	Graph   gexfGraph `xml:"graph"`
+}
+
+type gexfGraph struct {
+	DefaultEdgeType string         `xml:"defaultedgetype,attr"`
+	Attributes      gexfAttributes `xml:"attributes"`
+	Nodes           []gexfNode     `xml:"nodes>node"`
+	Edges           []gexfEdge     `xml:"edges>edge"`
+}
+
+type gexfAttributes struct {
+	Class     string          `xml:"class,attr"`
+	Attribute []gexfAttribute `xml:"attribute"`
+}
+
+type gexfAttribute struct {
+	ID    string `xml:"id,attr"`
+	Title string `xml:"title,attr"`
+	Type  string `xml:"type,attr"`
+}
+
+type gexfNode struct {
+	ID        string         `xml:"id,attr"`
+	Label     string         `xml:"label,attr"`
+	AttValues []gexfAttValue `xml:"attvalues>attvalue"`
+}
+
+type gexfAttValue struct {
+	For   string `xml:"for,attr"`
+	Value int64  `xml:"value,attr"`
+}
+
+type gexfEdge struct {
+	ID     string `xml:"id,attr"`
+	Source string `xml:"source,attr"`
+	Target string `xml:"target,attr"`
+	Weight int64  `xml:"weight,attr"`
+}
+
+// writeGEXF writes g as GEXF with the node attributes flat and cum, and the
+// edge weights.
+func (g *callGraph) writeGEXF(w io.Writer) error {
+	doc := gexf{
+		Version: "1.3",
+		Graph: gexfGraph{
+			DefaultEdgeType: "directed",
+			Attributes: gexfAttributes{
+				Class: "node",
+				Attribute: []gexfAttribute{
+					{ID: "flat", Title: "flat (" + g.unit + ")", Type: "long"},
+					{ID: "cum", Title: "cum (" + g.unit + ")", Type: "long"},
+				},
+			},
+		},
+	}
+	for i, n := range g.nodes {
+		doc.Graph.Nodes = append(doc.Graph.Nodes, gexfNode{
+			ID:        strconv.Itoa(i),
+			Label:     n.name,
+			AttValues: []gexfAttValue{{"flat", n.flat}, {"cum", n.cum}},
+		})
+	}
+	for i, e := range g.edges {
+		doc.Graph.Edges = append(doc.Graph.Edges, gexfEdge{
+			ID:     strconv.Itoa(i),
+			Source: strconv.Itoa(e.caller),
+			Target: strconv.Itoa(e.callee),
+			Weight: e.weight,
+		})
+	}
+	return writeXML(w, doc)
+}
+
+func writeXML(w io.Writer, v interface{}) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", " ")
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// callGraphFormats maps the format query parameter of call graph exports to
+// the content type.
+var callGraphFormats = map[string]string{
+	"graphml": "application/graphml+xml",
+	"gexf":    "application/gexf+xml",
+}
+
+// callGraphHandler serves the call graph of a stored profile with
+// GET /api/v1/callgraph?profile=cpu.pb.gz[&si=sample_type][&format=gexf]
+// as GraphML (the default) or GEXF for graph analysis tools like Gephi.
+func (s *server) callGraphHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = "graphml"
+	}
+	contentType, ok := callGraphFormats[format]
+	if !ok {
+		http.Error(w, "format must be graphml or gexf", http.StatusBadRequest)
+		return
+	}
+	if query.Get("profile") == "" {
+		http.Error(w, "profile is required", http.StatusBadRequest)
+		return
+	}
+	_, name, p, ok := s.openProfile(w, r, query.Get("profile"))
+	if !ok {
+		return
+	}
+	sampleIndex, err := selectSampleIndex(p, query.Get("si"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	g := buildCallGraph(p, sampleIndex)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exportName(name)+"."+format))
+	write := g.writeGraphML
+	if format == "gexf" {
+		write = g.writeGEXF
+	}
+	if err := write(w); err != nil {
+		s.logger.Printf("%s call graph: %v", requestID(r.Context()), err)
+	}
+}
@@ -0,0 +1,349 @@
+package pprofweb
+
+import (
+	"fmt"
+	"html/template"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/google/pprof/profile"
+)
+
+const (
+	// defaultCallTreeMin hides the nodes of call trees below this share of
+	// the total, so trees of huge profiles stay small.
+	defaultCallTreeMin = 0.001
+	// maxCallTreeNodes limits the nodes of a page of a call tree.
+	maxCallTreeNodes = 5000
+	// callTreeOpenShare expands the nodes of at least this share of the total
+	// on the first load.
+	callTreeOpenShare = 0.1
+)
+
+// callTreeNode is a function in a call tree, on the stacks of the samples of
+// its path from the root of the tree.
+type callTreeNode struct {
+	name string
+	// cum is the value of the samples through the node, flat of those
+	// ending in it.
+	cum      int64
+	flat     int64
+	children map[string]*callTreeNode
+}
+
+func (n *callTreeNode) child(name string) *callTreeNode {
+	c, ok := n.children[name]
+	if !ok {
+		c = &callTreeNode{name: name, children: make(map[string]*callTreeNode)}
+		n.children[name] = c
+	}
+	return c
+}
+
+// sortedChildren returns the children of n, heaviest first.
+func (n *callTreeNode) sortedChildren() []*callTreeNode {
+	children := make([]*callTreeNode, 0, len(n.children))
+	for _, c := range n.children {
+		children = append(children, c)
+	}
+	sort.Slice(children, func(i, j int) bool {
+		if children[i].cum != children[j].cum {
+			return abs64(children[i].cum) > abs64(children[j].cum)
+		}
+		return children[i].name < children[j].name
+	})
+	return children
+}
+
+// buildCallTree returns the call tree of the values at sampleIndex: callers
+// above their callees top down, or functions above their callers bottom up,
+// where the first level is the functions the samples end in. If root isn't
+// empty, the tree starts at the function root, merging its stacks wherever
+// it is called.
+func buildCallTree(p *profile.Profile, sampleIndex int, bottomUp bool, root string) *callTreeNode {
+	tree := &callTreeNode{children: make(map[string]*callTreeNode)}
+	for _, s := range p.Sample {
+		v := s.Value[sampleIndex]
+		frames := sampleFrames(s)
+		if bottomUp {
+			for i, j := 0, len(frames)-1; i < j; i, j = i+1, j-1 {
+				frames[i], frames[j] = frames[j], frames[i]
+			}
+		}
+		if root != "" {
+			start := -1
+			for i, name := range frames {
+				if name == root {
+					start = i
+					break
+				}
+			}
+			if start < 0 {
+				continue
+			}
+			frames = frames[start:]
+		}
+		if len(frames) == 0 {
+			continue
+		}
+		tree.cum += v
+		node := tree
+		for _, name := range frames {
+			node = node.child(name)
+			node.cum += v
+		}
+		node.flat += v
+	}
+	return tree
+}
+
+// callTreeRow is a node of a call tree on its page.
+type callTreeRow struct {
+	Name  string
+	Value string
+	Flat  string
+	Share string
+	// Width is the share of the node of the total in percent for its bar.
+	Width    float64
+	Open     bool
+	Children []*callTreeRow
+	// Hidden counts the children below the minimum share.
+	Hidden int
+	// FocusURL and FlameURL open the views of pprof focused on the
+	// function, RootURL the call tree starting at it, and HistoryURL its
+	// history in the profiles of the service, if the profile is of one.
+	FocusURL   string
+	FlameURL   string
+	RootURL    string
+	HistoryURL string
+}
+
+// callTreeHandler serves the call tree of a session: an expandable table of
+// the stacks of the profile, top down (?mode=topdown, the default) or bottom
+// up (?mode=bottomup), as an alternative to the flamegraph for methodical
+// drill-down. ?root= starts the tree at a function, ?min= hides nodes below a
+// share of the total (default 0.001), and ?si= selects the sample type.
+func (s *server) callTreeHandler(info *sessionInfo, p *profile.Profile) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+			return
+		}
+		query := r.URL.Query()
+		si := query.Get("si")
+		if si == "" {
+			si = info.urlDefaults.Get("si")
+		}
+		sampleIndex, err := selectSampleIndex(p, si)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mode := query.Get("mode")
+		switch mode {
+		case "":
+			mode = "topdown"
+		case "topdown", "bottomup":
+		default:
+			http.Error(w, fmt.Sprintf("unknown mode %q: use topdown or bottomup", mode), http.StatusBadRequest)
+			return
+		}
+		minShare := defaultCallTreeMin
+		if m := query.Get("min"); m != "" {
+			minShare, err = strconv.ParseFloat(m, 64)
+			if err != nil || minShare < 0 || minShare > 1 {
+				http.Error(w, "min must be a share between 0 and 1", http.StatusBadRequest)
+				return
+			}
+		}
+		prefs, err := s.requestPrefs(r)
+		if err != nil {
+			prefs = s.displayPrefs
+		}
+
+		root := query.Get("root")
+		tree := buildCallTree(p, sampleIndex, mode == "bottomup", root)
+		st := p.SampleType[sampleIndex]
+		total := sampleTotal(p, sampleIndex)
+		// the focus links keep the sample type the tree shows
+		viewQuery := func(name string) url.Values {
+			values := url.Values{"f": {"^" + regexp.QuoteMeta(name) + "$"}}
+			if query.Get("si") != "" {
+				values.Set("si", st.Type)
+			}
+			return values
+		}
+		treeQuery := func(mode, root string) string {
+			values := url.Values{"mode": {mode}}
+			if root != "" {
+				values.Set("root", root)
+			}
+			for _, key := range []string{"si", "min"} {
+				if v := query.Get(key); v != "" {
+					values.Set(key, v)
+				}
+			}
+			return "calltree?" + values.Encode()
+		}
+
+		nodes := 0
+		var rows func(n *callTreeNode) ([]*callTreeRow, int)
+		rows = func(n *callTreeNode) ([]*callTreeRow, int) {
+			var list []*callTreeRow
+			hidden := 0
+			for _, c := range n.sortedChildren() {
+				share := 0.0
+				if total != 0 {
+					share = float64(c.cum) / float64(total)
+				}
+				if math.Abs(share) < minShare || nodes >= maxCallTreeNodes {
+					hidden++
+					continue
+				}
+				nodes++
+				row := &callTreeRow{
+					Name:     c.name,
+					Value:    prefs.value(c.cum, st.Unit),
+					Share:    fmt.Sprintf("%.2f%%", 100*share),
+					Width:    math.Min(100, math.Abs(100*share)),
+					Open:     math.Abs(share) >= callTreeOpenShare,
+					FocusURL: "./?" + viewQuery(c.name).Encode(),
+					FlameURL: "./flamegraph?" + viewQuery(c.name).Encode(),
+					RootURL:  treeQuery(mode, c.name),
+				}
+				if service, typ, ok := profileSeries(info.profileName); ok && !info.combined {
+					row.HistoryURL = functionURL(c.name, service, typ)
+				}
+				if mode == "topdown" && c.flat != 0 {
+					row.Flat = prefs.value(c.flat, st.Unit)
+				}
+				row.Children, row.Hidden = rows(c)
+				list = append(list, row)
+			}
+			return list, hidden
+		}
+		page := struct {
+			Title, Profile string
+			SampleType     string
+			Mode           string
+			Root           string
+			Total          string
+			MinShare       string
+			// Tree is the invisible root of the rows.
+			Tree        callTreeRow
+			Truncated   bool
+			TopDownURL  string
+			BottomUpURL string
+			UnrootURL   string
+		}{
+			Title:       info.profileType.title(),
+			Profile:     info.profileName,
+			SampleType:  fmt.Sprintf("%s (%s)", st.Type, st.Unit),
+			Mode:        mode,
+			Root:        root,
+			Total:       prefs.value(tree.cum, st.Unit),
+			MinShare:    fmt.Sprintf("%g%%", 100*minShare),
+			TopDownURL:  treeQuery("topdown", root),
+			BottomUpURL: treeQuery("bottomup", root),
+			UnrootURL:   treeQuery(mode, ""),
+		}
+		page.Tree.Children, page.Tree.Hidden = rows(tree)
+		page.Truncated = nodes >= maxCallTreeNodes
+		if err := callTreeTemplate.Execute(w, page); err != nil {
+			s.logger.Printf("%s call tree: %v", requestID(r.Context()), err)
+		}
+	})
+}
+
+var callTreeTemplate = template.Must(template.New("calltree").Parse(`{{define "rows"}}<ul>
+{{range .Children}}<li{{if .Open}} class="open"{{end}}><div class="row" tabindex="-1">` +
+	`<span class="toggle">{{if .Children}}&#9656;{{end}}</span>` +
+	`<span class="value">{{.Value}}</span><span class="share">{{.Share}}</span>` +
+	`<span class="bar"><span style="width:{{printf "%.1f" .Width}}%"></span></span>` +
+	`<code>{{.Name}}</code>{{if .Flat}} <span class="flat">flat {{.Flat}}</span>{{end}}` +
+	`<span class="actions"><a href="{{.FocusURL}}" data-key="f">focus</a> <a href="{{.FlameURL}}" data-key="g">flamegraph</a> <a href="{{.RootURL}}" data-key="r">root here</a>` +
+	`{{if .HistoryURL}} <a href="{{.HistoryURL}}" data-key="y">history</a>{{end}}</span></div>
+{{if .Children}}{{template "rows" .}}{{end}}</li>
+{{end}}{{if .Hidden}}<li class="hidden">{{.Hidden}} more below the minimum share</li>
+{{end}}</ul>{{end}}<!doctype html>
+<html>
+<head><title>{{.Profile}} call tree</title>
+<style>
+body { font-family: sans-serif; }
+ul { list-style: none; margin: 0; padding-left: 1.2em; }
+#tree > ul { padding-left: 0; }
+li:not(.open) > ul { display: none; }
+.row { white-space: nowrap; padding: 1px 4px; cursor: default; }
+.row:focus { background: #def; outline: none; }
+.toggle { display: inline-block; width: 1em; }
+li.open > .row > .toggle { transform: rotate(90deg); }
+.value { display: inline-block; width: 7em; text-align: right; }
+.share { display: inline-block; width: 5em; text-align: right; color: #666; }
+.bar { display: inline-block; width: 60px; height: 8px; margin: 0 6px; background: #eee; }
+.bar span { display: block; height: 100%; background: #c33; }
+.flat { color: #666; font-size: 12px; }
+.actions { visibility: hidden; margin-left: 1em; font-size: 12px; }
+.row:hover .actions, .row:focus .actions { visibility: visible; }
+li.hidden { color: #999; font-size: 12px; padding-left: 1.5em; }
+code { font-size: 12px; }
+</style>
+</head>
+<body>
+<h1>{{.Title}} {{.Profile}}</h1>
+<p>{{.SampleType}}, {{.Total}}{{if .Root}} through <code>{{.Root}}</code> (<a href="{{.UnrootURL}}">all stacks</a>){{end}}.
+{{if eq .Mode "topdown"}}<b>Top down</b>{{else}}<a href="{{.TopDownURL}}">Top down</a>{{end}} |
+{{if eq .Mode "bottomup"}}<b>Bottom up</b>{{else}}<a href="{{.BottomUpURL}}">Bottom up</a>{{end}} |
+<a href="./">back to the graph</a></p>
+<p>Nodes below {{.MinShare}} of the total are hidden{{if .Truncated}}; the tree is truncated, raise ?min= or use root here{{end}}.
+Keys: &uarr;/&darr; move, &rarr;/&larr; expand and collapse, Enter toggles, f focuses the graph, g the flamegraph, r roots the tree at the function, y shows its history in the profiles of the service.</p>
+<div id="tree">{{template "rows" .Tree}}</div>
+<script>
+(function() {
+  var tree = document.getElementById('tree');
+  function rows() {
+    return Array.prototype.filter.call(tree.querySelectorAll('.row'), function(e) { return e.offsetParent !== null; });
+  }
+  function select(row) {
+    if (row) { row.focus(); }
+  }
+  function toggle(li, open) {
+    if (li.querySelector(':scope > ul')) { li.classList.toggle('open', open); }
+  }
+  tree.addEventListener('click', function(e) {
+    var row = e.target.closest('.row');
+    if (!row || e.target.closest('a')) { return; }
+    select(row);
+    toggle(row.parentNode);
+  });
+  tree.addEventListener('keydown', function(e) {
+    var row = e.target.closest('.row');
+    if (!row) { return; }
+    var li = row.parentNode, list = rows(), i = list.indexOf(row);
+    switch (e.key) {
+    case 'ArrowDown': case 'j': select(list[i + 1]); break;
+    case 'ArrowUp': case 'k': select(list[i - 1]); break;
+    case 'ArrowRight': case 'l':
+      if (li.classList.contains('open')) { select(list[i + 1]); } else { toggle(li, true); }
+      break;
+    case 'ArrowLeft': case 'h':
+      if (li.classList.contains('open')) { toggle(li, false); } else { select(li.parentNode.closest('li') && li.parentNode.closest('li').querySelector('.row')); }
+      break;
+    case 'Enter': case ' ': toggle(li); break;
+    case 'f': case 'g': case 'r': case 'y':
+      var a = row.querySelector('a[data-key="' + e.key + '"]');
+      if (a) { location.href = a.href; }
+      break;
+    default: return;
+    }
+    e.preventDefault();
+  });
+  select(rows()[0]);
+})();
+</script>
+</body>
+</html>
+`))
@@ -0,0 +1,269 @@
+package pprofweb
+
+import (
+	"encoding/json"
+	"html/template"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/google/pprof/profile"
+)
+
+// defaultChartMin prunes the nodes below this share of the total from the
+// flame graph JSON of sessions, so charts of huge profiles stay responsive.
+const defaultChartMin = 0.001
+
+// charts are the renderings of the chart page of sessions, the values of the
+// display preference chart.
+var charts = []string{"icicle", "sunburst"}
+
+// flameGraphReport is the JSON of the flame graph of a session.
+type flameGraphReport struct {
+	Profile    string     `json:"profile"`
+	SampleType string     `json:"sample_type"`
+	Unit       string     `json:"unit"`
+	Total      int64      `json:"total"`
+	FlameGraph *flameNode `json:"flamegraph"`
+}
+
+// prune removes the descendants of n with values below min in magnitude.
+func (n *flameNode) prune(min int64) {
+	children := n.Children[:0]
+	for _, c := range n.Children {
+		if abs64(c.Value) >= min {
+			c.prune(min)
+			children = append(children, c)
+		}
+	}
+	n.Children = children
+}
+
+// flameGraphJSONHandler serves the stacks of the profile of a session as the
+// JSON of flameGraphReport, the data of its chart page: ?si= selects the
+// sample type and ?min= prunes nodes below a share of the total (default
+// 0.001; 0 keeps all).
+func (s *server) flameGraphJSONHandler(info *sessionInfo, p *profile.Profile) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+			return
+		}
+		query := r.URL.Query()
+		si := query.Get("si")
+		if si == "" {
+			si = info.urlDefaults.Get("si")
+		}
+		sampleIndex, err := selectSampleIndex(p, si)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		minShare := defaultChartMin
+		if m := query.Get("min"); m != "" {
+			minShare, err = strconv.ParseFloat(m, 64)
+			if err != nil || minShare < 0 || minShare > 1 {
+				http.Error(w, "min must be a share between 0 and 1", http.StatusBadRequest)
+				return
+			}
+		}
+		graph := buildFlameGraph(p, sampleIndex)
+		graph.prune(int64(math.Ceil(minShare * math.Abs(float64(graph.Value)))))
+		writeJSON(w, flameGraphReport{
+			Profile:    info.profileName,
+			SampleType: p.SampleType[sampleIndex].Type,
+			Unit:       p.SampleType[sampleIndex].Unit,
+			Total:      graph.Value,
+			FlameGraph: graph,
+		})
+	})
+}
+
+// chartHandler serves the chart page of a session: the stacks of the
+// flame graph JSON rendered in the browser as an icicle, top down like the
+// flamegraph, or a sunburst of rings around the root. ?chart= selects the
+// rendering, by default the display preference of the user.
+func (s *server) chartHandler(info *sessionInfo) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+			return
+		}
+		prefs, err := s.requestPrefs(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		options, _ := json.Marshal(struct {
+			Chart string `json:"chart"`
+		}{prefs.chart})
+		page := struct {
+			Title, Profile string
+			Chart          string
+			Charts         []string
+			Options        template.JS
+		}{
+			Title:   info.profileType.title(),
+			Profile: info.profileName,
+			Chart:   prefs.chart,
+			Charts:  charts,
+			Options: template.JS(options),
+		}
+		if err := chartTemplate.Execute(w, page); err != nil {
+			s.logger.Printf("%s chart: %v", requestID(r.Context()), err)
+		}
+	})
+}
+
+// chartTemplate renders the flame graph JSON with SVG. Clicking a node zooms
+// into it; clicking the root, the center of the sunburst, or Escape zooms
+// out.
+var chartTemplate = template.Must(template.New("chart").Parse(`<!doctype html>
+<html>
+<head><title>{{.Profile}} {{.Chart}}</title>
+<style>
+body { font-family: sans-serif; margin: 8px; }
+#chart { width: 100%; }
+#chart text { font: 11px sans-serif; pointer-events: none; }
+#chart .node { cursor: pointer; stroke: #fff; stroke-width: 0.5; }
+#chart .node:hover { opacity: 0.8; }
+#info { height: 1.4em; font-size: 13px; color: #333; }
+</style>
+</head>
+<body>
+<h1>{{.Title}} {{.Profile}}</h1>
+<p>{{range $i, $c := .Charts}}{{if $i}} | {{end}}<a href="#" data-chart="{{$c}}">{{$c}}</a>{{end}} |
+<a href="./flamegraph">flamegraph</a> | <a href="/preferences">change the default</a></p>
+<div id="info"></div>
+<svg id="chart"></svg>
+<script>
+(function() {
+  var options = {{.Options}};
+  var params = new URLSearchParams(location.search);
+  var chart = params.get('chart') || options.chart;
+  var svg = document.getElementById('chart'), info = document.getElementById('info');
+  var ns = 'http://www.w3.org/2000/svg';
+  var data, focus, parents = new Map();
+
+  function color(name) {
+    var h = 0;
+    for (var i = 0; i < name.length; i++) { h = (h * 31 + name.charCodeAt(i)) | 0; }
+    return 'hsl(' + (Math.abs(h) % 50) + ',80%,' + (55 + Math.abs(h >> 8) % 20) + '%)';
+  }
+  function describe(node) {
+    var share = data.total ? (100 * node.value / data.total).toFixed(2) + '%' : '';
+    return node.name + ': ' + node.value + ' ' + data.unit + ' (' + share + ')';
+  }
+  function el(tag, attrs, parent) {
+    var e = document.createElementNS(ns, tag);
+    for (var k in attrs) { e.setAttribute(k, attrs[k]); }
+    parent.appendChild(e);
+    return e;
+  }
+  function node(shape, attrs, n) {
+    attrs['class'] = 'node';
+    attrs.fill = color(n.name);
+    var e = el(shape, attrs, svg);
+    el('title', {}, e).textContent = describe(n);
+    e.addEventListener('click', function() { zoom(n === focus ? parents.get(n) || n : n); });
+    e.addEventListener('mouseover', function() { info.textContent = describe(n); });
+    return e;
+  }
+  function index(n) {
+    (n.children || []).forEach(function(c) { parents.set(c, n); index(c); });
+  }
+
+  function icicle() {
+    var width = svg.clientWidth || 1000, rowHeight = 18, depth = 0;
+    var ancestors = [];
+    for (var a = parents.get(focus); a; a = parents.get(a)) { ancestors.unshift(a); }
+    // the ancestors of the zoomed node span the width like in the flamegraph
+    ancestors.forEach(function(a, i) {
+      draw(a, 0, width, i, false);
+    });
+    function draw(n, x, w, row, children) {
+      if (w < 1) { return; }
+      depth = Math.max(depth, row + 1);
+      node('rect', {x: x, y: row * rowHeight, width: w, height: rowHeight - 1}, n);
+      if (w > 40) {
+        var t = el('text', {x: x + 3, y: row * rowHeight + 13}, svg);
+        t.textContent = n.name.length * 6.5 > w - 6 ? n.name.slice(0, Math.floor((w - 6) / 6.5)) + '…' : n.name;
+      }
+      if (!children || !focus.value) { return; }
+      var cx = x;
+      (n.children || []).forEach(function(c) {
+        var cw = w * Math.abs(c.value) / Math.abs(n.value || 1);
+        draw(c, cx, cw, row + 1, true);
+        cx += cw;
+      });
+    }
+    draw(focus, 0, width, ancestors.length, true);
+    svg.setAttribute('height', depth * rowHeight);
+  }
+
+  function sunburst() {
+    var size = Math.min(svg.clientWidth || 800, 800), r = size / 2, rings = 10;
+    var ring = r / (rings + 1);
+    svg.setAttribute('height', size);
+    function arc(n, a0, a1, d) {
+      if (d > rings || (a1 - a0) * (d + 1) * ring < 0.5) { return; }
+      if (d === 0) {
+        node('circle', {cx: r, cy: r, r: ring}, n);
+      } else {
+        var r0 = d * ring, r1 = r0 + ring, large = a1 - a0 > Math.PI ? 1 : 0;
+        if (a1 - a0 >= 2 * Math.PI - 1e-6) { a1 = a0 + 2 * Math.PI - 1e-6; large = 1; }
+        var p = function(radius, angle) { return (r + radius * Math.sin(angle)) + ',' + (r - radius * Math.cos(angle)); };
+        node('path', {d: 'M' + p(r0, a0) + 'L' + p(r1, a0) + 'A' + r1 + ',' + r1 + ' 0 ' + large + ' 1 ' + p(r1, a1) +
+          'L' + p(r0, a1) + 'A' + r0 + ',' + r0 + ' 0 ' + large + ' 0 ' + p(r0, a0) + 'Z'}, n);
+      }
+      var a = a0;
+      (n.children || []).forEach(function(c) {
+        var span = (a1 - a0) * Math.abs(c.value) / Math.abs(n.value || 1);
+        arc(c, a, a + span, d + 1);
+        a += span;
+      });
+    }
+    arc(focus, 0, 2 * Math.PI, 0);
+    var t = el('text', {x: r, y: r + 4, 'text-anchor': 'middle'}, svg);
+    t.textContent = focus.name.length > 20 ? focus.name.slice(0, 19) + '…' : focus.name;
+  }
+
+  function zoom(n) {
+    focus = n;
+    while (svg.firstChild) { svg.removeChild(svg.firstChild); }
+    (chart === 'sunburst' ? sunburst : icicle)();
+    info.textContent = describe(n);
+  }
+
+  document.querySelectorAll('a[data-chart]').forEach(function(a) {
+    a.style.fontWeight = a.dataset.chart === chart ? 'bold' : '';
+    a.addEventListener('click', function(e) {
+      e.preventDefault();
+      chart = a.dataset.chart;
+      params.set('chart', chart);
+      history.replaceState(null, '', '?' + params);
+      document.querySelectorAll('a[data-chart]').forEach(function(b) { b.style.fontWeight = b === a ? 'bold' : ''; });
+      document.title = {{.Profile}} + ' ' + chart;
+      zoom(focus);
+    });
+  });
+  document.addEventListener('keydown', function(e) {
+    if (e.key === 'Escape' && data) { zoom(data.flamegraph); }
+  });
+  window.addEventListener('resize', function() { if (data) { zoom(focus); } });
+
+  var query = new URLSearchParams();
+  ['si', 'min'].forEach(function(k) { if (params.get(k)) { query.set(k, params.get(k)); } });
+  fetch('flamegraph.json?' + query).then(function(r) {
+    if (!r.ok) { return r.text().then(function(t) { throw new Error(t); }); }
+    return r.json();
+  }).then(function(report) {
+    data = report;
+    index(data.flamegraph);
+    zoom(data.flamegraph);
+  }).catch(function(err) { info.textContent = 'Loading the stacks failed: ' + err.message; });
+})();
+</script>
+</body>
+</html>
+`))
@@ -0,0 +1,199 @@
+//go:build js && wasm
+
+// Command pprofweb-wasm reports small profiles in the browser, for the local
+// page of pprofweb. go generate in the root of the module builds it into
+// wasm/ with wasm_exec.js, which go build embeds in pprofweb; by hand:
+//
+//	GOOS=js GOARCH=wasm go build -o wasm/pprofweb.wasm ./cmd/pprofweb-wasm
+//	cp "$(go env GOROOT)/misc/wasm/wasm_exec.js" wasm/
+//
+// (lib/wasm since Go 1.24), and serve the directory with --wasm-dir. It
+// defines the JavaScript function pprofwebReport(bytes, sampleType), which
+// returns the JSON of the top table and flame graph of the profile bytes.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"syscall/js"
+
+	"github.com/google/pprof/profile"
+)
+
+// maxTop limits the rows of the top table.
+const maxTop = 100
+
+// minFlameShare prunes nodes of the flame graph with a smaller share of the
+// total, which are too narrow to see.
+const minFlameShare = 0.001
+
+type sampleType struct {
+	Type string `json:"type"`
+	Unit string `json:"unit"`
+}
+
+type topEntry struct {
+	Name string `json:"name"`
+	Flat int64  `json:"flat"`
+	Cum  int64  `json:"cum"`
+}
+
+type flameNode struct {
+	Name     string       `json:"name"`
+	Value    int64        `json:"value"`
+	Children []*flameNode `json:"children,omitempty"`
+
+	childByName map[string]*flameNode
+}
+
+type report struct {
+	SampleTypes []sampleType `json:"sample_types"`
+	SampleType  int          `json:"sample_type"`
+	Total       int64        `json:"total"`
+	Top         []topEntry   `json:"top"`
+	Flame       *flameNode   `json:"flame"`
+	Error       string       `json:"error,omitempty"`
+}
+
+func main() {
+	js.Global().Set("pprofwebReport", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		data := make([]byte, args[0].Get("length").Int())
+		js.CopyBytesToGo(data, args[0])
+		sampleType := ""
+		if len(args) > 1 && args[1].Type() == js.TypeString {
+			sampleType = args[1].String()
+		}
+		r, err := newReport(data, sampleType)
+		if err != nil {
+			r = &report{Error: err.Error()}
+		}
+		out, err := json.Marshal(r)
+		if err != nil {
+			return fmt.Sprintf(`{"error":%q}`, err.Error())
+		}
+		return string(out)
+	}))
+	select {}
+}
+
+// newReport parses the profile data and reports the sample type name, the
+// default of the profile if empty. It mirrors the top tables and flame graphs
+// of the server, whose package is too large to load in browsers.
+func newReport(data []byte, name string) (*report, error) {
+	p, err := profile.ParseData(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(p.SampleType) == 0 {
+		return nil, fmt.Errorf("profile has no sample types")
+	}
+	r := &report{SampleType: len(p.SampleType) - 1}
+	for i, st := range p.SampleType {
+		r.SampleTypes = append(r.SampleTypes, sampleType{st.Type, st.Unit})
+		if st.Type == name || (name == "" && st.Type == p.DefaultSampleType) {
+			r.SampleType = i
+		}
+	}
+
+	entries := make(map[string]*topEntry)
+	entry := func(name string) *topEntry {
+		e, ok := entries[name]
+		if !ok {
+			e = &topEntry{Name: name}
+			entries[name] = e
+		}
+		return e
+	}
+	r.Flame = &flameNode{Name: "root"}
+	for _, s := range p.Sample {
+		v := s.Value[r.SampleType]
+		r.Total += v
+		frames := sampleFrames(s)
+		node := r.Flame
+		node.Value += v
+		seen := make(map[string]bool, len(frames))
+		for _, name := range frames {
+			node = node.child(name)
+			node.Value += v
+			if !seen[name] {
+				seen[name] = true
+				entry(name).Cum += v
+			}
+		}
+		if len(frames) > 0 {
+			entry(frames[len(frames)-1]).Flat += v
+		}
+	}
+
+	for _, e := range entries {
+		r.Top = append(r.Top, *e)
+	}
+	sort.Slice(r.Top, func(i, j int) bool {
+		if r.Top[i].Flat != r.Top[j].Flat {
+			return r.Top[i].Flat > r.Top[j].Flat
+		}
+		if r.Top[i].Cum != r.Top[j].Cum {
+			return r.Top[i].Cum > r.Top[j].Cum
+		}
+		return r.Top[i].Name < r.Top[j].Name
+	})
+	if len(r.Top) > maxTop {
+		r.Top = r.Top[:maxTop]
+	}
+	r.Flame.prune(int64(float64(r.Flame.Value) * minFlameShare))
+	return r, nil
+}
+
+// sampleFrames returns the function names of the stack of s from the root
+// to the leaf, with inlined functions.
+func sampleFrames(s *profile.Sample) []string {
+	var frames []string
+	for i := len(s.Location) - 1; i >= 0; i-- {
+		loc := s.Location[i]
+		if len(loc.Line) == 0 {
+			frames = append(frames, fmt.Sprintf("0x%x", loc.Address))
+			continue
+		}
+		for j := len(loc.Line) - 1; j >= 0; j-- {
+			name := "?"
+			if loc.Line[j].Function != nil {
+				name = loc.Line[j].Function.Name
+			}
+			frames = append(frames, name)
+		}
+	}
+	return frames
+}
+
+func (n *flameNode) child(name string) *flameNode {
+	if c, ok := n.childByName[name]; ok {
+		return c
+	}
+	if n.childByName == nil {
+		n.childByName = make(map[string]*flameNode)
+	}
+	c := &flameNode{Name: name}
+	n.childByName[name] = c
+	n.Children = append(n.Children, c)
+	return c
+}
+
+// prune removes the children with values below min and orders the others by
+// value.
+func (n *flameNode) prune(min int64) {
+	kept := n.Children[:0]
+	for _, c := range n.Children {
+		if c.Value >= min && c.Value > 0 {
+			c.prune(min)
+			kept = append(kept, c)
+		}
+	}
+	n.Children = kept
+	sort.Slice(n.Children, func(i, j int) bool {
+		if n.Children[i].Value != n.Children[j].Value {
+			return n.Children[i].Value > n.Children[j].Value
+		}
+		return n.Children[i].Name < n.Children[j].Name
+	})
+}
@@ -0,0 +1,8 @@
+// Command pprofweb serves the pprof web UI of stored and uploaded profiles.
+package main
+
+import "github.com/evanj/pprofweb"
+
+func main() {
+	pprofweb.Main()
+}
@@ -0,0 +1,103 @@
+package pprofweb
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// compressedExtensions are the suffixes of profiles recompressed for storage,
+// e.g. cpu.pb.gz.zst. They are accepted after any allowed extension and
+// decompressed before parsing.
+var compressedExtensions = []string{".zst", ".xz", ".bz2"}
+
+// maxDecompressedSize limits the size of decompressed profiles, so a small
+// file can't exhaust the memory of the server.
+const maxDecompressedSize int64 = 2 << 30
+
+var (
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	xzMagic    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	bzip2Magic = []byte("BZh")
+)
+
+// trimCompressedExtension returns name without its compressed extension.
+func trimCompressedExtension(name string) string {
+	for _, ext := range compressedExtensions {
+		if strings.HasSuffix(name, ext) {
+			return strings.TrimSuffix(name, ext)
+		}
+	}
+	return name
+}
+
+// isCompressed reports whether data starts like a zstd, xz, or bzip2 stream.
+// pprof decompresses gzip itself.
+func isCompressed(data []byte) bool {
+	return bytes.HasPrefix(data, zstdMagic) || bytes.HasPrefix(data, xzMagic) || bytes.HasPrefix(data, bzip2Magic)
+}
+
+// decompress returns the decompressed contents of zstd, xz, or bzip2
+// compressed data, and other data unchanged.
+func decompress(data []byte) ([]byte, error) {
+	var r io.Reader
+	switch {
+	case bytes.HasPrefix(data, zstdMagic):
+		d, err := zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		defer d.Close()
+		r = d
+	case bytes.HasPrefix(data, xzMagic):
+		var err error
+		r, err = xz.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+	case bytes.HasPrefix(data, bzip2Magic):
+		r = bzip2.NewReader(bytes.NewReader(data))
+	default:
+		return data, nil
+	}
+	out, err := io.ReadAll(io.LimitReader(r, maxDecompressedSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("could not decompress: %w", err)
+	}
+	if int64(len(out)) > maxDecompressedSize {
+		return nil, fmt.Errorf("decompressed profile is larger than %s", formatBytes(maxDecompressedSize))
+	}
+	return out, nil
+}
+
+// decompressStream returns a reader of the decompressed stream in if it is
+// gzip, zstd, xz, or bzip2 compressed, and whether it is, or else of in
+// itself. It reads from in with a buffer.
+func decompressStream(in io.Reader) (io.ReadCloser, bool, error) {
+	r := bufio.NewReader(in)
+	magic, _ := r.Peek(len(xzMagic))
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		d, err := gzip.NewReader(r)
+		return d, true, err
+	case bytes.HasPrefix(magic, zstdMagic):
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, true, err
+		}
+		return d.IOReadCloser(), true, nil
+	case bytes.HasPrefix(magic, xzMagic):
+		d, err := xz.NewReader(r)
+		return io.NopCloser(d), true, err
+	case bytes.HasPrefix(magic, bzip2Magic):
+		return io.NopCloser(bzip2.NewReader(r)), true, nil
+	}
+	return io.NopCloser(r), false, nil
+}
@@ -0,0 +1,316 @@
+package pprofweb
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// applyConfigFile sets the flags of context that aren't set on the command
+// line or by environment variables to the values of the YAML file path. Its
+// keys are the names of the flags, e.g.
+//
+//	profiles: /var/lib/pprofweb
+//	root: [prod=/var/lib/pprofweb/prod;token=secret]
+//	valid: 30m
+func applyConfigFile(context *cli.Context, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	flags := make(map[string]cli.Flag)
+	for _, f := range context.App.Flags {
+		for _, name := range f.Names() {
+			flags[name] = f
+		}
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f, ok := flags[name]
+		if !ok || name == "config" {
+			return fmt.Errorf("%s: unknown option %q%s", path, name, suggestFlag(name, flags))
+		}
+		if context.IsSet(name) {
+			continue
+		}
+		var settings []string
+		switch value := values[name].(type) {
+		case nil:
+			continue
+		case []interface{}:
+			if !isSliceFlag(f) {
+				return fmt.Errorf("%s: option %s takes a single value, not a list", path, name)
+			}
+			for _, v := range value {
+				settings = append(settings, fmt.Sprint(v))
+			}
+		case map[string]interface{}:
+			return fmt.Errorf("%s: option %s takes a value, not a mapping", path, name)
+		default:
+			settings = []string{fmt.Sprint(value)}
+		}
+		for _, setting := range settings {
+			if err := context.Set(name, setting); err != nil {
+				return fmt.Errorf("%s: option %s: invalid value %q: %v", path, name, setting, err)
+			}
+		}
+	}
+	return nil
+}
+
+func isSliceFlag(f cli.Flag) bool {
+	switch f.(type) {
+	case *cli.StringSliceFlag, *cli.IntSliceFlag, *cli.Int64SliceFlag, *cli.Float64SliceFlag:
+		return true
+	}
+	return false
+}
+
+// suggestFlag returns a hint of the flag closest to the misspelled name, if
+// one is close.
+func suggestFlag(name string, flags map[string]cli.Flag) string {
+	best, bestDistance := "", 3
+	for candidate := range flags {
+		if d := editDistance(name, candidate); d < bestDistance || (d == bestDistance && best != "" && candidate < best) {
+			best, bestDistance = candidate, d
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf(", did you mean %q?", best)
+}
+
+// editDistance returns the Levenshtein distance of a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = cur[j-1] + 1
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if prev[j-1]+cost < cur[j] {
+				cur[j] = prev[j-1] + cost
+			}
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+var checkConfigCommand = &cli.Command{
+	Name:      "check-config",
+	Usage:     "validate a configuration file of the server without starting it, e.g. in CI",
+	UsageText: "pprofweb check-config [--storage] config.yaml",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "storage",
+			Usage: "also check that the profile directories and the temp dir exist and are writable",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		if context.NArg() != 1 {
+			return errors.New("expected the path of the configuration file")
+		}
+		path := context.Args().First()
+		set := flag.NewFlagSet(context.App.Name, flag.ContinueOnError)
+		for _, f := range context.App.Flags {
+			if err := f.Apply(set); err != nil {
+				return err
+			}
+		}
+		if err := set.Parse(nil); err != nil {
+			return err
+		}
+		config := cli.NewContext(context.App, set, nil)
+		if err := applyConfigFile(config, path); err != nil {
+			return err
+		}
+		errs := checkServerConfig(config, context.Bool("storage"))
+		for _, err := range errs {
+			fmt.Fprintf(context.App.ErrWriter, "%s: %v\n", path, err)
+		}
+		if len(errs) > 0 {
+			return fmt.Errorf("%s: %d errors", path, len(errs))
+		}
+		fmt.Fprintf(context.App.Writer, "%s: ok\n", path)
+		return nil
+	},
+}
+
+// checkServerConfig returns the errors of the flags of the server in
+// context, checking the directories of the profiles and temporary files if
+// storage is set. It parses like the server but has no side effects.
+func checkServerConfig(context *cli.Context, storage bool) []error {
+	var errs []error
+	check := func(option string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", option, err))
+		}
+	}
+
+	if context.Int64("upload-max-expanded-size") < 0 {
+		check("upload-max-expanded-size", errors.New("must not be negative"))
+	}
+	if context.Float64("upload-max-ratio") < 0 {
+		check("upload-max-ratio", errors.New("must not be negative"))
+	}
+	if context.Duration("rescan-interval") < 0 {
+		check("rescan-interval", errors.New("must not be negative"))
+	}
+	valid, lifetime := context.Duration("valid"), context.Duration("max-lifetime")
+	defaultRoot := &profileRoot{path: context.String("profiles"), validDuration: valid, maxLifetime: lifetime}
+	roots := []*profileRoot{}
+	for _, def := range context.StringSlice("root") {
+		root, err := parseProfileRoot(def, valid, lifetime)
+		check("root", err)
+		if err == nil {
+			roots = append(roots, root)
+		}
+	}
+	for _, def := range context.StringSlice("target") {
+		_, err := parseCaptureTarget(def, defaultRoot, roots, logger)
+		check("target", err)
+	}
+	if path := context.String("targets-file"); path != "" {
+		_, err := loadTargetRegistry(path, defaultRoot, roots, logger)
+		check("targets-file", err)
+	}
+	if path := context.String("scrape-config"); path != "" {
+		_, err := loadScrapeConfig(path, defaultRoot, roots, logger)
+		check("scrape-config", err)
+	}
+	if bucket := context.String("s3-events-bucket"); bucket != "" {
+		_, err := newS3Events(bucket, context.String("s3-events-queue"))
+		check("s3-events-bucket", err)
+	} else if context.String("s3-events-queue") != "" {
+		check("s3-events-queue", errors.New("requires s3-events-bucket"))
+	}
+	_, err := compileExpectedHot(context.StringSlice("expected-hot"))
+	check("expected-hot", err)
+	_, err = parseArchTools(context.StringSlice("arch-tools"))
+	check("arch-tools", err)
+	if schedule := context.String("report-schedule"); schedule != "" {
+		_, err := parseCron(schedule)
+		check("report-schedule", err)
+		if context.String("smtp") == "" || len(context.StringSlice("report-to")) == 0 {
+			check("report-schedule", errors.New("requires smtp and report-to"))
+		}
+	}
+	if view := context.String("default-view"); view != "" {
+		check("default-view", validateView(view))
+	}
+	if granularity := context.String("granularity"); granularity != "" {
+		check("granularity", validateGranularity(granularity))
+	}
+	check("graph defaults", validateGraphOptions(context.Int("node-count"), context.Float64("node-fraction"), context.Float64("edge-fraction")))
+	_, err = compileFrameRule(context.String("drop-frames"))
+	check("drop-frames", err)
+	_, err = compileFrameRule(context.String("keep-frames"))
+	check("keep-frames", err)
+	prefs := *defaultPrefs
+	check("display preferences", prefs.apply(url.Values{
+		prefByteUnits: {context.String("byte-units")},
+		prefTimeUnits: {context.String("time-units")},
+		prefNumbers:   {context.String("numbers")},
+		prefTimeZone:  {context.String("time-zone")},
+		prefChart:     {context.String("chart")},
+	}))
+	_, err = parseTrustedProxies(context.StringSlice("trusted-proxy"))
+	check("trusted-proxy", err)
+	_, err = parseFetchHosts(context.StringSlice("fetch-host"))
+	check("fetch-host", err)
+	if context.String("ldap-url") != "" {
+		for _, def := range context.StringSlice("ldap-group-role") {
+			_, _, err := parseNameRole(def)
+			check("ldap-group-role", err)
+		}
+		for _, def := range context.StringSlice("user-role") {
+			_, _, err := parseNameRole(def)
+			check("user-role", err)
+		}
+		_, err := parseRole(context.String("ldap-default-role"))
+		check("ldap-default-role", err)
+	}
+
+	if storage {
+		check("profiles", checkRootStorage(defaultRoot.path))
+		for _, root := range roots {
+			check("root "+root.name, checkRootStorage(root.path))
+		}
+		if dir := context.String("cache-dir"); dir != "" {
+			if _, err := os.Stat(dir); !os.IsNotExist(err) {
+				check("cache-dir", checkWritableDir(dir))
+			}
+		}
+		if dir := context.String("temp-dir"); dir != "" {
+			if _, err := os.Stat(dir); !os.IsNotExist(err) {
+				check("temp-dir", checkWritableDir(dir))
+			}
+		}
+	}
+	return errs
+}
+
+// checkRootStorage returns an error if the bucket of a root can't be used
+// with the environment, or its directory isn't writable.
+func checkRootStorage(rootPath string) error {
+	if isBucketPath(rootPath) {
+		_, err := newS3Storage(rootPath, "", nil)
+		return err
+	}
+	return checkWritableDir(rootPath)
+}
+
+// checkWritableDir returns an error if dir isn't a directory the server can
+// create files in.
+func checkWritableDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	f, err := os.CreateTemp(dir, ".check-config-*")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %w", dir, err)
+	}
+	f.Close()
+	return os.Remove(filepath.Clean(f.Name()))
+}
+
+// loadConfigFlag applies the file of --config, if set, before the server
+// starts. Its commands don't read it.
+func loadConfigFlag(context *cli.Context) error {
+	path := context.String("config")
+	if path == "" || context.Args().Present() {
+		return nil
+	}
+	return applyConfigFile(context, path)
+}
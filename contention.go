@@ -0,0 +1,184 @@
+package pprofweb
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// lockSite is the contention at a call site in a mutex or block profile.
+type lockSite struct {
+	// Function is the function closest to the leaf outside of the runtime
+	// and sync, the code waiting or holding the lock.
+	Function string `json:"function"`
+	// Wait is the runtime or sync function waiting, e.g. sync.(*Mutex).Lock
+	// or runtime.chanrecv1, empty if there is none.
+	Wait        string `json:"wait"`
+	Contentions int64  `json:"contentions"`
+	// Delay is the total delay in nanoseconds.
+	Delay int64 `json:"delay_ns"`
+	// AverageDelay is the delay per contention in nanoseconds.
+	AverageDelay int64   `json:"average_delay_ns"`
+	Share        float64 `json:"share"`
+}
+
+// contentionReport is the JSON response of GET /api/v1/contention.
+type contentionReport struct {
+	Profile     string     `json:"profile"`
+	Type        string     `json:"type"`
+	Contentions int64      `json:"contentions"`
+	Delay       int64      `json:"delay_ns"`
+	Sites       []lockSite `json:"sites"`
+}
+
+// lockSites returns the contention of the mutex or block profile p by call
+// site, largest delay first. p must have contentions and delay sample types.
+func lockSites(p *profile.Profile) []lockSite {
+	contentionsIndex, delayIndex := sampleIndexByName(p, "contentions"), sampleIndexByName(p, "delay")
+	var total int64
+	sites := make(map[[2]string]*lockSite)
+	for _, s := range p.Sample {
+		frames := sampleFrames(s)
+		var function, wait string
+		for j := len(frames) - 1; j >= 0; j-- {
+			if !runtimeFrame(frames[j]) {
+				function = frames[j]
+				break
+			}
+			wait = frames[j]
+		}
+		if function == "" && len(frames) > 0 {
+			function = frames[len(frames)-1]
+		}
+		key := [2]string{function, wait}
+		site := sites[key]
+		if site == nil {
+			site = &lockSite{Function: function, Wait: wait}
+			sites[key] = site
+		}
+		site.Contentions += s.Value[contentionsIndex]
+		site.Delay += s.Value[delayIndex]
+		total += s.Value[delayIndex]
+	}
+
+	result := make([]lockSite, 0, len(sites))
+	for _, site := range sites {
+		if site.Contentions > 0 {
+			site.AverageDelay = site.Delay / site.Contentions
+		}
+		if total > 0 {
+			site.Share = float64(site.Delay) / float64(total)
+		}
+		result = append(result, *site)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Delay != result[j].Delay {
+			return result[i].Delay > result[j].Delay
+		}
+		if result[i].Function != result[j].Function {
+			return result[i].Function < result[j].Function
+		}
+		return result[i].Wait < result[j].Wait
+	})
+	return result
+}
+
+// contentionHandler summarizes a mutex or block profile by lock site with
+// GET /contention?profile=mutex.pb.gz, JSON at /api/v1/contention: the
+// total delay, the contentions, and the average wait of each site.
+func (s *server) contentionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+	ref := r.URL.Query().Get("profile")
+	if ref == "" {
+		http.Error(w, "profile is required", http.StatusBadRequest)
+		return
+	}
+	prefs, err := s.requestPrefs(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	_, name, p, ok := s.openProfile(w, r, ref)
+	if !ok {
+		return
+	}
+	t := detectProfileType(p, name)
+	if (t != mutexProfile && t != blockProfile) || sampleIndexByName(p, "contentions") < 0 || sampleIndexByName(p, "delay") < 0 {
+		http.Error(w, fmt.Sprintf("%s is a %s, not a mutex or block profile", name, strings.ToLower(t.title())), http.StatusBadRequest)
+		return
+	}
+
+	report := contentionReport{Profile: name, Type: t.tag(), Sites: lockSites(p)}
+	for _, site := range report.Sites {
+		report.Contentions += site.Contentions
+		report.Delay += site.Delay
+	}
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		writeJSON(w, report)
+		return
+	}
+
+	type siteRow struct {
+		Function, Wait, Contentions, Delay, AverageDelay, Share string
+	}
+	page := struct {
+		Title, Profile, Captured   string
+		Contentions, Delay, Period string
+		Sites                      []siteRow
+	}{
+		Title:       t.title(),
+		Profile:     name,
+		Captured:    prefs.timestamp(captureTime(p)),
+		Contentions: prefs.number(fmt.Sprint(report.Contentions)),
+		Delay:       prefs.duration(report.Delay),
+	}
+	if p.DurationNanos > 0 {
+		page.Period = time.Duration(p.DurationNanos).Round(time.Second).String()
+	}
+	for _, site := range report.Sites {
+		page.Sites = append(page.Sites, siteRow{
+			Function:     site.Function,
+			Wait:         site.Wait,
+			Contentions:  prefs.number(fmt.Sprint(site.Contentions)),
+			Delay:        prefs.duration(site.Delay),
+			AverageDelay: prefs.duration(site.AverageDelay),
+			Share:        fmt.Sprintf("%.1f%%", 100*site.Share),
+		})
+	}
+	if err := contentionTemplate.Execute(w, page); err != nil {
+		s.logger.Printf("%s contention: %v", requestID(r.Context()), err)
+	}
+}
+
+var contentionTemplate = template.Must(template.New("contention").Parse(`<!doctype html>
+<html>
+<head><title>{{.Profile}} contention</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin: 1em 0; }
+td, th { border: 1px solid #ccc; padding: 2px 8px; text-align: left; }
+td.value { text-align: right; }
+code { font-size: 12px; }
+</style>
+</head>
+<body>
+<h1>{{.Title}} {{.Profile}}</h1>
+<p>{{.Contentions}} contentions waited {{.Delay}} in total{{if .Period}} in {{.Period}}{{end}}{{if .Captured}}, captured {{.Captured}}{{end}}.
+Open the <a href="/?profile={{.Profile}}">profile</a> for its stacks.</p>
+<table>
+<tr><th>Lock site</th><th>Via</th><th>Contentions</th><th>Total delay</th><th>Average wait</th><th>Share</th></tr>
+{{range .Sites}}<tr><td><code>{{.Function}}</code></td><td><code>{{.Wait}}</code></td><td class="value">{{.Contentions}}</td>
+<td class="value">{{.Delay}}</td><td class="value">{{.AverageDelay}}</td><td class="value">{{.Share}}</td></tr>
+{{else}}<tr><td colspan="6">No contention.</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
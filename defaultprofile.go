@@ -0,0 +1,88 @@
+package pprofweb
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// latestProfile is the value of --default-profile opening the newest profile
+// of the root, and the last element of profile references opening the newest
+// profile of their directory, e.g. service-x/latest.
+const latestProfile = "latest"
+
+// defaultProfileRef returns the reference of the profile opened by requests
+// of / without a profile: the profile --default-profile names, or the newest
+// profile of the root if it is latest or below the directory if it ends with
+// a slash, e.g. nightly/.
+func (s *server) defaultProfileRef(r *http.Request) (string, error) {
+	ref := s.defaultProfile
+	if ref != latestProfile && !strings.HasSuffix(ref, "/") {
+		return ref, nil
+	}
+	dir := ""
+	if ref != latestProfile {
+		dir = ref
+	}
+	root, prefix := s.resolveRoot(r, dir)
+	name, err := s.newestProfile(root, prefix)
+	if err != nil {
+		return "", err
+	}
+	return root.reference(name), nil
+}
+
+// newestProfile returns the name of the most recently modified profile of
+// root whose name starts with prefix, e.g. nightly/ or an empty prefix for
+// the whole root.
+func (s *server) newestProfile(root *profileRoot, prefix string) (string, error) {
+	prefix = strings.TrimPrefix(prefix, "/")
+	files, err := root.listProfiles(s.allowedExtensions)
+	if err != nil {
+		return "", err
+	}
+	var newest *profileFile
+	for i, f := range files {
+		if strings.HasPrefix(f.name, prefix) && (newest == nil || f.modTime.After(newest.modTime)) {
+			newest = &files[i]
+		}
+	}
+	if newest == nil {
+		return "", fmt.Errorf("no profiles in %q", prefix)
+	}
+	return newest.name, nil
+}
+
+// isLatestReference reports whether the profile name relative to its root
+// ends with latest, e.g. service-x/latest, which loadProfile resolves to the
+// newest profile of the directory at request time unless a file has the name.
+func isLatestReference(name string) bool {
+	return path.Base(name) == latestProfile
+}
+
+// resolveLatest returns the name of the newest profile of the directory of
+// the latest reference name of root.
+func (s *server) resolveLatest(root *profileRoot, name string) (string, error) {
+	dir := path.Dir(strings.TrimPrefix(name, "/"))
+	if dir == "." {
+		dir = ""
+	} else {
+		dir += "/"
+	}
+	return s.newestProfile(root, dir)
+}
+
+// redirectDefaultProfile redirects requests of / without a profile to the
+// default profile, keeping their other query parameters, e.g. view.
+func (s *server) redirectDefaultProfile(w http.ResponseWriter, r *http.Request) {
+	ref, err := s.defaultProfileRef(r)
+	if err != nil {
+		s.logger.Printf("%s default profile: %v", requestID(r.Context()), err)
+		http.Error(w, "the default profile is not available", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	query.Set("profile", ref)
+	http.Redirect(w, r, "/?"+query.Encode(), http.StatusFound)
+}
@@ -0,0 +1,321 @@
+package pprofweb
+
+import (
+	"fmt"
+	"html/template"
+	"math"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/google/pprof/profile"
+)
+
+// diffNode is a node of a flame graph comparing a base and a head profile.
+type diffNode struct {
+	Name     string
+	Base     int64
+	Head     int64
+	Children []*diffNode
+}
+
+// buildDiffFlameGraph joins the flame graphs of base and head by stack.
+// Base values are multiplied by scale, e.g. to normalize the totals.
+func buildDiffFlameGraph(base, head *flameNode, scale float64) *diffNode {
+	n := &diffNode{}
+	if head != nil {
+		n.Name, n.Head = head.Name, head.Value
+	}
+	if base != nil {
+		n.Name, n.Base = base.Name, int64(math.Round(float64(base.Value)*scale))
+	}
+
+	children := make(map[string][2]*flameNode)
+	var names []string
+	add := func(nodes []*flameNode, side int) {
+		for _, c := range nodes {
+			pair, ok := children[c.Name]
+			if !ok {
+				names = append(names, c.Name)
+			}
+			pair[side] = c
+			children[c.Name] = pair
+		}
+	}
+	if base != nil {
+		add(base.Children, 0)
+	}
+	if head != nil {
+		add(head.Children, 1)
+	}
+	for _, name := range names {
+		pair := children[name]
+		n.Children = append(n.Children, buildDiffFlameGraph(pair[0], pair[1], scale))
+	}
+	sort.SliceStable(n.Children, func(i, j int) bool {
+		return n.Children[i].Head > n.Children[j].Head
+	})
+	return n
+}
+
+// diffFrame is a rectangle of the rendered diff flame graph.
+type diffFrame struct {
+	Name  string
+	Left  float64
+	Width float64
+	Depth int
+	Top   int
+	Color string
+	Title string
+}
+
+// diffFrameHeight is the height of the frames in pixels.
+const diffFrameHeight = 18
+
+// minDiffFrameWidth is the narrowest frame drawn in percent of the width.
+const minDiffFrameWidth = 0.05
+
+// diffFrames lays out the nodes below root as frames sized by the head value,
+// like a flame graph of the head profile, colored red for growth and green for
+// shrinkage relative to the largest change. The values in the titles are
+// formatted with prefs.
+func diffFrames(root *diffNode, unit string, prefs *displayPrefs) []diffFrame {
+	var maxDelta int64
+	var walk func(n *diffNode)
+	walk = func(n *diffNode) {
+		if d := abs64(n.Head - n.Base); d > maxDelta && n != root {
+			maxDelta = d
+		}
+		for _, c := range n.Children {
+			walk(c)
+		}
+	}
+	walk(root)
+
+	var frames []diffFrame
+	var layout func(n *diffNode, left float64, depth int)
+	layout = func(n *diffNode, left float64, depth int) {
+		width := 100 * float64(n.Head) / float64(root.Head)
+		if width < minDiffFrameWidth {
+			return
+		}
+		frames = append(frames, diffFrame{
+			Name:  n.Name,
+			Left:  left,
+			Width: width,
+			Depth: depth,
+			Top:   depth * diffFrameHeight,
+			Color: diffColor(n.Head-n.Base, maxDelta),
+			Title: fmt.Sprintf("%s\n%s → %s (%s)", n.Name, prefs.value(n.Base, unit), prefs.value(n.Head, unit),
+				prefs.change(n.Base, n.Head, unit)),
+		})
+		for _, c := range n.Children {
+			layout(c, left, depth+1)
+			left += 100 * float64(c.Head) / float64(root.Head)
+		}
+	}
+	if root.Head > 0 {
+		layout(root, 0, 0)
+	}
+	return frames
+}
+
+// diffColor returns white for no change, shading to red for the largest
+// growth and to green for the largest shrinkage.
+func diffColor(delta, maxDelta int64) string {
+	if maxDelta == 0 || delta == 0 {
+		return "#ffffff"
+	}
+	// keep small changes visible
+	shade := int(math.Round(40 + 215*float64(abs64(delta))/float64(maxDelta)))
+	other := 255 - shade
+	if delta > 0 {
+		return fmt.Sprintf("#ff%02x%02x", other, other)
+	}
+	return fmt.Sprintf("#%02xff%02x", other, other)
+}
+
+// formatChange formats the change from base to head with its percentage.
+func formatChange(base, head int64, unit string) string {
+	return defaultPrefs.change(base, head, unit)
+}
+
+type diffPage struct {
+	Base string
+	Head string
+	// BaseTime and HeadTime are the capture times of the profiles if known.
+	BaseTime   string
+	HeadTime   string
+	SampleType string
+	BaseTotal  string
+	HeadTotal  string
+	Change     string
+	Normalized bool
+	// ExportURL is the JSON diff of all functions, exported to spreadsheets
+	// with format=csv or format=xlsx.
+	ExportURL template.URL
+	Frames    []diffFrame
+	// Height is the height of the flame graph in pixels.
+	Height int
+}
+
+// diffHandler renders a flame graph of the head profile colored by the change
+// of every frame compared to the base profile:
+// /diff?base=old.pb.gz&head=new.pb.gz[&si=sample_type][&normalize=true].
+// base=auto compares to the previous release.
+func (s *server) diffHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("base") == "" || query.Get("head") == "" {
+		http.Error(w, "base and head are required", http.StatusBadRequest)
+		return
+	}
+	prefs, err := s.requestPrefs(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	baseName, base, headName, head, ok := s.openDiffProfiles(w, r)
+	if !ok {
+		return
+	}
+	baseIndex, headIndex, err := diffSampleIndexes(base, head, query.Get("si"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	unit := head.SampleType[headIndex].Unit
+
+	baseTotal, headTotal := sampleTotal(base, baseIndex), sampleTotal(head, headIndex)
+	normalize := query.Get("normalize") == "true"
+	scale := 1.0
+	if normalize && baseTotal != 0 {
+		scale = float64(headTotal) / float64(baseTotal)
+	}
+	root := buildDiffFlameGraph(buildFlameGraph(base, baseIndex), buildFlameGraph(head, headIndex), scale)
+
+	page := diffPage{
+		Base:       baseName,
+		Head:       headName,
+		BaseTime:   prefs.timestamp(captureTime(base)),
+		HeadTime:   prefs.timestamp(captureTime(head)),
+		SampleType: head.SampleType[headIndex].Type,
+		BaseTotal:  prefs.value(baseTotal, unit),
+		HeadTotal:  prefs.value(headTotal, unit),
+		Change:     prefs.change(baseTotal, headTotal, unit),
+		Normalized: normalize,
+		Frames:     diffFrames(root, unit, prefs),
+	}
+	exportQuery := url.Values{"base": {baseName}, "head": {headName}, "n": {"0"}, "si": {page.SampleType}}
+	if normalize {
+		exportQuery.Set("normalize", "true")
+	}
+	page.ExportURL = template.URL("/api/v1/diff?" + exportQuery.Encode())
+	for _, f := range page.Frames {
+		if f.Top+diffFrameHeight > page.Height {
+			page.Height = f.Top + diffFrameHeight
+		}
+	}
+	if err := diffTemplate.Execute(w, page); err != nil {
+		s.logger.Printf("%s diff: %v", requestID(r.Context()), err)
+	}
+}
+
+// openDiffProfiles opens the base and head profiles of the query of r and
+// returns their references. base=auto selects the profile of the previous
+// release of head by their version labels, base=baseline the baseline of the
+// release before head, and base=baseline@v1.2.0 the one of that release. It writes an error response and
+// returns false if a profile can't be opened.
+func (s *server) openDiffProfiles(w http.ResponseWriter, r *http.Request) (string, *profile.Profile, string, *profile.Profile, bool) {
+	query := r.URL.Query()
+	headRoot, headName, head, ok := s.openProfile(w, r, query.Get("head"))
+	if !ok {
+		return "", nil, "", nil, false
+	}
+	baseRef := query.Get("base")
+	if baseRef == "baseline" || strings.HasPrefix(baseRef, "baseline@") {
+		_, name := s.resolveRoot(r, query.Get("head"))
+		ref, err := headBaseline(headRoot, name, head, strings.TrimPrefix(strings.TrimPrefix(baseRef, "baseline"), "@"))
+		if err != nil {
+			writeLoadError(w, r, headRoot, err)
+			return "", nil, "", nil, false
+		}
+		s.logger.Printf("%s baseline of %s is %s", requestID(r.Context()), headName, ref)
+		baseRef = ref
+	}
+	if baseRef == "auto" {
+		_, name := s.resolveRoot(r, query.Get("head"))
+		f, version, err := s.versions.previousRelease(r.Context(), headRoot, path.Clean(strings.TrimPrefix(name, "/")), head, s.allowedExtensions)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return "", nil, "", nil, false
+		}
+		baseRef = headRoot.reference(f.name)
+		s.logger.Printf("%s previous release of %s is %s (%s)", requestID(r.Context()), headName, baseRef, version)
+	}
+	_, baseName, base, ok := s.openProfile(w, r, baseRef)
+	if !ok {
+		return "", nil, "", nil, false
+	}
+	return baseName, base, headName, head, true
+}
+
+// diffSampleIndexes returns the indexes of the sample type name in base and
+// head, by default the default sample type of head.
+func diffSampleIndexes(base, head *profile.Profile, name string) (int, int, error) {
+	if name == "" {
+		name = head.SampleType[defaultSampleIndex(head)].Type
+	}
+	headIndex := sampleIndexByName(head, name)
+	if headIndex < 0 {
+		return 0, 0, fmt.Errorf("head profile has no sample type %q", name)
+	}
+	baseIndex := sampleIndexByName(base, name)
+	if baseIndex < 0 {
+		return 0, 0, fmt.Errorf("base profile has no sample type %q", name)
+	}
+	if base.SampleType[baseIndex].Unit != head.SampleType[headIndex].Unit {
+		return 0, 0, fmt.Errorf("sample type %q has different units", name)
+	}
+	return baseIndex, headIndex, nil
+}
+
+// compatibleProfiles returns an error if pprof can't subtract base from
+// head: their sample types must be the same.
+func compatibleProfiles(base, head *profile.Profile) error {
+	if len(base.SampleType) != len(head.SampleType) {
+		return fmt.Errorf("base has %d sample types, head has %d", len(base.SampleType), len(head.SampleType))
+	}
+	for i, st := range head.SampleType {
+		if base.SampleType[i].Type != st.Type || base.SampleType[i].Unit != st.Unit {
+			return fmt.Errorf("sample type %s/%s of head is %s/%s in base", st.Type, st.Unit, base.SampleType[i].Type, base.SampleType[i].Unit)
+		}
+	}
+	return nil
+}
+
+var diffTemplate = template.Must(template.New("diff").Parse(`<!doctype html>
+<html>
+<head><title>{{.Head}} vs. {{.Base}}</title>
+<style>
+body { font-family: sans-serif; }
+#flame { position: relative; width: 100%; }
+.frame { position: absolute; height: 17px; overflow: hidden; white-space: nowrap; box-sizing: border-box;
+	border: 1px solid #fff; border-radius: 2px; font: 12px monospace; line-height: 15px; padding-left: 2px; cursor: default; }
+.legend span { display: inline-block; padding: 0 8px; border: 1px solid #ccc; }
+</style>
+</head>
+<body>
+<h1>{{.Head}} vs. {{.Base}}</h1>
+{{if or .BaseTime .HeadTime}}<p>Captured {{or .HeadTime "at an unknown time"}} vs. {{or .BaseTime "at an unknown time"}}.</p>
+{{end}}<p>{{.SampleType}}: {{.BaseTotal}} → {{.HeadTotal}} ({{.Change}}){{if .Normalized}}; frames of the base are normalized to the head total{{end}}.
+Frames are sized by the head profile; hover for values.
+Export the changes of all functions as <a href="{{.ExportURL}}&amp;format=csv">CSV</a> or <a href="{{.ExportURL}}&amp;format=xlsx">XLSX</a>.</p>
+<p class="legend"><span style="background:#ff0000">grew</span> <span>unchanged</span> <span style="background:#00ff00">shrank</span></p>
+<div id="flame" style="height:{{.Height}}px">
+{{range .Frames}}<div class="frame" style="left:{{printf "%.4f" .Left}}%;width:{{printf "%.4f" .Width}}%;top:{{.Top}}px;background:{{.Color}}" title="{{.Title}}">{{.Name}}</div>
+{{end}}</div>
+</body>
+</html>
+`))
@@ -0,0 +1,150 @@
+package pprofweb
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/google/pprof/profile"
+)
+
+// diffReport is the comparison of the functions of two profiles.
+type diffReport struct {
+	Base       string `json:"base"`
+	Head       string `json:"head"`
+	SampleType string `json:"sample_type"`
+	Unit       string `json:"unit"`
+	BaseTotal  int64  `json:"base_total"`
+	HeadTotal  int64  `json:"head_total"`
+	// Normalized is set if base values are scaled to the head total.
+	Normalized bool `json:"normalized"`
+	// LargestAbsolute are the functions with the largest absolute change of
+	// the flat value, LargestRelative those with the largest change relative
+	// to their base value. Functions new in head have no relative change.
+	LargestAbsolute []diffEntry `json:"largest_absolute"`
+	LargestRelative []diffEntry `json:"largest_relative"`
+}
+
+// diffEntry is the change of a function between the base and head profile.
+type diffEntry struct {
+	topDelta
+	Delta int64 `json:"delta"`
+	// Relative is the change of the flat value relative to the base, e.g. 0.5
+	// for 50% growth; nil if the base value is 0.
+	Relative *float64 `json:"relative"`
+}
+
+// compareProfiles compares the sample type sampleType (the default of head
+// if empty) of two profiles and returns the n functions with the largest
+// changes. With normalize, base values are scaled to the total of head.
+func compareProfiles(base, head *profile.Profile, sampleType string, normalize bool, n int) (*diffReport, error) {
+	baseIndex, headIndex, err := diffSampleIndexes(base, head, sampleType)
+	if err != nil {
+		return nil, err
+	}
+	report := &diffReport{
+		SampleType: head.SampleType[headIndex].Type,
+		Unit:       head.SampleType[headIndex].Unit,
+		BaseTotal:  sampleTotal(base, baseIndex),
+		HeadTotal:  sampleTotal(head, headIndex),
+		Normalized: normalize,
+	}
+
+	baseTop := topTable(base, baseIndex)
+	if normalize && report.BaseTotal != 0 {
+		scale := float64(report.HeadTotal) / float64(report.BaseTotal)
+		for i := range baseTop {
+			baseTop[i].Flat = int64(math.Round(float64(baseTop[i].Flat) * scale))
+			baseTop[i].Cum = int64(math.Round(float64(baseTop[i].Cum) * scale))
+		}
+	}
+
+	var entries []diffEntry
+	for _, d := range diffTop(baseTop, topTable(head, headIndex)) {
+		e := diffEntry{topDelta: d, Delta: d.flatDelta()}
+		if d.BaseFlat != 0 {
+			relative := float64(e.Delta) / float64(d.BaseFlat)
+			e.Relative = &relative
+		}
+		entries = append(entries, e)
+	}
+
+	// diffTop orders by absolute change
+	report.LargestAbsolute = firstN(entries, n)
+	var relative []diffEntry
+	for _, e := range entries {
+		if e.Relative != nil && *e.Relative != 0 {
+			relative = append(relative, e)
+		}
+	}
+	sort.SliceStable(relative, func(i, j int) bool {
+		return math.Abs(*relative[i].Relative) > math.Abs(*relative[j].Relative)
+	})
+	report.LargestRelative = firstN(relative, n)
+	return report, nil
+}
+
+// firstN returns the first n entries, all if n is 0.
+func firstN(entries []diffEntry, n int) []diffEntry {
+	if entries == nil {
+		return []diffEntry{}
+	}
+	if n > 0 && len(entries) > n {
+		return entries[:n]
+	}
+	return entries
+}
+
+// diffAPIHandler serves
+// GET /api/v1/diff?base=old.pb.gz&head=new.pb.gz[&n=20][&si=sample_type][&normalize=true]
+// as a JSON diffReport. base=auto compares to the previous release. With
+// format=csv or format=xlsx, it serves the functions with the largest absolute
+// change as a spreadsheet.
+func (s *server) diffAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	if query.Get("base") == "" || query.Get("head") == "" {
+		http.Error(w, "base and head are required", http.StatusBadRequest)
+		return
+	}
+	format := query.Get("format")
+	if err := validExportFormat(format); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	n := 20
+	if v := query.Get("n"); v != "" {
+		var err error
+		n, err = strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "n must be a non-negative number", http.StatusBadRequest)
+			return
+		}
+	}
+	baseName, base, headName, head, ok := s.openDiffProfiles(w, r)
+	if !ok {
+		return
+	}
+
+	report, err := compareProfiles(base, head, query.Get("si"), query.Get("normalize") == "true", n)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	report.Base, report.Head = baseName, headName
+	if format == "csv" || format == "xlsx" {
+		if err := serveTable(w, diffExportTable(report), format); err != nil {
+			s.logger.Printf("%s export: %v", requestID(r.Context()), err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+}
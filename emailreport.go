@@ -0,0 +1,297 @@
+package pprofweb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"net"
+	"net/smtp"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// emailReporter periodically emails a summary of the profiles of the last
+// window per service. A service is a top level directory of a root.
+type emailReporter struct {
+	schedule   *cronSchedule
+	window     time.Duration
+	roots      []*profileRoot
+	extensions []string
+	// publicURL is the base URL of this server used for links in the email.
+	publicURL string
+
+	smtpAddr     string
+	smtpUser     string
+	smtpPassword string
+	from         string
+	to           []string
+}
+
+// serviceSummary is the merged profile of one service and profile type.
+type serviceSummary struct {
+	Service     string
+	SampleType  string
+	Total       string
+	PrevTotal   string
+	Profiles    []summaryLink
+	Top         []summaryRow
+	Regressions []summaryRow
+}
+
+type summaryLink struct {
+	Name string
+	URL  string
+}
+
+type summaryRow struct {
+	Name  string
+	Value string
+	Share string
+	Delta string
+}
+
+// summaryTopN is the number of rows in the tables of the email.
+const summaryTopN = 10
+
+func (e *emailReporter) run() {
+	for {
+		next := e.schedule.next(time.Now())
+		if next.IsZero() {
+			logger.Println("email report: schedule never matches")
+			return
+		}
+		time.Sleep(time.Until(next))
+		if err := e.send(time.Now()); err != nil {
+			logger.Printf("email report: %v", err)
+		}
+	}
+}
+
+// send builds the report of the window ending at now and emails it.
+func (e *emailReporter) send(now time.Time) error {
+	summaries, err := e.summarize(now)
+	if err != nil {
+		return err
+	}
+	var body bytes.Buffer
+	err = emailReportTemplate.Execute(&body, struct {
+		From, To  string
+		Summaries []serviceSummary
+	}{
+		From:      now.Add(-e.window).Format("2006-01-02 15:04"),
+		To:        now.Format("2006-01-02 15:04"),
+		Summaries: summaries,
+	})
+	if err != nil {
+		return err
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", e.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(e.to, ", "))
+	fmt.Fprintf(&msg, "Subject: pprofweb report %s\r\n", now.Format("2006-01-02"))
+	fmt.Fprintf(&msg, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/html; charset=utf-8\r\n\r\n")
+	msg.Write(body.Bytes())
+
+	logger.Printf("email report: sending %d summaries to %s", len(summaries), strings.Join(e.to, ", "))
+	return sendMail(e.smtpAddr, e.smtpUser, e.smtpPassword, e.from, e.to, msg.Bytes())
+}
+
+// sendMail sends msg with PLAIN authentication if user is set.
+func sendMail(addr, user, password, from string, to []string, msg []byte) error {
+	var auth smtp.Auth
+	if user != "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", user, password, host)
+	}
+	return smtp.SendMail(addr, auth, from, to, msg)
+}
+
+// reportGroup collects the profiles of a service and profile type.
+type reportGroup struct {
+	service    string
+	sampleType string
+	links      []summaryLink
+	current    []*profile.Profile
+	previous   []*profile.Profile
+}
+
+// summarize merges the profiles modified in the window ending at now per
+// service and compares them with the window before.
+func (e *emailReporter) summarize(now time.Time) ([]serviceSummary, error) {
+	start, prevStart := now.Add(-e.window), now.Add(-2*e.window)
+	groups := make(map[string]*reportGroup)
+	for _, root := range e.roots {
+		files, err := root.listProfiles(e.extensions)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if file.modTime.Before(prevStart) || file.modTime.After(now) {
+				continue
+			}
+			err := root.fetch(context.Background(), file)
+			var p *profile.Profile
+			if err == nil {
+				p, err = parseProfileFile(file.path)
+			}
+			if err != nil {
+				logger.Printf("email report: skipping %s: %v", file.path, err)
+				continue
+			}
+			if len(p.SampleType) == 0 {
+				continue
+			}
+
+			service := serviceName(root, file.name)
+			sampleType := p.SampleType[defaultSampleIndex(p)].Type
+			key := service + "\x00" + sampleType
+			g, ok := groups[key]
+			if !ok {
+				g = &reportGroup{service: service, sampleType: sampleType}
+				groups[key] = g
+			}
+			if file.modTime.Before(start) {
+				g.previous = append(g.previous, p)
+				continue
+			}
+			g.current = append(g.current, p)
+			g.links = append(g.links, summaryLink{Name: file.name, URL: e.profileURL(root.reference(file.name))})
+		}
+	}
+
+	var summaries []serviceSummary
+	for _, g := range groups {
+		if len(g.current) == 0 {
+			continue
+		}
+		summary, err := g.summarize()
+		if err != nil {
+			logger.Printf("email report: %s %s: %v", g.service, g.sampleType, err)
+			continue
+		}
+		summaries = append(summaries, summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].Service != summaries[j].Service {
+			return summaries[i].Service < summaries[j].Service
+		}
+		return summaries[i].SampleType < summaries[j].SampleType
+	})
+	return summaries, nil
+}
+
+func (g *reportGroup) summarize() (serviceSummary, error) {
+	current, err := profile.Merge(g.current)
+	if err != nil {
+		return serviceSummary{}, err
+	}
+	sampleIndex := sampleIndexByName(current, g.sampleType)
+	unit := current.SampleType[sampleIndex].Unit
+	total := sampleTotal(current, sampleIndex)
+	top := topTable(current, sampleIndex)
+
+	summary := serviceSummary{
+		Service:    g.service,
+		SampleType: g.sampleType,
+		Total:      formatValue(total, unit),
+		Profiles:   g.links,
+	}
+	for i := 0; i < len(top) && i < summaryTopN; i++ {
+		summary.Top = append(summary.Top, summaryRow{
+			Name:  top[i].Name,
+			Value: formatValue(top[i].Flat, unit),
+			Share: formatShare(top[i].Flat, total),
+		})
+	}
+
+	if len(g.previous) == 0 {
+		return summary, nil
+	}
+	previous, err := profile.Merge(g.previous)
+	if err != nil {
+		// the previous window can't be compared but the summary is still useful
+		logger.Printf("email report: merging previous %s %s: %v", g.service, g.sampleType, err)
+		return summary, nil
+	}
+	prevIndex := sampleIndexByName(previous, g.sampleType)
+	if prevIndex < 0 {
+		return summary, nil
+	}
+	summary.PrevTotal = formatValue(sampleTotal(previous, prevIndex), unit)
+	for _, d := range diffTop(topTable(previous, prevIndex), top) {
+		if len(summary.Regressions) == summaryTopN {
+			break
+		}
+		if d.flatDelta() <= 0 {
+			continue
+		}
+		summary.Regressions = append(summary.Regressions, summaryRow{
+			Name:  d.Name,
+			Value: formatValue(d.HeadFlat, unit),
+			Delta: "+" + formatValue(d.flatDelta(), unit),
+		})
+	}
+	return summary, nil
+}
+
+// serviceName returns the service of the profile name in root: its top level
+// directory, or the root itself for files directly in it.
+func serviceName(root *profileRoot, name string) string {
+	if i := strings.Index(name, "/"); i > 0 {
+		return root.reference(name[:i])
+	}
+	if root.name != "" {
+		return root.name
+	}
+	return "."
+}
+
+func (e *emailReporter) profileURL(reference string) string {
+	return strings.TrimSuffix(e.publicURL, "/") + "/?profile=" + url.QueryEscape(reference)
+}
+
+func formatShare(v, total int64) string {
+	if total == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", 100*float64(v)/float64(total))
+}
+
+var emailReportTemplate = template.Must(template.New("email").Parse(`<!doctype html>
+<html>
+<body style="font-family: sans-serif">
+<h1>Performance report</h1>
+<p>Profiles from {{.From}} to {{.To}}.</p>
+{{range .Summaries}}
+<h2>{{.Service}}: {{.SampleType}}</h2>
+<p>Total {{.Total}}{{if .PrevTotal}} (previous period {{.PrevTotal}}){{end}} in {{len .Profiles}} profiles.</p>
+<table>
+<tr><th align="left">Top function</th><th>Flat</th><th>Share</th></tr>
+{{range .Top}}<tr><td>{{.Name}}</td><td align="right">{{.Value}}</td><td align="right">{{.Share}}</td></tr>
+{{end}}</table>
+{{if .Regressions}}
+<table>
+<tr><th align="left">Largest increase</th><th>Flat</th><th>Change</th></tr>
+{{range .Regressions}}<tr><td>{{.Name}}</td><td align="right">{{.Value}}</td><td align="right">{{.Delta}}</td></tr>
+{{end}}</table>
+{{end}}
+<ul>
+{{range .Profiles}}<li><a href="{{.URL}}">{{.Name}}</a></li>
+{{end}}</ul>
+{{else}}
+<p>No profiles were added.</p>
+{{end}}
+</body>
+</html>
+`))
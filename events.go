@@ -0,0 +1,402 @@
+package pprofweb
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// loadingPageDelay is how long opening a profile may take before the
+// browser is shown a page with the progress instead of waiting.
+const loadingPageDelay = time.Second
+
+// expiryWarning is how long before a session expires the browser is warned.
+const expiryWarning = time.Minute
+
+// sseKeepAliveInterval is the interval of comments sent on idle event streams
+// so proxies don't close them.
+const sseKeepAliveInterval = 30 * time.Second
+
+// sessionEvent is a server-sent event of a session.
+type sessionEvent struct {
+	name string
+	data string
+}
+
+// eventBroker fans out the events of a session to the connected browsers.
+type eventBroker struct {
+	root *profileRoot
+
+	mu          sync.Mutex
+	subscribers map[chan sessionEvent]bool
+	// last is replayed to new subscribers, e.g. a loading page connecting
+	// after the profile was loaded.
+	last   *sessionEvent
+	closed bool
+}
+
+// publish sends an event to all subscribers and replays it to later ones
+// until the next published event.
+func (b *eventBroker) publish(name, data string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e := sessionEvent{name, data}
+	b.last = &e
+	b.sendLocked(e)
+}
+
+// send sends an event to the current subscribers only.
+func (b *eventBroker) send(name, data string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sendLocked(sessionEvent{name, data})
+}
+
+// sendLocked sends e to all subscribers. Slow subscribers miss events instead
+// of blocking the session.
+func (b *eventBroker) sendLocked(e sessionEvent) {
+	for ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// subscribe returns a channel receiving the events until the broker is
+// closed or unsubscribe is called.
+func (b *eventBroker) subscribe() (<-chan sessionEvent, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ch := make(chan sessionEvent, 8)
+	if b.last != nil {
+		ch <- *b.last
+	}
+	if b.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	b.subscribers[ch] = true
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.subscribers[ch] {
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// close publishes the last event and disconnects all subscribers.
+func (b *eventBroker) close(name, data string) {
+	b.publish(name, data)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for ch := range b.subscribers {
+		close(ch)
+	}
+	b.subscribers = nil
+}
+
+// broker returns the event broker of the session id, creating it for root.
+func (s *server) broker(id string, root *profileRoot) *eventBroker {
+	s.brokersMutex.Lock()
+	defer s.brokersMutex.Unlock()
+	b, ok := s.brokers[id]
+	if !ok {
+		b = &eventBroker{root: root, subscribers: make(map[chan sessionEvent]bool)}
+		s.brokers[id] = b
+	}
+	return b
+}
+
+// closeBroker disconnects the browsers of the session id with a last event.
+func (s *server) closeBroker(id, name, data string) {
+	s.brokersMutex.Lock()
+	b, ok := s.brokers[id]
+	delete(s.brokers, id)
+	s.brokersMutex.Unlock()
+	if ok {
+		b.close(name, data)
+	}
+}
+
+// serveEvents streams the events of the session id: progress, ready, and
+// failed while it loads, expiring, ending, expired, and ended once it runs.
+// Connections don't keep the session alive.
+func (s *server) serveEvents(w http.ResponseWriter, r *http.Request, id string) {
+	s.brokersMutex.Lock()
+	b, ok := s.brokers[id]
+	s.brokersMutex.Unlock()
+	if !ok {
+		http.Error(w, "profile handler not loaded", http.StatusNotFound)
+		return
+	}
+	if !requireAuth(w, r, b.root) {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// disable buffering of nginx
+	w.Header().Set("X-Accel-Buffering", "no")
+	flusher.Flush()
+
+	events, unsubscribe := b.subscribe()
+	defer unsubscribe()
+	ticker := time.NewTicker(sseKeepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.name, strings.ReplaceAll(e.data, "\n", "\ndata: "))
+		case <-ticker.C:
+			io.WriteString(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// keepAlive resets the expiry of the session id and its linked sessions on
+// POST.
+func (s *server) keepAlive(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+	s.pprofHandlerMutex.RLock()
+	defer s.pprofHandlerMutex.RUnlock()
+	handler, ok := s.pprofHandler[id]
+	if !ok {
+		http.Error(w, "profile handler not loaded", http.StatusNotFound)
+		return
+	}
+	if !requireAuth(w, r, handler.root) {
+		return
+	}
+	s.touch(id, handler)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// expiryWarningAfter returns when the browsers of a session valid for valid
+// are warned about its expiry.
+func expiryWarningAfter(valid time.Duration) time.Duration {
+	if valid-expiryWarning < valid/2 {
+		return valid / 2
+	}
+	return valid - expiryWarning
+}
+
+// loadSessionAsync opens the profile ref, and the base profile of opts if
+// set, and starts session id in the background, publishing the progress to the browsers of the session. If it
+// takes longer than loadingPageDelay, the response is a page showing the
+// progress, which continues to the session once it is ready.
+func (s *server) loadSessionAsync(w http.ResponseWriter, r *http.Request, id, ref string, opts *sessionOptions) {
+	root, _ := s.resolveRoot(r, ref)
+	b := s.broker(id, root)
+	// the request context ends with the response
+	ctx := context.WithValue(context.Background(), requestIDKey{}, requestID(r.Context()))
+
+	type result struct {
+		root        *profileRoot
+		sessionPath string
+		err         error
+	}
+	done := make(chan result, 1)
+	go func() {
+		progress := func(msg string) { b.publish("progress", msg) }
+		root, profileName, p, err := s.loadProfile(ctx, r, ref, progress)
+		if err == nil && opts.baseRef != "" {
+			progress("loading the base profile")
+			var base *profile.Profile
+			if _, _, base, err = s.loadProfile(ctx, r, opts.baseRef, progress); err == nil {
+				if compatErr := compatibleProfiles(base, p); compatErr != nil {
+					err = &statusError{http.StatusBadRequest, fmt.Sprintf("base profile can't be compared: %v", compatErr)}
+				}
+				opts.base = base
+			}
+		}
+		if err != nil {
+			done <- result{root, "", err}
+			b.publish("failed", err.Error())
+			// let loading pages receive the error before forgetting the session
+			time.AfterFunc(expiryWarning, func() { s.closeBroker(id, "failed", err.Error()) })
+			return
+		}
+		b.publish("progress", "starting pprof")
+		sessionPath, err := s.newSession(id, root, profileName, p, opts)
+		if err != nil {
+			s.logger.Printf("%s pprof error: %+v", requestID(ctx), err)
+			err = &statusError{http.StatusInternalServerError, "pprof error"}
+			b.publish("failed", err.Error())
+			time.AfterFunc(expiryWarning, func() { s.closeBroker(id, "failed", err.Error()) })
+		} else {
+			b.publish("ready", sessionPath)
+		}
+		done <- result{root, sessionPath, err}
+	}()
+
+	timer := time.NewTimer(loadingPageDelay)
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		if res.err != nil {
+			writeLoadError(w, r, res.root, res.err)
+			return
+		}
+		http.Redirect(w, r, res.sessionPath, http.StatusSeeOther)
+	case <-timer.C:
+		err := loadingTemplate.Execute(w, struct {
+			Profile string
+			Events  string
+		}{ref, pprofWebPath + id + "/events"})
+		if err != nil {
+			s.logger.Printf("%s loading page: %v", requestID(r.Context()), err)
+		}
+	}
+}
+
+// readFileProgress reads the file at path of size bytes, reporting the
+// percentage read to progress. It stops if ctx is canceled.
+func readFileProgress(ctx context.Context, path string, size int64, progress func(string)) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if size <= 0 {
+		return io.ReadAll(f)
+	}
+
+	data := make([]byte, 0, size)
+	buf := make([]byte, 1<<20)
+	lastPercent := -1
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		n, err := f.Read(buf)
+		data = append(data, buf[:n]...)
+		if percent := int(100 * int64(len(data)) / size); percent/10 != lastPercent/10 {
+			lastPercent = percent
+			progress("reading " + strconv.Itoa(percent) + "%")
+		}
+		if err == io.EOF {
+			return data, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+var loadingTemplate = template.Must(template.New("loading").Parse(`<!doctype html>
+<html>
+<head><title>Loading {{.Profile}}</title></head>
+<body style="font-family:sans-serif">
+<h1>Loading {{.Profile}}</h1>
+<p id="progress">opening profile</p>
+<script>
+(function() {
+  var progress = document.getElementById('progress');
+  var events = new EventSource({{.Events}});
+  events.addEventListener('progress', function(e) { progress.textContent = e.data; });
+  events.addEventListener('ready', function(e) { events.close(); location.replace(e.data); });
+  events.addEventListener('failed', function(e) {
+    events.close();
+    progress.textContent = 'Error: ' + e.data;
+  });
+})();
+</script>
+</body>
+</html>
+`))
+
+// sessionExpiry shows a bar with a keep alive button on session pages before
+// the session expires.
+const sessionExpiry = `<div id="pprofweb-expiry" style="display:none;position:fixed;top:0;left:0;right:0;z-index:1002;` +
+	`background:#fc6;padding:6px;text-align:center;font:14px sans-serif"><span></span> <button>Keep alive</button></div>
+<script>
+(function() {
+  if (!window.EventSource) return;
+  var session = location.pathname.split('/').slice(0, 3).join('/') + '/';
+  var bar = document.getElementById('pprofweb-expiry');
+  var text = bar.querySelector('span'), button = bar.querySelector('button');
+  var events = new EventSource(session + 'events');
+  events.addEventListener('expiring', function(e) {
+    text.textContent = 'This session expires in ' + e.data + ' seconds.';
+    button.style.display = '';
+    bar.style.display = 'block';
+  });
+  events.addEventListener('ending', function(e) {
+    text.textContent = 'This session reached its maximum lifetime and ends in ' + e.data +
+      ' seconds. Open the profile again to continue.';
+    button.style.display = 'none';
+    bar.style.display = 'block';
+  });
+  events.addEventListener('expired', function() {
+    events.close();
+    text.textContent = 'This session expired. Open the profile again to continue.';
+    button.style.display = 'none';
+    bar.style.display = 'block';
+  });
+  events.addEventListener('ended', function() {
+    events.close();
+    text.textContent = 'An administrator ended this session. Open the profile again to continue.';
+    button.style.display = 'none';
+    bar.style.display = 'block';
+  });
+  button.onclick = function() {
+    fetch(session + 'keepalive', {method: 'POST'}).then(function(r) {
+      if (r.ok) bar.style.display = 'none';
+    });
+  };
+})();
+</script>
+`
+
+// minHeartbeatInterval limits the rate of heartbeats of sessions with short
+// validity.
+const minHeartbeatInterval = 5 * time.Second
+
+// sessionHeartbeat returns a script keeping the session alive while one of its
+// pages is open and visible by posting to keepalive three times per valid
+// duration. Sessions of closed or hidden tabs expire after valid.
+func sessionHeartbeat(valid time.Duration) string {
+	interval := valid / 3
+	if interval < minHeartbeatInterval {
+		interval = minHeartbeatInterval
+	}
+	return fmt.Sprintf(`<script>
+(function() {
+  var session = location.pathname.split('/').slice(0, 3).join('/') + '/';
+  function beat() {
+    if (document.visibilityState === 'visible') fetch(session + 'keepalive', {method: 'POST'});
+  }
+  setInterval(beat, %d);
+  document.addEventListener('visibilitychange', beat);
+})();
+</script>
+`, interval.Milliseconds())
+}
@@ -0,0 +1,227 @@
+package pprofweb
+
+import (
+	"bufio"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// defaultExpectedHotTop is the number of functions of the top table compared
+// to the expected hot functions.
+const defaultExpectedHotTop = 20
+
+// parseExpectedHot parses a definition of the functions expected to be hot
+// in the profiles of a service, "service=regexp" or "service=@file" with a
+// regexp per line of the file. Lines starting with # are comments.
+func parseExpectedHot(def string) (string, []string, error) {
+	service, value := splitKeyValue(def)
+	if service == "" || value == "" {
+		return "", nil, fmt.Errorf("expected hot functions %q: expected service=regexp or service=@file", def)
+	}
+	if !strings.HasPrefix(value, "@") {
+		if _, err := regexp.Compile(value); err != nil {
+			return "", nil, fmt.Errorf("expected hot functions of %s: %w", service, err)
+		}
+		return service, []string{value}, nil
+	}
+
+	f, err := os.Open(value[1:])
+	if err != nil {
+		return "", nil, fmt.Errorf("expected hot functions of %s: %w", service, err)
+	}
+	defer f.Close()
+	var patterns []string
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		pattern := strings.TrimSpace(scanner.Text())
+		if pattern == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+		if _, err := regexp.Compile(pattern); err != nil {
+			return "", nil, fmt.Errorf("%s:%d: %w", value[1:], line, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	if err := scanner.Err(); err != nil {
+		return "", nil, fmt.Errorf("expected hot functions of %s: %w", service, err)
+	}
+	return service, patterns, nil
+}
+
+// compileExpectedHot returns the regexps matching the expected hot functions
+// by service of the definitions defs.
+func compileExpectedHot(defs []string) (map[string]*regexp.Regexp, error) {
+	patterns := make(map[string][]string)
+	for _, def := range defs {
+		service, p, err := parseExpectedHot(def)
+		if err != nil {
+			return nil, err
+		}
+		patterns[service] = append(patterns[service], p...)
+	}
+	expected := make(map[string]*regexp.Regexp)
+	for service, p := range patterns {
+		if len(p) == 0 {
+			continue
+		}
+		expected[service] = regexp.MustCompile("(?:" + strings.Join(p, ")|(?:") + ")")
+	}
+	return expected, nil
+}
+
+// profileService returns the service of the profile name of a root: the
+// first directory of its name, as for profiles captured from targets.
+func profileService(name string) string {
+	name = path.Clean(strings.TrimPrefix(name, "/"))
+	if i := strings.Index(name, "/"); i > 0 {
+		return name[:i]
+	}
+	return ""
+}
+
+// hotEntry is a function of the top table of a profile and whether it
+// was expected there.
+type hotEntry struct {
+	topEntry
+	Expected bool `json:"expected"`
+}
+
+// expectedHotReport is the JSON response of GET /api/v1/expected-hot.
+type expectedHotReport struct {
+	Profile    string     `json:"profile"`
+	Service    string     `json:"service"`
+	SampleType string     `json:"sample_type"`
+	Unit       string     `json:"unit"`
+	Total      int64      `json:"total"`
+	Top        []hotEntry `json:"top"`
+	// Unexpected is the number of functions of Top not on the list.
+	Unexpected int `json:"unexpected"`
+}
+
+// expectedHotHandler compares the top functions by flat value of a profile
+// with the functions expected to be hot in the profiles of its service with
+// GET /expected-hot?profile=api/cpu/cpu.pb.gz, JSON at /api/v1/expected-hot,
+// so reviews of routine profiles can focus on unexpected entrants. service
+// overrides the service of the profile, n the size of the top table, and si
+// the sample type.
+func (s *server) expectedHotHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	ref := query.Get("profile")
+	if ref == "" {
+		http.Error(w, "profile is required", http.StatusBadRequest)
+		return
+	}
+	n := defaultExpectedHotTop
+	if v := query.Get("n"); v != "" {
+		var err error
+		n, err = strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "n must be a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+	prefs, err := s.requestPrefs(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	root, name, p, ok := s.openProfile(w, r, ref)
+	if !ok {
+		return
+	}
+	service := query.Get("service")
+	if service == "" {
+		service = profileService(root.relative(name))
+	}
+	expected := s.expectedHot[service]
+	if expected == nil {
+		http.Error(w, fmt.Sprintf("no expected hot functions are defined for the service %q", service), http.StatusNotFound)
+		return
+	}
+	sampleIndex, err := selectSampleIndex(p, query.Get("si"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report := expectedHotReport{
+		Profile:    name,
+		Service:    service,
+		SampleType: p.SampleType[sampleIndex].Type,
+		Unit:       p.SampleType[sampleIndex].Unit,
+		Total:      sampleTotal(p, sampleIndex),
+		Top:        []hotEntry{},
+	}
+	for i, e := range topTable(p, sampleIndex) {
+		if i == n || e.Flat == 0 {
+			break
+		}
+		f := hotEntry{topEntry: e, Expected: expected.MatchString(e.Name)}
+		if !f.Expected {
+			report.Unexpected++
+		}
+		report.Top = append(report.Top, f)
+	}
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		writeJSON(w, report)
+		return
+	}
+
+	type row struct {
+		Rank                   int
+		Name, Flat, Share, Cum string
+		Expected               bool
+	}
+	page := struct {
+		expectedHotReport
+		Pattern string
+		Rows    []row
+	}{expectedHotReport: report, Pattern: expected.String()}
+	for i, f := range report.Top {
+		share := ""
+		if report.Total != 0 {
+			share = fmt.Sprintf("%.1f%%", 100*float64(f.Flat)/float64(report.Total))
+		}
+		page.Rows = append(page.Rows, row{i + 1, f.Name, prefs.value(f.Flat, report.Unit), share,
+			prefs.value(f.Cum, report.Unit), f.Expected})
+	}
+	if err := expectedHotTemplate.Execute(w, page); err != nil {
+		s.logger.Printf("%s expected hot: %v", requestID(r.Context()), err)
+	}
+}
+
+var expectedHotTemplate = template.Must(template.New("expectedhot").Parse(`<!doctype html>
+<html>
+<head><title>{{.Profile}} unexpected hot functions</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin: 1em 0; }
+td, th { border: 1px solid #ccc; padding: 2px 8px; text-align: left; }
+td.value { text-align: right; }
+tr.unexpected { background: #fdd; font-weight: bold; }
+tr.expected { color: #888; }
+</style>
+</head>
+<body>
+<h1>{{.Profile}}</h1>
+<p>{{if .Unexpected}}{{.Unexpected}} of the top {{len .Top}} functions by flat {{.SampleType}} are not{{else}}All top {{len .Top}} functions by flat {{.SampleType}} are{{end}}
+expected to be hot in profiles of <b>{{.Service}}</b> (<code>{{.Pattern}}</code>).
+Open the <a href="/?profile={{.Profile}}">profile</a>.</p>
+<table>
+<tr><th>#</th><th>Function</th><th>Flat</th><th>Flat %</th><th>Cum</th><th></th></tr>
+{{range .Rows}}<tr class="{{if .Expected}}expected{{else}}unexpected{{end}}"><td class="value">{{.Rank}}</td><td>{{.Name}}</td>
+<td class="value">{{.Flat}}</td><td class="value">{{.Share}}</td><td class="value">{{.Cum}}</td><td>{{if not .Expected}}unexpected{{end}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
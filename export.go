@@ -0,0 +1,255 @@
+package pprofweb
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// exportTable is a table exported as CSV or XLSX for spreadsheets. The cells
+// of rows are strings, int64, or float64; nil leaves a cell empty.
+type exportTable struct {
+	// name is the file name of the download without extension.
+	name   string
+	header []string
+	rows   [][]interface{}
+}
+
+// exportFormats maps the format query parameter to the content type.
+var exportFormats = map[string]string{
+	"csv":  "text/csv; charset=utf-8",
+	"xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+}
+
+// serveTable writes t as a download in format, csv or xlsx.
+func serveTable(w http.ResponseWriter, t *exportTable, format string) error {
+	w.Header().Set("Content-Type", exportFormats[format])
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", t.name+"."+format))
+	if format == "xlsx" {
+		return writeXLSX(w, t)
+	}
+	return writeCSV(w, t)
+}
+
+// validExportFormat returns an error for formats other than json (the
+// default if empty), csv, and xlsx.
+func validExportFormat(format string) error {
+	if _, ok := exportFormats[format]; ok || format == "" || format == "json" {
+		return nil
+	}
+	return fmt.Errorf("format must be json, csv, or xlsx")
+}
+
+func writeCSV(w io.Writer, t *exportTable) error {
+	cw := csv.NewWriter(w)
+	cw.Write(t.header)
+	record := make([]string, len(t.header))
+	for _, row := range t.rows {
+		for i, cell := range row {
+			record[i] = formatCell(cell)
+		}
+		cw.Write(record)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func formatCell(cell interface{}) string {
+	switch v := cell.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	return fmt.Sprint(cell)
+}
+
+// xlsxFiles are the parts of a workbook with a single sheet besides the
+// sheet itself.
+var xlsxFiles = []struct{ name, content string }{
+	{"[Content_Types].xml", xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`</Types>`},
+	{"_rels/.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`},
+	{"xl/workbook.xml", xml.Header + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" ` +
+		`xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+		`<sheets><sheet name="pprofweb" sheetId="1" r:id="rId1"/></sheets></workbook>`},
+	{"xl/_rels/workbook.xml.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`</Relationships>`},
+}
+
+// writeXLSX writes t as an Office Open XML workbook with inline strings, the
+// smallest workbook Excel, LibreOffice, and Google Sheets open.
+func writeXLSX(w io.Writer, t *exportTable) error {
+	zw := zip.NewWriter(w)
+	for _, f := range xlsxFiles {
+		fw, err := zw.Create(f.name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(fw, f.content); err != nil {
+			return err
+		}
+	}
+
+	fw, err := zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	b.WriteString(xml.Header + `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	header := make([]interface{}, len(t.header))
+	for i, h := range t.header {
+		header[i] = h
+	}
+	for _, row := range append([][]interface{}{header}, t.rows...) {
+		b.WriteString("<row>")
+		for _, cell := range row {
+			switch v := cell.(type) {
+			case nil:
+				b.WriteString("<c/>")
+			case string:
+				b.WriteString(`<c t="inlineStr"><is><t>`)
+				xml.EscapeText(&b, []byte(v))
+				b.WriteString("</t></is></c>")
+			default:
+				b.WriteString("<c><v>" + formatCell(v) + "</v></c>")
+			}
+		}
+		b.WriteString("</row>")
+	}
+	b.WriteString("</sheetData></worksheet>")
+	if _, err := io.WriteString(fw, b.String()); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// exportName returns the file name of a download for the profile reference
+// ref without the extension.
+func exportName(ref string) string {
+	name := trimCompressedExtension(path.Base(ref))
+	for _, ext := range defaultProfileExtensions {
+		name = strings.TrimSuffix(name, ext)
+	}
+	return name
+}
+
+// topExportTable returns the top table of a profile with values in unit.
+func topExportTable(name, unit string, total int64, table []topEntry) *exportTable {
+	t := &exportTable{
+		name:   name,
+		header: []string{"function", "flat (" + unit + ")", "flat %", "cum (" + unit + ")", "cum %"},
+	}
+	for _, e := range table {
+		t.rows = append(t.rows, []interface{}{e.Name, e.Flat, share(e.Flat, total), e.Cum, share(e.Cum, total)})
+	}
+	return t
+}
+
+// share returns v as a percentage of total, nil if total is 0.
+func share(v, total int64) interface{} {
+	if total == 0 {
+		return nil
+	}
+	return 100 * float64(v) / float64(total)
+}
+
+// diffExportTable returns the functions of a diff report ordered by the
+// largest absolute change.
+func diffExportTable(report *diffReport) *exportTable {
+	unit := report.Unit
+	t := &exportTable{
+		name: exportName(report.Head) + "-vs-" + exportName(report.Base),
+		header: []string{"function", "base flat (" + unit + ")", "head flat (" + unit + ")", "delta (" + unit + ")",
+			"relative change", "base cum (" + unit + ")", "head cum (" + unit + ")"},
+	}
+	for _, e := range report.LargestAbsolute {
+		var relative interface{}
+		if e.Relative != nil {
+			relative = *e.Relative
+		}
+		t.rows = append(t.rows, []interface{}{e.Name, e.BaseFlat, e.HeadFlat, e.Delta, relative, e.BaseCum, e.HeadCum})
+	}
+	return t
+}
+
+// topReport is the JSON response of GET /api/v1/top.
+type topReport struct {
+	Profile    string     `json:"profile"`
+	SampleType string     `json:"sample_type"`
+	Unit       string     `json:"unit"`
+	Total      int64      `json:"total"`
+	Top        []topEntry `json:"top"`
+}
+
+// topHandler serves the top functions of a stored profile with
+// GET /api/v1/top?profile=cpu.pb.gz[&si=sample_type][&n=50][&format=csv]
+// as JSON, CSV, or XLSX.
+func (s *server) topHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	format := query.Get("format")
+	if err := validExportFormat(format); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	n := 0
+	if v := query.Get("n"); v != "" {
+		var err error
+		n, err = strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "n must be a non-negative number", http.StatusBadRequest)
+			return
+		}
+	}
+	if query.Get("profile") == "" {
+		http.Error(w, "profile is required", http.StatusBadRequest)
+		return
+	}
+	_, name, p, ok := s.openProfile(w, r, query.Get("profile"))
+	if !ok {
+		return
+	}
+	sampleIndex, err := selectSampleIndex(p, query.Get("si"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	report := topReport{
+		Profile:    name,
+		SampleType: p.SampleType[sampleIndex].Type,
+		Unit:       p.SampleType[sampleIndex].Unit,
+		Total:      sampleTotal(p, sampleIndex),
+		Top:        topTable(p, sampleIndex),
+	}
+	if n > 0 && len(report.Top) > n {
+		report.Top = report.Top[:n]
+	}
+	if format == "" || format == "json" {
+		writeJSON(w, report)
+		return
+	}
+	if err := serveTable(w, topExportTable(exportName(name), report.Unit, report.Total, report.Top), format); err != nil {
+		s.logger.Printf("%s export: %v", requestID(r.Context()), err)
+	}
+}
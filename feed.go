@@ -0,0 +1,142 @@
+package pprofweb
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// profileEvent is the data of a profile event of GET /api/v1/profiles/events.
+type profileEvent struct {
+	Profile string `json:"profile"`
+	Size    int64  `json:"size"`
+	SHA256  string `json:"sha256,omitempty"`
+	// Type and Version are detected from the profile, if it can be parsed.
+	Type    string `json:"type,omitempty"`
+	Version string `json:"version,omitempty"`
+	// Source is upload, capture, or scan for files found by the periodic
+	// re-scan; Target is the captured target.
+	Source string    `json:"source"`
+	Target string    `json:"target,omitempty"`
+	Time   time.Time `json:"time"`
+	// URL opens a new session of the profile.
+	URL string `json:"url"`
+
+	root *profileRoot
+}
+
+// profileFeed fans out the events of new profiles to the subscribers of
+// GET /api/v1/profiles/events.
+type profileFeed struct {
+	mu          sync.Mutex
+	subscribers map[chan profileEvent]bool
+}
+
+func newProfileFeed() *profileFeed {
+	return &profileFeed{subscribers: make(map[chan profileEvent]bool)}
+}
+
+// publish sends e to all subscribers. Slow subscribers miss events instead of
+// blocking uploads.
+func (f *profileFeed) publish(e profileEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for ch := range f.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// subscribe returns a channel receiving the events until unsubscribe is
+// called.
+func (f *profileFeed) subscribe() (<-chan profileEvent, func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ch := make(chan profileEvent, 64)
+	f.subscribers[ch] = true
+	return ch, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		delete(f.subscribers, ch)
+	}
+}
+
+// publishProfile publishes the event of the new profile f of root from
+// source, stored by an upload, a capture of target, or found by a scan.
+func (s *server) publishProfile(root *profileRoot, f profileFile, sum, source, target string) {
+	ref := root.reference(f.name)
+	e := profileEvent{
+		Profile: ref,
+		Size:    f.size,
+		SHA256:  sum,
+		Source:  source,
+		Target:  target,
+		Time:    f.modTime,
+		URL:     "/?profile=" + url.QueryEscape(ref),
+		root:    root,
+	}
+	if v, err := s.versions.lookup(f.path, f.modTime); err == nil {
+		e.Type = string(v.typ)
+		e.Version = v.version
+	}
+	s.feed.publish(e)
+}
+
+// profileEventsHandler serves GET /api/v1/profiles/events: a stream of
+// server-sent events named profile with the JSON profileEvent of every
+// profile uploaded to or captured into the roots the request is authorized
+// for, so bots and dashboards can react without polling.
+func (s *server) profileEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	prefs, err := s.requestPrefs(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// disable buffering of nginx
+	w.Header().Set("X-Accel-Buffering", "no")
+	flusher.Flush()
+
+	events, unsubscribe := s.feed.subscribe()
+	defer unsubscribe()
+	ticker := time.NewTicker(sseKeepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case e := <-events:
+			if !e.root.authorized(r) {
+				continue
+			}
+			e.Time = e.Time.In(prefs.location)
+			data, err := json.Marshal(e)
+			if err != nil {
+				s.logger.Printf("%s profile event: %v", requestID(r.Context()), err)
+				continue
+			}
+			fmt.Fprintf(w, "event: profile\ndata: %s\n\n", data)
+		case <-ticker.C:
+			io.WriteString(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
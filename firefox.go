@@ -0,0 +1,418 @@
+package pprofweb
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// firefoxProfilerURL opens a profile served at the escaped URL appended to it
+// in the Firefox Profiler.
+const firefoxProfilerURL = "https://profiler.firefox.com/from-url/"
+
+// firefoxProfilerOrigin may fetch the exported profiles.
+const firefoxProfilerOrigin = "https://profiler.firefox.com"
+
+// firefoxLinkDuration is the validity of the signed URLs the Firefox Profiler
+// loads profiles from.
+const firefoxLinkDuration = 15 * time.Minute
+
+// The processed profile format of the Firefox Profiler, see
+// https://github.com/firefox-devtools/profiler/blob/main/docs-developer/PROCESSED-PROFILES.md.
+// Tables are stored as columns. The profiler upgrades older versions of the
+// format when loading them.
+type firefoxProfile struct {
+	Meta    firefoxMeta     `json:"meta"`
+	Libs    []interface{}   `json:"libs"`
+	Pages   []interface{}   `json:"pages"`
+	Threads []firefoxThread `json:"threads"`
+}
+
+type firefoxMeta struct {
+	// Interval is the sampling interval in milliseconds.
+	Interval                   float64           `json:"interval"`
+	StartTime                  float64           `json:"startTime"`
+	ProcessType                int               `json:"processType"`
+	Product                    string            `json:"product"`
+	Stackwalk                  int               `json:"stackwalk"`
+	Version                    int               `json:"version"`
+	PreprocessedProfileVersion int               `json:"preprocessedProfileVersion"`
+	Symbolicated               bool              `json:"symbolicated"`
+	Categories                 []firefoxCategory `json:"categories"`
+	MarkerSchema               []interface{}     `json:"markerSchema"`
+}
+
+type firefoxCategory struct {
+	Name          string   `json:"name"`
+	Color         string   `json:"color"`
+	Subcategories []string `json:"subcategories"`
+}
+
+type firefoxThread struct {
+	ProcessType         string               `json:"processType"`
+	ProcessStartupTime  float64              `json:"processStartupTime"`
+	ProcessShutdownTime *float64             `json:"processShutdownTime"`
+	RegisterTime        float64              `json:"registerTime"`
+	UnregisterTime      *float64             `json:"unregisterTime"`
+	PausedRanges        []interface{}        `json:"pausedRanges"`
+	Name                string               `json:"name"`
+	IsMainThread        bool                 `json:"isMainThread"`
+	PID                 string               `json:"pid"`
+	TID                 int                  `json:"tid"`
+	Samples             firefoxSamples       `json:"samples"`
+	Markers             firefoxMarkers       `json:"markers"`
+	StackTable          firefoxStackTable    `json:"stackTable"`
+	FrameTable          firefoxFrameTable    `json:"frameTable"`
+	FuncTable           firefoxFuncTable     `json:"funcTable"`
+	ResourceTable       firefoxResourceTable `json:"resourceTable"`
+	StringArray         []string             `json:"stringArray"`
+}
+
+type firefoxSamples struct {
+	Length int       `json:"length"`
+	Stack  []int     `json:"stack"`
+	Time   []float64 `json:"time"`
+	Weight []float64 `json:"weight"`
+	// WeightType is samples, tracing-ms, or bytes.
+	WeightType string `json:"weightType"`
+}
+
+type firefoxMarkers struct {
+	Length    int           `json:"length"`
+	Category  []int         `json:"category"`
+	Data      []interface{} `json:"data"`
+	EndTime   []float64     `json:"endTime"`
+	Name      []int         `json:"name"`
+	Phase     []int         `json:"phase"`
+	StartTime []float64     `json:"startTime"`
+}
+
+type firefoxStackTable struct {
+	Length      int    `json:"length"`
+	Frame       []int  `json:"frame"`
+	Prefix      []*int `json:"prefix"`
+	Category    []int  `json:"category"`
+	Subcategory []int  `json:"subcategory"`
+}
+
+type firefoxFrameTable struct {
+	Length         int           `json:"length"`
+	Address        []int         `json:"address"`
+	InlineDepth    []int         `json:"inlineDepth"`
+	Category       []int         `json:"category"`
+	Subcategory    []int         `json:"subcategory"`
+	Func           []int         `json:"func"`
+	NativeSymbol   []*int        `json:"nativeSymbol"`
+	InnerWindowID  []*int        `json:"innerWindowID"`
+	Implementation []*string     `json:"implementation"`
+	Line           []*int64      `json:"line"`
+	Column         []*int64      `json:"column"`
+	Optimizations  []interface{} `json:"optimizations"`
+}
+
+type firefoxFuncTable struct {
+	Length        int      `json:"length"`
+	Name          []int    `json:"name"`
+	IsJS          []bool   `json:"isJS"`
+	RelevantForJS []bool   `json:"relevantForJS"`
+	Resource      []int    `json:"resource"`
+	FileName      []*int   `json:"fileName"`
+	LineNumber    []*int64 `json:"lineNumber"`
+	ColumnNumber  []*int64 `json:"columnNumber"`
+}
+
+type firefoxResourceTable struct {
+	Length int   `json:"length"`
+	Lib    []int `json:"lib"`
+	Name   []int `json:"name"`
+	Host   []int `json:"host"`
+	Type   []int `json:"type"`
+}
+
+// firefoxBuilder adds the samples of a profile to a thread, sharing strings,
+// functions, frames, and stack prefixes.
+type firefoxBuilder struct {
+	t       *firefoxThread
+	strings map[string]int
+	funcs   map[string]int
+	frames  map[string]int
+	stacks  map[[2]int]int
+}
+
+func (b *firefoxBuilder) str(s string) int {
+	i, ok := b.strings[s]
+	if !ok {
+		i = len(b.t.StringArray)
+		b.strings[s] = i
+		b.t.StringArray = append(b.t.StringArray, s)
+	}
+	return i
+}
+
+func (b *firefoxBuilder) function(name, file string) int {
+	key := name + "\x00" + file
+	i, ok := b.funcs[key]
+	if ok {
+		return i
+	}
+	ft := &b.t.FuncTable
+	i = ft.Length
+	b.funcs[key] = i
+	ft.Length++
+	ft.Name = append(ft.Name, b.str(name))
+	ft.IsJS = append(ft.IsJS, false)
+	ft.RelevantForJS = append(ft.RelevantForJS, false)
+	ft.Resource = append(ft.Resource, -1)
+	var fileName *int
+	if file != "" {
+		s := b.str(file)
+		fileName = &s
+	}
+	ft.FileName = append(ft.FileName, fileName)
+	ft.LineNumber = append(ft.LineNumber, nil)
+	ft.ColumnNumber = append(ft.ColumnNumber, nil)
+	return i
+}
+
+func (b *firefoxBuilder) frame(name, file string, line int64) int {
+	key := fmt.Sprintf("%s\x00%s\x00%d", name, file, line)
+	i, ok := b.frames[key]
+	if ok {
+		return i
+	}
+	fn := b.function(name, file)
+	ft := &b.t.FrameTable
+	i = ft.Length
+	b.frames[key] = i
+	ft.Length++
+	ft.Address = append(ft.Address, -1)
+	ft.InlineDepth = append(ft.InlineDepth, 0)
+	ft.Category = append(ft.Category, 0)
+	ft.Subcategory = append(ft.Subcategory, 0)
+	ft.Func = append(ft.Func, fn)
+	ft.NativeSymbol = append(ft.NativeSymbol, nil)
+	ft.InnerWindowID = append(ft.InnerWindowID, nil)
+	ft.Implementation = append(ft.Implementation, nil)
+	var lineNumber *int64
+	if line > 0 {
+		lineNumber = &line
+	}
+	ft.Line = append(ft.Line, lineNumber)
+	ft.Column = append(ft.Column, nil)
+	ft.Optimizations = append(ft.Optimizations, nil)
+	return i
+}
+
+// stack returns the stack of frame called from prefix, -1 for the root.
+func (b *firefoxBuilder) stack(prefix, frame int) int {
+	key := [2]int{prefix, frame}
+	i, ok := b.stacks[key]
+	if ok {
+		return i
+	}
+	st := &b.t.StackTable
+	i = st.Length
+	b.stacks[key] = i
+	st.Length++
+	st.Frame = append(st.Frame, frame)
+	var p *int
+	if prefix >= 0 {
+		p = &prefix
+	}
+	st.Prefix = append(st.Prefix, p)
+	st.Category = append(st.Category, 0)
+	st.Subcategory = append(st.Subcategory, 0)
+	return i
+}
+
+// firefoxExport converts the values at sampleIndex of p to the processed
+// format of the Firefox Profiler. Every pprof sample becomes one sample
+// weighted by its value; the samples are spread over time by their order.
+func firefoxExport(p *profile.Profile, sampleIndex int, name string) *firefoxProfile {
+	unit := p.SampleType[sampleIndex].Unit
+	interval := 1.0
+	if unit == "nanoseconds" && p.Period > 0 {
+		interval = float64(p.Period) / 1e6
+	}
+	weightType, scale := "samples", 1.0
+	switch unit {
+	case "nanoseconds":
+		weightType, scale = "tracing-ms", 1e-6
+	case "bytes":
+		weightType = "bytes"
+	}
+	start := 0.0
+	if p.TimeNanos != 0 {
+		start = float64(p.TimeNanos) / 1e6
+	}
+
+	t := firefoxThread{
+		ProcessType:  "default",
+		PausedRanges: []interface{}{},
+		Name:         name,
+		IsMainThread: true,
+		PID:          "0",
+		Samples:      firefoxSamples{WeightType: weightType},
+		Markers: firefoxMarkers{
+			Category: []int{}, Data: []interface{}{}, EndTime: []float64{},
+			Name: []int{}, Phase: []int{}, StartTime: []float64{},
+		},
+		ResourceTable: firefoxResourceTable{Lib: []int{}, Name: []int{}, Host: []int{}, Type: []int{}},
+		StringArray:   []string{},
+	}
+	b := &firefoxBuilder{
+		t:       &t,
+		strings: make(map[string]int),
+		funcs:   make(map[string]int),
+		frames:  make(map[string]int),
+		stacks:  make(map[[2]int]int),
+	}
+	for _, s := range p.Sample {
+		v := s.Value[sampleIndex]
+		if v == 0 || len(s.Location) == 0 {
+			continue
+		}
+		stack := -1
+		// from the root to the leaf, inlined functions after their caller
+		for i := len(s.Location) - 1; i >= 0; i-- {
+			loc := s.Location[i]
+			if len(loc.Line) == 0 {
+				stack = b.stack(stack, b.frame(fmt.Sprintf("0x%x", loc.Address), "", 0))
+				continue
+			}
+			for j := len(loc.Line) - 1; j >= 0; j-- {
+				line := loc.Line[j]
+				name, file := "?", ""
+				if line.Function != nil {
+					name, file = line.Function.Name, line.Function.Filename
+				}
+				stack = b.stack(stack, b.frame(name, file, line.Line))
+			}
+		}
+		t.Samples.Stack = append(t.Samples.Stack, stack)
+		t.Samples.Time = append(t.Samples.Time, float64(t.Samples.Length)*interval)
+		t.Samples.Weight = append(t.Samples.Weight, float64(v)*scale)
+		t.Samples.Length++
+	}
+
+	return &firefoxProfile{
+		Meta: firefoxMeta{
+			Interval:                   interval,
+			StartTime:                  start,
+			Product:                    "pprofweb: " + name,
+			Version:                    24,
+			PreprocessedProfileVersion: 33,
+			Symbolicated:               true,
+			Categories:                 []firefoxCategory{{Name: "Other", Color: "grey", Subcategories: []string{"Other"}}},
+			MarkerSchema:               []interface{}{},
+		},
+		Libs:    []interface{}{},
+		Pages:   []interface{}{},
+		Threads: []firefoxThread{t},
+	}
+}
+
+type signedKey struct{}
+
+// signedRoot returns the root whose export or upload the request of ctx
+// carries a valid signature of, or nil.
+func signedRoot(ctx context.Context) *profileRoot {
+	root, _ := ctx.Value(signedKey{}).(*profileRoot)
+	return root
+}
+
+// firefoxSignature returns the signature of the Firefox Profiler export of
+// the sample type si of the profile name of the root rootName that expires at
+// the unix time expires.
+func (s *server) firefoxSignature(rootName, name, si, expires string) string {
+	mac := hmac.New(sha256.New, s.signingKey)
+	fmt.Fprintf(mac, "firefox\x00%s\x00%s\x00%s\x00%s", rootName, name, si, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validSignature returns the root of r if it is an unexpired export or
+// upload with a valid signature, which is served without other credentials,
+// else nil.
+func (s *server) validSignature(r *http.Request) *profileRoot {
+	if r.URL.Path == "/api/v1/profiles" {
+		return s.validUploadSignature(r)
+	}
+	if r.URL.Path != "/api/v1/firefox" {
+		return nil
+	}
+	query := r.URL.Query()
+	sig, expires := query.Get("sig"), query.Get("expires")
+	if sig == "" {
+		return nil
+	}
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().After(time.Unix(unix, 0)) {
+		return nil
+	}
+	root, name := s.resolveRoot(r, query.Get("profile"))
+	want := s.firefoxSignature(root.name, name, query.Get("si"), expires)
+	if !hmac.Equal([]byte(sig), []byte(want)) {
+		return nil
+	}
+	return root
+}
+
+// firefoxHandler serves a stored profile in the processed format of the
+// Firefox Profiler with
+// GET /api/v1/firefox?profile=cpu.pb.gz[&si=sample_type]. The profiler fetches
+// it from a signed URL valid for firefoxLinkDuration, created by
+// GET /firefox?profile=cpu.pb.gz[&si=sample_type], which redirects to the
+// profiler.
+func (s *server) firefoxHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	ref := query.Get("profile")
+	if ref == "" {
+		http.Error(w, "profile is required", http.StatusBadRequest)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		w.Header().Set("Access-Control-Allow-Origin", firefoxProfilerOrigin)
+	} else if s.offline {
+		http.Error(w, "the Firefox Profiler is unavailable offline: download the profile from /api/v1/firefox and load it into a local copy", http.StatusNotFound)
+		return
+	}
+	_, name, p, ok := s.openProfile(w, r, ref)
+	if !ok {
+		return
+	}
+	sampleIndex, err := selectSampleIndex(p, query.Get("si"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		writeJSON(w, firefoxExport(p, sampleIndex, name))
+		return
+	}
+	expires := strconv.FormatInt(time.Now().Add(firefoxLinkDuration).Unix(), 10)
+	// the reference names the root, which the host of publicURL may not
+	root, rootName := s.resolveRoot(r, ref)
+	signed := url.Values{
+		"profile": {root.reference(rootName)},
+		"si":      {query.Get("si")},
+		"expires": {expires},
+		"sig":     {s.firefoxSignature(root.name, rootName, query.Get("si"), expires)},
+	}
+	exportURL := strings.TrimSuffix(s.publicURL, "/") + "/api/v1/firefox?" + signed.Encode()
+	s.logger.Printf("%s opening %s in the Firefox Profiler", requestID(r.Context()), name)
+	http.Redirect(w, r, firefoxProfilerURL+url.QueryEscape(exportURL)+"/", http.StatusSeeOther)
+}
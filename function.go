@@ -0,0 +1,436 @@
+package pprofweb
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultFunctionHistory is the number of the latest profiles of a
+	// service of a function history.
+	defaultFunctionHistory = 30
+	// functionNeighbors is the number of callers and callees of a function
+	// history.
+	functionNeighbors = 10
+	// maxProfileSummaries limits the profiles summarized in memory.
+	maxProfileSummaries = 1000
+)
+
+// profileSummary is the flat and cumulative value of every function of a
+// profile at a sample type, and the value of the calls between them, so
+// function histories don't parse the profiles again.
+type profileSummary struct {
+	modTime    time.Time
+	lastUsed   time.Time
+	sampleType string
+	unit       string
+	// captured is the capture time of the profile, else its modification
+	// time.
+	captured  time.Time
+	total     int64
+	functions map[string]topEntry
+	// calls are the values of the stacks with a caller calling a callee,
+	// counted once per stack.
+	calls map[[2]string]int64
+}
+
+// summaryCache keeps the summaries of the profile files by path and sample
+// type, dropping the least recently used beyond maxProfileSummaries.
+type summaryCache struct {
+	mu        sync.Mutex
+	summaries map[string]*profileSummary
+}
+
+func newSummaryCache() *summaryCache {
+	return &summaryCache{summaries: make(map[string]*profileSummary)}
+}
+
+// summary returns the summary of the profile f at the sample type si, the
+// default sample type if empty.
+func (c *summaryCache) summary(f profileFile, si string) (*profileSummary, error) {
+	key := f.path + "\x00" + si
+	c.mu.Lock()
+	summary, ok := c.summaries[key]
+	if ok && summary.modTime.Equal(f.modTime) {
+		summary.lastUsed = time.Now()
+		c.mu.Unlock()
+		return summary, nil
+	}
+	c.mu.Unlock()
+
+	p, err := parseProfileFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+	sampleIndex, err := selectSampleIndex(p, si)
+	if err != nil {
+		return nil, err
+	}
+	summary = &profileSummary{
+		modTime:    f.modTime,
+		lastUsed:   time.Now(),
+		sampleType: p.SampleType[sampleIndex].Type,
+		unit:       p.SampleType[sampleIndex].Unit,
+		captured:   captureTime(p),
+		total:      sampleTotal(p, sampleIndex),
+		functions:  make(map[string]topEntry),
+		calls:      make(map[[2]string]int64),
+	}
+	if summary.captured.IsZero() {
+		summary.captured = f.modTime
+	}
+	for _, e := range topTable(p, sampleIndex) {
+		summary.functions[e.Name] = e
+	}
+	for _, s := range p.Sample {
+		v := s.Value[sampleIndex]
+		frames := sampleFrames(s)
+		seen := make(map[[2]string]bool, len(frames))
+		for i := 1; i < len(frames); i++ {
+			call := [2]string{frames[i-1], frames[i]}
+			if !seen[call] {
+				seen[call] = true
+				summary.calls[call] += v
+			}
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.summaries[key] = summary
+	if len(c.summaries) > maxProfileSummaries {
+		var oldest string
+		for k, s := range c.summaries {
+			if oldest == "" || s.lastUsed.Before(c.summaries[oldest].lastUsed) {
+				oldest = k
+			}
+		}
+		delete(c.summaries, oldest)
+	}
+	return summary, nil
+}
+
+// functionSample is the value of a function in a profile of a function
+// history.
+type functionSample struct {
+	Profile string    `json:"profile"`
+	Time    time.Time `json:"time"`
+	Flat    int64     `json:"flat"`
+	Cum     int64     `json:"cum"`
+	Total   int64     `json:"total"`
+	// Share is the share of Cum of Total.
+	Share float64 `json:"share"`
+	URL   string  `json:"url"`
+	Error string  `json:"error,omitempty"`
+}
+
+// functionCall is the value of the calls of a function from a caller or to a
+// callee over all profiles of a function history.
+type functionCall struct {
+	Function string `json:"function"`
+	Value    int64  `json:"value"`
+}
+
+// functionHistory is the JSON response of GET /api/v1/function.
+type functionHistory struct {
+	Function   string `json:"function"`
+	Service    string `json:"service"`
+	Type       string `json:"type"`
+	SampleType string `json:"sample_type"`
+	Unit       string `json:"unit"`
+	// Profiles are the latest profiles of the service, oldest first.
+	Profiles []functionSample `json:"profiles"`
+	Callers  []functionCall   `json:"callers"`
+	Callees  []functionCall   `json:"callees"`
+	// Similar are the names of functions containing Function if no profile
+	// has it.
+	Similar []string `json:"similar,omitempty"`
+}
+
+// profileSeries returns the service and the profile type of the profile
+// reference ref stored as service/type/file by the agent and the captures of
+// targets.
+func profileSeries(ref string) (string, string, bool) {
+	dir := path.Dir(ref)
+	service := path.Dir(dir)
+	if service == "." || service == "/" {
+		return "", "", false
+	}
+	return service, path.Base(dir), true
+}
+
+// serviceProfiles returns the profiles of type typ of service stored in root
+// as service/type/file, oldest first. It writes an error response and
+// returns false if there are none.
+func (s *server) serviceProfiles(w http.ResponseWriter, r *http.Request, root *profileRoot, service, typ string) ([]profileFile, bool) {
+	files, err := root.listProfiles(s.allowedExtensions)
+	if err != nil {
+		s.logger.Printf("%s list %s: %v", requestID(r.Context()), root.path, err)
+		http.Error(w, "could not list the profiles", http.StatusInternalServerError)
+		return nil, false
+	}
+	dir := strings.Trim(service, "/") + "/" + typ + "/"
+	var series []profileFile
+	for _, f := range files {
+		if strings.HasPrefix(f.name, dir) && !strings.Contains(f.name[len(dir):], "/") {
+			series = append(series, f)
+		}
+	}
+	if len(series) == 0 {
+		http.Error(w, fmt.Sprintf("no profiles in %s", dir), http.StatusNotFound)
+		return nil, false
+	}
+	sort.Slice(series, func(i, j int) bool { return series[i].modTime.Before(series[j].modTime) })
+	return series, true
+}
+
+// functionURL returns the page of the history of function in the profiles of
+// type of service.
+func functionURL(function, service, typ string) string {
+	return "/function?" + url.Values{"function": {function}, "service": {service}, "type": {typ}}.Encode()
+}
+
+// sortedCalls returns the heaviest n calls of values.
+func sortedCalls(values map[string]int64, n int) []functionCall {
+	calls := []functionCall{}
+	for function, v := range values {
+		calls = append(calls, functionCall{function, v})
+	}
+	sort.Slice(calls, func(i, j int) bool {
+		if calls[i].Value != calls[j].Value {
+			return abs64(calls[i].Value) > abs64(calls[j].Value)
+		}
+		return calls[i].Function < calls[j].Function
+	})
+	if len(calls) > n {
+		calls = calls[:n]
+	}
+	return calls
+}
+
+// functionHandler shows the weight of a function in the latest profiles of a
+// service over time with GET
+// /function?function=main.encodeJSON&service=api&type=cpu, JSON at
+// /api/v1/function, with its heaviest callers and callees, to answer whether
+// it has always been this expensive. The profiles are those stored as
+// service/type/file; service may start with the name of a root. si selects
+// the sample type and n the number of profiles.
+func (s *server) functionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	function, serviceRef := query.Get("function"), strings.Trim(query.Get("service"), "/")
+	typ := query.Get("type")
+	if typ == "" {
+		typ = "cpu"
+	}
+	n := defaultFunctionHistory
+	if v := query.Get("n"); v != "" {
+		var err error
+		n, err = strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxSeriesProfiles {
+			http.Error(w, fmt.Sprintf("n must be between 1 and %d", maxSeriesProfiles), http.StatusBadRequest)
+			return
+		}
+	}
+	prefs, err := s.requestPrefs(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	api := strings.HasPrefix(r.URL.Path, "/api/")
+	if function == "" || serviceRef == "" {
+		if api {
+			http.Error(w, "function and service are required", http.StatusBadRequest)
+			return
+		}
+		s.writeFunctionPage(w, r, prefs, &functionHistory{Function: function, Service: serviceRef, Type: typ})
+		return
+	}
+
+	root, service := s.resolveRoot(r, serviceRef)
+	if !requireAuth(w, r, root) {
+		return
+	}
+	series, ok := s.serviceProfiles(w, r, root, service, typ)
+	if !ok {
+		return
+	}
+	if len(series) > n {
+		series = series[len(series)-n:]
+	}
+
+	history := &functionHistory{Function: function, Service: serviceRef, Type: typ, Profiles: []functionSample{}}
+	callers, callees := make(map[string]int64), make(map[string]int64)
+	found := false
+	var summaries []*profileSummary
+	for _, f := range series {
+		ref := root.reference(f.name)
+		sample := functionSample{Profile: ref, Time: f.modTime.In(prefs.location), URL: "/?profile=" + url.QueryEscape(ref)}
+		err := root.fetch(r.Context(), f)
+		var summary *profileSummary
+		if err == nil {
+			summary, err = s.summaries.summary(f, query.Get("si"))
+		}
+		if err != nil {
+			sample.Error = err.Error()
+			history.Profiles = append(history.Profiles, sample)
+			continue
+		}
+		summaries = append(summaries, summary)
+		history.SampleType, history.Unit = summary.sampleType, summary.unit
+		e, ok := summary.functions[function]
+		found = found || ok
+		sample.Time = summary.captured.In(prefs.location)
+		sample.Flat, sample.Cum, sample.Total = e.Flat, e.Cum, summary.total
+		if summary.total != 0 {
+			sample.Share = float64(e.Cum) / float64(summary.total)
+		}
+		history.Profiles = append(history.Profiles, sample)
+		for call, v := range summary.calls {
+			if call[1] == function && call[0] != function {
+				callers[call[0]] += v
+			}
+			if call[0] == function && call[1] != function {
+				callees[call[1]] += v
+			}
+		}
+	}
+	history.Callers = sortedCalls(callers, functionNeighbors)
+	history.Callees = sortedCalls(callees, functionNeighbors)
+	if !found && len(summaries) > 0 {
+		// suggest the functions of the latest profile with the name
+		similar := make(map[string]int64)
+		latest := summaries[len(summaries)-1]
+		for name, e := range latest.functions {
+			if strings.Contains(strings.ToLower(name), strings.ToLower(function)) {
+				similar[name] = e.Cum
+			}
+		}
+		for _, c := range sortedCalls(similar, functionNeighbors) {
+			history.Similar = append(history.Similar, c.Function)
+		}
+	}
+
+	if api {
+		writeJSON(w, history)
+		return
+	}
+	s.writeFunctionPage(w, r, prefs, history)
+}
+
+// writeFunctionPage writes the HTML page of history, with only the form if it
+// has no profiles.
+func (s *server) writeFunctionPage(w http.ResponseWriter, r *http.Request, prefs *displayPrefs, history *functionHistory) {
+	type sampleRow struct {
+		Profile, URL, Time, Flat, Cum, Share, Error string
+	}
+	type callRow struct {
+		Function, Value, URL string
+	}
+	page := struct {
+		*functionHistory
+		Rows                  []sampleRow
+		Sparkline             template.HTML
+		CallerRows            []callRow
+		CalleeRows            []callRow
+		SimilarURLs           []callRow
+		Queried               bool
+		First, Last           string
+		FirstShare, LastShare string
+		HasFirstAndLast       bool
+		ProfilesSearched      int
+	}{functionHistory: history, Queried: history.Profiles != nil, ProfilesSearched: len(history.Profiles)}
+	var cums []int64
+	var valid []functionSample
+	for _, sample := range history.Profiles {
+		row := sampleRow{Profile: sample.Profile, URL: sample.URL, Time: prefs.timestamp(sample.Time), Error: sample.Error}
+		if sample.Error == "" {
+			row.Flat = prefs.value(sample.Flat, history.Unit)
+			row.Cum = prefs.value(sample.Cum, history.Unit)
+			row.Share = fmt.Sprintf("%.2f%%", 100*sample.Share)
+			cums = append(cums, sample.Cum)
+			valid = append(valid, sample)
+		}
+		page.Rows = append(page.Rows, row)
+	}
+	if len(cums) > 1 {
+		page.Sparkline = sparkline(cums)
+	}
+	if len(valid) > 1 {
+		first, last := valid[0], valid[len(valid)-1]
+		page.HasFirstAndLast = true
+		page.First, page.Last = prefs.value(first.Cum, history.Unit), prefs.value(last.Cum, history.Unit)
+		page.FirstShare, page.LastShare = fmt.Sprintf("%.2f%%", 100*first.Share), fmt.Sprintf("%.2f%%", 100*last.Share)
+	}
+	calls := func(list []functionCall) []callRow {
+		var rows []callRow
+		for _, c := range list {
+			rows = append(rows, callRow{c.Function, prefs.value(c.Value, history.Unit), functionURL(c.Function, history.Service, history.Type)})
+		}
+		return rows
+	}
+	page.CallerRows, page.CalleeRows = calls(history.Callers), calls(history.Callees)
+	for _, name := range history.Similar {
+		page.SimilarURLs = append(page.SimilarURLs, callRow{Function: name, URL: functionURL(name, history.Service, history.Type)})
+	}
+	if err := functionTemplate.Execute(w, page); err != nil {
+		s.logger.Printf("%s function: %v", requestID(r.Context()), err)
+	}
+}
+
+var functionTemplate = template.Must(template.New("function").Parse(`<!doctype html>
+<html>
+<head><title>{{if .Function}}{{.Function}} in {{.Service}}{{else}}pprofweb function history{{end}}</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin: 1em 0; }
+td, th { border: 1px solid #ccc; padding: 2px 8px; text-align: left; }
+td.value { text-align: right; }
+code { font-size: 12px; }
+</style>
+</head>
+<body>
+<h1>{{if .Function}}<code>{{.Function}}</code> in {{.Service}}{{else}}Function history{{end}}</h1>
+<form method="get" action="/function">
+<label>Function <input name="function" value="{{.Function}}" size="40" placeholder="main.encodeJSON"></label>
+<label>Service <input name="service" value="{{.Service}}" placeholder="api or root/api"></label>
+<label>Type <input name="type" value="{{.Type}}" size="10"></label>
+<input type="submit" value="Show">
+</form>
+{{if .Queried}}
+{{if not .Rows}}<p>No {{.Type}} profiles are stored below {{.Service}}/{{.Type}}/.</p>
+{{else}}
+<p>The {{.ProfilesSearched}} latest {{.Type}} profiles of {{.Service}}, {{.SampleType}}.
+{{if .HasFirstAndLast}}Cumulative {{.First}} ({{.FirstShare}}) in the first, {{.Last}} ({{.LastShare}}) in the last. {{.Sparkline}}{{end}}</p>
+{{if .SimilarURLs}}<p>No profile has <code>{{.Function}}</code>. Did you mean
+{{range $i, $f := .SimilarURLs}}{{if $i}}, {{end}}<a href="{{$f.URL}}"><code>{{$f.Function}}</code></a>{{end}}?</p>{{end}}
+<table>
+<tr><th>Profile</th><th>Captured</th><th>Flat</th><th>Cum</th><th>Share of total</th></tr>
+{{range .Rows}}<tr><td><a href="{{.URL}}">{{.Profile}}</a></td><td>{{.Time}}</td>{{if .Error}}<td colspan="3">{{.Error}}</td>{{else}}
+<td class="value">{{.Flat}}</td><td class="value">{{.Cum}}</td><td class="value">{{.Share}}</td>{{end}}</tr>
+{{end}}</table>
+<h2>Callers</h2>
+<table>
+{{range .CallerRows}}<tr><td><a href="{{.URL}}"><code>{{.Function}}</code></a></td><td class="value">{{.Value}}</td></tr>
+{{else}}<tr><td>None.</td></tr>
+{{end}}</table>
+<h2>Callees</h2>
+<table>
+{{range .CalleeRows}}<tr><td><a href="{{.URL}}"><code>{{.Function}}</code></a></td><td class="value">{{.Value}}</td></tr>
+{{else}}<tr><td>None.</td></tr>
+{{end}}</table>
+{{end}}{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,232 @@
+package pprofweb
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/google/pprof/profile"
+	"github.com/urfave/cli/v2"
+)
+
+var gateCommand = &cli.Command{
+	Name:  "gate",
+	Usage: "fail if a function or the total regressed between two profiles, e.g. in CI",
+	Flags: []cli.Flag{
+		&cli.PathFlag{
+			Name:  "base",
+			Value: "auto",
+			Usage: "profile before the change; auto selects the profile of the previous release next to the head by the version label, baseline the baseline of the release before the head from --server, and baseline@v1.2.0 the one of that release",
+		},
+		&cli.StringFlag{
+			Name:  "server",
+			Usage: "URL of the pprofweb server to download the baseline from",
+		},
+		&cli.StringFlag{
+			Name:    "token",
+			EnvVars: []string{"PPROFWEB_TOKEN"},
+			Usage:   "token of the profile root of the baseline",
+		},
+		&cli.StringFlag{
+			Name:  "service",
+			Usage: "service of the baseline, e.g. api",
+		},
+		&cli.PathFlag{
+			Name:     "head",
+			Required: true,
+			Usage:    "profile after the change",
+		},
+		&cli.StringFlag{
+			Name:  "max-regression",
+			Value: "5%",
+			Usage: "maximum growth of the flat value of a function relative to the base",
+		},
+		&cli.StringFlag{
+			Name:  "max-total-regression",
+			Usage: "maximum growth of the total; --max-regression by default",
+		},
+		&cli.StringFlag{
+			Name:  "min-share",
+			Value: "1%",
+			Usage: "ignore functions with a smaller share of the head total, which are mostly noise",
+		},
+		&cli.StringFlag{
+			Name:  "sample-type",
+			Usage: "sample type to compare, e.g. alloc_space; the default of the head profile by default",
+		},
+		&cli.BoolFlag{
+			Name:  "normalize",
+			Usage: "scale the base to the total of the head, e.g. for CPU profiles of different durations",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		maxRegression, err := parsePercent(context.String("max-regression"))
+		if err != nil {
+			return err
+		}
+		maxTotalRegression := maxRegression
+		if v := context.String("max-total-regression"); v != "" {
+			maxTotalRegression, err = parsePercent(v)
+			if err != nil {
+				return err
+			}
+		}
+		minShare, err := parsePercent(context.String("min-share"))
+		if err != nil {
+			return err
+		}
+
+		head, err := parseProfileFile(context.String("head"))
+		if err != nil {
+			return fmt.Errorf("head: %w", err)
+		}
+		basePath := context.String("base")
+		var base *profile.Profile
+		switch {
+		case basePath == "baseline" || strings.HasPrefix(basePath, "baseline@"):
+			if context.String("server") == "" || context.String("service") == "" {
+				return fmt.Errorf("--base %s requires --server and --service", basePath)
+			}
+			query := url.Values{"service": {context.String("service")}, "type": {string(detectProfileType(head, context.String("head")))}}
+			if version := strings.TrimPrefix(strings.TrimPrefix(basePath, "baseline"), "@"); version != "" {
+				query.Set("version", version)
+			} else if version := profileVersion(head); version != "" {
+				query.Set("before", version)
+			}
+			var b *baseline
+			b, base, err = fetchBaseline(context.String("server"), context.String("token"), query)
+			if err != nil {
+				return err
+			}
+			basePath = b.Profile
+			fmt.Fprintf(context.App.Writer, "base: %s (baseline of %s)\n", basePath, b.Version)
+		case basePath == "auto":
+			headPath := context.String("head")
+			root := &profileRoot{path: filepath.Dir(headPath)}
+			f, version, err := (*versionIndex)(nil).previousRelease(context.Context, root, filepath.Base(headPath), head, defaultProfileExtensions)
+			if err != nil {
+				return err
+			}
+			basePath = f.path
+			fmt.Fprintf(context.App.Writer, "base: %s (version %s)\n", basePath, version)
+			fallthrough
+		default:
+			base, err = parseProfileFile(basePath)
+			if err != nil {
+				return fmt.Errorf("base: %w", err)
+			}
+		}
+		report, err := compareProfiles(base, head, context.String("sample-type"), context.Bool("normalize"), 0)
+		if err != nil {
+			return err
+		}
+		report.Base, report.Head = basePath, context.String("head")
+
+		failures := writeGateReport(os.Stdout, report, maxRegression, maxTotalRegression, minShare)
+		if failures > 0 {
+			return cli.Exit(fmt.Sprintf("%d regressions exceed the thresholds", failures), 1)
+		}
+		return nil
+	},
+}
+
+// parsePercent parses percentages like "5%" or "5" into fractions like 0.05.
+func parsePercent(s string) (float64, error) {
+	v, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(s), "%"), 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid percentage %q", s)
+	}
+	return v / 100, nil
+}
+
+// writeGateReport writes the total and the functions that grew to w, marking
+// regressions beyond the thresholds, and returns their number. Functions new
+// in head exceed any threshold.
+func writeGateReport(w io.Writer, report *diffReport, maxRegression, maxTotalRegression, minShare float64) int {
+	failures := 0
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "%s vs. %s (%s)\n", report.Head, report.Base, report.SampleType)
+	fmt.Fprintf(tw, "\tbase\thead\tchange\t\n")
+
+	status := "ok"
+	if report.BaseTotal != 0 && float64(report.HeadTotal-report.BaseTotal)/float64(report.BaseTotal) > maxTotalRegression {
+		status = "FAIL"
+		failures++
+	}
+	fmt.Fprintf(tw, "total\t%s\t%s\t%s\t%s\n", formatValue(report.BaseTotal, report.Unit),
+		formatValue(report.HeadTotal, report.Unit), formatChange(report.BaseTotal, report.HeadTotal, report.Unit), status)
+
+	for _, e := range report.LargestAbsolute {
+		if e.Delta <= 0 || float64(e.HeadFlat) < minShare*float64(report.HeadTotal) {
+			continue
+		}
+		status := "ok"
+		if e.Relative == nil || *e.Relative > maxRegression {
+			status = "FAIL"
+			failures++
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", e.Name, formatValue(e.BaseFlat, report.Unit),
+			formatValue(e.HeadFlat, report.Unit), formatChange(e.BaseFlat, e.HeadFlat, report.Unit), status)
+	}
+	tw.Flush()
+	return failures
+}
+
+// fetchBaseline resolves the baseline of query, the parameters of
+// /api/v1/baselines/resolve, on the server at serverURL and downloads its
+// profile.
+func fetchBaseline(serverURL, token string, query url.Values) (*baseline, *profile.Profile, error) {
+	base, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	get := func(path, query string) ([]byte, error) {
+		req, err := http.NewRequest(http.MethodGet, base.ResolveReference(&url.URL{Path: path, RawQuery: query}).String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s: %s", resp.Status, apiErrorMessage(body))
+		}
+		return body, nil
+	}
+	data, err := get("/api/v1/baselines/resolve", query.Encode())
+	if err != nil {
+		return nil, nil, fmt.Errorf("resolving the baseline failed: %w", err)
+	}
+	b := &baseline{}
+	if err := json.Unmarshal(data, b); err != nil {
+		return nil, nil, fmt.Errorf("baseline response: %w", err)
+	}
+	if b.SHA256 == "" {
+		return nil, nil, fmt.Errorf("the baseline %s no longer exists", b.Profile)
+	}
+	data, err = get("/api/v1/blobs/"+b.SHA256, "")
+	if err != nil {
+		return nil, nil, fmt.Errorf("downloading the baseline %s failed: %w", b.Profile, err)
+	}
+	p, err := parseProfileData(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("base: %w", err)
+	}
+	return b, p, nil
+}
@@ -4,14 +4,21 @@ go 1.17
 
 require (
 	github.com/NYTimes/gziphandler v1.1.1
+	github.com/go-ldap/ldap/v3 v3.4.1
 	github.com/google/pprof v0.0.0-20220729232143-a41b82acbcb1
+	github.com/google/uuid v1.3.0
+	github.com/klauspost/compress v1.15.10
+	github.com/ulikunitz/xz v0.5.11
+	github.com/urfave/cli/v2 v2.11.1
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
+	github.com/Azure/go-ntlmssp v0.0.0-20200615164410-66371956d46c // indirect
 	github.com/cpuguy83/go-md2man/v2 v2.0.2 // indirect
-	github.com/google/uuid v1.3.0 // indirect
+	github.com/go-asn1-ber/asn1-ber v1.5.1 // indirect
 	github.com/ianlancetaylor/demangle v0.0.0-20220319035150-800ac71e25c2 // indirect
 	github.com/russross/blackfriday/v2 v2.1.0 // indirect
-	github.com/urfave/cli/v2 v2.11.1 // indirect
 	github.com/xrash/smetrics v0.0.0-20201216005158-039620a65673 // indirect
+	golang.org/x/crypto v0.0.0-20220525230936-793ad666bf5e // indirect
 )
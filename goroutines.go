@@ -0,0 +1,196 @@
+package pprofweb
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/google/pprof/profile"
+)
+
+// goroutineHeader matches the first line of a goroutine in the text dumps of
+// /debug/pprof/goroutine?debug=2 and panics, e.g.
+// "goroutine 7 [chan receive, 5 minutes]:".
+var goroutineHeader = regexp.MustCompile(`^goroutine (\d+) \[([^\]]*)\]:?`)
+
+// isGoroutineDump reports whether data starts like a debug=2 goroutine dump.
+func isGoroutineDump(data []byte) bool {
+	return goroutineHeader.Match(bytes.TrimLeft(data, " \t\r\n"))
+}
+
+// isGoroutineCount reports whether data starts like a debug=1 goroutine
+// profile, which profile.Parse understands.
+func isGoroutineCount(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimLeft(data, " \t\r\n"), []byte("goroutine profile: total "))
+}
+
+// goroutineDumpBuilder builds a synthetic goroutine profile with one sample
+// per distinct stack and state.
+type goroutineDumpBuilder struct {
+	p         *profile.Profile
+	functions map[string]*profile.Function
+	locations map[string]*profile.Location
+	samples   map[string]*profile.Sample
+}
+
+// parseGoroutineDump converts a text goroutine dump into a profile counting
+// goroutines. Samples carry the goroutine state (e.g. "chan receive") in the
+// label "state" and the creating function in "created_by".
+func parseGoroutineDump(r io.Reader) (*profile.Profile, error) {
+	b := &goroutineDumpBuilder{
+		p: &profile.Profile{
+			SampleType: []*profile.ValueType{{Type: "goroutine", Unit: "count"}},
+			PeriodType: &profile.ValueType{Type: "goroutine", Unit: "count"},
+			Period:     1,
+		},
+		functions: make(map[string]*profile.Function),
+		locations: make(map[string]*profile.Location),
+		samples:   make(map[string]*profile.Sample),
+	}
+
+	scanner := bufio.NewScanner(r)
+	// frames of huge generated functions can have very long argument lists
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	var (
+		state     string
+		inStack   bool
+		stack     []*profile.Location
+		createdBy string
+		function  string
+		nextIsPos bool
+	)
+	flush := func() {
+		if inStack {
+			b.addSample(stack, state, createdBy)
+		}
+		inStack, stack, createdBy, function, nextIsPos = false, nil, "", "", false
+	}
+
+	goroutines := 0
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if m := goroutineHeader.FindStringSubmatch(line); m != nil {
+			flush()
+			inStack = true
+			goroutines++
+			state = strings.TrimSpace(strings.Split(m[2], ",")[0])
+			continue
+		}
+		if !inStack {
+			continue
+		}
+		switch {
+		case strings.TrimSpace(line) == "":
+			flush()
+		case nextIsPos && strings.HasPrefix(line, "\t"):
+			// the position following "created by" is the go statement,
+			// which is not part of the stack
+			if function != "" {
+				file, lineno := parseFramePosition(line)
+				stack = append(stack, b.location(function, file, lineno))
+			}
+			function, nextIsPos = "", false
+		case strings.HasPrefix(line, "created by "):
+			createdBy = strings.TrimPrefix(line, "created by ")
+			if i := strings.Index(createdBy, " in goroutine "); i >= 0 {
+				createdBy = createdBy[:i]
+			}
+			nextIsPos = true
+		case strings.HasPrefix(line, "...") || strings.HasPrefix(line, "\t"):
+			// "...additional frames elided..." or positions without function
+		default:
+			function = frameFunctionName(line)
+			nextIsPos = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	flush()
+	if goroutines == 0 {
+		return nil, fmt.Errorf("no goroutines found in dump")
+	}
+	return b.p, b.p.CheckValid()
+}
+
+// frameFunctionName removes the arguments from a frame line like
+// "main.(*T).run(0xc000010000, {0x1, 0x2})".
+func frameFunctionName(line string) string {
+	line = strings.TrimSpace(line)
+	if i := strings.LastIndex(line, "("); i > 0 && strings.HasSuffix(line, ")") {
+		return line[:i]
+	}
+	return line
+}
+
+// parseFramePosition parses a position line like "\t/src/main.go:12 +0x1d".
+func parseFramePosition(line string) (string, int64) {
+	pos := strings.TrimSpace(line)
+	if i := strings.LastIndex(pos, " +0x"); i >= 0 {
+		pos = pos[:i]
+	}
+	i := strings.LastIndex(pos, ":")
+	if i < 0 {
+		return pos, 0
+	}
+	lineno, err := strconv.ParseInt(pos[i+1:], 10, 64)
+	if err != nil {
+		return pos, 0
+	}
+	return pos[:i], lineno
+}
+
+func (b *goroutineDumpBuilder) location(function, file string, line int64) *profile.Location {
+	key := fmt.Sprintf("%s\x00%s\x00%d", function, file, line)
+	if loc, ok := b.locations[key]; ok {
+		return loc
+	}
+	fnKey := function + "\x00" + file
+	fn, ok := b.functions[fnKey]
+	if !ok {
+		fn = &profile.Function{
+			ID:         uint64(len(b.p.Function) + 1),
+			Name:       function,
+			SystemName: function,
+			Filename:   file,
+		}
+		b.functions[fnKey] = fn
+		b.p.Function = append(b.p.Function, fn)
+	}
+	loc := &profile.Location{
+		ID:   uint64(len(b.p.Location) + 1),
+		Line: []profile.Line{{Function: fn, Line: line}},
+	}
+	b.locations[key] = loc
+	b.p.Location = append(b.p.Location, loc)
+	return loc
+}
+
+func (b *goroutineDumpBuilder) addSample(stack []*profile.Location, state, createdBy string) {
+	var key strings.Builder
+	key.WriteString(state)
+	key.WriteString("\x00")
+	key.WriteString(createdBy)
+	for _, loc := range stack {
+		fmt.Fprintf(&key, "\x00%d", loc.ID)
+	}
+	if s, ok := b.samples[key.String()]; ok {
+		s.Value[0]++
+		return
+	}
+	labels := map[string][]string{"state": {state}}
+	if createdBy != "" {
+		labels["created_by"] = []string{createdBy}
+	}
+	s := &profile.Sample{
+		Location: stack,
+		Value:    []int64{1},
+		Label:    labels,
+	}
+	b.samples[key.String()] = s
+	b.p.Sample = append(b.p.Sample, s)
+}
@@ -0,0 +1,418 @@
+package pprofweb
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultGuestLinkDuration is the validity of guest links that don't ask for
+// one.
+const defaultGuestLinkDuration = 4 * time.Hour
+
+const guestCookie = "pprofweb_guest"
+
+// guestLink grants read access to some profiles and sessions until it
+// expires, e.g. to responders of an incident without accounts.
+type guestLink struct {
+	token   string
+	creator string
+	expires time.Time
+
+	mu sync.Mutex
+	// profiles are the references of the shared profiles as shared by the
+	// root and name they resolved to.
+	profiles map[guestGrant]string
+	sessions map[string]bool
+	// roots are the roots of the shared profiles and sessions.
+	roots map[*profileRoot]bool
+}
+
+// guestGrant is a profile shared with a guest.
+type guestGrant struct {
+	root *profileRoot
+	name string
+}
+
+// allowsProfile reports whether the guest may open the profile name of root.
+func (g *guestLink) allowsProfile(root *profileRoot, name string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, ok := g.profiles[guestGrant{root, name}]
+	return ok
+}
+
+// allowsRoot reports whether the guest may open some profiles or sessions
+// of root.
+func (g *guestLink) allowsRoot(root *profileRoot) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.roots[root]
+}
+
+// allowsSession reports whether the guest may use the session id.
+func (g *guestLink) allowsSession(id string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.sessions[id]
+}
+
+// allowSession grants the guest access to the session id, e.g. of a profile
+// the guest opened, which is of one of the roots of the guest.
+func (g *guestLink) allowSession(id string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.sessions[id] = true
+}
+
+// grants returns the sorted profiles and sessions the guest may use.
+func (g *guestLink) grants() ([]string, []string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var profiles, sessions []string
+	for _, ref := range g.profiles {
+		profiles = append(profiles, ref)
+	}
+	for id := range g.sessions {
+		sessions = append(sessions, id)
+	}
+	sort.Strings(profiles)
+	sort.Strings(sessions)
+	return profiles, sessions
+}
+
+// guestLinks are the valid guest links by token.
+type guestLinks struct {
+	mu    sync.Mutex
+	links map[string]*guestLink
+}
+
+func newGuestLinks() *guestLinks {
+	return &guestLinks{links: make(map[string]*guestLink)}
+}
+
+// add creates a guest link for the profiles, by their reference, and the
+// sessions of roots.
+func (l *guestLinks) add(creator string, duration time.Duration, profiles map[guestGrant]string, sessions []string, roots []*profileRoot) (*guestLink, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	g := &guestLink{
+		token:    base64.RawURLEncoding.EncodeToString(buf),
+		creator:  creator,
+		expires:  time.Now().Add(duration),
+		profiles: profiles,
+		sessions: make(map[string]bool),
+		roots:    make(map[*profileRoot]bool),
+	}
+	for grant := range profiles {
+		g.roots[grant.root] = true
+	}
+	for _, id := range sessions {
+		g.sessions[id] = true
+	}
+	for _, root := range roots {
+		g.roots[root] = true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for token, link := range l.links {
+		if now.After(link.expires) {
+			delete(l.links, token)
+		}
+	}
+	l.links[g.token] = g
+	return g, nil
+}
+
+// get returns the valid guest link token, or nil.
+func (l *guestLinks) get(token string) *guestLink {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	g, ok := l.links[token]
+	if !ok || time.Now().After(g.expires) {
+		return nil
+	}
+	return g
+}
+
+func (l *guestLinks) revoke(token string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.links[token]
+	delete(l.links, token)
+	return ok
+}
+
+type guestKey struct{}
+
+// requestGuest returns the guest link of the request of ctx, or nil.
+func requestGuest(ctx context.Context) *guestLink {
+	g, _ := ctx.Value(guestKey{}).(*guestLink)
+	return g
+}
+
+// guestRequest returns the guest link of the cookie of r if r carries no
+// other credentials.
+func (s *server) guestRequest(r *http.Request) *guestLink {
+	if r.Header.Get("Authorization") != "" {
+		return nil
+	}
+	cookie, err := r.Cookie(guestCookie)
+	if err != nil {
+		return nil
+	}
+	return s.guests.get(cookie.Value)
+}
+
+// guestAllowed reports whether the guest g may make the request r: open the
+// guest page, its profiles, its sessions, and compare its profiles. Profiles
+// are compared by the root they resolve to for r, e.g. by its Host header.
+func (s *server) guestAllowed(g *guestLink, r *http.Request) bool {
+	query := r.URL.Query()
+	allows := func(ref string) bool {
+		root, name := s.resolveRoot(r, ref)
+		return g.allowsProfile(root, name)
+	}
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/guest/"):
+		return true
+	case r.URL.Path == "/":
+		for _, param := range []string{"offcpu", "base", "diff_base"} {
+			if ref := query.Get(param); ref != "" && !allows(ref) {
+				return false
+			}
+		}
+		return allows(query.Get("profile"))
+	case r.URL.Path == "/diff" || r.URL.Path == "/api/v1/diff":
+		return allows(query.Get("base")) && allows(query.Get("head"))
+	case r.URL.Path == "/api/v1/top" || r.URL.Path == "/api/v1/insights" || r.URL.Path == "/api/v1/callgraph" || r.URL.Path == "/firefox",
+		r.URL.Path == "/contention" || r.URL.Path == "/api/v1/contention",
+		r.URL.Path == "/expected-hot" || r.URL.Path == "/api/v1/expected-hot":
+		return allows(query.Get("profile"))
+	case strings.HasPrefix(r.URL.Path, pprofWebPath):
+		id := strings.Split(strings.TrimPrefix(r.URL.Path, pprofWebPath), "/")[0]
+		if g.allowsSession(id) {
+			return true
+		}
+		// sessions of the guest's profiles opened by others
+		s.pprofHandlerMutex.RLock()
+		handler, ok := s.pprofHandler[id]
+		s.pprofHandlerMutex.RUnlock()
+		return ok && g.allowsProfile(handler.root, handler.root.relative(handler.info.profileName))
+	}
+	return false
+}
+
+// guestLinkRequest is the JSON body of POST /api/v1/guest-links.
+type guestLinkRequest struct {
+	Profiles []string `json:"profiles"`
+	Sessions []string `json:"sessions"`
+	// Duration is the validity of the link, e.g. 2h.
+	Duration string `json:"duration"`
+}
+
+// guestLinkResponse is the JSON response to a new guest link.
+type guestLinkResponse struct {
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+}
+
+// guestLinksHandler creates guest links with POST /api/v1/guest-links and
+// revokes them with DELETE /api/v1/guest-links/{token}. Creators must be
+// authorized for the profiles and sessions they share.
+func (s *server) guestLinksHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.mayCreateGuestLinks(w, r) {
+		return
+	}
+	if r.Method == http.MethodDelete {
+		token := strings.TrimPrefix(r.URL.Path, "/api/v1/guest-links/")
+		g := s.guests.get(token)
+		if g == nil {
+			http.Error(w, "guest link not found", http.StatusNotFound)
+			return
+		}
+		if g.creator != s.viewerName(r) && !s.requireRole(w, r, adminRole) {
+			return
+		}
+		s.guests.revoke(token)
+		s.logger.Printf("%s %s revoked guest link of %s", requestID(r.Context()), s.viewerName(r), g.creator)
+		profiles, sessions := g.grants()
+		s.audit(r, auditEvent{Action: "guest-link-revoke", Profiles: profiles, Sessions: sessions})
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodPost || r.URL.Path != "/api/v1/guest-links" {
+		w.Header().Set("Allow", "POST, DELETE")
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req guestLinkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	g, ok := s.newGuestLink(w, r, req)
+	if !ok {
+		return
+	}
+	s.audit(r, auditEvent{Action: "guest-link", Profiles: req.Profiles, Sessions: req.Sessions, Expires: &g.expires})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(guestLinkResponse{URL: "/guest/" + g.token, Expires: g.expires})
+}
+
+// mayCreateGuestLinks writes a 403 response and returns false if the
+// requester of r is a guest or, with LDAP, not logged in.
+func (s *server) mayCreateGuestLinks(w http.ResponseWriter, r *http.Request) bool {
+	if requestGuest(r.Context()) != nil || (s.ldap != nil && requestUser(r.Context()) == nil) {
+		http.Error(w, "forbidden: guest links are created by logged in users", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// newGuestLink creates the guest link of req for the requester of r if they
+// are authorized for its profiles and sessions, or writes an error response
+// and returns false.
+func (s *server) newGuestLink(w http.ResponseWriter, r *http.Request, req guestLinkRequest) (*guestLink, bool) {
+	if !s.requireRole(w, r, viewerRole) {
+		return nil, false
+	}
+	if len(req.Profiles) == 0 && len(req.Sessions) == 0 {
+		http.Error(w, "no profiles or sessions to share", http.StatusBadRequest)
+		return nil, false
+	}
+	duration := defaultGuestLinkDuration
+	if req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d <= 0 {
+			http.Error(w, fmt.Sprintf("invalid duration %q", req.Duration), http.StatusBadRequest)
+			return nil, false
+		}
+		duration = d
+	}
+	if duration > s.maxGuestLinkDuration {
+		http.Error(w, fmt.Sprintf("duration exceeds the maximum of %s", s.maxGuestLinkDuration), http.StatusBadRequest)
+		return nil, false
+	}
+	profiles := make(map[guestGrant]string)
+	for _, ref := range req.Profiles {
+		root, name := s.resolveRoot(r, ref)
+		if !requireAuth(w, r, root) {
+			return nil, false
+		}
+		profiles[guestGrant{root, name}] = ref
+	}
+	var roots []*profileRoot
+	s.pprofHandlerMutex.RLock()
+	for _, id := range req.Sessions {
+		handler, ok := s.pprofHandler[id]
+		if !ok {
+			s.pprofHandlerMutex.RUnlock()
+			http.Error(w, fmt.Sprintf("session %s not loaded", id), http.StatusNotFound)
+			return nil, false
+		}
+		if !requireAuth(w, r, handler.root) {
+			s.pprofHandlerMutex.RUnlock()
+			return nil, false
+		}
+		roots = append(roots, handler.root)
+	}
+	s.pprofHandlerMutex.RUnlock()
+
+	g, err := s.guests.add(s.viewerName(r), duration, profiles, req.Sessions, roots)
+	if err != nil {
+		s.logger.Printf("%s guest link: %v", requestID(r.Context()), err)
+		http.Error(w, "could not create guest link", http.StatusInternalServerError)
+		return nil, false
+	}
+	s.logger.Printf("%s %s created a guest link for %d profiles and %d sessions until %s",
+		requestID(r.Context()), g.creator, len(req.Profiles), len(req.Sessions), g.expires.Format(time.RFC3339))
+	return g, true
+}
+
+// guestPageHandler serves /guest/{token}: it sets the guest cookie and lists
+// the shared profiles and sessions.
+func (s *server) guestPageHandler(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, "/guest/")
+	g := s.guests.get(token)
+	if g == nil {
+		http.Error(w, "this guest link is invalid or expired", http.StatusNotFound)
+		return
+	}
+	prefs, err := s.requestPrefs(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     guestCookie,
+		Value:    g.token,
+		Path:     "/",
+		Expires:  g.expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	type item struct{ Name, URL string }
+	var profiles, sessions []item
+	g.mu.Lock()
+	for _, ref := range g.profiles {
+		profiles = append(profiles, item{ref, "/?profile=" + url.QueryEscape(ref)})
+	}
+	sessionIDs := make([]string, 0, len(g.sessions))
+	for id := range g.sessions {
+		sessionIDs = append(sessionIDs, id)
+	}
+	g.mu.Unlock()
+	s.pprofHandlerMutex.RLock()
+	for _, id := range sessionIDs {
+		if handler, ok := s.pprofHandler[id]; ok {
+			sessions = append(sessions, item{handler.info.profileName, pprofWebPath + id + "/"})
+		}
+	}
+	s.pprofHandlerMutex.RUnlock()
+	sortItems := func(items []item) {
+		sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+	}
+	sortItems(profiles)
+	sortItems(sessions)
+
+	if err := guestTemplate.Execute(w, struct {
+		Creator  string
+		Expires  string
+		Profiles []item
+		Sessions []item
+	}{g.creator, prefs.timestamp(g.expires), profiles, sessions}); err != nil {
+		s.logger.Printf("%s guest page: %v", requestID(r.Context()), err)
+	}
+}
+
+var guestTemplate = template.Must(template.New("guest").Parse(`<!doctype html>
+<html>
+<head><title>pprofweb guest access</title></head>
+<body style="font-family:sans-serif">
+<h1>Guest access</h1>
+<p>Shared by {{.Creator}} until {{.Expires}}.</p>
+{{if .Profiles}}<h2>Profiles</h2>
+<ul>{{range .Profiles}}<li><a href="{{.URL}}">{{.Name}}</a></li>{{end}}</ul>{{end}}
+{{if .Sessions}}<h2>Sessions</h2>
+<ul>{{range .Sessions}}<li><a href="{{.URL}}">{{.Name}}</a></li>{{end}}</ul>{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,253 @@
+package pprofweb
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/pprof/profile"
+)
+
+// defaultHeapGrowthSites is the number of allocation sites of a heap growth
+// report.
+const defaultHeapGrowthSites = 20
+
+// allocationSite is the in-use memory allocated by a function over a series
+// of heap profiles.
+type allocationSite struct {
+	// Function is the function closest to the leaf outside of the runtime.
+	Function string `json:"function"`
+	// Values are the in-use values of the site in each profile.
+	Values []int64 `json:"values"`
+	Growth int64   `json:"growth"`
+	// Share is the share of the growth of all growing sites.
+	Share float64 `json:"share"`
+}
+
+// heapGrowthReport is the JSON response of GET /api/v1/heap-growth.
+type heapGrowthReport struct {
+	// Profiles are the references of the profiles, oldest first.
+	Profiles   []string         `json:"profiles"`
+	SampleType string           `json:"sample_type"`
+	Unit       string           `json:"unit"`
+	Totals     []int64          `json:"totals"`
+	Sites      []allocationSite `json:"sites"`
+}
+
+// heapGrowth returns the allocation sites of profiles with the values at
+// sampleIndexes that grew from the first to the last profile, largest
+// growth first.
+func heapGrowth(profiles []*profile.Profile, sampleIndexes []int) []allocationSite {
+	sites := make(map[string][]int64)
+	for i, p := range profiles {
+		for _, s := range p.Sample {
+			frames := sampleFrames(s)
+			if len(frames) == 0 {
+				continue
+			}
+			function := frames[len(frames)-1]
+			for j := len(frames) - 1; j >= 0; j-- {
+				if !runtimeFrame(frames[j]) {
+					function = frames[j]
+					break
+				}
+			}
+			values := sites[function]
+			if values == nil {
+				values = make([]int64, len(profiles))
+				sites[function] = values
+			}
+			values[i] += s.Value[sampleIndexes[i]]
+		}
+	}
+
+	var growing []allocationSite
+	var totalGrowth int64
+	for function, values := range sites {
+		growth := values[len(values)-1] - values[0]
+		if growth <= 0 {
+			continue
+		}
+		growing = append(growing, allocationSite{Function: function, Values: values, Growth: growth})
+		totalGrowth += growth
+	}
+	for i := range growing {
+		growing[i].Share = float64(growing[i].Growth) / float64(totalGrowth)
+	}
+	sort.Slice(growing, func(i, j int) bool {
+		if growing[i].Growth != growing[j].Growth {
+			return growing[i].Growth > growing[j].Growth
+		}
+		return growing[i].Function < growing[j].Function
+	})
+	return growing
+}
+
+// sparkline returns an SVG line chart of values starting at zero.
+func sparkline(values []int64) template.HTML {
+	const width, height = 120, 24
+	var max int64
+	for _, v := range values {
+		if v > max {
+			max = v
+		}
+	}
+	points := make([]string, len(values))
+	for i, v := range values {
+		x := float64(width) * float64(i) / float64(len(values)-1)
+		y := float64(height - 1)
+		if max > 0 {
+			y -= float64(height-2) * float64(v) / float64(max)
+		}
+		points[i] = fmt.Sprintf("%.1f,%.1f", x, y)
+	}
+	return template.HTML(fmt.Sprintf(`<svg width="%d" height="%d"><polyline points="%s" `+
+		`fill="none" stroke="#c33" stroke-width="1.5"/></svg>`, width, height, strings.Join(points, " ")))
+}
+
+// heapGrowthHandler attributes the growth of in-use memory over a series of
+// heap profiles of the same process to allocation sites with GET
+// /heap-growth?profile=a.pb.gz&profile=b.pb.gz, JSON at /api/v1/heap-growth,
+// to hunt slow leaks. si selects the sample type, inuse_space by default, and
+// n the number of sites, all with n=0.
+func (s *server) heapGrowthHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	n := defaultHeapGrowthSites
+	if v := query.Get("n"); v != "" {
+		var err error
+		n, err = strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "n must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+	}
+	sampleType := query.Get("si")
+	if sampleType == "" {
+		sampleType = "inuse_space"
+	}
+	prefs, err := s.requestPrefs(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	profiles, ok := s.openProfileSeries(w, r, heapProfile)
+	if !ok {
+		return
+	}
+
+	report := heapGrowthReport{SampleType: sampleType}
+	var parsed []*profile.Profile
+	var sampleIndexes []int
+	for _, o := range profiles {
+		i, err := selectSampleIndex(o.p, sampleType)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("%s: %v", o.name, err), http.StatusBadRequest)
+			return
+		}
+		report.Profiles = append(report.Profiles, o.name)
+		report.Unit = o.p.SampleType[i].Unit
+		report.Totals = append(report.Totals, sampleTotal(o.p, i))
+		parsed = append(parsed, o.p)
+		sampleIndexes = append(sampleIndexes, i)
+	}
+	report.Sites = heapGrowth(parsed, sampleIndexes)
+	if n > 0 && len(report.Sites) > n {
+		report.Sites = report.Sites[:n]
+	}
+	if report.Sites == nil {
+		report.Sites = []allocationSite{}
+	}
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		writeJSON(w, report)
+		return
+	}
+
+	type siteRow struct {
+		Function, First, Last, Change, Share string
+		Sparkline                            template.HTML
+	}
+	page := struct {
+		SampleType   string
+		Profiles     []string
+		Times        []string
+		Totals       []string
+		Total        siteRow
+		Sites        []siteRow
+		DiffURL      string
+		OtherTypeURL string
+	}{SampleType: sampleType}
+	for i, o := range profiles {
+		page.Profiles = append(page.Profiles, o.name)
+		page.Times = append(page.Times, prefs.timestamp(captureTime(o.p)))
+		page.Totals = append(page.Totals, prefs.value(report.Totals[i], report.Unit))
+	}
+	row := func(function string, values []int64, share float64) siteRow {
+		first, last := values[0], values[len(values)-1]
+		return siteRow{
+			Function:  function,
+			First:     prefs.value(first, report.Unit),
+			Last:      prefs.value(last, report.Unit),
+			Change:    prefs.change(first, last, report.Unit),
+			Share:     percent(share),
+			Sparkline: sparkline(values),
+		}
+	}
+	page.Total = row("total", report.Totals, 1)
+	for _, site := range report.Sites {
+		page.Sites = append(page.Sites, row(site.Function, site.Values, site.Share))
+	}
+	page.DiffURL = "/diff?" + url.Values{
+		"base": {report.Profiles[0]},
+		"head": {report.Profiles[len(report.Profiles)-1]},
+		"si":   {sampleType},
+	}.Encode()
+	other := url.Values{"profile": report.Profiles}
+	if sampleType == "inuse_space" {
+		other.Set("si", "inuse_objects")
+	} else {
+		other.Set("si", "inuse_space")
+	}
+	page.OtherTypeURL = "/heap-growth?" + other.Encode()
+	if err := heapGrowthTemplate.Execute(w, page); err != nil {
+		s.logger.Printf("%s heap growth: %v", requestID(r.Context()), err)
+	}
+}
+
+var heapGrowthTemplate = template.Must(template.New("heapgrowth").Parse(`<!doctype html>
+<html>
+<head><title>pprofweb heap growth</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin: 1em 0; }
+td, th { border: 1px solid #ccc; padding: 2px 8px; text-align: left; }
+td.value { text-align: right; }
+tr.total { font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>Heap growth: {{.SampleType}}</h1>
+<table>
+<tr><th>Profile</th><th>Captured</th><th>{{.SampleType}}</th></tr>
+{{range $i, $p := .Profiles}}<tr><td>{{$p}}</td><td>{{index $.Times $i}}</td><td class="value">{{index $.Totals $i}}</td></tr>
+{{end}}</table>
+<p>The allocation sites whose in-use memory grew the most from the first to the
+last profile; a site growing steadily in all profiles is probably leaking.
+Compare the first and last profile in a <a href="{{.DiffURL}}">flame graph</a>,
+or show <a href="{{.OtherTypeURL}}">{{if eq .SampleType "inuse_space"}}inuse_objects{{else}}inuse_space{{end}}</a>.</p>
+<table>
+<tr><th>Allocation site</th><th>Over time</th><th>First</th><th>Last</th><th>Change</th><th>Share of growth</th></tr>
+{{with .Total}}<tr class="total"><td>{{.Function}}</td><td>{{.Sparkline}}</td><td class="value">{{.First}}</td><td class="value">{{.Last}}</td><td class="value">{{.Change}}</td><td></td></tr>{{end}}
+{{range .Sites}}<tr><td>{{.Function}}</td><td>{{.Sparkline}}</td><td class="value">{{.First}}</td><td class="value">{{.Last}}</td><td class="value">{{.Change}}</td><td class="value">{{.Share}}</td></tr>
+{{else}}<tr><td colspan="6">No allocation site grew.</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
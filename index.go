@@ -0,0 +1,113 @@
+package pprofweb
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// indexFile is the file of a root recording the hash, type, and version of
+// its profiles as a JSON object by profile name, so the server doesn't hash
+// and parse every profile again after a restart. The re-scan updates it and
+// pprofweb admin reindex rebuilds it from the profiles.
+const indexFile = ".index.json"
+
+// indexEntry is a profile in the indexFile, valid while the size and
+// modification time of the profile are unchanged.
+type indexEntry struct {
+	Size    int64       `json:"size"`
+	ModTime time.Time   `json:"mod_time"`
+	SHA256  string      `json:"sha256"`
+	Type    profileType `json:"type,omitempty"`
+	Version string      `json:"version,omitempty"`
+}
+
+// matches reports whether e is of the current contents of f.
+func (e indexEntry) matches(f profileFile) bool {
+	return e.Size == f.size && e.ModTime.Equal(f.modTime)
+}
+
+func (e indexEntry) equal(other indexEntry) bool {
+	return e.Size == other.Size && e.ModTime.Equal(other.ModTime) && e.SHA256 == other.SHA256 &&
+		e.Type == other.Type && e.Version == other.Version
+}
+
+// sameIndex reports whether the index entries a and b are equal.
+func sameIndex(a, b map[string]indexEntry) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, e := range a {
+		if other, ok := b[name]; !ok || !e.equal(other) {
+			return false
+		}
+	}
+	return true
+}
+
+// readIndex returns the index entries of root by profile name.
+func (root *profileRoot) readIndex() (map[string]indexEntry, error) {
+	entries := make(map[string]indexEntry)
+	data, err := os.ReadFile(root.filePath(indexFile))
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("%s: %w", root.filePath(indexFile), err)
+	}
+	return entries, nil
+}
+
+// writeIndex replaces the index of root with entries.
+func (root *profileRoot) writeIndex(entries map[string]indexEntry) error {
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	filePath := root.filePath(indexFile)
+	if err := os.WriteFile(filePath+".tmp", data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(filePath+".tmp", filePath)
+}
+
+// indexEntries returns the index entries of files of root from the caches
+// of s. Files that weren't hashed and parsed yet are left out.
+func (s *server) indexEntries(root *profileRoot, files []profileFile) map[string]indexEntry {
+	entries := make(map[string]indexEntry, len(files))
+	for _, f := range files {
+		sum, ok := s.blobs.cached(f)
+		if !ok {
+			continue
+		}
+		e, ok := s.versions.cached(f.path, f.modTime)
+		if !ok {
+			continue
+		}
+		entries[f.name] = indexEntry{Size: f.size, ModTime: f.modTime, SHA256: sum, Type: e.typ, Version: e.version}
+	}
+	return entries
+}
+
+// loadIndexes fills the hash and version caches from the index files of the
+// roots. The caches check the size and modification time of the profiles,
+// so entries of changed profiles are ignored.
+func (s *server) loadIndexes() {
+	for _, root := range append([]*profileRoot{s.defaultRoot}, s.roots...) {
+		entries, err := root.readIndex()
+		if err != nil {
+			s.logger.Printf("index %s: %v", root.path, err)
+			continue
+		}
+		for name, e := range entries {
+			f := profileFile{name: name, path: root.filePath(name), size: e.Size, modTime: e.ModTime}
+			s.blobs.add(f, e.SHA256)
+			s.versions.add(f.path, versionEntry{modTime: e.ModTime, version: e.Version, typ: e.Type})
+		}
+		s.scan.indexed(root, entries)
+	}
+}
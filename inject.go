@@ -0,0 +1,194 @@
+package pprofweb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// injectHTML returns a handler that inserts snippet at the end of the body of
+// the HTML pages served by handler. This adds our own elements to the pages
+// of the pprof web UI.
+func injectHTML(handler http.Handler, snippet string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &bufferedResponse{header: w.Header(), status: http.StatusOK}
+		handler.ServeHTTP(rec, r)
+
+		body := rec.body.Bytes()
+		contentType := rec.header.Get("Content-Type")
+		if contentType == "" && len(body) > 0 {
+			contentType = http.DetectContentType(body)
+			rec.header.Set("Content-Type", contentType)
+		}
+		if strings.HasPrefix(contentType, "text/html") && rec.status == http.StatusOK {
+			body = insertBeforeBodyEnd(body, []byte(snippet))
+			rec.header.Set("Content-Length", strconv.Itoa(len(body)))
+		}
+		w.WriteHeader(rec.status)
+		w.Write(body)
+	})
+}
+
+func insertBeforeBodyEnd(page, snippet []byte) []byte {
+	i := bytes.LastIndex(page, []byte("</body>"))
+	if i < 0 {
+		return append(page, snippet...)
+	}
+	out := make([]byte, 0, len(page)+len(snippet))
+	out = append(out, page[:i]...)
+	out = append(out, snippet...)
+	return append(out, page[i:]...)
+}
+
+// bufferedResponse records a response so it can be modified before sending.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	b.status = status
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	return b.body.Write(p)
+}
+
+// sessionExports are the downloads of the stored profile of a session linked
+// from its banner.
+var sessionExports = []struct{ prefix, path, format, label string }{
+	{" | top: ", "/api/v1/top", "csv", "CSV"},
+	{" ", "/api/v1/top", "xlsx", "XLSX"},
+	{" | graph: ", "/api/v1/callgraph", "graphml", "GraphML"},
+	{" ", "/api/v1/callgraph", "gexf", "GEXF"},
+	{" | ", "/firefox", "", "Firefox Profiler"},
+}
+
+// sampleTypeSelect returns the control of the banner switching the session id
+// to another sample type of its profile, if it has several: the sample type
+// of the page's si parameter, or else the session's default, is selected.
+func sampleTypeSelect(id string, info *sessionInfo) string {
+	if info.details == nil || len(info.details.SampleTypes) < 2 {
+		return ""
+	}
+	current := info.urlDefaults.Get("si")
+	if current == "" {
+		current = info.details.DefaultSampleType
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, ` <select id="pprofweb-si" title="switch the sample type of this session" style="font:12px sans-serif" `+
+		`onchange="var q=new URLSearchParams(location.search);q.set('si',this.value);`+
+		`q.set('view',location.pathname.split('/')[3]||'');location.href='%s?'+q">`, html.EscapeString(pprofWebPath+id+"/sample"))
+	for i, st := range info.details.SampleTypes {
+		name := st
+		if j := strings.LastIndex(st, "/"); j >= 0 {
+			name = st[:j]
+		}
+		selected := ""
+		if name == current || (current == "" && i == len(info.details.SampleTypes)-1) {
+			selected = " selected"
+		}
+		fmt.Fprintf(&b, `<option value="%s"%s>%s</option>`, html.EscapeString(name), selected, html.EscapeString(st))
+	}
+	b.WriteString(`</select><script>(function(){var si=new URLSearchParams(location.search).get('si');` +
+		`if(si){document.getElementById('pprofweb-si').value=si}})()</script>`)
+	return b.String()
+}
+
+// sessionBanner returns a badge showing the type and name of the profile of
+// the session id and links to the same view of related sessions and to the
+// exports of the stored profile. offline omits the links to external tools
+// and shareEmail adds sharing the session via email.
+func sessionBanner(id string, info *sessionInfo, offline, shareEmail bool) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, `<div id="pprofweb-banner" style="position:fixed;bottom:8px;right:8px;z-index:1000;`+
+		`background:#333;color:#fff;padding:4px 8px;border-radius:4px;font:13px sans-serif;opacity:0.9">`+
+		`<b>%s</b> %s`, html.EscapeString(info.profileType.title()), html.EscapeString(info.profileName))
+	if info.base != nil {
+		verb := "minus"
+		if info.diffBase {
+			verb = "vs."
+		}
+		fmt.Fprintf(&b, ` %s %s`, verb, html.EscapeString(info.baseName))
+	}
+	b.WriteString(sampleTypeSelect(id, info))
+	for _, link := range info.links {
+		if link.id == id {
+			fmt.Fprintf(&b, ` | <u>%s</u>`, html.EscapeString(link.label))
+			continue
+		}
+		fmt.Fprintf(&b, ` | <a style="color:#9cf" href="%s" `+
+			`onclick="location.href=location.pathname.replace('%s','%s')+location.search;return false">%s</a>`,
+			html.EscapeString(pprofWebPath+link.id+"/"), id, link.id, html.EscapeString(link.label))
+	}
+	if len(info.insights) > 0 {
+		fmt.Fprintf(&b, ` | <a style="color:#9cf" href="#" onclick="var e=document.getElementById('pprofweb-insights');`+
+			`e.style.display=e.style.display==='none'?'block':'none';return false">Insights (%d)</a>`, len(info.insights))
+	}
+	fmt.Fprintf(&b, ` | <a style="color:#9cf" href="%s">build info</a>`, html.EscapeString(pprofWebPath+id+"/buildinfo"))
+	fmt.Fprintf(&b, ` | <a style="color:#9cf" href="%s" title="expandable top-down and bottom-up call tree">call tree</a>`,
+		html.EscapeString(pprofWebPath+id+"/calltree"))
+	fmt.Fprintf(&b, ` | <a style="color:#9cf" href="%s" title="icicle and sunburst charts of the stacks">charts</a>`,
+		html.EscapeString(pprofWebPath+id+"/chart"))
+	// the view and its state are in the URL of the page
+	fmt.Fprintf(&b, ` | <a style="color:#9cf" href="%s" title="download this view as a single HTML file" `+
+		`onclick="var q=new URLSearchParams(location.search);q.set('view',location.pathname.split('/').pop()||'graph');`+
+		`location.href=this.href+'?'+q;return false">export this view</a>`, html.EscapeString(pprofWebPath+id+"/snapshot"))
+	fmt.Fprintf(&b, ` | <a style="color:#9cf" href="%s" title="top report as plain text, without graphviz or JavaScript">plain text</a>`,
+		html.EscapeString(pprofWebPath+id+"/text"))
+	fmt.Fprintf(&b, `<noscript> | JavaScript is disabled: <a style="color:#9cf" href="%s">plain text stacks</a></noscript>`,
+		html.EscapeString(pprofWebPath+id+"/text?report=traces"))
+	if shareEmail {
+		share := guestLinkRequest{Sessions: []string{id}}
+		if !info.combined {
+			share.Profiles = []string{info.profileName}
+		}
+		shareJSON, _ := json.Marshal(share)
+		fmt.Fprintf(&b, ` | <a style="color:#9cf" href="#" data-share="%s" title="email a guest link to this session" `+
+			`onclick="var to=prompt('Email addresses to share this profile with');if(!to)return false;`+
+			`var req=JSON.parse(this.dataset.share);req.to=to.split(/[\s,;]+/).filter(Boolean);`+
+			`fetch('/api/v1/share-email',{method:'POST',headers:{'Content-Type':'application/json'},body:JSON.stringify(req)})`+
+			`.then(function(r){return r.ok?'Shared with '+req.to.join(', '):r.text()}).then(alert);return false">share via email</a>`,
+			html.EscapeString(string(shareJSON)))
+	}
+	if info.runtimeMetrics != nil {
+		b.WriteString(` | <a style="color:#9cf" href="#" onclick="var e=document.getElementById('pprofweb-runtime');` +
+			`e.style.display=e.style.display==='none'?'block':'none';return false">runtime</a>`)
+	}
+	if info.expectedHot {
+		fmt.Fprintf(&b, ` | <a style="color:#9cf" href="%s">unexpected hot</a>`,
+			html.EscapeString("/expected-hot?"+url.Values{"profile": {info.profileName}}.Encode()))
+	}
+	if !info.combined && (info.profileType == mutexProfile || info.profileType == blockProfile) {
+		fmt.Fprintf(&b, ` | <a style="color:#9cf" href="%s">contention</a>`,
+			html.EscapeString("/contention?"+url.Values{"profile": {info.profileName}}.Encode()))
+	}
+	if !info.combined {
+		for _, export := range sessionExports {
+			if offline && export.path == "/firefox" {
+				continue
+			}
+			query := url.Values{"profile": {info.profileName}, "si": {info.urlDefaults.Get("si")}}
+			if export.format != "" {
+				query.Set("format", export.format)
+			}
+			// export the sample type shown on the page
+			fmt.Fprintf(&b, `%s<a style="color:#9cf" href="%s" `+
+				`onclick="var si=new URLSearchParams(location.search).get('si');`+
+				`if(si){this.href=this.href.replace(/([?&]si=)[^&]*/,'$1'+encodeURIComponent(si))}">%s</a>`,
+				export.prefix, html.EscapeString(export.path+"?"+query.Encode()), export.label)
+		}
+	}
+	b.WriteString(`</div>`)
+	return b.String()
+}
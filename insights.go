@@ -0,0 +1,311 @@
+package pprofweb
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/google/pprof/profile"
+)
+
+// insight is a plain language finding about a profile for users new to
+// pprof, shown next to the views of its sessions.
+type insight struct {
+	// Severity is warning for likely problems and info otherwise.
+	Severity string `json:"severity"`
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+	// Share is the share of the total of the profile the finding is about.
+	Share float64 `json:"share"`
+}
+
+// Thresholds of the shares of the total at which insights are reported.
+const (
+	gcInsightShare        = 0.15
+	mallocInsightShare    = 0.15
+	syscallInsightShare   = 0.25
+	mapInsightShare       = 0.15
+	encodingInsightShare  = 0.15
+	hotFunctionShare      = 0.30
+	allocationSiteShare   = 0.25
+	contentionSiteShare   = 0.50
+	goroutineStackShare   = 0.50
+	manyGoroutines        = 10000
+	minGoroutinesForLeaks = 1000
+)
+
+// gcFunctions are the functions of the garbage collector of the Go runtime.
+var gcFunctions = []string{
+	"runtime.gcBgMarkWorker", "runtime.gcAssistAlloc", "runtime.gcDrain", "runtime.markroot",
+	"runtime.scanobject", "runtime.bgsweep", "runtime.sweepone", "runtime.gcStart", "runtime.GC",
+}
+
+// runtimeFrame reports whether name is a function of the runtime or of
+// packages like sync that are rarely the cause of what they do.
+func runtimeFrame(name string) bool {
+	for _, prefix := range []string{"runtime.", "runtime/", "internal/", "sync.", "sync/", "reflect."} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// stackAttribution is the value of the samples with a frame matching a
+// function, attributed to the first caller outside of the runtime.
+type stackAttribution struct {
+	total   int64
+	matched int64
+	callers map[string]int64
+}
+
+// attribute returns the attribution of the values at sampleIndex of the
+// samples with a frame matching match.
+func attribute(p *profile.Profile, sampleIndex int, match func(string) bool) *stackAttribution {
+	a := &stackAttribution{callers: make(map[string]int64)}
+	for _, s := range p.Sample {
+		v := s.Value[sampleIndex]
+		a.total += v
+		frames := sampleFrames(s)
+		// the frame closest to the root, so callers are outside of it
+		i := -1
+		for j, frame := range frames {
+			if match(frame) {
+				i = j
+				break
+			}
+		}
+		if i < 0 {
+			continue
+		}
+		a.matched += v
+		for j := i - 1; j >= 0; j-- {
+			if !runtimeFrame(frames[j]) {
+				a.callers[frames[j]] += v
+				break
+			}
+		}
+	}
+	return a
+}
+
+// leafAttribution returns the attribution of all samples to the frame closest
+// to the leaf outside of the runtime, e.g. the caller of sync.(*Mutex).Lock.
+func leafAttribution(p *profile.Profile, sampleIndex int) *stackAttribution {
+	a := &stackAttribution{callers: make(map[string]int64)}
+	for _, s := range p.Sample {
+		v := s.Value[sampleIndex]
+		a.total += v
+		a.matched += v
+		frames := sampleFrames(s)
+		for j := len(frames) - 1; j >= 0; j-- {
+			if !runtimeFrame(frames[j]) {
+				a.callers[frames[j]] += v
+				break
+			}
+		}
+	}
+	return a
+}
+
+// share returns the share of the matched samples of the total.
+func (a *stackAttribution) share() float64 {
+	if a.total == 0 {
+		return 0
+	}
+	return float64(a.matched) / float64(a.total)
+}
+
+// topCaller returns the caller with the largest value and its share of the
+// matched samples.
+func (a *stackAttribution) topCaller() (string, float64) {
+	name, value := "", int64(0)
+	for caller, v := range a.callers {
+		if v > value || (v == value && caller < name) {
+			name, value = caller, v
+		}
+	}
+	if a.matched == 0 {
+		return name, 0
+	}
+	return name, float64(value) / float64(a.matched)
+}
+
+// insightSampleIndex returns the sample type insights are computed for: the
+// default of the profile type, else the default of the profile.
+func insightSampleIndex(p *profile.Profile, t profileType) int {
+	if i := sampleIndexByName(p, profileTypeDefaults[t].sampleIndex); i >= 0 {
+		return i
+	}
+	return defaultSampleIndex(p)
+}
+
+// percent formats a share as a whole percentage.
+func percent(share float64) string {
+	return fmt.Sprintf("%.0f%%", 100*share)
+}
+
+// hasPrefixFunc returns a match of the function names with any of prefixes.
+func hasPrefixFunc(prefixes ...string) func(string) bool {
+	return func(name string) bool {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// profileInsights returns the findings of heuristics for common problems of
+// Go programs in p of type t, largest share first.
+func profileInsights(p *profile.Profile, t profileType) []insight {
+	if len(p.Sample) == 0 || len(p.SampleType) == 0 {
+		return nil
+	}
+	sampleIndex := insightSampleIndex(p, t)
+	var insights []insight
+	add := func(severity, code string, share float64, format string, args ...interface{}) {
+		insights = append(insights, insight{severity, code, fmt.Sprintf(format, args...), share})
+	}
+
+	switch t {
+	case cpuProfile, wallProfile:
+		if gc := attribute(p, sampleIndex, hasPrefixFunc(gcFunctions...)); gc.share() >= gcInsightShare {
+			add("warning", "gc", gc.share(),
+				"%s of CPU time is spent in garbage collection: reduce allocations (see the heap profile's alloc_space) or tune GOGC and GOMEMLIMIT",
+				percent(gc.share()))
+		}
+		if malloc := attribute(p, sampleIndex, hasPrefixFunc("runtime.mallocgc")); malloc.share() >= mallocInsightShare {
+			caller, callerShare := malloc.topCaller()
+			msg := fmt.Sprintf("%s of CPU time is spent allocating memory in runtime.mallocgc", percent(malloc.share()))
+			if caller != "" {
+				msg += fmt.Sprintf(", %s of it for allocations of %s", percent(callerShare), caller)
+			}
+			add("warning", "malloc", malloc.share(), "%s", msg)
+		}
+		syscalls := attribute(p, sampleIndex, hasPrefixFunc("syscall.Syscall", "syscall.RawSyscall", "runtime/internal/syscall.", "internal/runtime/syscall."))
+		if syscalls.share() >= syscallInsightShare {
+			caller, _ := syscalls.topCaller()
+			add("info", "syscalls", syscalls.share(), "%s of CPU time is spent in system calls, mostly from %s: consider buffering I/O",
+				percent(syscalls.share()), caller)
+		}
+		if maps := attribute(p, sampleIndex, hasPrefixFunc("runtime.mapaccess", "runtime.mapassign", "runtime.mapdelete", "internal/runtime/maps.")); maps.share() >= mapInsightShare {
+			caller, _ := maps.topCaller()
+			add("info", "maps", maps.share(), "%s of CPU time is spent in map operations, mostly from %s", percent(maps.share()), caller)
+		}
+		if enc := attribute(p, sampleIndex, hasPrefixFunc("encoding/json.", "encoding/xml.", "encoding/gob.")); enc.share() >= encodingInsightShare {
+			caller, _ := enc.topCaller()
+			add("info", "encoding", enc.share(), "%s of CPU time is spent encoding and decoding with reflection, mostly from %s: consider a code generated codec",
+				percent(enc.share()), caller)
+		}
+		hotFunction(p, sampleIndex, add)
+	case heapProfile:
+		total := sampleTotal(p, sampleIndex)
+		if top := topTable(p, sampleIndex); total > 0 && len(top) > 0 {
+			if share := float64(top[0].Flat) / float64(total); share >= allocationSiteShare {
+				add("info", "allocation_site", share, "%s of %s is allocated by %s",
+					percent(share), p.SampleType[sampleIndex].Type, top[0].Name)
+			}
+		}
+	case mutexProfile, blockProfile:
+		caller, share := leafAttribution(p, sampleIndex).topCaller()
+		if caller != "" && share >= contentionSiteShare {
+			what := "lock contention"
+			if t == blockProfile {
+				what = "blocking"
+			}
+			add("warning", "contention", share, "%s of the %s is concentrated in %s", percent(share), what, caller)
+		}
+	case goroutineProfile:
+		total := sampleTotal(p, sampleIndex)
+		if total >= manyGoroutines {
+			add("warning", "many_goroutines", 1, "%d goroutines: check for goroutine leaks", total)
+		}
+		if total >= minGoroutinesForLeaks {
+			if caller, share := leafAttribution(p, sampleIndex).topCaller(); caller != "" && share >= goroutineStackShare {
+				add("warning", "goroutine_leak", share, "%s of %d goroutines are in %s, a possible leak", percent(share), total, caller)
+			}
+		}
+	}
+
+	sort.SliceStable(insights, func(i, j int) bool {
+		return insights[i].Share > insights[j].Share
+	})
+	return insights
+}
+
+// hotFunction reports a function with a large flat share of a CPU profile.
+func hotFunction(p *profile.Profile, sampleIndex int, add func(severity, code string, share float64, format string, args ...interface{})) {
+	total := sampleTotal(p, sampleIndex)
+	top := topTable(p, sampleIndex)
+	if total == 0 || len(top) == 0 {
+		return
+	}
+	if share := float64(top[0].Flat) / float64(total); share >= hotFunctionShare {
+		add("info", "hot_function", share, "%s alone takes %s of CPU time (flat): optimize its own code, see the source view",
+			top[0].Name, percent(share))
+	}
+}
+
+// insightsPanel returns the panel of the session pages listing insights,
+// opened from the banner.
+func insightsPanel(insights []insight) string {
+	if len(insights) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString(`<div id="pprofweb-insights" style="display:none;position:fixed;bottom:40px;right:8px;z-index:1000;` +
+		`width:420px;max-width:90%;background:#fff;border:1px solid #999;box-shadow:0 4px 16px rgba(0,0,0,.3);` +
+		`padding:8px 12px;font:13px/1.4 sans-serif"><b>Insights</b><ul style="margin:4px 0;padding-left:18px">`)
+	for _, i := range insights {
+		color := "#333"
+		if i.Severity == "warning" {
+			color = "#b30"
+		}
+		fmt.Fprintf(&b, `<li style="color:%s">%s</li>`, color, html.EscapeString(i.Message))
+	}
+	b.WriteString(`</ul><small style="color:#888">Heuristics: check them against the views.</small></div>`)
+	return b.String()
+}
+
+// insightsReport is the JSON response of GET /api/v1/insights.
+type insightsReport struct {
+	Profile    string    `json:"profile"`
+	Type       string    `json:"type"`
+	SampleType string    `json:"sample_type"`
+	Insights   []insight `json:"insights"`
+}
+
+// insightsHandler serves the insights of a stored profile with
+// GET /api/v1/insights?profile=cpu.pb.gz.
+func (s *server) insightsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+	ref := r.URL.Query().Get("profile")
+	if ref == "" {
+		http.Error(w, "profile is required", http.StatusBadRequest)
+		return
+	}
+	_, name, p, ok := s.openProfile(w, r, ref)
+	if !ok {
+		return
+	}
+	t := detectProfileType(p, name)
+	report := insightsReport{
+		Profile:  name,
+		Type:     t.tag(),
+		Insights: profileInsights(p, t),
+	}
+	if len(p.SampleType) > 0 {
+		report.SampleType = p.SampleType[insightSampleIndex(p, t)].Type
+	}
+	if report.Insights == nil {
+		report.Insights = []insight{}
+	}
+	writeJSON(w, report)
+}
@@ -0,0 +1,613 @@
+package pprofweb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/google/uuid"
+)
+
+// The states of jobs.
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	// jobCanceling jobs are canceled while running and stop at their next
+	// step, e.g. the next chunk of a file being read.
+	jobCanceling = "canceling"
+	jobDone      = "done"
+	jobFailed    = "failed"
+	jobCanceled  = "canceled"
+)
+
+// maxQueuedJobs limits the jobs waiting for a worker.
+const maxQueuedJobs = 100
+
+// maxJobProfiles limits the profiles of one merge job.
+const maxJobProfiles = 100
+
+// jobRetention is how long finished jobs and their results are kept.
+const jobRetention = time.Hour
+
+// jobHeapInterval is how often job workers sample their heap.
+const jobHeapInterval = 50 * time.Millisecond
+
+// jobRequest is the JSON body of POST /api/v1/jobs.
+type jobRequest struct {
+	// Type is merge, diff, or convert.
+	Type string `json:"type"`
+	// Profiles are merged by merge.
+	Profiles []string `json:"profiles,omitempty"`
+	// Base and Head are compared by diff.
+	Base string `json:"base,omitempty"`
+	Head string `json:"head,omitempty"`
+	// Profile is converted by convert to Format: pprof, firefox, csv, or
+	// xlsx.
+	Profile string `json:"profile,omitempty"`
+	Format  string `json:"format,omitempty"`
+	// SampleType selects the sample type of diff and convert, by default the
+	// default of the profile.
+	SampleType string `json:"sample_type,omitempty"`
+	// Normalize and N are the options of diff like the si, normalize, and n
+	// parameters of /api/v1/diff; N 0 reports all functions.
+	Normalize bool `json:"normalize,omitempty"`
+	N         int  `json:"n,omitempty"`
+}
+
+// jobStatus is the JSON of a job.
+type jobStatus struct {
+	ID       string   `json:"id"`
+	Type     string   `json:"type"`
+	Profiles []string `json:"profiles"`
+	// Submitter is the viewer who submitted the job; only they and admins
+	// see and cancel it.
+	Submitter string     `json:"submitter"`
+	Status    string     `json:"status"`
+	Progress  string     `json:"progress,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	Created   time.Time  `json:"created"`
+	Started   *time.Time `json:"started,omitempty"`
+	Finished  *time.Time `json:"finished,omitempty"`
+	// Result is the path of the result of a done job.
+	Result string `json:"result,omitempty"`
+	// CPUSeconds is the CPU time of the worker process of the job, and
+	// PeakHeapBytes the largest heap of a worker that finished. Servers
+	// embedded in other programs run jobs in-process and report neither.
+	CPUSeconds    float64 `json:"cpu_seconds,omitempty"`
+	PeakHeapBytes uint64  `json:"peak_heap_bytes,omitempty"`
+}
+
+// jobCost is the cost of a job measured from its worker process.
+type jobCost struct {
+	cpu      time.Duration
+	peakHeap uint64
+}
+
+// jobResult is the download of a done job.
+type jobResult struct {
+	contentType string
+	filename    string
+	data        []byte
+}
+
+// jobProfile is a profile of a job, resolved and authorized when the job is
+// submitted, since the job runs after the request ends.
+type jobProfile struct {
+	ref  string
+	root *profileRoot
+	name string
+	// exe is the executable of core dumps, the parameter exe of the request.
+	exe string
+}
+
+// job is an expensive operation on profiles run by the workers of a
+// jobQueue rather than in the request submitting it.
+type job struct {
+	run    func(ctx context.Context, progress func(string)) (*jobResult, jobCost, error)
+	ctx    context.Context
+	cancel context.CancelFunc
+	// roots are the roots of the profiles, which requests for the job must
+	// be authorized for.
+	roots []*profileRoot
+
+	mu     sync.Mutex
+	status jobStatus
+	result *jobResult
+}
+
+func (j *job) snapshot() jobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status
+}
+
+func (j *job) setProgress(msg string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status.Progress = msg
+}
+
+// jobQueue holds the jobs by id. They are kept in memory, so they are lost
+// on restarts.
+type jobQueue struct {
+	queue chan *job
+
+	mu   sync.Mutex
+	jobs map[string]*job
+}
+
+func newJobQueue() *jobQueue {
+	return &jobQueue{queue: make(chan *job, maxQueuedJobs), jobs: make(map[string]*job)}
+}
+
+// add queues j and removes the jobs finished for jobRetention. It returns
+// false if the queue is full.
+func (q *jobQueue) add(j *job) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for id, other := range q.jobs {
+		if status := other.snapshot(); status.Finished != nil && time.Since(*status.Finished) > jobRetention {
+			delete(q.jobs, id)
+		}
+	}
+	select {
+	case q.queue <- j:
+		q.jobs[j.status.ID] = j
+		return true
+	default:
+		return false
+	}
+}
+
+func (q *jobQueue) get(id string) *job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.jobs[id]
+}
+
+// list returns the status of all jobs, the newest first.
+func (q *jobQueue) list() []jobStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	list := make([]jobStatus, 0, len(q.jobs))
+	for _, j := range q.jobs {
+		list = append(list, j.snapshot())
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.After(list[j].Created)
+	})
+	return list
+}
+
+// runJobs runs the queued jobs one after the other; s.start runs
+// --job-workers of them.
+func (s *server) runJobs() {
+	for j := range s.jobs.queue {
+		s.runJob(j)
+	}
+}
+
+func (s *server) runJob(j *job) {
+	j.mu.Lock()
+	if j.status.Status != jobQueued {
+		// canceled while queued
+		j.mu.Unlock()
+		return
+	}
+	start := time.Now()
+	j.status.Status = jobRunning
+	j.status.Started = &start
+	j.mu.Unlock()
+
+	result, cost, err := j.run(j.ctx, j.setProgress)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	finished := time.Now()
+	j.status.Finished = &finished
+	j.status.Progress = ""
+	if cost.cpu > 0 {
+		j.status.CPUSeconds = cost.cpu.Seconds()
+		s.stats.Timing("job.cpu", cost.cpu, "type:"+j.status.Type)
+	}
+	j.status.PeakHeapBytes = cost.peakHeap
+	switch {
+	case j.ctx.Err() != nil:
+		j.status.Status = jobCanceled
+	case err != nil:
+		j.status.Status = jobFailed
+		j.status.Error = err.Error()
+		s.logger.Printf("%s job %s failed: %v", requestID(j.ctx), j.status.ID, err)
+	default:
+		j.status.Status = jobDone
+		j.status.Result = "/api/v1/jobs/" + j.status.ID + "/result"
+		j.result = result
+	}
+	j.cancel()
+	s.stats.Count("jobs."+j.status.Status, 1, "type:"+j.status.Type)
+	s.stats.Timing("job.run", finished.Sub(start), "type:"+j.status.Type)
+}
+
+// jobsHandler serves the job API: POST /api/v1/jobs queues a jobRequest,
+// GET /api/v1/jobs/<id> returns its status, GET /api/v1/jobs/<id>/result
+// downloads the result of a done job, and DELETE /api/v1/jobs/<id> cancels
+// it. GET /api/v1/jobs lists all jobs for admins. A job is only accessible to
+// its submitter and admins who are authorized for the roots of its profiles.
+func (s *server) jobsHandler(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/jobs"), "/")
+	if rest == "" && r.Method == http.MethodGet {
+		s.jobListHandler(w, r)
+		return
+	}
+	if rest == "" {
+		s.submitJob(w, r)
+		return
+	}
+	id, action := rest, ""
+	if i := strings.Index(rest, "/"); i >= 0 {
+		id, action = rest[:i], rest[i+1:]
+	}
+	j := s.jobs.get(id)
+	if j == nil || (action != "" && action != "result") {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+	if j.snapshot().Submitter != s.viewerName(r) && !s.requireRole(w, r, adminRole) {
+		return
+	}
+	for _, root := range j.roots {
+		if !requireAuth(w, r, root) {
+			return
+		}
+	}
+	switch {
+	case action == "result" && r.Method == http.MethodGet:
+		j.mu.Lock()
+		result, status := j.result, j.status.Status
+		j.mu.Unlock()
+		if result == nil {
+			http.Error(w, fmt.Sprintf("job is %s", status), http.StatusConflict)
+			return
+		}
+		w.Header().Set("Content-Type", result.contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", result.filename))
+		w.Write(result.data)
+	case action == "" && r.Method == http.MethodGet:
+		writeJSON(w, j.snapshot())
+	case action == "" && r.Method == http.MethodDelete:
+		j.mu.Lock()
+		switch j.status.Status {
+		case jobQueued:
+			finished := time.Now()
+			j.status.Status = jobCanceled
+			j.status.Finished = &finished
+		case jobRunning:
+			j.status.Status = jobCanceling
+		}
+		j.mu.Unlock()
+		j.cancel()
+		s.logger.Printf("%s canceled job %s", requestID(r.Context()), id)
+		writeJSON(w, j.snapshot())
+	default:
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+	}
+}
+
+// submitJob queues the job of the jobRequest in the body of r.
+func (s *server) submitJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+	var req jobRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var refs []string
+	switch req.Type {
+	case "merge":
+		if len(req.Profiles) < 2 || len(req.Profiles) > maxJobProfiles {
+			http.Error(w, fmt.Sprintf("between 2 and %d profiles are required", maxJobProfiles), http.StatusBadRequest)
+			return
+		}
+		refs = req.Profiles
+	case "diff":
+		if req.Base == "" || req.Head == "" {
+			http.Error(w, "base and head are required", http.StatusBadRequest)
+			return
+		}
+		if req.N < 0 {
+			http.Error(w, "n must be a non-negative number", http.StatusBadRequest)
+			return
+		}
+		refs = []string{req.Base, req.Head}
+	case "convert":
+		if req.Profile == "" {
+			http.Error(w, "profile is required", http.StatusBadRequest)
+			return
+		}
+		switch req.Format {
+		case "pprof", "firefox", "csv", "xlsx":
+		default:
+			http.Error(w, "format must be pprof, firefox, csv, or xlsx", http.StatusBadRequest)
+			return
+		}
+		refs = []string{req.Profile}
+	default:
+		http.Error(w, "type must be merge, diff, or convert", http.StatusBadRequest)
+		return
+	}
+
+	// the job must not use r, which ends with the response
+	profiles := make([]jobProfile, len(refs))
+	var roots []*profileRoot
+	for i, ref := range refs {
+		unescaped, err := url.QueryUnescape(ref)
+		if err != nil {
+			http.Error(w, "could not url decode "+ref, http.StatusBadRequest)
+			return
+		}
+		root, name := s.resolveRoot(r, unescaped)
+		if !requireAuth(w, r, root) {
+			return
+		}
+		profiles[i] = jobProfile{ref: ref, root: root, name: name, exe: r.URL.Query().Get("exe")}
+		if !containsRoot(roots, root) {
+			roots = append(roots, root)
+		}
+	}
+	// the request context ends with the response
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), requestIDKey{}, requestID(r.Context())))
+	j := &job{
+		run: func(ctx context.Context, progress func(string)) (*jobResult, jobCost, error) {
+			return s.executeJob(ctx, req, profiles, progress)
+		},
+		ctx:    ctx,
+		cancel: cancel,
+		roots:  roots,
+		status: jobStatus{ID: uuid.New().String(), Type: req.Type, Profiles: refs, Submitter: s.viewerName(r),
+			Status: jobQueued, Created: time.Now()},
+	}
+	if !s.jobs.add(j) {
+		cancel()
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "too many queued jobs", http.StatusServiceUnavailable)
+		return
+	}
+	s.logger.Printf("%s queued %s job %s", requestID(r.Context()), req.Type, j.status.ID)
+	w.Header().Set("Location", "/api/v1/jobs/"+j.status.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(j.snapshot())
+}
+
+// executeJob locates the profiles of a job and computes its result in a job
+// worker, or in the server if it has none, without measuring its cost.
+func (s *server) executeJob(ctx context.Context, req jobRequest, profiles []jobProfile, progress func(string)) (*jobResult, jobCost, error) {
+	spec := jobSpec{Request: req}
+	var temps []string
+	defer func() {
+		for _, path := range temps {
+			os.Remove(path)
+		}
+	}()
+	for _, jp := range profiles {
+		if err := ctx.Err(); err != nil {
+			return nil, jobCost{}, err
+		}
+		in, temp, err := s.locateJobInput(ctx, jp, func(msg string) { progress(jp.ref + ": " + msg) })
+		if temp != "" {
+			temps = append(temps, temp)
+		}
+		if err != nil {
+			return nil, jobCost{}, err
+		}
+		spec.Inputs = append(spec.Inputs, in)
+	}
+	if s.jobExecutable == "" {
+		result, err := computeJob(ctx, spec, progress)
+		return result, jobCost{}, err
+	}
+	return s.runJobWorker(ctx, spec, progress)
+}
+
+// locateJobInput locates the files of jp for a job worker. Core dumps are
+// converted by viewcore in the sandbox first, to a temporary file that the
+// caller removes.
+func (s *server) locateJobInput(ctx context.Context, jp jobProfile, progress func(string)) (in jobInput, temp string, err error) {
+	located, err := s.locateProfile(ctx, jp.root, jp.name, progress)
+	if err != nil {
+		return jobInput{}, "", err
+	}
+	in = jobInput{Ref: jp.ref, Name: located.ref}
+	if located.pattern != "" || !s.isCoreDump(located.files[0].path) {
+		for _, f := range located.files {
+			in.Paths = append(in.Paths, f.path)
+		}
+		return in, "", nil
+	}
+	p, err := s.convertCoreDump(ctx, located.files[0].path, jp.exe, progress)
+	if err != nil {
+		return jobInput{}, "", err
+	}
+	var dir string
+	if s.temp != nil {
+		dir = s.temp.path
+	}
+	f, err := os.CreateTemp(dir, "job-*.pb.gz")
+	if err != nil {
+		return jobInput{}, "", err
+	}
+	err = p.Write(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	in.Paths = []string{f.Name()}
+	return in, f.Name(), err
+}
+
+// containsRoot reports whether roots contains root.
+func containsRoot(roots []*profileRoot, root *profileRoot) bool {
+	for _, r := range roots {
+		if r == root {
+			return true
+		}
+	}
+	return false
+}
+
+func mergeJob(profiles []*profile.Profile, progress func(string)) (*jobResult, error) {
+	progress(fmt.Sprintf("merging %d profiles", len(profiles)))
+	p, err := profile.Merge(profiles)
+	if err != nil {
+		return nil, fmt.Errorf("could not merge the profiles: %w", err)
+	}
+	var b bytes.Buffer
+	if err := p.Write(&b); err != nil {
+		return nil, err
+	}
+	return &jobResult{"application/octet-stream", "merged.pb.gz", b.Bytes()}, nil
+}
+
+func diffJob(baseName string, base *profile.Profile, headName string, head *profile.Profile, req jobRequest, progress func(string)) (*jobResult, error) {
+	progress("comparing")
+	report, err := compareProfiles(base, head, req.SampleType, req.Normalize, req.N)
+	if err != nil {
+		return nil, err
+	}
+	report.Base, report.Head = baseName, headName
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return &jobResult{"application/json", exportName(headName) + "-vs-" + exportName(baseName) + ".json", data}, nil
+}
+
+func convertJob(name string, p *profile.Profile, req jobRequest, progress func(string)) (*jobResult, error) {
+	progress("converting to " + req.Format)
+	if req.Format == "pprof" {
+		var b bytes.Buffer
+		if err := p.Write(&b); err != nil {
+			return nil, err
+		}
+		return &jobResult{"application/octet-stream", exportName(name) + ".pb.gz", b.Bytes()}, nil
+	}
+	sampleIndex, err := selectSampleIndex(p, req.SampleType)
+	if err != nil {
+		return nil, err
+	}
+	if req.Format == "firefox" {
+		data, err := json.Marshal(firefoxExport(p, sampleIndex, name))
+		if err != nil {
+			return nil, err
+		}
+		return &jobResult{"application/json", exportName(name) + ".firefox.json", data}, nil
+	}
+	t := topExportTable(exportName(name), p.SampleType[sampleIndex].Unit, sampleTotal(p, sampleIndex), topTable(p, sampleIndex))
+	var b bytes.Buffer
+	write := writeCSV
+	if req.Format == "xlsx" {
+		write = writeXLSX
+	}
+	if err := write(&b, t); err != nil {
+		return nil, err
+	}
+	return &jobResult{exportFormats[req.Format], t.name + "." + req.Format, b.Bytes()}, nil
+}
+
+// jobListHandler lists the jobs with their CPU time and peak heap for
+// admins, to see which operations are expensive and cancel them: the page
+// GET /jobs and JSON at GET /api/v1/jobs.
+func (s *server) jobListHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.requireRole(w, r, adminRole) {
+		return
+	}
+	jobs := s.jobs.list()
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		writeJSON(w, jobs)
+		return
+	}
+	prefs, err := s.requestPrefs(r)
+	if err != nil {
+		prefs = s.displayPrefs
+	}
+	type row struct {
+		jobStatus
+		Created, Duration, CPU, PeakHeap string
+		Cancelable                       bool
+	}
+	rows := make([]row, 0, len(jobs))
+	for _, j := range jobs {
+		rw := row{jobStatus: j, Created: prefs.timestamp(j.Created)}
+		if j.Started != nil {
+			end := time.Now()
+			if j.Finished != nil {
+				end = *j.Finished
+			}
+			rw.Duration = prefs.duration(int64(end.Sub(*j.Started)))
+		}
+		if j.CPUSeconds > 0 {
+			rw.CPU = prefs.duration(int64(j.CPUSeconds * float64(time.Second)))
+		}
+		if j.PeakHeapBytes > 0 {
+			rw.PeakHeap = prefs.bytes(int64(j.PeakHeapBytes))
+		}
+		rw.Cancelable = j.Status == jobQueued || j.Status == jobRunning
+		rows = append(rows, rw)
+	}
+	if err := jobsTemplate.Execute(w, rows); err != nil {
+		s.logger.Printf("%s jobs: %v", requestID(r.Context()), err)
+	}
+}
+
+var jobsTemplate = template.Must(template.New("jobs").Parse(`<!doctype html>
+<html>
+<head><title>pprofweb jobs</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 2px 8px; text-align: left; vertical-align: top; }
+</style>
+</head>
+<body>
+<h1>Jobs</h1>
+<table>
+<tr><th>Created</th><th>Submitter</th><th>Type</th><th>Profiles</th><th>Status</th><th>Duration</th><th>CPU time</th><th>Peak heap</th><th></th></tr>
+{{range .}}<tr><td>{{.Created}}</td><td>{{.Submitter}}</td><td>{{.Type}}</td><td>{{range .Profiles}}{{.}}<br>{{end}}</td>
+<td>{{.Status}}{{if .Progress}}: {{.Progress}}{{end}}{{if .Error}}: {{.Error}}{{end}}</td>
+<td>{{.Duration}}</td><td>{{.CPU}}</td><td>{{.PeakHeap}}</td>
+<td>{{if .Cancelable}}<button onclick="cancelJob('{{.ID}}')">Cancel</button>{{else if .Result}}<a href="{{.Result}}">result</a>{{end}}</td></tr>
+{{else}}<tr><td colspan="9">No jobs in the last hour.</td></tr>
+{{end}}</table>
+<p>Jobs run in worker processes: the CPU time and peak heap are those of the worker of the job. Locating and
+downloading its profiles and converting core dumps happen in the server and aren't included.</p>
+<script>
+function cancelJob(id) {
+  fetch('/api/v1/jobs/' + id, {method: 'DELETE'}).then(() => location.reload());
+}
+</script>
+</body>
+</html>
+`))
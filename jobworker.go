@@ -0,0 +1,221 @@
+package pprofweb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime/metrics"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/urfave/cli/v2"
+)
+
+// jobSpec is the work of a job for a job worker: its request and the local
+// files of its profiles, located and authorized by the server.
+type jobSpec struct {
+	Request jobRequest `json:"request"`
+	Inputs  []jobInput `json:"inputs"`
+}
+
+// jobInput is a profile of a job: the files at Paths are merged, e.g. the
+// matches of a glob.
+type jobInput struct {
+	// Ref is the reference of the request, shown in progress.
+	Ref string `json:"ref"`
+	// Name is the resolved reference, which names the results.
+	Name  string   `json:"name"`
+	Paths []string `json:"paths"`
+}
+
+// jobOutput is the output of a job worker.
+type jobOutput struct {
+	ContentType string `json:"content_type"`
+	Filename    string `json:"filename"`
+	Data        []byte `json:"data"`
+	// PeakHeapBytes is the largest heap of the worker.
+	PeakHeapBytes uint64 `json:"peak_heap_bytes"`
+}
+
+// jobWorkerCommand runs a job in its own process, so the server can measure
+// its CPU time and heap, which Go doesn't account per goroutine. It reads the
+// jobSpec as JSON from stdin, writes progress to stderr, and the jobOutput as
+// JSON to stdout. Errors are the last line of stderr.
+var jobWorkerCommand = &cli.Command{
+	Name:   "job-worker",
+	Usage:  "run a job of /api/v1/jobs for the server",
+	Hidden: true,
+	Action: func(context *cli.Context) error {
+		var spec jobSpec
+		if err := json.NewDecoder(os.Stdin).Decode(&spec); err != nil {
+			return cli.Exit(fmt.Sprintf("invalid job: %v", err), 1)
+		}
+		peak := peakHeap(jobHeapInterval)
+		result, err := computeJob(context.Context, spec, func(msg string) {
+			fmt.Fprintln(context.App.ErrWriter, msg)
+		})
+		if err != nil {
+			return cli.Exit(err.Error(), 1)
+		}
+		return json.NewEncoder(context.App.Writer).Encode(jobOutput{
+			ContentType:   result.contentType,
+			Filename:      result.filename,
+			Data:          result.data,
+			PeakHeapBytes: peak(),
+		})
+	},
+}
+
+// peakHeap samples the heap of the process every interval until the
+// returned function is called, which returns the largest sample.
+func peakHeap(interval time.Duration) (stop func() uint64) {
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	heap := func() uint64 {
+		metrics.Read(sample)
+		if sample[0].Value.Kind() != metrics.KindUint64 {
+			return 0
+		}
+		return sample[0].Value.Uint64()
+	}
+	done := make(chan struct{})
+	result := make(chan uint64)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		var peak uint64
+		for {
+			if h := heap(); h > peak {
+				peak = h
+			}
+			select {
+			case <-ticker.C:
+			case <-done:
+				result <- peak
+				return
+			}
+		}
+	}()
+	return func() uint64 {
+		close(done)
+		return <-result
+	}
+}
+
+// runJobWorker runs spec in a job worker, the job-worker command of
+// s.jobExecutable, passing its progress to progress. The CPU time is that of
+// the worker, also if it fails.
+func (s *server) runJobWorker(ctx context.Context, spec jobSpec, progress func(string)) (*jobResult, jobCost, error) {
+	in, err := json.Marshal(spec)
+	if err != nil {
+		return nil, jobCost{}, err
+	}
+	cmd := exec.CommandContext(ctx, s.jobExecutable, "job-worker")
+	cmd.Stdin = bytes.NewReader(in)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, jobCost{}, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, jobCost{}, fmt.Errorf("could not start the job worker: %w", err)
+	}
+	var last string
+	lines := bufio.NewScanner(stderr)
+	for lines.Scan() {
+		if last = lines.Text(); last != "" {
+			progress(last)
+		}
+	}
+	err = cmd.Wait()
+	var cost jobCost
+	if cmd.ProcessState != nil {
+		cost.cpu = cmd.ProcessState.UserTime() + cmd.ProcessState.SystemTime()
+	}
+	if ctx.Err() != nil {
+		return nil, cost, ctx.Err()
+	}
+	if err != nil {
+		if last != "" {
+			return nil, cost, errors.New(last)
+		}
+		return nil, cost, fmt.Errorf("job worker: %w", err)
+	}
+	var output jobOutput
+	if err := json.Unmarshal(out.Bytes(), &output); err != nil {
+		return nil, cost, fmt.Errorf("invalid output of the job worker: %w", err)
+	}
+	cost.peakHeap = output.PeakHeapBytes
+	return &jobResult{output.ContentType, output.Filename, output.Data}, cost, nil
+}
+
+// computeJob computes the result of spec, in a job worker or, for servers
+// without one, in the server.
+func computeJob(ctx context.Context, spec jobSpec, progress func(string)) (*jobResult, error) {
+	profiles := make([]*profile.Profile, len(spec.Inputs))
+	for i, in := range spec.Inputs {
+		p, err := readJobInput(ctx, in, func(msg string) { progress(in.Ref + ": " + msg) })
+		if err != nil {
+			return nil, err
+		}
+		profiles[i] = p
+	}
+	req := spec.Request
+	switch req.Type {
+	case "merge":
+		return mergeJob(profiles, progress)
+	case "diff":
+		return diffJob(spec.Inputs[0].Name, profiles[0], spec.Inputs[1].Name, profiles[1], req, progress)
+	case "convert":
+		return convertJob(spec.Inputs[0].Name, profiles[0], req, progress)
+	}
+	return nil, fmt.Errorf("unknown job type %q", req.Type)
+}
+
+// readJobInput reads and parses the files of in, merging them if there are
+// several, stopping if ctx is done.
+func readJobInput(ctx context.Context, in jobInput, progress func(string)) (*profile.Profile, error) {
+	// the files of globs report their count rather than their percentage
+	fileProgress := progress
+	if len(in.Paths) > 1 {
+		fileProgress = func(string) {}
+	}
+	profiles := make([]*profile.Profile, 0, len(in.Paths))
+	for i, path := range in.Paths {
+		if len(in.Paths) > 1 {
+			progress(fmt.Sprintf("reading %s (%d of %d)", filepath.Base(path), i+1, len(in.Paths)))
+		}
+		var data []byte
+		info, err := os.Stat(path)
+		if err == nil {
+			data, err = readFileProgress(ctx, path, info.Size(), fileProgress)
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read profile %s: %w", in.Ref, err)
+		}
+		fileProgress("parsing")
+		p, err := parseProfileData(data)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse profile %s: %w", in.Ref, err)
+		}
+		profiles = append(profiles, p)
+	}
+	if len(profiles) == 1 {
+		return profiles[0], nil
+	}
+	progress(fmt.Sprintf("merging %d profiles", len(profiles)))
+	p, err := profile.Merge(profiles)
+	if err != nil {
+		return nil, fmt.Errorf("could not merge the profiles matching %s: %w", in.Ref, err)
+	}
+	return p, nil
+}
@@ -0,0 +1,172 @@
+package pprofweb
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sessionRoutes are the pages of a session below pprofWebPath/id/, besides the
+// views of pprofViews, tagging its requests; others are tagged other.
+var sessionRoutes = map[string]bool{
+	"events":          true,
+	"keepalive":       true,
+	"sample":          true,
+	"snapshot":        true,
+	"text":            true,
+	"buildinfo":       true,
+	"calltree":        true,
+	"chart":           true,
+	"download":        true,
+	"flamegraph.json": true,
+}
+
+// requestTracker counts the requests in flight, in total and by the pattern
+// of their route, for the gauges and the status page.
+type requestTracker struct {
+	mu       sync.Mutex
+	total    int
+	inFlight map[string]int
+}
+
+func newRequestTracker() *requestTracker {
+	return &requestTracker{inFlight: make(map[string]int)}
+}
+
+func (t *requestTracker) begin(route string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.total++
+	t.inFlight[route]++
+}
+
+func (t *requestTracker) end(route string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.total--
+	t.inFlight[route]--
+}
+
+// routeCount is the number of requests in flight of a route.
+type routeCount struct {
+	Route    string
+	InFlight int
+}
+
+// snapshot returns the requests in flight, in total and of every route that
+// served a request, sorted by route.
+func (t *requestTracker) snapshot() (int, []routeCount) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	routes := make([]routeCount, 0, len(t.inFlight))
+	for route, n := range t.inFlight {
+		routes = append(routes, routeCount{route, n})
+	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Route < routes[j].Route })
+	return t.total, routes
+}
+
+// sessionView returns the session id and the page of the session of a path
+// below pprofWebPath: the pprof view, e.g. flamegraph, one of sessionRoutes,
+// or other.
+func sessionView(path string) (string, string) {
+	parts := strings.SplitN(strings.TrimPrefix(path, pprofWebPath), "/", 3)
+	id, view := parts[0], ""
+	if len(parts) > 1 {
+		view = parts[1]
+	}
+	if view == pprofViews["graph"] {
+		return id, "graph"
+	}
+	if pprofViews[view] == view || sessionRoutes[view] {
+		return id, view
+	}
+	return id, "other"
+}
+
+// trackRequests measures the requests of handler, routed by mux: it counts
+// them in flight, sends their latency as the timing http.request tagged by
+// route, and logs and counts the requests slower than slowRequest, with the
+// session and the pprof view they render. Streams of events aren't measured.
+func (s *server) trackRequests(mux *http.ServeMux, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		s.requests.begin(route)
+		defer s.requests.end(route)
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		handler.ServeHTTP(sw, r)
+		d := time.Since(start)
+		if strings.HasPrefix(sw.Header().Get("Content-Type"), "text/event-stream") {
+			return
+		}
+
+		tags := []string{"route:" + route}
+		var id, view, profileType string
+		if route == pprofWebPath {
+			id, view = sessionView(r.URL.Path)
+			s.pprofHandlerMutex.RLock()
+			if h, ok := s.pprofHandler[id]; ok {
+				profileType = h.info.profileType.tag()
+			}
+			s.pprofHandlerMutex.RUnlock()
+			tags = append(tags, "view:"+view)
+			if profileType != "" {
+				tags = append(tags, "profile_type:"+profileType)
+			}
+		}
+		s.stats.Timing("http.request", d, tags...)
+		if s.slowRequest <= 0 || d < s.slowRequest {
+			return
+		}
+		s.stats.Count("http.slow_requests", 1, tags...)
+		atomic.AddInt64(&s.counters.slowRequests, 1)
+		if id != "" {
+			s.logger.Printf("%s slow request %s %s: %s, status %d, session %s, view %s, profile type %s",
+				requestID(r.Context()), r.Method, r.URL, d.Round(time.Millisecond), sw.status, id, view, profileType)
+			return
+		}
+		s.logger.Printf("%s slow request %s %s: %s, status %d, route %s",
+			requestID(r.Context()), r.Method, r.URL, d.Round(time.Millisecond), sw.status, route)
+	})
+}
+
+// statusWriter records the status of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush implements http.Flusher for streaming responses.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// reportRequestGauges sends the gauges of the requests in flight, in total
+// and tagged by route.
+func (s *server) reportRequestGauges() {
+	total, routes := s.requests.snapshot()
+	s.stats.Gauge("http.in_flight", float64(total))
+	for _, route := range routes {
+		s.stats.Gauge("http.in_flight_by_route", float64(route.InFlight), "route:"+route.Route)
+	}
+}
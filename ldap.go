@@ -0,0 +1,188 @@
+package pprofweb
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ldapCacheDuration is how long successful logins are cached, so the many
+// requests of the pprof web UI don't all bind to the LDAP server.
+const ldapCacheDuration = 5 * time.Minute
+
+// ldapTimeout limits connecting to and requests of the LDAP server.
+const ldapTimeout = 10 * time.Second
+
+// ErrInvalidCredentials rejects the credentials of a request, e.g. from the
+// identity hook of WithIdentity.
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// ldapConfig configures authenticating users with an LDAP or Active
+// Directory server: the user entry is searched with the service account, then
+// bound to with the user's password. The groups of the entry select the role.
+type ldapConfig struct {
+	url      string
+	startTLS bool
+	// bindDN and bindPassword is the service account searching users; an
+	// anonymous search is used if bindDN is empty.
+	bindDN       string
+	bindPassword string
+	userBase     string
+	// userFilter finds the entry of a user; %s is the escaped user name.
+	userFilter string
+	// groupAttribute of the user entry lists the DNs of its groups, e.g.
+	// memberOf.
+	groupAttribute string
+	// groupRoles maps lower case group names, the common names of their DNs,
+	// to the role of their members. Users get the highest role of their
+	// groups, or defaultRole.
+	groupRoles  map[string]role
+	defaultRole role
+	// userRoles maps lower case user names to their roles, overriding the
+	// roles of their groups.
+	userRoles map[string]role
+}
+
+// parseNameRole parses a mapping of a group or user name to a role like
+// "perf-team=admin".
+func parseNameRole(def string) (string, role, error) {
+	i := strings.Index(def, "=")
+	if i <= 0 {
+		return "", noRole, fmt.Errorf("invalid role assignment %q: must be name=role", def)
+	}
+	r, err := parseRole(def[i+1:])
+	if err != nil {
+		return "", noRole, err
+	}
+	return strings.ToLower(strings.TrimSpace(def[:i])), r, nil
+}
+
+// ldapLogin is a cached successful login.
+type ldapLogin struct {
+	user    *user
+	expires time.Time
+}
+
+type ldapAuthenticator struct {
+	config ldapConfig
+
+	mu sync.Mutex
+	// logins maps the user name and password hash to cached logins.
+	logins map[string]ldapLogin
+}
+
+func newLDAPAuthenticator(config ldapConfig) *ldapAuthenticator {
+	return &ldapAuthenticator{config: config, logins: make(map[string]ldapLogin)}
+}
+
+// authenticate returns the user name with password, or ErrInvalidCredentials.
+func (a *ldapAuthenticator) authenticate(name, password string) (*user, error) {
+	// an empty password is an unauthenticated bind, which succeeds
+	if name == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+	sum := sha256.Sum256([]byte(name + "\x00" + password))
+	key := string(sum[:])
+	now := time.Now()
+	a.mu.Lock()
+	login, ok := a.logins[key]
+	a.mu.Unlock()
+	if ok && now.Before(login.expires) {
+		return login.user, nil
+	}
+
+	u, err := a.bind(name, password)
+	if err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	for k, l := range a.logins {
+		if now.After(l.expires) {
+			delete(a.logins, k)
+		}
+	}
+	a.logins[key] = ldapLogin{user: u, expires: now.Add(ldapCacheDuration)}
+	a.mu.Unlock()
+	return u, nil
+}
+
+func (a *ldapAuthenticator) bind(name, password string) (*user, error) {
+	conn, err := ldap.DialURL(a.config.url, ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetTimeout(ldapTimeout)
+	if a.config.startTLS {
+		if err := conn.StartTLS(&tls.Config{ServerName: hostOfURL(a.config.url)}); err != nil {
+			return nil, err
+		}
+	}
+	if a.config.bindDN != "" {
+		if err := conn.Bind(a.config.bindDN, a.config.bindPassword); err != nil {
+			return nil, fmt.Errorf("bind service account: %w", err)
+		}
+	}
+
+	result, err := conn.Search(ldap.NewSearchRequest(
+		a.config.userBase, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(a.config.userFilter, ldap.EscapeFilter(name)),
+		[]string{a.config.groupAttribute}, nil))
+	if err != nil {
+		return nil, fmt.Errorf("search user: %w", err)
+	}
+	if len(result.Entries) != 1 {
+		return nil, ErrInvalidCredentials
+	}
+	entry := result.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, fmt.Errorf("bind user: %w", err)
+	}
+
+	u := &user{name: name, role: a.config.defaultRole}
+	for _, group := range entry.GetAttributeValues(a.config.groupAttribute) {
+		if r := a.config.groupRoles[strings.ToLower(groupName(group))]; r > u.role {
+			u.role = r
+		}
+	}
+	if r, ok := a.config.userRoles[strings.ToLower(name)]; ok {
+		u.role = r
+	}
+	return u, nil
+}
+
+// groupName returns the common name of the group dn, e.g. perf-team for
+// cn=perf-team,ou=groups,dc=example,dc=com, or dn if it has none.
+func groupName(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) == 0 {
+		return dn
+	}
+	for _, attr := range parsed.RDNs[0].Attributes {
+		if strings.EqualFold(attr.Type, "cn") {
+			return attr.Value
+		}
+	}
+	return dn
+}
+
+// hostOfURL returns the host name of an ldap:// URL.
+func hostOfURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
@@ -0,0 +1,231 @@
+package pprofweb
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/pprof/profile"
+)
+
+// maxSeriesProfiles limits the profiles of one report over time.
+const maxSeriesProfiles = 100
+
+// defaultLeakGrowth is the number of goroutines a stack must gain to be
+// reported as a probable leak.
+const defaultLeakGrowth = 10
+
+// goroutineLeak is a stack with a goroutine count that never shrinks across
+// goroutine profiles of a process.
+type goroutineLeak struct {
+	// Function is the function closest to the leaf outside of the runtime,
+	// usually the one the goroutines wait in.
+	Function string   `json:"function"`
+	Stack    []string `json:"stack"`
+	// Counts are the goroutines with the stack in each profile.
+	Counts []int64 `json:"counts"`
+	Growth int64   `json:"growth"`
+}
+
+// goroutineLeakReport is the JSON response of GET /api/v1/goroutine-leaks.
+type goroutineLeakReport struct {
+	// Profiles are the references of the profiles, oldest first.
+	Profiles []string        `json:"profiles"`
+	Totals   []int64         `json:"totals"`
+	Leaks    []goroutineLeak `json:"leaks"`
+}
+
+// findGoroutineLeaks returns the stacks of the goroutine profiles, oldest
+// first, with counts growing monotonically by at least minGrowth, largest
+// growth first.
+func findGoroutineLeaks(profiles []*profile.Profile, minGrowth int64) []goroutineLeak {
+	type stack struct {
+		frames []string
+		counts []int64
+	}
+	stacks := make(map[string]*stack)
+	for i, p := range profiles {
+		sampleIndex := defaultSampleIndex(p)
+		for _, s := range p.Sample {
+			frames := sampleFrames(s)
+			// dumps have a sample per stack and state, count them together
+			key := strings.Join(frames, "\n")
+			st := stacks[key]
+			if st == nil {
+				st = &stack{frames: frames, counts: make([]int64, len(profiles))}
+				stacks[key] = st
+			}
+			st.counts[i] += s.Value[sampleIndex]
+		}
+	}
+
+	var leaks []goroutineLeak
+	for _, st := range stacks {
+		growth := st.counts[len(st.counts)-1] - st.counts[0]
+		if growth < minGrowth {
+			continue
+		}
+		monotonic := true
+		for i := 1; i < len(st.counts); i++ {
+			if st.counts[i] < st.counts[i-1] {
+				monotonic = false
+				break
+			}
+		}
+		if !monotonic {
+			continue
+		}
+		leak := goroutineLeak{Stack: st.frames, Counts: st.counts, Growth: growth}
+		for j := len(st.frames) - 1; j >= 0; j-- {
+			if !runtimeFrame(st.frames[j]) {
+				leak.Function = st.frames[j]
+				break
+			}
+		}
+		if leak.Function == "" && len(st.frames) > 0 {
+			leak.Function = st.frames[len(st.frames)-1]
+		}
+		leaks = append(leaks, leak)
+	}
+	sort.Slice(leaks, func(i, j int) bool {
+		if leaks[i].Growth != leaks[j].Growth {
+			return leaks[i].Growth > leaks[j].Growth
+		}
+		return strings.Join(leaks[i].Stack, "\n") < strings.Join(leaks[j].Stack, "\n")
+	})
+	return leaks
+}
+
+// seriesProfile is a profile of a series of profiles of the same process.
+type seriesProfile struct {
+	name string
+	p    *profile.Profile
+}
+
+// openProfileSeries opens the profiles of type t referenced by the profile
+// query parameters of r, at least two. They are ordered by their capture time
+// if all have one, else by the order of the query. It writes an error
+// response and returns false if a profile can't be opened.
+func (s *server) openProfileSeries(w http.ResponseWriter, r *http.Request, t profileType) ([]seriesProfile, bool) {
+	refs := r.URL.Query()["profile"]
+	if len(refs) < 2 {
+		http.Error(w, "at least two profile parameters are required", http.StatusBadRequest)
+		return nil, false
+	}
+	if len(refs) > maxSeriesProfiles {
+		http.Error(w, fmt.Sprintf("at most %d profiles can be compared", maxSeriesProfiles), http.StatusBadRequest)
+		return nil, false
+	}
+	var profiles []seriesProfile
+	allTimed := true
+	for _, ref := range refs {
+		_, name, p, ok := s.openProfile(w, r, ref)
+		if !ok {
+			return nil, false
+		}
+		if pt := detectProfileType(p, name); pt != t {
+			http.Error(w, fmt.Sprintf("%s is a %s, not a %s", name, strings.ToLower(pt.title()), strings.ToLower(t.title())),
+				http.StatusBadRequest)
+			return nil, false
+		}
+		allTimed = allTimed && p.TimeNanos != 0
+		profiles = append(profiles, seriesProfile{name, p})
+	}
+	if allTimed {
+		sort.SliceStable(profiles, func(i, j int) bool {
+			return profiles[i].p.TimeNanos < profiles[j].p.TimeNanos
+		})
+	}
+	return profiles, true
+}
+
+// goroutineLeaksHandler compares two or more goroutine profiles of the same
+// process with GET /goroutine-leaks?profile=a.pb.gz&profile=b.pb.gz and
+// reports the stacks with growing goroutine counts, JSON at
+// /api/v1/goroutine-leaks. min_growth sets the growth of a stack to be
+// reported.
+func (s *server) goroutineLeaksHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	minGrowth := int64(defaultLeakGrowth)
+	if v := query.Get("min_growth"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 {
+			http.Error(w, "min_growth must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		minGrowth = n
+	}
+	prefs, err := s.requestPrefs(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	profiles, ok := s.openProfileSeries(w, r, goroutineProfile)
+	if !ok {
+		return
+	}
+
+	report := goroutineLeakReport{Leaks: []goroutineLeak{}}
+	var parsed []*profile.Profile
+	for _, o := range profiles {
+		report.Profiles = append(report.Profiles, o.name)
+		report.Totals = append(report.Totals, sampleTotal(o.p, defaultSampleIndex(o.p)))
+		parsed = append(parsed, o.p)
+	}
+	if leaks := findGoroutineLeaks(parsed, minGrowth); leaks != nil {
+		report.Leaks = leaks
+	}
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		writeJSON(w, report)
+		return
+	}
+
+	page := struct {
+		goroutineLeakReport
+		Times     []string
+		MinGrowth int64
+	}{report, nil, minGrowth}
+	for _, o := range profiles {
+		page.Times = append(page.Times, prefs.timestamp(captureTime(o.p)))
+	}
+	if err := goroutineLeaksTemplate.Execute(w, page); err != nil {
+		s.logger.Printf("%s goroutine leaks: %v", requestID(r.Context()), err)
+	}
+}
+
+var goroutineLeaksTemplate = template.Must(template.New("leaks").Parse(`<!doctype html>
+<html>
+<head><title>pprofweb goroutine leaks</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin: 1em 0; }
+td, th { border: 1px solid #ccc; padding: 2px 8px; text-align: left; vertical-align: top; }
+td.count { text-align: right; }
+pre { margin: 4px 0; font-size: 12px; }
+</style>
+</head>
+<body>
+<h1>Goroutine leaks</h1>
+<table>
+<tr><th>Profile</th><th>Captured</th><th>Goroutines</th></tr>
+{{range $i, $p := .Profiles}}<tr><td>{{$p}}</td><td>{{index $.Times $i}}</td><td class="count">{{index $.Totals $i}}</td></tr>
+{{end}}</table>
+{{if .Leaks}}<p>Stacks that gained at least {{.MinGrowth}} goroutines and never lost any are probable leaks,
+largest growth first.</p>
+<table>
+<tr><th>Function</th><th>Growth</th><th>Goroutines</th></tr>
+{{range .Leaks}}<tr><td><details><summary>{{.Function}}</summary><pre>{{range .Stack}}{{.}}
+{{end}}</pre></details></td><td class="count">+{{.Growth}}</td><td>{{range $i, $c := .Counts}}{{if $i}} → {{end}}{{$c}}{{end}}</td></tr>
+{{end}}</table>
+{{else}}<p>No stack gained {{.MinGrowth}} goroutines without losing any.</p>
+{{end}}</body>
+</html>
+`))
@@ -0,0 +1,192 @@
+package pprofweb
+
+import (
+	"embed"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"strings"
+)
+
+//go:generate sh -c "GOOS=js GOARCH=wasm go build -o wasm/pprofweb.wasm ./cmd/pprofweb-wasm"
+//go:generate sh -c "cp \"$(go env GOROOT)/lib/wasm/wasm_exec.js\" wasm/ 2>/dev/null || cp \"$(go env GOROOT)/misc/wasm/wasm_exec.js\" wasm/"
+
+// wasmBuild is the directory wasm with the WASM build of the browser mode,
+// if it was generated before building.
+//
+//go:embed wasm
+var wasmBuild embed.FS
+
+// wasmFiles are the files of the WASM build served under /wasm/: the build
+// of cmd/pprofweb-wasm and the JavaScript support of Go's WASM builds.
+var wasmFiles = map[string]bool{"pprofweb.wasm": true, "wasm_exec.js": true}
+
+// embeddedWasm returns the WASM build embedded in the binary, nil if it
+// wasn't generated.
+func embeddedWasm() fs.FS {
+	dir, err := fs.Sub(wasmBuild, "wasm")
+	if err != nil {
+		return nil
+	}
+	for name := range wasmFiles {
+		if _, err := fs.Stat(dir, name); err != nil {
+			return nil
+		}
+	}
+	return dir
+}
+
+// localHandler serves GET /local, which reports small profiles of the user's
+// computer in the browser with the WASM build of cmd/pprofweb-wasm: the top
+// table and a flame graph, without uploading them or loading them into the
+// memory of the server. Larger profiles are meant to be uploaded.
+func (s *server) localHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.wasm == nil {
+		http.Error(w, "the browser mode is disabled: build with go generate or set --wasm-dir", http.StatusNotFound)
+		return
+	}
+	page := struct {
+		MaxSize     int64
+		MaxSizeText string
+		Upload      bool
+	}{s.maxLocalSize, formatBytes(s.maxLocalSize), s.allowUpload}
+	if err := localTemplate.Execute(w, page); err != nil {
+		s.logger.Printf("%s local: %v", requestID(r.Context()), err)
+	}
+}
+
+// wasmHandler serves the files of the WASM build of the browser mode.
+func (s *server) wasmHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/wasm/")
+	if s.wasm == nil || !wasmFiles[name] {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	http.StripPrefix("/wasm/", http.FileServer(http.FS(s.wasm))).ServeHTTP(w, r)
+}
+
+var localTemplate = template.Must(template.New("local").Parse(`<!doctype html>
+<html>
+<head><title>Open a profile in the browser</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin: 1em 0; }
+td, th { border: 1px solid #ccc; padding: 2px 8px; text-align: left; }
+td.value { text-align: right; }
+#flame { position: relative; font: 11px sans-serif; margin: 1em 0; }
+#flame div { position: absolute; height: 16px; overflow: hidden; white-space: nowrap; box-sizing: border-box;
+  border: 1px solid #fff; background: #f0a060; cursor: pointer; padding: 0 2px; }
+</style>
+</head>
+<body>
+<h1>Open a profile in the browser</h1>
+<p>Profiles up to {{.MaxSizeText}} are read and reported by your browser; they aren't uploaded.
+{{if .Upload}}Upload larger profiles to open them in the full pprof web UI.{{end}}</p>
+<p><input type="file" id="file"> <select id="si" style="display:none"></select> <span id="status">Loading…</span></p>
+<h2 id="flameTitle" style="display:none">Flame graph</h2>
+<div id="flame"></div>
+<table id="top"></table>
+<script src="/wasm/wasm_exec.js"></script>
+<script>
+const maxSize = {{.MaxSize}};
+const status = document.getElementById('status');
+let data = null, unit = '';
+const go = new Go();
+const ready = WebAssembly.instantiateStreaming(fetch('/wasm/pprofweb.wasm'), go.importObject).then(r => {
+  go.run(r.instance);
+  status.textContent = '';
+}).catch(err => { status.textContent = 'could not load the WASM module: ' + err; });
+
+function format(v) {
+  if (unit === 'nanoseconds') {
+    for (const [u, d] of [['s', 1e9], ['ms', 1e6], ['µs', 1e3]]) { if (Math.abs(v) >= d) return (v / d).toFixed(2) + u; }
+    return v + 'ns';
+  }
+  if (unit === 'bytes') {
+    for (const [u, d] of [['GiB', 1 << 30], ['MiB', 1 << 20], ['KiB', 1 << 10]]) { if (Math.abs(v) >= d) return (v / d).toFixed(1) + u; }
+    return v + 'B';
+  }
+  return String(v);
+}
+
+function cell(row, text, cls) {
+  const td = row.insertCell();
+  td.textContent = text;
+  if (cls) td.className = cls;
+}
+
+function renderFlame(root, total) {
+  const flame = document.getElementById('flame');
+  flame.textContent = '';
+  let depth = 0;
+  const draw = (node, x, width, level) => {
+    if (width < 0.001) return;
+    const div = document.createElement('div');
+    div.style.left = (100 * x) + '%';
+    div.style.width = (100 * width) + '%';
+    div.style.top = (17 * level) + 'px';
+    div.textContent = node.name;
+    div.title = node.name + ' ' + format(node.value) + ' (' + (100 * node.value / total).toFixed(1) + '%)';
+    div.onclick = () => renderFlame(node, node.value);
+    flame.appendChild(div);
+    depth = Math.max(depth, level + 1);
+    let cx = x;
+    for (const c of node.children || []) {
+      const cw = width * c.value / node.value;
+      draw(c, cx, cw, level + 1);
+      cx += cw;
+    }
+  };
+  draw(root, 0, 1, 0);
+  flame.style.height = (17 * depth) + 'px';
+}
+
+function render(sampleType) {
+  const report = JSON.parse(pprofwebReport(data, sampleType));
+  if (report.error) {
+    status.textContent = report.error;
+    return;
+  }
+  status.textContent = '';
+  unit = report.sample_types[report.sample_type].unit;
+  const si = document.getElementById('si');
+  si.textContent = '';
+  report.sample_types.forEach((st, i) => si.add(new Option(st.type + ' (' + st.unit + ')', st.type, false, i === report.sample_type)));
+  si.style.display = '';
+  document.getElementById('flameTitle').style.display = '';
+  renderFlame(report.flame, report.total);
+  const top = document.getElementById('top');
+  top.textContent = '';
+  const head = top.insertRow();
+  for (const h of ['Function', 'Flat', 'Flat %', 'Cum', 'Cum %']) head.appendChild(document.createElement('th')).textContent = h;
+  for (const e of report.top) {
+    const row = top.insertRow();
+    const share = v => report.total ? (100 * v / report.total).toFixed(1) + '%' : '';
+    cell(row, e.name);
+    cell(row, format(e.flat), 'value');
+    cell(row, share(e.flat), 'value');
+    cell(row, format(e.cum), 'value');
+    cell(row, share(e.cum), 'value');
+  }
+}
+
+document.getElementById('file').onchange = async e => {
+  const file = e.target.files[0];
+  if (!file) return;
+  if (file.size > maxSize) {
+    status.textContent = file.name + ' is larger than ' + {{.MaxSizeText}} + ': upload it instead.';
+    return;
+  }
+  await ready;
+  data = new Uint8Array(await file.arrayBuffer());
+  render('');
+};
+document.getElementById('si').onchange = e => render(e.target.value);
+</script>
+</body>
+</html>
+`))
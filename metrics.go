@@ -0,0 +1,196 @@
+package pprofweb
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// headlineMetric is a number summarizing the latest profile of a type of the
+// services, e.g. the heap in use.
+type headlineMetric struct {
+	name string
+	help string
+	// profileType is the directory of the profiles below the service, as
+	// created by the agent and captures of targets.
+	profileType string
+	value       func(p *profile.Profile) (float64, bool)
+}
+
+var headlineMetrics = []headlineMetric{
+	{
+		name:        "pprofweb_profile_cpu_samples_per_second",
+		help:        "CPU samples per second of the latest CPU profile of the service.",
+		profileType: "cpu",
+		value:       cpuSamplesPerSecond,
+	},
+	{
+		name:        "pprofweb_profile_heap_inuse_bytes",
+		help:        "Bytes in use of the latest heap profile of the service.",
+		profileType: "heap",
+		value:       typeTotal("inuse_space"),
+	},
+	{
+		name:        "pprofweb_profile_goroutines",
+		help:        "Goroutines of the latest goroutine profile of the service.",
+		profileType: "goroutine",
+		value:       goroutineCount,
+	},
+}
+
+// typeTotal returns a function summing the values of sampleType.
+func typeTotal(sampleType string) func(p *profile.Profile) (float64, bool) {
+	return func(p *profile.Profile) (float64, bool) {
+		i := sampleIndexByName(p, sampleType)
+		if i < 0 {
+			return 0, false
+		}
+		return float64(sampleTotal(p, i)), true
+	}
+}
+
+func cpuSamplesPerSecond(p *profile.Profile) (float64, bool) {
+	if p.DurationNanos <= 0 {
+		return 0, false
+	}
+	samples, ok := typeTotal("samples")(p)
+	if !ok {
+		return 0, false
+	}
+	return samples / (float64(p.DurationNanos) / float64(time.Second)), true
+}
+
+func goroutineCount(p *profile.Profile) (float64, bool) {
+	for _, sampleType := range []string{"goroutine", "goroutines"} {
+		if v, ok := typeTotal(sampleType)(p); ok {
+			return v, true
+		}
+	}
+	return 0, false
+}
+
+// headlineValue is the value of a headline metric of a profile file.
+type headlineValue struct {
+	modTime time.Time
+	value   float64
+	ok      bool
+}
+
+// headlineCache keeps the values of the profile files by path, so scrapes
+// only parse new profiles.
+type headlineCache struct {
+	logger *log.Logger
+	mu     sync.Mutex
+	values map[string]headlineValue
+}
+
+func newHeadlineCache(logger *log.Logger) *headlineCache {
+	return &headlineCache{logger: logger, values: make(map[string]headlineValue)}
+}
+
+// value returns the value of metric of the profile f.
+func (c *headlineCache) value(metric headlineMetric, f profileFile) (float64, bool) {
+	c.mu.Lock()
+	v, ok := c.values[f.path]
+	c.mu.Unlock()
+	if ok && v.modTime.Equal(f.modTime) {
+		return v.value, v.ok
+	}
+
+	v = headlineValue{modTime: f.modTime}
+	p, err := parseProfileFile(f.path)
+	if err != nil {
+		c.logger.Printf("metrics: parse %s: %v", f.path, err)
+	} else {
+		v.value, v.ok = metric.value(p)
+	}
+	c.mu.Lock()
+	c.values[f.path] = v
+	c.mu.Unlock()
+	return v.value, v.ok
+}
+
+// latestServiceProfiles returns the newest profile of the type profileType of
+// every service in files, which are named service/type/file.
+func latestServiceProfiles(files []profileFile, profileType string) map[string]profileFile {
+	latest := make(map[string]profileFile)
+	for _, f := range files {
+		dir := f.name[:strings.LastIndex(f.name, "/")+1]
+		if !strings.HasSuffix(dir, "/"+profileType+"/") {
+			continue
+		}
+		service := strings.TrimSuffix(dir, "/"+profileType+"/")
+		if prev, ok := latest[service]; !ok || f.modTime.After(prev.modTime) {
+			latest[service] = f
+		}
+	}
+	return latest
+}
+
+// metricsHandler serves the headline metrics of the latest profiles of the
+// services in the Prometheus text format, for the roots the request is
+// authorized for.
+func (s *server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	type sample struct {
+		root, service string
+		value         float64
+		modTime       time.Time
+	}
+	samples := make([][]sample, len(headlineMetrics))
+	for _, root := range append([]*profileRoot{s.defaultRoot}, s.roots...) {
+		if !root.authorized(r) {
+			continue
+		}
+		files, err := root.listProfiles(s.allowedExtensions)
+		if err != nil {
+			s.logger.Printf("%s list %s: %v", requestID(r.Context()), root.path, err)
+			continue
+		}
+		for i, metric := range headlineMetrics {
+			for service, f := range latestServiceProfiles(files, metric.profileType) {
+				if err := root.fetch(r.Context(), f); err != nil {
+					s.logger.Printf("%s metrics: %v", requestID(r.Context()), err)
+					continue
+				}
+				if v, ok := s.headlines.value(metric, f); ok {
+					samples[i] = append(samples[i], sample{root.name, service, v, f.modTime})
+				}
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for i, metric := range headlineMetrics {
+		sort.Slice(samples[i], func(a, b int) bool {
+			if samples[i][a].root != samples[i][b].root {
+				return samples[i][a].root < samples[i][b].root
+			}
+			return samples[i][a].service < samples[i][b].service
+		})
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", metric.name, metric.help, metric.name)
+		for _, s := range samples[i] {
+			fmt.Fprintf(w, "%s{root=%s,service=%s} %g\n", metric.name, promLabel(s.root), promLabel(s.service), s.value)
+		}
+	}
+	fmt.Fprintf(w, "# HELP pprofweb_profile_timestamp_seconds Modification time of the latest profile of the service.\n"+
+		"# TYPE pprofweb_profile_timestamp_seconds gauge\n")
+	for i, metric := range headlineMetrics {
+		for _, s := range samples[i] {
+			fmt.Fprintf(w, "pprofweb_profile_timestamp_seconds{root=%s,service=%s,type=%s} %d\n",
+				promLabel(s.root), promLabel(s.service), promLabel(metric.profileType), s.modTime.Unix())
+		}
+	}
+}
+
+// promLabel quotes v as a Prometheus label value.
+func promLabel(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, "\n", `\n`)
+	return `"` + strings.ReplaceAll(v, `"`, `\"`) + `"`
+}
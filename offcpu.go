@@ -0,0 +1,143 @@
+package pprofweb
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+
+	"github.com/google/pprof/profile"
+	"github.com/google/uuid"
+)
+
+// nanosecondsIndex returns the index of the sample type measuring time: cpu
+// for CPU profiles, delay for block and mutex profiles, or time for wall
+// clock profiles. It returns -1 if there is none.
+func nanosecondsIndex(p *profile.Profile) int {
+	for _, name := range []string{"cpu", "delay", "time"} {
+		if i := sampleIndexByName(p, name); i >= 0 && p.SampleType[i].Unit == "nanoseconds" {
+			return i
+		}
+	}
+	for i, st := range p.SampleType {
+		if st.Unit == "nanoseconds" {
+			return i
+		}
+	}
+	return -1
+}
+
+// combineOnOffCPU overlays an on-CPU and an off-CPU profile of the same
+// capture into one profile of the time spent per stack. Samples are labeled
+// with "kind" on-cpu or off-cpu so each part can be focused with tagfocus.
+func combineOnOffCPU(onCPU, offCPU *profile.Profile) (*profile.Profile, error) {
+	on, err := timeProfile(onCPU, "on-cpu")
+	if err != nil {
+		return nil, fmt.Errorf("on-CPU profile: %w", err)
+	}
+	off, err := timeProfile(offCPU, "off-cpu")
+	if err != nil {
+		return nil, fmt.Errorf("off-CPU profile: %w", err)
+	}
+	return profile.Merge([]*profile.Profile{on, off})
+}
+
+// timeProfile returns a copy of p with only its time sample type, renamed to
+// time, and samples labeled with kind.
+func timeProfile(p *profile.Profile, kind string) (*profile.Profile, error) {
+	i := nanosecondsIndex(p)
+	if i < 0 {
+		return nil, fmt.Errorf("no sample type in nanoseconds")
+	}
+	c := p.Copy()
+	c.SampleType = []*profile.ValueType{{Type: "time", Unit: "nanoseconds"}}
+	c.DefaultSampleType = ""
+	c.PeriodType = &profile.ValueType{Type: "time", Unit: "nanoseconds"}
+	c.Period = 1
+	for _, s := range c.Sample {
+		s.Value = []int64{s.Value[i]}
+		if s.Label == nil {
+			s.Label = make(map[string][]string)
+		}
+		s.Label["kind"] = []string{kind}
+	}
+	return c, nil
+}
+
+// startOnOffCPUSessions starts sessions for the on-CPU profile onCPU, opened
+// with the reference onName, the off-CPU profile referenced by offCPURef, and,
+// if their time can be added, both overlaid. The sessions link to each other
+// and expire together.
+func (s *server) startOnOffCPUSessions(w http.ResponseWriter, r *http.Request, root *profileRoot, onName string,
+	onCPU *profile.Profile, opts *sessionOptions, offCPURef string) {
+	offRoot, offName, offCPU, ok := s.openProfile(w, r, offCPURef)
+	if !ok {
+		return
+	}
+	onType := detectProfileType(onCPU, onName)
+	opts.applyProfileType(onType, onCPU)
+	onInfo := &sessionInfo{
+		profileName: onName,
+		profileType: onType,
+		urlDefaults: opts.urlDefaults(),
+		insights:    profileInsights(onCPU, onType),
+	}
+	id := uuid.New().String()
+
+	// the options were validated for the on-CPU profile already
+	offOpts, _ := s.parseSessionOptions(r.URL.Query())
+	offType := detectProfileType(offCPU, offName)
+	offOpts.applyProfileType(offType, offCPU)
+	offInfo := &sessionInfo{
+		profileName: offName,
+		profileType: offType,
+		urlDefaults: offOpts.urlDefaults(),
+		insights:    profileInsights(offCPU, offType),
+	}
+	offID := uuid.New().String()
+	links := []sessionLink{{label: "On-CPU", id: id}, {label: "Off-CPU", id: offID}}
+
+	// pprof modifies the profiles of sessions, so combine them first
+	var combinedInfo *sessionInfo
+	combined, err := combineOnOffCPU(onCPU, offCPU)
+	combinedID := uuid.New().String()
+	if err != nil {
+		s.logger.Printf("%s not combining %s and %s: %v", requestID(r.Context()), onInfo.profileName, offName, err)
+	} else {
+		combinedOpts, _ := s.parseSessionOptions(r.URL.Query())
+		combinedOpts.applyProfileType(wallProfile, combined)
+		combinedInfo = &sessionInfo{
+			profileName: onInfo.profileName + " + " + offName,
+			profileType: wallProfile,
+			urlDefaults: combinedOpts.urlDefaults(),
+			combined:    true,
+		}
+		links = append(links, sessionLink{label: "Combined", id: combinedID})
+		combinedInfo.links = links
+	}
+	onInfo.links, offInfo.links = links, links
+	if g := requestGuest(r.Context()); g != nil {
+		for _, link := range links {
+			g.allowSession(link.id)
+		}
+	}
+
+	opts.pruneFrames(onCPU)
+	opts.pruneFrames(offCPU)
+	if combinedInfo != nil {
+		opts.pruneFrames(combined)
+	}
+	startErr := s.startSession(id, root, onCPU, onInfo, opts.args)
+	if startErr == nil {
+		startErr = s.startSession(offID, offRoot, offCPU, offInfo, opts.args)
+	}
+	if startErr == nil && combinedInfo != nil {
+		startErr = s.startSession(combinedID, root, combined, combinedInfo, opts.args)
+	}
+	if startErr != nil {
+		s.logger.Printf("%s pprof error: %+v", requestID(r.Context()), startErr)
+		http.Error(w, "pprof error", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, path.Join(pprofWebPath, id, pprofViews[opts.view]), http.StatusSeeOther)
+}
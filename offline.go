@@ -0,0 +1,25 @@
+package pprofweb
+
+import (
+	"net/http"
+)
+
+// offlineContentSecurityPolicy restricts the pages to resources of this
+// server, so a page that would fetch from the internet fails visibly in
+// development rather than in an air-gapped environment. Every page, script,
+// and style, including pprof's web UI, is compiled into the binary; the pages
+// use inline scripts and styles and data: images, and /local runs WASM.
+const offlineContentSecurityPolicy = "default-src 'self'; script-src 'self' 'unsafe-inline' 'wasm-unsafe-eval'; " +
+	"style-src 'self' 'unsafe-inline'; img-src 'self' data:; connect-src 'self'; form-action 'self'"
+
+// offlineHeaders sets the content security policy of offline operation on
+// the responses of handler if the server runs with --offline.
+func (s *server) offlineHeaders(handler http.Handler) http.Handler {
+	if !s.offline {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Security-Policy", offlineContentSecurityPolicy)
+		handler.ServeHTTP(w, r)
+	})
+}
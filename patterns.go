@@ -0,0 +1,126 @@
+package pprofweb
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// maxPatternProfiles limits the profiles merged for one glob reference.
+const maxPatternProfiles = 100
+
+// defaultDateLayout formats date templates without a layout.
+const defaultDateLayout = "2006-01-02"
+
+// dateTemplate matches the date templates of profile references: {today} or
+// {yesterday} in the server's time zone, optionally with a Go time layout,
+// e.g. {today:20060102}.
+var dateTemplate = regexp.MustCompile(`\{(today|yesterday)(?::([^{}]+))?\}`)
+
+// expandDateTemplates replaces the date templates of the profile name with
+// the dates relative to now.
+func expandDateTemplates(name string, now time.Time) string {
+	return dateTemplate.ReplaceAllStringFunc(name, func(template string) string {
+		m := dateTemplate.FindStringSubmatch(template)
+		day := now
+		if m[1] == "yesterday" {
+			day = now.AddDate(0, 0, -1)
+		}
+		layout := m[2]
+		if layout == "" {
+			layout = defaultDateLayout
+		}
+		return day.Format(layout)
+	})
+}
+
+// isGlobReference reports whether the profile name is a pattern of
+// path.Match, e.g. service-x/*/cpu-*.pb.gz.
+func isGlobReference(name string) bool {
+	return strings.ContainsAny(name, "*?[")
+}
+
+// locateGlob returns the profiles of root matching the pattern name, for
+// locateProfile, sorted by name. Profiles of buckets are downloaded.
+func (s *server) locateGlob(ctx context.Context, root *profileRoot, name string, progress func(string)) (locatedProfile, error) {
+	pattern := strings.TrimPrefix(name, "/")
+	if _, err := path.Match(pattern, ""); err != nil {
+		return locatedProfile{}, &statusError{http.StatusBadRequest, fmt.Sprintf("invalid profile pattern: %v", err)}
+	}
+	files, err := root.listProfiles(s.allowedExtensions)
+	if err != nil {
+		s.logger.Printf("%s list %s: %v", requestID(ctx), root.path, err)
+		return locatedProfile{}, &statusError{http.StatusInternalServerError, "could not list profiles"}
+	}
+	var matches []profileFile
+	for _, f := range files {
+		if ok, _ := path.Match(pattern, f.name); ok {
+			matches = append(matches, f)
+		}
+	}
+	if len(matches) == 0 {
+		return locatedProfile{}, &statusError{http.StatusNotFound, "no profiles match " + pattern}
+	}
+	if len(matches) > maxPatternProfiles {
+		return locatedProfile{}, &statusError{http.StatusBadRequest,
+			fmt.Sprintf("%d profiles match %s; at most %d can be merged", len(matches), pattern, maxPatternProfiles)}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].name < matches[j].name })
+
+	for i, f := range matches {
+		if err := ctx.Err(); err != nil {
+			return locatedProfile{}, err
+		}
+		if root.storage == nil {
+			continue
+		}
+		progress(fmt.Sprintf("downloading %s (%d of %d)", f.name, i+1, len(matches)))
+		if err := root.fetch(ctx, f); err != nil {
+			s.logger.Printf("%s read %s: %v", requestID(ctx), f.path, err)
+			return locatedProfile{}, &statusError{http.StatusInternalServerError, "could not read profile"}
+		}
+	}
+	return locatedProfile{ref: root.reference(pattern), files: matches, pattern: pattern}, nil
+}
+
+// parseGlob reads and merges the profiles of root located by locateGlob,
+// for loadProfile. It returns the same values.
+func (s *server) parseGlob(ctx context.Context, root *profileRoot, located locatedProfile, progress func(string)) (*profileRoot, string, *profile.Profile, error) {
+	start := time.Now()
+	profiles := make([]*profile.Profile, 0, len(located.files))
+	for i, f := range located.files {
+		if err := ctx.Err(); err != nil {
+			return root, "", nil, err
+		}
+		progress(fmt.Sprintf("reading %s (%d of %d)", f.name, i+1, len(located.files)))
+		data, err := os.ReadFile(f.path)
+		if err != nil {
+			s.logger.Printf("%s read %s: %v", requestID(ctx), f.path, err)
+			return root, "", nil, &statusError{http.StatusInternalServerError, "could not read profile"}
+		}
+		p, err := parseProfileData(data)
+		if err != nil {
+			s.logger.Printf("%s parse %s: %v", requestID(ctx), f.path, err)
+			return root, "", nil, &statusError{http.StatusBadRequest, "could not parse profile " + f.name}
+		}
+		profiles = append(profiles, p)
+	}
+	if err := ctx.Err(); err != nil {
+		return root, "", nil, err
+	}
+	progress(fmt.Sprintf("merging %d profiles", len(profiles)))
+	p, err := profile.Merge(profiles)
+	if err != nil {
+		return root, "", nil, &statusError{http.StatusBadRequest, fmt.Sprintf("could not merge the profiles matching %s: %v", located.pattern, err)}
+	}
+	s.stats.Timing("profile.parse", time.Since(start))
+	return root, located.ref, p, nil
+}
@@ -0,0 +1,294 @@
+package pprofweb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// pinsFile is the file of a root recording its pinned profiles, which are
+// never deleted, as a JSON object by profile name.
+const pinsFile = ".pins.json"
+
+// errPinned is returned when deleting a pinned profile.
+var errPinned = errors.New("profile is pinned")
+
+// pinEntry is why and by whom a profile was pinned.
+type pinEntry struct {
+	By     string    `json:"by"`
+	Time   time.Time `json:"time"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// profilePin is a pinned profile in the responses of /api/v1/pins.
+type profilePin struct {
+	Profile string `json:"profile"`
+	pinEntry
+}
+
+// pinRequest is the JSON body of POST /api/v1/pins.
+type pinRequest struct {
+	Profile string `json:"profile"`
+	// Reason is e.g. the incident the profile is evidence of.
+	Reason string `json:"reason"`
+}
+
+// pinName returns the key of the profile name of a root in its pinsFile.
+func pinName(name string) string {
+	return path.Clean(strings.TrimPrefix(name, "/"))
+}
+
+// readPins returns the pinned profiles of root by name.
+func (root *profileRoot) readPins() (map[string]pinEntry, error) {
+	pins := make(map[string]pinEntry)
+	data, err := os.ReadFile(root.filePath(pinsFile))
+	if os.IsNotExist(err) {
+		return pins, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &pins); err != nil {
+		return nil, fmt.Errorf("%s: %w", root.filePath(pinsFile), err)
+	}
+	return pins, nil
+}
+
+// pinned reports whether the profile name of root is pinned. Profiles count
+// as pinned if the pins can't be read, so they aren't deleted by mistake.
+func (root *profileRoot) pinned(name string) (bool, error) {
+	pins, err := root.readPins()
+	if err != nil {
+		return true, err
+	}
+	_, ok := pins[pinName(name)]
+	return ok, nil
+}
+
+// updatePins changes the pinned profiles of root with update and writes them
+// back if it succeeds.
+func (s *server) updatePins(root *profileRoot, update func(pins map[string]pinEntry) error) error {
+	s.pinsMu.Lock()
+	defer s.pinsMu.Unlock()
+	pins, err := root.readPins()
+	if err != nil {
+		return err
+	}
+	if err := update(pins); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(pins, "", "  ")
+	if err != nil {
+		return err
+	}
+	filePath := root.filePath(pinsFile)
+	if err := os.WriteFile(filePath+".tmp", data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(filePath+".tmp", filePath)
+}
+
+// movePin moves the pin of the profile from of root to to, e.g. when it is
+// archived.
+func (s *server) movePin(root *profileRoot, from, to string) error {
+	return s.updatePins(root, func(pins map[string]pinEntry) error {
+		if pin, ok := pins[pinName(from)]; ok {
+			delete(pins, pinName(from))
+			pins[pinName(to)] = pin
+		}
+		return nil
+	})
+}
+
+// listPins returns the pinned profiles of the roots r is authorized for,
+// latest first.
+func (s *server) listPins(r *http.Request) []profilePin {
+	pinned := []profilePin{}
+	for _, root := range append([]*profileRoot{s.defaultRoot}, s.roots...) {
+		if !root.authorized(r) {
+			continue
+		}
+		pins, err := root.readPins()
+		if err != nil {
+			s.logger.Printf("%s pins of %s: %v", requestID(r.Context()), root.path, err)
+			continue
+		}
+		for name, pin := range pins {
+			pinned = append(pinned, profilePin{Profile: root.reference(name), pinEntry: pin})
+		}
+	}
+	sort.Slice(pinned, func(i, j int) bool {
+		if !pinned[i].Time.Equal(pinned[j].Time) {
+			return pinned[i].Time.After(pinned[j].Time)
+		}
+		return pinned[i].Profile < pinned[j].Profile
+	})
+	return pinned
+}
+
+// pinsHandler serves the pinned profiles: GET /api/v1/pins lists them, POST
+// a pinRequest pins a profile, which requires the uploader role, and DELETE
+// /api/v1/pins?profile= unpins one, which requires the admin role like
+// deleting it. POST requires JSON, so browsers can't send it from other sites
+// without CORS.
+func (s *server) pinsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if !s.requireRole(w, r, viewerRole) {
+			return
+		}
+		writeJSON(w, s.listPins(r))
+	case http.MethodPost:
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+			http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+			return
+		}
+		var req pinRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if req.Profile == "" {
+			http.Error(w, "missing profile", http.StatusBadRequest)
+			return
+		}
+		root, name := s.resolveRoot(r, req.Profile)
+		if !requireAuth(w, r, root) || !s.requireRole(w, r, uploaderRole) {
+			return
+		}
+		if reservedName(name) || (!hasAllowedExtension(name, s.allowedExtensions) && !strings.HasSuffix(name, coreExtension)) {
+			http.Error(w, errNotProfile.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := root.stat(name); err != nil {
+			http.Error(w, "profile not found", http.StatusNotFound)
+			return
+		}
+		pin := profilePin{Profile: root.reference(pinName(name)), pinEntry: pinEntry{By: s.viewerName(r), Time: time.Now().UTC(), Reason: req.Reason}}
+		err := s.updatePins(root, func(pins map[string]pinEntry) error {
+			pins[pinName(name)] = pin.pinEntry
+			return nil
+		})
+		if err != nil {
+			s.logger.Printf("%s pin %s: %v", requestID(r.Context()), req.Profile, err)
+			http.Error(w, "could not pin profile", http.StatusInternalServerError)
+			return
+		}
+		s.logger.Printf("%s pinned %s", requestID(r.Context()), root.filePath(name))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(pin)
+	case http.MethodDelete:
+		ref := r.URL.Query().Get("profile")
+		if ref == "" {
+			http.Error(w, "missing profile", http.StatusBadRequest)
+			return
+		}
+		root, name := s.resolveRoot(r, ref)
+		if !requireAuth(w, r, root) || !s.requireRole(w, r, adminRole) {
+			return
+		}
+		err := s.updatePins(root, func(pins map[string]pinEntry) error {
+			if _, ok := pins[pinName(name)]; !ok {
+				return os.ErrNotExist
+			}
+			delete(pins, pinName(name))
+			return nil
+		})
+		switch {
+		case os.IsNotExist(err):
+			http.Error(w, "profile is not pinned", http.StatusNotFound)
+		case err != nil:
+			s.logger.Printf("%s unpin %s: %v", requestID(r.Context()), ref, err)
+			http.Error(w, "could not unpin profile", http.StatusInternalServerError)
+		default:
+			s.logger.Printf("%s unpinned %s", requestID(r.Context()), root.filePath(name))
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+	}
+}
+
+// pinsPageHandler serves /pins, the pinned profiles with forms to pin and
+// unpin them through /api/v1/pins.
+func (s *server) pinsPageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.requireRole(w, r, viewerRole) {
+		return
+	}
+	prefs, err := s.requestPrefs(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	type pinRow struct {
+		profilePin
+		Pinned string
+	}
+	var rows []pinRow
+	for _, pin := range s.listPins(r) {
+		rows = append(rows, pinRow{pin, prefs.timestamp(pin.Time)})
+	}
+	if err := pinsTemplate.Execute(w, rows); err != nil {
+		s.logger.Printf("%s pins: %v", requestID(r.Context()), err)
+	}
+}
+
+var pinsTemplate = template.Must(template.New("pins").Parse(`<!doctype html>
+<html>
+<head><title>pprofweb pinned profiles</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin: 1em 0; }
+td, th { border: 1px solid #ccc; padding: 2px 8px; text-align: left; }
+</style>
+</head>
+<body>
+<h1>Pinned profiles</h1>
+<p>Pinned profiles, like the evidence of incidents or the baselines of
+releases, can't be deleted until they are unpinned.</p>
+<form id="pin">
+<label>Profile <input name="profile" size="40" placeholder="api/cpu/2024-05-01.pb.gz" required></label>
+<label>Reason <input name="reason" size="40" placeholder="e.g. incident 123"></label>
+<button type="submit">Pin</button>
+</form>
+<table>
+<tr><th>Profile</th><th>Pinned</th><th>By</th><th>Reason</th><th></th></tr>
+{{range .}}<tr><td><a href="/?profile={{.Profile}}">{{.Profile}}</a></td><td>{{.Pinned}}</td><td>{{.By}}</td><td>{{.Reason}}</td>
+<td><button data-profile="{{.Profile}}" class="unpin">Unpin</button></td></tr>
+{{else}}<tr><td colspan="5">No profile is pinned.</td></tr>
+{{end}}</table>
+<script>
+function check(r) {
+  if (!r.ok) { return r.text().then(function(t) { throw new Error(t); }); }
+  location.reload();
+}
+document.getElementById('pin').addEventListener('submit', function(e) {
+  e.preventDefault();
+  var body = {profile: this.profile.value, reason: this.reason.value};
+  fetch('/api/v1/pins', {method: 'POST', headers: {'Content-Type': 'application/json'}, body: JSON.stringify(body)})
+    .then(check).catch(function(err) { alert(err.message); });
+});
+document.querySelectorAll('button.unpin').forEach(function(b) {
+  b.addEventListener('click', function() {
+    fetch('/api/v1/pins?profile=' + encodeURIComponent(b.dataset.profile), {method: 'DELETE'})
+      .then(check).catch(function(err) { alert(err.message); });
+  });
+});
+</script>
+</body>
+</html>
+`))
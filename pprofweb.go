@@ -1,19 +1,30 @@
-package main
+package pprofweb
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
 	"errors"
 	"flag"
 	"fmt"
+	"html/template"
 	"io"
+	"io/fs"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
+	"runtime"
 	"runtime/debug"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/NYTimes/gziphandler"
@@ -25,33 +36,323 @@ import (
 
 const pprofWebPath = "/pprofweb/"
 
-func newServer(listenAddr, baseProfilesPath string, profileValidDuration time.Duration) *server {
+func newServer(config serverConfig) *server {
+	if config.logger == nil {
+		config.logger = logger
+	}
+	for _, root := range append([]*profileRoot{config.defaultRoot}, config.roots...) {
+		if root != nil && root.logger == nil {
+			root.logger = config.logger
+		}
+	}
+	if config.usage == nil {
+		config.usage = &usageTracker{logger: config.logger, months: make(map[string]map[string]*tenantUsage)}
+	}
+	if config.displayPrefs == nil {
+		config.displayPrefs = defaultPrefs
+	}
+	signingKey := make([]byte, 32)
+	if _, err := rand.Read(signingKey); err != nil {
+		panic(err)
+	}
+	if config.stats == nil {
+		config.stats = noMetrics{}
+	}
+	if config.jobWorkers <= 0 {
+		config.jobWorkers = defaultJobWorkers
+	}
+	if config.registry == nil {
+		config.registry = &targetRegistry{targets: make(map[string]*captureTarget)}
+	}
 	return &server{
-		listenAddr:           listenAddr,
-		baseProfilesPath:     baseProfilesPath,
-		profileValidDuration: profileValidDuration,
-		pprofHandler:         make(map[string]*handlerWithExpire),
+		serverConfig:     config,
+		pprofHandler:     make(map[string]*handlerWithExpire),
+		brokers:          make(map[string]*eventBroker),
+		headlines:        newHeadlineCache(config.logger),
+		guests:           newGuestLinks(),
+		blobs:            newBlobIndex(),
+		versions:         newVersionIndex(),
+		signingKey:       signingKey,
+		resumableUploads: newResumableUploads(),
+		jobs:             newJobQueue(),
+		storage:          newStorageCache(),
+		scan:             &storageScan{},
+		announcement:     &announcementState{current: config.announcement},
+		watches:          newWatchCache(),
+		feed:             newProfileFeed(),
+		requests:         newRequestTracker(),
+		summaries:        newSummaryCache(),
 	}
 }
 
+type serverConfig struct {
+	listenAddr string
+	// logger logs the requests and errors of the server.
+	logger            *log.Logger
+	defaultRoot       *profileRoot
+	roots             []*profileRoot
+	allowedExtensions []string
+	// sniffContent accepts files without an allowed extension if their
+	// contents look like a profile.
+	sniffContent bool
+	// pprofArgs are additional command line flags for pprof.
+	pprofArgs []string
+	// defaultView and defaultGranularity apply to sessions without the
+	// view and granularity query parameters.
+	defaultView        string
+	defaultGranularity string
+	// nodeCount, nodeFraction, and edgeFraction are the defaults of the
+	// options of sessions pruning the graph view; 0 is pprof's default.
+	nodeCount    int
+	nodeFraction float64
+	edgeFraction float64
+	// tour shows a guided tour of the pprof web UI on the first visit of
+	// session pages.
+	tour bool
+	// dropFrames and keepFrames are the default frame filtering rules of
+	// sessions, see sessionOptions.
+	dropFrames string
+	keepFrames string
+	// displayPrefs are the default units and time zone of the pages, which
+	// users can override with a cookie.
+	displayPrefs *displayPrefs
+	// trustedProxies are the networks of reverse proxies whose
+	// X-Forwarded-For and X-Real-IP headers are used for client addresses.
+	trustedProxies []*net.IPNet
+	// stats receives metrics.
+	stats Metrics
+	// allowUpload enables storing profiles with POST /api/v1/profiles.
+	allowUpload   bool
+	maxUploadSize int64
+	// maxResumableUploadSize limits the size of uploads in chunks.
+	maxResumableUploadSize int64
+	// targets are the services profiles can be captured of by name.
+	targets map[string]*captureTarget
+	// scrape discovers more targets with Prometheus scrape configs if set.
+	scrape *scrapeDiscovery
+	// s3Events ingests the profiles created in a bucket if set.
+	s3Events *s3Events
+	// registry keeps the targets added with the API.
+	registry *targetRegistry
+	// viewcore is the path of the viewcore tool converting core dumps to heap
+	// profiles; core dumps are not accepted if empty. binaries is the search
+	// path of the executables of core dumps.
+	viewcore string
+	binaries string
+	// sandbox runs converters like viewcore, graphviz, and the object tools.
+	sandbox *sandbox
+	// usage counts the usage of the roots per month.
+	usage *usageTracker
+	// adminToken protects the admin pages, which are disabled if empty.
+	adminToken string
+	// ldap authenticates users if set.
+	ldap *ldapAuthenticator
+	// maxGuestLinkDuration limits the validity of guest links.
+	maxGuestLinkDuration time.Duration
+	// temp holds the temporary files of the server and its child processes.
+	temp *tempDir
+	// publicURL is the base URL users reach this server at.
+	publicURL string
+	// maxUploadURLDuration limits the validity of pre-signed upload URLs.
+	maxUploadURLDuration time.Duration
+	// trashRetention is how long deleted profiles are kept in the trash of
+	// their root. Deletes are permanent if 0.
+	trashRetention time.Duration
+	// expectedHot matches the functions expected in the top tables of the
+	// profiles of a service by service.
+	expectedHot map[string]*regexp.Regexp
+	// tools are pprof's default object tools, and archTools the tools for
+	// binaries of other architectures by GOARCH, e.g. cross binutils.
+	tools     string
+	archTools map[string]string
+	// offline disables the features that need the internet, like the Firefox
+	// Profiler, and restricts pages to resources of this server.
+	offline bool
+	// middleware wraps the handler of the server outside of authentication,
+	// first outermost, e.g. for the auth middleware of an embedding service.
+	middleware []func(http.Handler) http.Handler
+	// identify returns the user of a request authenticated by an embedding
+	// service, e.g. from the headers of its auth proxy. See authenticate.
+	identify func(r *http.Request) (*user, error)
+	// driverOptions customizes the pprof driver options of the sessions of
+	// profiles, see startPprof.
+	driverOptions func(profile string, opts *driver.Options)
+	// wasm holds the WASM build of the browser mode, which is disabled if
+	// nil, and maxLocalSize limits the size of the profiles it opens.
+	wasm         fs.FS
+	maxLocalSize int64
+	// defaultProfile is opened by requests of / without a profile, see
+	// defaultProfileRef.
+	defaultProfile string
+	// jobWorkers is the number of jobs of /api/v1/jobs run concurrently.
+	jobWorkers int
+	// jobExecutable is the pprofweb binary running the job-worker command
+	// for jobs, so their cost is measured; jobs run in-process if empty.
+	jobExecutable string
+	// storageQuota and sessionQuota are the quotas of roots without their
+	// own, see quotas; 0 is unlimited.
+	storageQuota int64
+	sessionQuota int
+	// smtpAddr, smtpUser and smtpPassword are of the SMTP server sending
+	// share emails from mailFrom; sharing via email is disabled without
+	// smtpAddr.
+	smtpAddr     string
+	smtpUser     string
+	smtpPassword string
+	mailFrom     string
+	// auditLog records access grants and requests proxied to targets; they
+	// are logged without it.
+	auditLog *auditLog
+	// announcement is shown on all pages from the start, see announce.
+	announcement announcement
+	// slowRequest is the latency above which requests are logged as slow,
+	// see trackRequests; 0 logs none.
+	slowRequest time.Duration
+	// fetchHosts are the hosts profiles may be fetched from with ?url=,
+	// see fetchAllowed; none disables fetching.
+	fetchHosts   []string
+	fetchTimeout time.Duration
+	// rescanInterval is the interval of re-scanning the roots for profiles
+	// written by other systems; 0 disables it.
+	rescanInterval time.Duration
+	// sizeScreen rejects uploads that are compression bombs, before
+	// screeners check them, e.g. for viruses.
+	sizeScreen sizeScreener
+	screeners  []Screener
+}
+
 type server struct {
-	listenAddr           string
-	baseProfilesPath     string
-	profileValidDuration time.Duration
-	pprofHandler         map[string]*handlerWithExpire
-	pprofHandlerMutex    sync.RWMutex
+	serverConfig
+	pprofHandler      map[string]*handlerWithExpire
+	pprofHandlerMutex sync.RWMutex
+	counters          serverCounters
+	requests          *requestTracker
+	// summaries cache the functions of profiles for function histories.
+	summaries *summaryCache
+	// bisectMu serializes appending to the bisect logs of roots.
+	bisectMu sync.Mutex
+	// pinsMu serializes changing the pinned profiles of roots.
+	pinsMu sync.Mutex
+	// baselinesMu serializes changing the baselines of roots.
+	baselinesMu sync.Mutex
+	// brokers send the events of loading and loaded sessions.
+	brokers      map[string]*eventBroker
+	brokersMutex sync.Mutex
+	// headlines caches the values of /metrics.
+	headlines *headlineCache
+	guests    *guestLinks
+	blobs     *blobIndex
+	// versions caches the version labels of profiles for diffs with the
+	// previous release.
+	versions         *versionIndex
+	resumableUploads *resumableUploads
+	jobs             *jobQueue
+	storage          *storageCache
+	scan             *storageScan
+	// announcement is the current announcement, which admins change.
+	announcement *announcementState
+	// watches caches the samples of the watch pages of targets.
+	watches *watchCache
+	// feed streams the events of new profiles.
+	feed *profileFeed
+	// signingKey signs the URLs of exports fetched by other services. It is
+	// random, so the URLs are invalid after a restart.
+	signingKey []byte
 }
 
 type handlerWithExpire struct {
 	http.Handler
-	timer *time.Timer
+	root *profileRoot
+	info *sessionInfo
+	// profile is the profile of the session, to start it with other options.
+	profile *profile.Profile
+	timer   *time.Timer
+	// warnTimer warns the browsers of the session before it expires.
+	warnTimer *time.Timer
+	// deadline is the end of the maximum lifetime of the session; zero if
+	// it is unlimited.
+	deadline time.Time
+}
+
+// idleTimeout returns how long the session stays loaded without activity:
+// the valid duration of its root, but not beyond its deadline.
+func (h *handlerWithExpire) idleTimeout() time.Duration {
+	d := h.root.validDuration
+	if !h.deadline.IsZero() {
+		if remaining := time.Until(h.deadline); remaining < d {
+			d = remaining
+		}
+	}
+	return d
+}
+
+// reset restarts the idle timeout of the session.
+func (h *handlerWithExpire) reset() {
+	d := h.idleTimeout()
+	h.timer.Reset(d)
+	h.warnTimer.Reset(expiryWarningAfter(d))
+}
+
+// warn tells the browsers of the session that it expires soon: "expiring"
+// if activity can keep it alive, "ending" at its deadline.
+func (h *handlerWithExpire) warn(b *eventBroker) {
+	if !h.deadline.IsZero() && time.Until(h.deadline) < h.root.validDuration {
+		b.send("ending", strconv.Itoa(int(time.Until(h.deadline)/time.Second)))
+		return
+	}
+	b.send("expiring", strconv.Itoa(int((h.root.validDuration-expiryWarningAfter(h.root.validDuration))/time.Second)))
 }
 
 func (s *server) Run() error {
-	return http.ListenAndServe(s.listenAddr, s.logRequest(s.handler()))
+	return http.ListenAndServe(s.listenAddr, s.serveHandler())
+}
+
+// serveHandler returns the handler of all requests: the pages and API of
+// handler behind authentication and the middleware, with request ids,
+// request logs, latency metrics, and panic recovery.
+func (s *server) serveHandler() http.Handler {
+	mux := s.handler()
+	var handler http.Handler = s.authenticate(mux)
+	for i := len(s.middleware) - 1; i >= 0; i-- {
+		handler = s.middleware[i](handler)
+	}
+	return withRequestID(s.logRequest(s.trackRequests(mux, s.recoverPanic("server", s.offlineHeaders(s.announce(handler))))))
+}
+
+// start starts the background work of the server: storing usage, purging
+// the trash, collecting temporary files, running jobs, sending gauges
+// every gaugeInterval if it isn't 0, discovering targets, receiving S3 event
+// notifications, and re-scanning the roots. It loads the index files of the
+// roots first.
+func (s *server) start(gaugeInterval time.Duration) {
+	if s.usage.path != "" {
+		go s.usage.run()
+	}
+	if s.trashRetention > 0 {
+		go s.runTrash(trashPurgeInterval)
+	}
+	if s.temp != nil {
+		go s.temp.run(tempCollectInterval)
+	}
+	for i := 0; i < s.jobWorkers; i++ {
+		go s.runJobs()
+	}
+	if gaugeInterval > 0 {
+		go s.reportGauges(gaugeInterval)
+	}
+	if s.scrape != nil {
+		go s.scrape.run()
+	}
+	if s.s3Events != nil && s.s3Events.queueURL != "" {
+		go s.runS3Events()
+	}
+	s.loadIndexes()
+	if s.rescanInterval > 0 {
+		go s.runRescan(s.rescanInterval)
+	}
 }
 
-func (s *server) startHTTP(args *driver.HTTPServerArgs) error {
+func (s *server) startHTTP(args *driver.HTTPServerArgs, root *profileRoot, p *profile.Profile, info *sessionInfo) error {
 	id := args.Host
 	s.pprofHandlerMutex.Lock()
 	defer s.pprofHandlerMutex.Unlock()
@@ -69,39 +370,89 @@ func (s *server) startHTTP(args *driver.HTTPServerArgs) error {
 		}
 		mux.Handle(joinedPattern, handler)
 	}
+	mux.Handle(pprofWebPath+id+"/buildinfo", s.buildInfoHandler(info))
 
+	snippet := sessionBanner(id, info, s.offline, s.smtpAddr != "") + insightsPanel(info.insights) + runtimeMetricsPanel(info.runtimeMetrics) + quickSwitcher + sessionExpiry + sessionHeartbeat(root.validDuration)
+	if s.tour {
+		snippet += sessionTour
+	}
+	pages := withQueryDefaults(mux, info.urlDefaults)
+	sessionMux := http.NewServeMux()
+	sessionMux.Handle(pprofWebPath+id+"/snapshot", s.snapshotHandler(id, info, pages))
+	sessionMux.Handle(pprofWebPath+id+"/text", s.textReportHandler(info, p))
+	sessionMux.Handle(pprofWebPath+id+"/calltree", s.callTreeHandler(info, p))
+	sessionMux.Handle(pprofWebPath+id+"/chart", s.chartHandler(info))
+	sessionMux.Handle(pprofWebPath+id+"/flamegraph.json", s.flameGraphJSONHandler(info, p))
+	sessionMux.Handle(pprofWebPath+id+"/", injectHTML(s.textFallback(pages, id, info, p), snippet))
 	// enable gzip compression: flamegraphs can be big!
-	handler := gziphandler.GzipHandler(mux)
+	handler := gziphandler.GzipHandler(s.recoverPanic("session", sessionMux))
 
-	timer := time.AfterFunc(s.profileValidDuration, func() {
+	h := &handlerWithExpire{
+		Handler: handler,
+		root:    root,
+		info:    info,
+		profile: p,
+	}
+	if root.maxLifetime > 0 {
+		h.deadline = time.Now().Add(root.maxLifetime)
+	}
+	b := s.broker(id, root)
+	d := h.idleTimeout()
+	h.warnTimer = time.AfterFunc(expiryWarningAfter(d), func() {
+		h.warn(b)
+	})
+	h.timer = time.AfterFunc(d, func() {
 		s.pprofHandlerMutex.Lock()
 		defer s.pprofHandlerMutex.Unlock()
-		log.Println("removing", id)
+		if s.pprofHandler[id] != h {
+			// ended while the timer fired
+			return
+		}
+		s.logger.Println("removing", id)
 		delete(s.pprofHandler, id)
+		h.warnTimer.Stop()
+		s.closeBroker(id, "expired", "")
+		s.stats.Count("sessions.expired", 1)
+		atomic.AddInt64(&s.counters.sessionsExpired, 1)
 		// the profiles could consume a lot of memory (multiple gb per profile)
 		// so it is better to force the garbage collection to return the freed memory immediately
 		debug.FreeOSMemory()
 	})
 
-	s.pprofHandler[id] = &handlerWithExpire{
-		Handler: handler,
-		timer:   timer,
-	}
+	s.pprofHandler[id] = h
+	s.stats.Count("sessions.started", 1, "profile_type:"+info.profileType.tag())
+	atomic.AddInt64(&s.counters.sessionsStarted, 1)
+	s.usage.sessionCreated(root)
 
 	return nil
 }
 
 func (s *server) servePprof(w http.ResponseWriter, r *http.Request) {
-	id := strings.TrimPrefix(r.URL.Path, pprofWebPath)
-	if parts := strings.Split(id, "/"); len(parts) > 0 {
-		id = parts[0]
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, pprofWebPath), "/")
+	id := parts[0]
+	if len(parts) == 2 {
+		switch parts[1] {
+		case "events":
+			s.serveEvents(w, r, id)
+			return
+		case "keepalive":
+			s.keepAlive(w, r, id)
+			return
+		case "sample":
+			s.switchSampleType(w, r, id)
+			return
+		}
 	}
 
 	s.pprofHandlerMutex.RLock()
 	defer s.pprofHandlerMutex.RUnlock()
 
 	if handler, ok := s.pprofHandler[id]; ok {
-		handler.timer.Reset(s.profileValidDuration)
+		if !requireAuth(w, r, handler.root) {
+			return
+		}
+		s.touch(id, handler)
+		s.usage.viewed(handler.root, s.viewerName(r))
 		handler.ServeHTTP(w, r)
 		return
 	}
@@ -110,15 +461,36 @@ func (s *server) servePprof(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+// endSession removes the session id before it expires. The caller must hold
+// pprofHandlerMutex.
+func (s *server) endSession(id string, h *handlerWithExpire) {
+	h.timer.Stop()
+	h.warnTimer.Stop()
+	delete(s.pprofHandler, id)
+	s.closeBroker(id, "ended", "")
+	debug.FreeOSMemory()
+}
+
+// touch resets the expiry of the session id and its linked sessions, which
+// are used together. The caller must hold pprofHandlerMutex.
+func (s *server) touch(id string, handler *handlerWithExpire) {
+	handler.reset()
+	for _, link := range handler.info.links {
+		if linked, ok := s.pprofHandler[link.id]; ok && link.id != id {
+			linked.reset()
+		}
+	}
+}
+
 func (s *server) logRequest(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("%s %s %s\n", r.RemoteAddr, r.Method, r.URL)
+		s.logger.Printf("%s %s %s %s\n", requestID(r.Context()), s.clientIP(r), r.Method, r.URL)
 		handler.ServeHTTP(w, r)
 	})
 }
 
 func (s *server) rootHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("rootHandler %s %s", r.Method, r.URL.String())
+	s.logger.Printf("rootHandler %s %s", r.Method, r.URL.String())
 	if r.Method != http.MethodGet {
 		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
 		return
@@ -130,64 +502,351 @@ func (s *server) rootHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	profileQueryParam := r.URL.Query().Get("profile")
+	if remoteURL := r.URL.Query().Get("url"); remoteURL != "" && profileQueryParam == "" {
+		opts, err := s.parseSessionOptions(r.URL.Query())
+		if err == nil && opts.baseRef != "" {
+			err = errors.New("base and diff_base can't be used with url")
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !s.checkMaintenance(w) || !s.checkSessionQuota(w, s.defaultRoot) {
+			return
+		}
+		s.openRemoteProfile(w, r, remoteURL, opts)
+		return
+	}
+	if profileQueryParam == "" && s.defaultProfile != "" {
+		s.redirectDefaultProfile(w, r)
+		return
+	}
 	if profileQueryParam == "" {
-		w.Write([]byte(rootTemplate))
+		s.writeRootIndex(w, r)
 		return
 	}
-	profileQueryParam, err := url.QueryUnescape(profileQueryParam)
+	opts, err := s.parseSessionOptions(r.URL.Query())
+	if err == nil && opts.baseRef != "" && r.URL.Query().Get("offcpu") != "" {
+		err = errors.New("base and diff_base can't be used with offcpu")
+	}
 	if err != nil {
-		http.Error(w, "could not url decode query param", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	profileQueryParam = filepath.Clean(profileQueryParam) // prevent a user entering a path like ../../foo
-	pprofFilePath := filepath.Join(s.baseProfilesPath, profileQueryParam)
-	if !strings.HasSuffix(pprofFilePath, ".pb.gz") &&
-		!strings.HasSuffix(pprofFilePath, ".pb.") {
-		http.Error(w, "file extension is not allowed", http.StatusBadRequest)
+	if !s.checkMaintenance(w) {
 		return
 	}
-
-	if _, err := os.Stat(pprofFilePath); errors.Is(err, os.ErrNotExist) {
-		http.Error(w, "profile not found", http.StatusNotFound)
+	if root, _ := s.resolveRoot(r, profileQueryParam); !s.checkSessionQuota(w, root) {
+		return
+	}
+	if offCPUQueryParam := r.URL.Query().Get("offcpu"); offCPUQueryParam != "" {
+		root, profileName, p, ok := s.openProfile(w, r, profileQueryParam)
+		if !ok {
+			return
+		}
+		s.startOnOffCPUSessions(w, r, root, profileName, p, opts, offCPUQueryParam)
 		return
 	}
-
 	id := uuid.New().String()
+	if g := requestGuest(r.Context()); g != nil {
+		g.allowSession(id)
+	}
+	s.loadSessionAsync(w, r, id, profileQueryParam, opts)
+}
 
-	fetcher := func(src string, duration, timeout time.Duration) (*profile.Profile, string, error) {
-		log.Println("fetching", pprofFilePath)
-		f, err := os.Open(pprofFilePath)
+// baseSource is the source pprof fetches the base profile of a session
+// comparing profiles from.
+const baseSource = "pprofweb-base"
+
+// newSession starts the session id for the profile p of root, opened with the
+// reference profileName, and returns the path of its view.
+func (s *server) newSession(id string, root *profileRoot, profileName string, p *profile.Profile, opts *sessionOptions) (string, error) {
+	t := detectProfileType(p, profileName)
+	opts.applyProfileType(t, p)
+	if toolArgs := s.archToolArgs(p, opts.arch); toolArgs != nil {
+		opts.args = append(append([]string(nil), opts.args...), toolArgs...)
+	}
+	// before dropping frames: the heuristics look for runtime functions
+	insights := profileInsights(p, t)
+	opts.pruneFrames(p)
+	info := &sessionInfo{
+		profileName: profileName,
+		profileType: t,
+		urlDefaults: opts.urlDefaults(),
+		insights:    insights,
+		// there is no stored file to link to
+		combined: opts.unstored,
+	}
+	if opts.base != nil {
+		opts.pruneFrames(opts.base)
+		info.base, info.baseName, info.diffBase = opts.base, opts.baseRef, opts.diffBase
+		flag := "-base="
+		if opts.diffBase {
+			flag = "-diff_base="
+		}
+		opts.args = append(append([]string(nil), opts.args...), flag+baseSource)
+	}
+	if !opts.unstored {
+		info.expectedHot = s.expectedHot[profileService(root.relative(profileName))] != nil
+		m, err := readRuntimeMetrics(root.filePath(root.relative(profileName)))
 		if err != nil {
-			return nil, "", err
+			s.logger.Printf("session %s: %v", id, err)
 		}
-		defer f.Close()
-		p, err := profile.Parse(f)
+		info.runtimeMetrics = m
+	}
+	if err := s.startSession(id, root, p, info, opts.args); err != nil {
+		return "", err
+	}
+	return path.Join(pprofWebPath, id, pprofViews[opts.view]), nil
+}
+
+// openProfile resolves and parses the profile referenced by the profile
+// query parameter value ref. It writes an error response and returns false if
+// the profile can't be opened.
+func (s *server) openProfile(w http.ResponseWriter, r *http.Request, ref string) (*profileRoot, string, *profile.Profile, bool) {
+	root, profileName, p, err := s.loadProfile(r.Context(), r, ref, nil)
+	if err != nil {
+		writeLoadError(w, r, root, err)
+		return nil, "", nil, false
+	}
+	return root, profileName, p, true
+}
+
+// statusError is an error with the HTTP status code it is answered with.
+type statusError struct {
+	code int
+	msg  string
+}
+
+func (e *statusError) Error() string {
+	return e.msg
+}
+
+// writeLoadError writes the response to the error of loadProfile for root.
+func writeLoadError(w http.ResponseWriter, r *http.Request, root *profileRoot, err error) {
+	var statusErr *statusError
+	if !errors.As(err, &statusErr) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if statusErr.code == http.StatusUnauthorized {
+		requireAuth(w, r, root)
+		return
+	}
+	http.Error(w, statusErr.msg, statusErr.code)
+}
+
+// loadProfile resolves and parses the profile referenced by the profile query
+// parameter value ref of the request r, which may end with latest, contain
+// date templates, or be a glob merging the matches. ctx may outlive r.
+// progress, if not nil, receives messages about the steps. Errors are
+// *statusErrors, or the error of ctx if it is canceled; the root is returned
+// with them.
+func (s *server) loadProfile(ctx context.Context, r *http.Request, ref string, progress func(string)) (*profileRoot, string, *profile.Profile, error) {
+	ref, err := url.QueryUnescape(ref)
+	if err != nil {
+		return nil, "", nil, &statusError{http.StatusBadRequest, "could not url decode query param"}
+	}
+	root, profileName := s.resolveRoot(r, ref)
+	if !root.authorized(r) {
+		return root, "", nil, &statusError{http.StatusUnauthorized, "unauthorized"}
+	}
+	return s.loadRootProfile(ctx, root, profileName, r.URL.Query().Get("exe"), progress)
+}
+
+// locatedProfile is a stored profile found by locateProfile: the local
+// files to parse, several to merge if the reference is a glob.
+type locatedProfile struct {
+	// ref is the reference of the profile, e.g. with latest resolved.
+	ref   string
+	files []profileFile
+	// pattern is the glob the files match, if any.
+	pattern string
+}
+
+// locateProfile finds the files of the profile name of root, which the
+// caller authorized, like loadProfile and with the same errors, and makes
+// them readable at their local paths. Core dumps aren't converted.
+func (s *server) locateProfile(ctx context.Context, root *profileRoot, profileName string, progress func(string)) (locatedProfile, error) {
+	if reservedName(profileName) {
+		return locatedProfile{}, &statusError{http.StatusNotFound, "profile not found"}
+	}
+	profileName = expandDateTemplates(profileName, time.Now())
+	f, err := root.stat(profileName) // prevents a user entering a path like ../../foo
+	if errors.Is(err, os.ErrNotExist) && isLatestReference(profileName) {
+		latest, latestErr := s.resolveLatest(root, profileName)
+		if latestErr != nil {
+			s.logger.Printf("%s latest %s: %v", requestID(ctx), root.reference(profileName), latestErr)
+			return locatedProfile{}, &statusError{http.StatusNotFound, "profile not found"}
+		}
+		progress("opening " + latest)
+		profileName = latest
+		f, err = root.stat(profileName)
+	}
+	if errors.Is(err, os.ErrNotExist) && isGlobReference(profileName) {
+		return s.locateGlob(ctx, root, profileName, progress)
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return locatedProfile{}, &statusError{http.StatusNotFound, "profile not found"}
+	}
+	if err == nil && root.storage != nil {
+		progress("downloading")
+		err = root.fetch(ctx, f)
+	}
+	if err != nil {
+		s.logger.Printf("%s stat %s: %v", requestID(ctx), root.filePath(profileName), err)
+		return locatedProfile{}, &statusError{http.StatusInternalServerError, "could not read profile"}
+	}
+	located := locatedProfile{ref: root.reference(profileName), files: []profileFile{f}}
+	if s.isCoreDump(f.path) || hasAllowedExtension(f.path, s.allowedExtensions) {
+		return located, nil
+	}
+	if !s.sniffContent {
+		return locatedProfile{}, &statusError{http.StatusBadRequest, "file extension is not allowed"}
+	}
+	ok, err := sniffProfileFile(f.path)
+	if err != nil {
+		s.logger.Printf("%s sniff %s: %v", requestID(ctx), f.path, err)
+		return locatedProfile{}, &statusError{http.StatusInternalServerError, "could not read profile"}
+	}
+	if !ok {
+		return locatedProfile{}, &statusError{http.StatusBadRequest, "file is not a profile"}
+	}
+	return located, nil
+}
+
+// isCoreDump reports whether the file at path is a core dump converted with
+// --viewcore.
+func (s *server) isCoreDump(path string) bool {
+	return s.viewcore != "" && isCoreDump(path)
+}
+
+// loadRootProfile is loadProfile of the profile name of root, which the
+// caller authorized. exe is the executable of core dumps in --binaries.
+func (s *server) loadRootProfile(ctx context.Context, root *profileRoot, profileName, exe string, progress func(string)) (*profileRoot, string, *profile.Profile, error) {
+	if progress == nil {
+		progress = func(string) {}
+	}
+	located, err := s.locateProfile(ctx, root, profileName, progress)
+	if err != nil {
+		return root, "", nil, err
+	}
+	if located.pattern != "" {
+		return s.parseGlob(ctx, root, located, progress)
+	}
+	f := located.files[0]
+	if s.isCoreDump(f.path) {
+		p, err := s.convertCoreDump(ctx, f.path, exe, progress)
 		if err != nil {
-			return nil, "", err
+			return root, "", nil, err
 		}
+		return root, located.ref, p, nil
+	}
 
+	s.logger.Println("fetching", f.path)
+	start := time.Now()
+	data, err := readFileProgress(ctx, f.path, f.size, progress)
+	if ctx.Err() != nil {
+		return root, "", nil, ctx.Err()
+	}
+	if err == nil {
+		progress("parsing")
+		var p *profile.Profile
+		p, err = parseProfileData(data)
+		if err == nil {
+			s.stats.Timing("profile.parse", time.Since(start))
+			return root, located.ref, p, nil
+		}
+	}
+	s.stats.Count("profile.parse_errors", 1)
+	atomic.AddInt64(&s.counters.parseErrors, 1)
+	s.logger.Printf("%s parse %s: %v", requestID(ctx), f.path, err)
+	return root, "", nil, &statusError{http.StatusBadRequest, "could not parse profile"}
+}
+
+// convertCoreDump returns the heap profile of the core dump at path, whose
+// executable is exe in --binaries.
+func (s *server) convertCoreDump(ctx context.Context, path, exe string, progress func(string)) (*profile.Profile, error) {
+	s.logger.Println("analyzing core dump", path)
+	progress("analyzing core dump")
+	p, err := coreHeapProfile(ctx, s.sandbox, s.viewcore, s.binaries, path, exe)
+	if err != nil {
+		s.logger.Printf("%s core dump %s: %v", requestID(ctx), path, err)
+		return nil, &statusError{http.StatusBadRequest, fmt.Sprintf("could not analyze core dump: %v", err)}
+	}
+	return p, nil
+}
+
+// startSession starts a pprof web UI for p served below pprofWebPath/id.
+func (s *server) startSession(id string, root *profileRoot, p *profile.Profile, info *sessionInfo, args []string) error {
+	fetcher := func(src string, duration, timeout time.Duration) (*profile.Profile, string, error) {
+		if src == baseSource && info.base != nil {
+			return info.base, "", nil
+		}
 		return p, "", nil
 	}
+	httpServer := func(args *driver.HTTPServerArgs) error {
+		return s.startHTTP(args, root, p, info)
+	}
+	info.details = newProfileDetails(p)
+	info.args = args
+	var configure func(*driver.Options)
+	if s.driverOptions != nil {
+		configure = func(opts *driver.Options) {
+			s.driverOptions(info.profileName, opts)
+		}
+	}
+	return startPprof(id, fetcher, httpServer, args, configure, s.logger)
+}
+
+// parseProfileFile reads and parses the profile at path. Besides the formats
+// understood by pprof, it accepts text goroutine dumps, and zstd, xz, and
+// bzip2 compression.
+func parseProfileFile(path string) (*profile.Profile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseProfileData(data)
+}
+
+func parseProfileData(data []byte) (*profile.Profile, error) {
+	data, err := decompress(data)
+	if err != nil {
+		return nil, err
+	}
+	if isGoroutineDump(data) {
+		return parseGoroutineDump(bytes.NewReader(data))
+	}
+	return profile.ParseData(data)
+}
 
+// startPprof runs the pprof driver for the profile returned by fetcher and
+// passes the web UI handlers for id to httpServer. extraArgs are passed to
+// pprof in addition to the flags starting the web UI. configure customizes
+// the driver options if set, except for the ones the web UI depends on. The
+// messages of pprof are logged to logger.
+func startPprof(id string, fetcher fetcherFn, httpServer func(*driver.HTTPServerArgs) error, extraArgs []string, configure func(*driver.Options), logger *log.Logger) error {
 	// start the pprof web handler: pass -http and -no_browser so it starts the
 	// handler but does not try to launch a browser
-	// our startHTTP will do the appropriate interception
+	// httpServer will do the appropriate interception
+	args := []string{"--http=" + id + ":0", "-no_browser", "--symbolize", "none"}
+	// the profile source is passed to the fetcher; it must be last
+	args = append(append(args, extraArgs...), "")
 	flags := &pprofFlags{
-		args: []string{"--http=" + id + ":0", "-no_browser", "--symbolize", "none", ""},
+		args: args,
 	}
 	options := &driver.Options{
 		Flagset:    flags,
-		HTTPServer: s.startHTTP,
-		UI:         &fakeUI{},
-		Fetch:      fetcherFn(fetcher),
+		HTTPServer: httpServer,
+		UI:         &fakeUI{logger},
+		Fetch:      fetcher,
 	}
-	if err := driver.PProf(options); err != nil {
-		log.Printf("pprof error: %+v", err)
-		http.Error(w, "pprof error", http.StatusInternalServerError)
-		return
+	if configure != nil {
+		configure(options)
+		options.Flagset, options.HTTPServer, options.UI, options.Fetch = flags, httpServer, &fakeUI{logger}, fetcher
 	}
-
-	http.Redirect(w, r, path.Join(pprofWebPath, id), http.StatusSeeOther)
+	return driver.PProf(options)
 }
 
 // handler returns a handler that servers the pprof web UI.
@@ -195,6 +854,65 @@ func (s *server) handler() *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", s.rootHandler)
 	mux.HandleFunc(pprofWebPath, s.servePprof)
+	mux.HandleFunc("/status", s.statusHandler)
+	mux.HandleFunc("/diff", s.diffHandler)
+	mux.HandleFunc("/api/v1/profiles", s.profilesHandler)
+	mux.HandleFunc("/api/v1/profiles/bulk", s.bulkHandler)
+	mux.HandleFunc("/upload", s.formUploadHandler)
+	mux.HandleFunc("/api/v1/profiles/metrics", s.runtimeMetricsHandler)
+	mux.HandleFunc("/api/v1/profiles/events", s.profileEventsHandler)
+	mux.HandleFunc("/api/v1/trash", s.trashHandler)
+	mux.HandleFunc("/api/v1/pins", s.pinsHandler)
+	mux.HandleFunc("/pins", s.pinsPageHandler)
+	mux.HandleFunc("/api/v1/baselines", s.baselinesHandler)
+	mux.HandleFunc("/api/v1/baselines/resolve", s.resolveBaselineHandler)
+	mux.HandleFunc("/api/v1/s3-events", s.s3EventsHandler)
+	mux.HandleFunc("/api/v1/upload-urls", s.uploadURLsHandler)
+	mux.HandleFunc("/capture-snippet", s.snippetHandler)
+	mux.HandleFunc("/api/v1/uploads", s.resumableUploadsHandler)
+	mux.HandleFunc("/api/v1/uploads/", s.resumableUploadsHandler)
+	mux.HandleFunc("/profiles", s.profileBrowserHandler)
+	mux.HandleFunc("/api/v1/sessions", s.listSessionsHandler)
+	mux.HandleFunc("/api/v1/sessions/", s.endSessionHandler)
+	mux.HandleFunc("/api/v1/targets", s.targetListHandler)
+	mux.HandleFunc("/api/v1/targets/", s.targetsHandler)
+	mux.HandleFunc("/targets/", s.watchHandler)
+	mux.HandleFunc("/api/v1/diff", s.diffAPIHandler)
+	mux.HandleFunc("/api/v1/jobs", s.jobsHandler)
+	mux.HandleFunc("/api/v1/jobs/", s.jobsHandler)
+	mux.HandleFunc("/jobs", s.jobListHandler)
+	mux.HandleFunc("/api/v1/quota", s.quotaHandler)
+	mux.HandleFunc("/api/v1/announcement", s.announcementHandler)
+	mux.HandleFunc("/api/v1/top", s.topHandler)
+	mux.HandleFunc("/api/v1/insights", s.insightsHandler)
+	mux.HandleFunc("/goroutine-leaks", s.goroutineLeaksHandler)
+	mux.HandleFunc("/api/v1/goroutine-leaks", s.goroutineLeaksHandler)
+	mux.HandleFunc("/heap-growth", s.heapGrowthHandler)
+	mux.HandleFunc("/api/v1/heap-growth", s.heapGrowthHandler)
+	mux.HandleFunc("/function", s.functionHandler)
+	mux.HandleFunc("/versions", s.versionsHandler)
+	mux.HandleFunc("/bisect", s.bisectHandler)
+	mux.HandleFunc("/api/v1/versions", s.versionsHandler)
+	mux.HandleFunc("/api/v1/function", s.functionHandler)
+	mux.HandleFunc("/contention", s.contentionHandler)
+	mux.HandleFunc("/api/v1/contention", s.contentionHandler)
+	mux.HandleFunc("/expected-hot", s.expectedHotHandler)
+	mux.HandleFunc("/api/v1/expected-hot", s.expectedHotHandler)
+	mux.HandleFunc("/api/v1/callgraph", s.callGraphHandler)
+	mux.HandleFunc("/api/v1/firefox", s.firefoxHandler)
+	mux.HandleFunc("/firefox", s.firefoxHandler)
+	mux.HandleFunc("/usage", s.usageHandler)
+	mux.HandleFunc("/preferences", s.preferencesHandler)
+	mux.HandleFunc("/metrics", s.metricsHandler)
+	mux.HandleFunc("/guest/", s.guestPageHandler)
+	mux.HandleFunc("/api/v1/blobs/", s.blobsHandler)
+	mux.HandleFunc("/api/v1/validate", s.validateHandler)
+	mux.HandleFunc("/api/v1/guest-links", s.guestLinksHandler)
+	mux.HandleFunc("/api/v1/guest-links/", s.guestLinksHandler)
+	mux.HandleFunc("/api/v1/share-email", s.shareEmailHandler)
+	mux.HandleFunc("/api/v1/usage", s.usageHandler)
+	mux.HandleFunc("/local", s.localHandler)
+	mux.HandleFunc("/wasm/", s.wasmHandler)
 
 	// mux.HandleFunc("/debug/pprof/", pprof.Index)
 	// mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
@@ -204,11 +922,16 @@ func (s *server) handler() *http.ServeMux {
 	return mux
 }
 
-func main() {
+// Main runs the pprofweb command with the arguments of the process.
+func Main() {
 	a := cli.App{
 		Name:        "pprofweb",
 		Description: "",
 		Flags: []cli.Flag{
+			&cli.PathFlag{
+				Name:  "config",
+				Usage: "YAML file of flags by name, e.g. profiles: /var/lib/pprofweb; flags on the command line take precedence",
+			},
 			&cli.StringFlag{
 				Name:    "listen",
 				Aliases: []string{"l"},
@@ -218,39 +941,850 @@ func main() {
 			&cli.PathFlag{
 				Name:  "profiles",
 				Value: ".",
-				Usage: "base path containing the profiles",
+				Usage: "base path containing the profiles, or a bucket s3://bucket/prefix/",
 			},
 			&cli.DurationFlag{
 				Name:  "valid",
-				Value: time.Minute * 10,
+				Value: defaultValidDuration,
 				Usage: "The generated profile link will be valid for a specific duration. " +
 					"Is there is no activity within this duration, the profile will be unloaded so the memory could be released.",
 			},
+			&cli.DurationFlag{
+				Name:  "max-lifetime",
+				Value: defaultMaxLifetime,
+				Usage: "maximum time a profile stays loaded regardless of activity, 0 for no limit",
+			},
+			&cli.StringSliceFlag{
+				Name: "root",
+				Usage: "additional named profile root: name=path[;valid=duration][;lifetime=duration][;host=hostname][;token=secret]. " +
+					"Profiles are selected with ?profile=name/file or by requesting the root's hostname.",
+			},
+			&cli.StringFlag{
+				Name: "default-profile",
+				Usage: "profile opened by / without ?profile=, e.g. for kiosks: a profile, latest for the newest profile, " +
+					"or a directory ending with / for the newest profile in it, e.g. nightly/",
+			},
+			&cli.IntFlag{
+				Name:  "job-workers",
+				Value: defaultJobWorkers,
+				Usage: "number of merge, diff, and convert jobs of /api/v1/jobs run concurrently",
+			},
+			&cli.Int64Flag{
+				Name:  "storage-quota",
+				Usage: "bytes of profiles each root may store, unless set with the storage-quota option of --root; 0 is unlimited",
+			},
+			&cli.IntFlag{
+				Name:  "session-quota",
+				Usage: "sessions each root may have loaded at once, unless set with the session-quota option of --root; 0 is unlimited",
+			},
+			&cli.StringFlag{
+				Name:  "announcement",
+				Usage: "text shown on all pages, e.g. 'maintenance at 18:00 UTC'; admins change it with PUT /api/v1/announcement",
+			},
+			&cli.BoolFlag{
+				Name:  "maintenance",
+				Usage: "start in maintenance mode: sessions already loaded keep working, but no new ones start",
+			},
+			&cli.StringSliceFlag{
+				Name:  "extensions",
+				Value: cli.NewStringSlice(defaultProfileExtensions...),
+				Usage: "file name extensions that are accepted as profiles",
+			},
+			&cli.BoolFlag{
+				Name:  "sniff",
+				Value: true,
+				Usage: "accept files with other extensions if their content looks like a profile (gzip or profile protobuf)",
+			},
+			&cli.PathFlag{
+				Name: "binaries",
+				Usage: "search path for the binaries of profiled programs (PPROF_BINARY_PATH), " +
+					"required for the disassembly and source views",
+			},
+			&cli.StringFlag{
+				Name: "viewcore",
+				Usage: "path of golang.org/x/debug/cmd/viewcore to open Go core dumps (*.core) as heap profiles; " +
+					"?exe= names the executable in --binaries",
+			},
+			&cli.StringFlag{
+				Name:  "tools",
+				Usage: "pprof object tool paths: comma separated [toolname:]path, e.g. objdump:/usr/bin/llvm-objdump",
+			},
+			&cli.StringSliceFlag{
+				Name: "arch-tools",
+				Usage: "object tools for binaries of another architecture, e.g. arm64=/usr/aarch64-linux-gnu/bin: " +
+					"arch=[toolname:]path,... like --tools, used before --tools for profiles of the arch",
+			},
+			&cli.StringFlag{
+				Name:  "symbolize",
+				Value: "none",
+				Usage: "pprof symbolization: none, local, or remote",
+			},
+			&cli.StringFlag{
+				Name:  "source-path",
+				Usage: "search path for source files shown by the source (weblist) view",
+			},
+			&cli.StringFlag{
+				Name: "default-view",
+				Usage: "view new sessions open with: graph, top, flamegraph, peek, source, or disasm. " +
+					"By default it depends on the profile type. Links can override it with ?view=",
+			},
+			&cli.BoolFlag{
+				Name:  "tour",
+				Value: true,
+				Usage: "show a guided tour explaining flat and cum, flame graphs, and filters on the first visit of profile pages",
+			},
+			&cli.StringFlag{
+				Name:  "granularity",
+				Usage: "default granularity: functions, filefunctions, files, lines, or addresses. Links can override it with ?granularity=",
+			},
+			&cli.IntFlag{
+				Name:  "node-count",
+				Usage: "default maximum number of nodes of the graph view; 0 is pprof's default of 80. Links can override it with ?node_count=",
+			},
+			&cli.Float64Flag{
+				Name:  "node-fraction",
+				Usage: "default fraction of the total below which nodes are hidden from the graph view; 0 is pprof's default of 0.005. Links can override it with ?node_fraction=",
+			},
+			&cli.Float64Flag{
+				Name:  "edge-fraction",
+				Usage: "default fraction of the total below which edges are hidden from the graph view; 0 is pprof's default of 0.001. Links can override it with ?edge_fraction=",
+			},
+			&cli.StringFlag{
+				Name: "drop-frames",
+				Usage: "regexp of functions removed from the stacks of sessions with their callees, e.g. 'runtime\\..*'; " +
+					"samples count for the caller. Links can override it with ?drop_frames=",
+			},
+			&cli.StringFlag{
+				Name:  "keep-frames",
+				Usage: "regexp of functions matching --drop-frames that are kept. Links can override it with ?keep_frames=",
+			},
+			&cli.StringFlag{
+				Name:  "byte-units",
+				Value: "iec",
+				Usage: "default units of bytes on pprofweb's pages: iec (KiB, MiB), si (kB, MB), or bytes. Users can change it at /preferences",
+			},
+			&cli.StringFlag{
+				Name:  "time-units",
+				Value: "auto",
+				Usage: "default units of durations on pprofweb's pages: auto, ms, or s",
+			},
+			&cli.StringFlag{
+				Name:  "numbers",
+				Value: "plain",
+				Usage: "default number format on pprofweb's pages: plain or grouped (1,234,567)",
+			},
+			&cli.StringFlag{
+				Name:  "time-zone",
+				Value: "UTC",
+				Usage: "default time zone of timestamps on pprofweb's pages and in the API, e.g. Local or Europe/Berlin",
+			},
+			&cli.StringFlag{
+				Name:  "chart",
+				Value: "icicle",
+				Usage: "default chart of the stacks of sessions on their charts page: icicle or sunburst",
+			},
+			&cli.StringSliceFlag{
+				Name: "trusted-proxy",
+				Usage: "CIDR or address of a reverse proxy, e.g. an ingress controller, " +
+					"whose X-Forwarded-For and X-Real-IP headers are trusted for client addresses",
+			},
+			&cli.StringSliceFlag{
+				Name: "target",
+				Usage: "service serving net/http/pprof to capture profiles of: name=url[;root=name][;service=dir]" +
+					"[;bearer=secret][;cert=secret;key=secret][;ca=secret], secrets like vault:path#field. " +
+					"Capture with POST /api/v1/targets/name/capture?type=cpu&seconds=30",
+			},
+			&cli.StringFlag{
+				Name:  "targets-file",
+				Usage: "JSON file storing the targets added with POST /api/v1/targets or pprofweb targets add; in memory only if empty",
+			},
+			&cli.StringFlag{
+				Name: "scrape-config",
+				Usage: "Prometheus configuration file whose scrape_configs discover more targets: static_configs, " +
+					"file_sd_configs, and kubernetes_sd_configs of pods, with relabel_configs",
+			},
+			&cli.StringFlag{
+				Name:  "s3-events-bucket",
+				Usage: "copy the profiles created in this S3 bucket into the default root when notified at POST /api/v1/s3-events or by --s3-events-queue; uses the AWS credentials and region of the environment",
+			},
+			&cli.StringFlag{
+				Name:  "s3-events-queue",
+				Usage: "URL of an SQS queue receiving the event notifications of --s3-events-bucket",
+			},
+			&cli.StringSliceFlag{
+				Name: "expected-hot",
+				Usage: "functions expected in the top tables of the profiles of a service, the first directory of their name: " +
+					"service=regexp or service=@file with a regexp per line. GET /expected-hot?profile= highlights the others",
+			},
+			&cli.BoolFlag{
+				Name:  "allow-upload",
+				Usage: "accept profiles with POST /api/v1/profiles, e.g. from pprofweb push",
+			},
+			&cli.Int64Flag{
+				Name:  "max-upload-size",
+				Value: defaultMaxUploadSize,
+				Usage: "maximum size of uploaded profiles in bytes",
+			},
+			&cli.Int64Flag{
+				Name:  "max-resumable-upload-size",
+				Value: defaultMaxResumableUploadSize,
+				Usage: "maximum size of profiles and core dumps uploaded in chunks with /api/v1/uploads in bytes",
+			},
+			&cli.StringFlag{
+				Name:  "usage-file",
+				Usage: "JSON file keeping the monthly usage counts of the roots across restarts",
+			},
+			&cli.StringFlag{
+				Name:    "admin-token",
+				EnvVars: []string{"PPROFWEB_ADMIN_TOKEN"},
+				Usage:   "token protecting the admin pages, e.g. /usage; they are disabled without it",
+			},
+			&cli.DurationFlag{
+				Name:  "converter-timeout",
+				Value: defaultConverterTimeout,
+				Usage: "time limit of converters like viewcore, graphviz, and the object tools",
+			},
+			&cli.Int64Flag{
+				Name:  "converter-memory",
+				Usage: "address space limit of converters in bytes; 0 is unlimited",
+			},
+			&cli.DurationFlag{
+				Name:  "converter-cpu",
+				Usage: "CPU time limit of converters; 0 is unlimited",
+			},
+			&cli.Int64Flag{
+				Name:  "converter-max-output",
+				Value: defaultConverterMaxOutput,
+				Usage: "limit of the output of converters in bytes",
+			},
+			&cli.BoolFlag{
+				Name:  "converter-isolate",
+				Usage: "run converters in new Linux namespaces without network access",
+			},
+			&cli.StringFlag{
+				Name:  "temp-dir",
+				Value: filepath.Join(os.TempDir(), "pprofweb"),
+				Usage: "directory of the temporary files of converters, cleaned periodically",
+			},
+			&cli.PathFlag{
+				Name:  "cache-dir",
+				Value: filepath.Join(os.TempDir(), "pprofweb-cache"),
+				Usage: "directory of the profiles downloaded from roots in buckets",
+			},
+			&cli.Int64Flag{
+				Name:  "cache-max-size",
+				Value: defaultCacheMaxSize,
+				Usage: "the least recently used profiles downloaded from buckets are removed when all exceed this size in bytes",
+			},
+			&cli.DurationFlag{
+				Name:  "temp-max-age",
+				Value: defaultTempMaxAge,
+				Usage: "temporary files older than this are removed",
+			},
+			&cli.Int64Flag{
+				Name:  "temp-max-size",
+				Value: defaultTempMaxSize,
+				Usage: "the oldest temporary files are removed when all exceed this size in bytes",
+			},
+			&cli.DurationFlag{
+				Name:  "max-upload-url-duration",
+				Value: defaultMaxUploadURLDuration,
+				Usage: "maximum validity of pre-signed upload URLs created with POST /api/v1/upload-urls",
+			},
+			&cli.DurationFlag{
+				Name:  "trash-retention",
+				Value: defaultTrashRetention,
+				Usage: "how long deleted profiles are kept in the .trash directory of their root to be restored; 0 deletes them permanently",
+			},
+			&cli.DurationFlag{
+				Name:  "max-guest-link-duration",
+				Value: defaultMaxGuestLinkDuration,
+				Usage: "maximum validity of guest links created with POST /api/v1/guest-links",
+			},
+			&cli.StringFlag{
+				Name:  "ldap-url",
+				Usage: "LDAP or Active Directory server authenticating users with basic auth, e.g. ldaps://ldap.example.com",
+			},
+			&cli.BoolFlag{
+				Name:  "ldap-start-tls",
+				Usage: "use StartTLS on ldap:// connections",
+			},
+			&cli.StringFlag{
+				Name:  "ldap-bind-dn",
+				Usage: "DN of the service account searching users; anonymous if empty",
+			},
+			&cli.StringFlag{
+				Name:    "ldap-bind-password",
+				EnvVars: []string{"PPROFWEB_LDAP_BIND_PASSWORD"},
+				Usage:   "password of the service account",
+			},
+			&cli.StringFlag{
+				Name:  "ldap-user-base",
+				Usage: "base DN of the search for users, e.g. ou=people,dc=example,dc=com",
+			},
+			&cli.StringFlag{
+				Name:  "ldap-user-filter",
+				Value: "(uid=%s)",
+				Usage: "filter finding the entry of a user name (%s); (sAMAccountName=%s) for Active Directory",
+			},
+			&cli.StringFlag{
+				Name:  "ldap-group-attribute",
+				Value: "memberOf",
+				Usage: "attribute of user entries listing their groups",
+			},
+			&cli.StringSliceFlag{
+				Name:  "ldap-group-role",
+				Usage: "role of the members of a group by common name: group=viewer, group=uploader, or group=admin",
+			},
+			&cli.StringSliceFlag{
+				Name:  "user-role",
+				Usage: "role of a user overriding the role of their groups, e.g. alice=admin",
+			},
+			&cli.StringFlag{
+				Name:  "ldap-default-role",
+				Value: "viewer",
+				Usage: "role of users without a group role: viewer, uploader, admin, or none to deny them",
+			},
+			&cli.StringFlag{
+				Name:  "statsd",
+				Usage: "statsd or DogStatsD agent address host:port to send metrics to, e.g. localhost:8125",
+			},
+			&cli.StringFlag{
+				Name:  "statsd-prefix",
+				Value: "pprofweb.",
+				Usage: "prefix of the statsd metric names",
+			},
+			&cli.BoolFlag{
+				Name:  "dogstatsd",
+				Usage: "send DogStatsD tags with the metrics",
+			},
+			&cli.StringSliceFlag{
+				Name:  "statsd-tag",
+				Usage: "DogStatsD tag added to all metrics, e.g. env:prod",
+			},
+			&cli.DurationFlag{
+				Name:  "statsd-interval",
+				Value: defaultGaugeInterval,
+				Usage: "interval of sending the session, memory, and goroutine gauges",
+			},
+			&cli.PathFlag{
+				Name:  "wasm-dir",
+				Usage: "directory of pprofweb.wasm (built from ./cmd/pprofweb-wasm) and wasm_exec.js for /local, instead of the build embedded by go generate",
+			},
+			&cli.Int64Flag{
+				Name:  "wasm-max-size",
+				Value: defaultMaxLocalSize,
+				Usage: "maximum size of profiles opened in the browser with /local",
+			},
+			&cli.BoolFlag{
+				Name:  "offline",
+				Usage: "run air-gapped: disable the Firefox Profiler and restrict pages to resources of this server",
+			},
+			&cli.StringFlag{
+				Name:  "public-url",
+				Value: defaultPublicURL,
+				Usage: "URL under which users reach this server, used for links in emails, profiles opened in the Firefox Profiler, and pre-signed upload URLs",
+			},
+			&cli.StringFlag{
+				Name:  "report-schedule",
+				Usage: "cron expression (minute hour day month weekday) for emailing a summary of new profiles, e.g. '0 8 * * 1'",
+			},
+			&cli.DurationFlag{
+				Name:  "report-window",
+				Value: 7 * 24 * time.Hour,
+				Usage: "profiles modified within this duration are summarized and compared to the window before",
+			},
+			&cli.StringFlag{
+				Name:  "smtp",
+				Usage: "SMTP server address host:port for sending report emails and sharing via email",
+			},
+			&cli.StringFlag{
+				Name:  "smtp-user",
+				Usage: "SMTP user for PLAIN authentication",
+			},
+			&cli.StringFlag{
+				Name:    "smtp-password",
+				EnvVars: []string{"PPROFWEB_SMTP_PASSWORD"},
+				Usage:   "SMTP password for PLAIN authentication",
+			},
+			&cli.StringFlag{
+				Name:  "report-from",
+				Value: "pprofweb@localhost",
+				Usage: "sender address of report and share emails",
+			},
+			&cli.StringSliceFlag{
+				Name:  "report-to",
+				Usage: "recipient addresses of report emails",
+			},
+			&cli.StringSliceFlag{
+				Name:  "fetch-host",
+				Usage: "allow opening profiles from URLs of this host, host:port, or *.domain with ?url=; repeatable, none disables it",
+			},
+			&cli.DurationFlag{
+				Name:  "fetch-timeout",
+				Value: defaultFetchTimeout,
+				Usage: "time limit of fetching a profile from a URL",
+			},
+			&cli.Int64Flag{
+				Name:  "upload-max-expanded-size",
+				Value: defaultUploadMaxExpandedSize,
+				Usage: "reject compressed uploads that decompress to more bytes than this; 0 disables it",
+			},
+			&cli.Float64Flag{
+				Name:  "upload-max-ratio",
+				Value: defaultUploadMaxRatio,
+				Usage: "reject compressed uploads that decompress to more than this many times their size, beyond 16 MiB; 0 disables it",
+			},
+			&cli.DurationFlag{
+				Name:  "rescan-interval",
+				Usage: "re-scan the profile roots this often for profiles written by other systems, indexing and publishing new and changed ones; 0 disables it",
+			},
+			&cli.DurationFlag{
+				Name:  "slow-request",
+				Value: defaultSlowRequest,
+				Usage: "log requests taking longer, with their session and view, and count them in http.slow_requests; 0 disables",
+			},
+			&cli.StringFlag{
+				Name:  "audit-log",
+				Usage: "file appended with a JSON line per access grant, guest links and shares via email, and per request proxied to a target",
+			},
 		},
 		Action: func(context *cli.Context) error {
 			listenAddr := context.String("listen")
 			baseProfilesPath := context.String("profiles")
 			profileValidDuration := context.Duration("valid")
+			allowedExtensions := context.StringSlice("extensions")
+			sniffContent := context.Bool("sniff")
+
+			maxLifetime := context.Duration("max-lifetime")
+			defaultRoot := &profileRoot{path: baseProfilesPath, validDuration: profileValidDuration, maxLifetime: maxLifetime}
+			var roots []*profileRoot
+			for _, def := range context.StringSlice("root") {
+				root, err := parseProfileRoot(def, profileValidDuration, maxLifetime)
+				if err != nil {
+					return err
+				}
+				roots = append(roots, root)
+			}
+
+			targets := make(map[string]*captureTarget)
+			for _, def := range context.StringSlice("target") {
+				target, err := parseCaptureTarget(def, defaultRoot, roots, logger)
+				if err != nil {
+					return err
+				}
+				targets[target.name] = target
+			}
+			expectedHot, err := compileExpectedHot(context.StringSlice("expected-hot"))
+			if err != nil {
+				return err
+			}
+			registry := &targetRegistry{targets: make(map[string]*captureTarget)}
+			if path := context.String("targets-file"); path != "" {
+				registry, err = loadTargetRegistry(path, defaultRoot, roots, logger)
+				if err != nil {
+					return err
+				}
+			}
+			var scrape *scrapeDiscovery
+			if path := context.String("scrape-config"); path != "" {
+				scrape, err = loadScrapeConfig(path, defaultRoot, roots, logger)
+				if err != nil {
+					return err
+				}
+			}
+			var events *s3Events
+			if bucket := context.String("s3-events-bucket"); bucket != "" {
+				events, err = newS3Events(bucket, context.String("s3-events-queue"))
+				if err != nil {
+					return err
+				}
+			} else if context.String("s3-events-queue") != "" {
+				return errors.New("--s3-events-queue requires --s3-events-bucket")
+			}
+			archTools, err := parseArchTools(context.StringSlice("arch-tools"))
+			if err != nil {
+				return err
+			}
+
+			if schedule := context.String("report-schedule"); schedule != "" {
+				cron, err := parseCron(schedule)
+				if err != nil {
+					return err
+				}
+				if context.String("smtp") == "" || len(context.StringSlice("report-to")) == 0 {
+					return errors.New("--report-schedule requires --smtp and --report-to")
+				}
+				reporter := &emailReporter{
+					schedule:     cron,
+					window:       context.Duration("report-window"),
+					roots:        append([]*profileRoot{defaultRoot}, roots...),
+					extensions:   allowedExtensions,
+					publicURL:    context.String("public-url"),
+					smtpAddr:     context.String("smtp"),
+					smtpUser:     context.String("smtp-user"),
+					smtpPassword: context.String("smtp-password"),
+					from:         context.String("report-from"),
+					to:           context.StringSlice("report-to"),
+				}
+				go reporter.run()
+			}
+
+			defaultView := context.String("default-view")
+			if defaultView != "" {
+				if err := validateView(defaultView); err != nil {
+					return err
+				}
+			}
+			defaultGranularity := context.String("granularity")
+			if defaultGranularity != "" {
+				if err := validateGranularity(defaultGranularity); err != nil {
+					return err
+				}
+			}
+
+			nodeCount, nodeFraction, edgeFraction := context.Int("node-count"), context.Float64("node-fraction"), context.Float64("edge-fraction")
+			if err := validateGraphOptions(nodeCount, nodeFraction, edgeFraction); err != nil {
+				return err
+			}
+
+			dropFrames, keepFrames := context.String("drop-frames"), context.String("keep-frames")
+			if _, err := compileFrameRule(dropFrames); err != nil {
+				return fmt.Errorf("drop-frames: %w", err)
+			}
+			if _, err := compileFrameRule(keepFrames); err != nil {
+				return fmt.Errorf("keep-frames: %w", err)
+			}
+
+			prefs := *defaultPrefs
+			if err := prefs.apply(url.Values{
+				prefByteUnits: {context.String("byte-units")},
+				prefTimeUnits: {context.String("time-units")},
+				prefNumbers:   {context.String("numbers")},
+				prefTimeZone:  {context.String("time-zone")},
+				prefChart:     {context.String("chart")},
+			}); err != nil {
+				return err
+			}
+
+			trustedProxies, err := parseTrustedProxies(context.StringSlice("trusted-proxy"))
+			if err != nil {
+				return err
+			}
+			fetchHosts, err := parseFetchHosts(context.StringSlice("fetch-host"))
+			if err != nil {
+				return err
+			}
 
-			s := newServer(listenAddr, baseProfilesPath, profileValidDuration)
-			log.Printf("listen on addr %s", listenAddr)
+			var stats *statsdClient
+			if addr := context.String("statsd"); addr != "" {
+				stats, err = newStatsdClient(addr, context.String("statsd-prefix"),
+					context.StringSlice("statsd-tag"), context.Bool("dogstatsd"))
+				if err != nil {
+					return err
+				}
+				logger.Printf("sending metrics to statsd %s", addr)
+			}
+
+			temp, err := newTempDir(context.String("temp-dir"), context.Duration("temp-max-age"),
+				context.Int64("temp-max-size"), stats, logger)
+			if err != nil {
+				return fmt.Errorf("temp dir: %w", err)
+			}
+			err = openBucketRoots(append([]*profileRoot{defaultRoot}, roots...), context.String("cache-dir"),
+				context.Int64("cache-max-size"), stats, logger)
+			if err != nil {
+				return err
+			}
+
+			sb, err := newSandbox(context.Duration("converter-timeout"), context.Int64("converter-memory"),
+				context.Duration("converter-cpu"), context.Int64("converter-max-output"), context.Bool("converter-isolate"))
+			if err != nil {
+				return err
+			}
+			sb.tempDir = temp.path
+
+			executable, err := os.Executable()
+			if err != nil {
+				logger.Printf("jobs run in the server, without their cost, and pprof runs its tools unsandboxed: %v", err)
+				executable = ""
+			}
+			// pprof runs graphviz and the object tools through the sandbox via
+			// shims in front of PATH and in place of the paths of the tools
+			tools := context.String("tools")
+			if executable != "" && runtime.GOOS != "windows" {
+				shims, err := newToolShims(sb, executable)
+				if err != nil {
+					return fmt.Errorf("tool shims: %w", err)
+				}
+				os.Setenv("PATH", shims.pathDir()+string(os.PathListSeparator)+os.Getenv("PATH"))
+				if tools, err = shims.tools(tools); err != nil {
+					return fmt.Errorf("tool shims: %w", err)
+				}
+				for arch, spec := range archTools {
+					if archTools[arch], err = shims.tools(spec); err != nil {
+						return fmt.Errorf("tool shims: %w", err)
+					}
+				}
+			}
+
+			wasm := embeddedWasm()
+			if dir := context.String("wasm-dir"); dir != "" {
+				wasm = os.DirFS(dir)
+			}
+
+			var ldapAuth *ldapAuthenticator
+			if ldapURL := context.String("ldap-url"); ldapURL != "" {
+				config := ldapConfig{
+					url:            ldapURL,
+					startTLS:       context.Bool("ldap-start-tls"),
+					bindDN:         context.String("ldap-bind-dn"),
+					bindPassword:   context.String("ldap-bind-password"),
+					userBase:       context.String("ldap-user-base"),
+					userFilter:     context.String("ldap-user-filter"),
+					groupAttribute: context.String("ldap-group-attribute"),
+					groupRoles:     make(map[string]role),
+					userRoles:      make(map[string]role),
+				}
+				for _, def := range context.StringSlice("ldap-group-role") {
+					group, r, err := parseNameRole(def)
+					if err != nil {
+						return err
+					}
+					config.groupRoles[group] = r
+				}
+				for _, def := range context.StringSlice("user-role") {
+					name, r, err := parseNameRole(def)
+					if err != nil {
+						return err
+					}
+					config.userRoles[name] = r
+				}
+				config.defaultRole, err = parseRole(context.String("ldap-default-role"))
+				if err != nil {
+					return err
+				}
+				ldapAuth = newLDAPAuthenticator(config)
+				logger.Printf("authenticating users with LDAP %s", ldapURL)
+			}
+
+			usage, err := newUsageTracker(context.String("usage-file"), logger)
+			if err != nil {
+				return fmt.Errorf("usage file: %w", err)
+			}
+
+			var audit *auditLog
+			if path := context.String("audit-log"); path != "" {
+				audit, err = openAuditLog(path)
+				if err != nil {
+					return fmt.Errorf("audit log: %w", err)
+				}
+			}
+
+			// pprof looks for binaries in PPROF_BINARY_PATH
+			if binaries := context.String("binaries"); binaries != "" {
+				os.Setenv("PPROF_BINARY_PATH", binaries)
+			}
+			pprofArgs := []string{"--symbolize", context.String("symbolize")}
+			if tools != "" {
+				pprofArgs = append(pprofArgs, "--tools", tools)
+			}
+			if sourcePath := context.String("source-path"); sourcePath != "" {
+				pprofArgs = append(pprofArgs, "--source_path", sourcePath)
+			}
+
+			s := newServer(serverConfig{
+				listenAddr:             listenAddr,
+				defaultRoot:            defaultRoot,
+				roots:                  roots,
+				allowedExtensions:      allowedExtensions,
+				sniffContent:           sniffContent,
+				pprofArgs:              pprofArgs,
+				defaultView:            defaultView,
+				tour:                   context.Bool("tour"),
+				defaultGranularity:     defaultGranularity,
+				nodeCount:              nodeCount,
+				nodeFraction:           nodeFraction,
+				edgeFraction:           edgeFraction,
+				dropFrames:             dropFrames,
+				keepFrames:             keepFrames,
+				displayPrefs:           &prefs,
+				trustedProxies:         trustedProxies,
+				stats:                  stats,
+				allowUpload:            context.Bool("allow-upload"),
+				maxUploadSize:          context.Int64("max-upload-size"),
+				maxResumableUploadSize: context.Int64("max-resumable-upload-size"),
+				targets:                targets,
+				scrape:                 scrape,
+				s3Events:               events,
+				registry:               registry,
+				viewcore:               context.String("viewcore"),
+				binaries:               context.String("binaries"),
+				sandbox:                sb,
+				usage:                  usage,
+				adminToken:             context.String("admin-token"),
+				ldap:                   ldapAuth,
+				maxGuestLinkDuration:   context.Duration("max-guest-link-duration"),
+				temp:                   temp,
+				publicURL:              context.String("public-url"),
+				trashRetention:         context.Duration("trash-retention"),
+				maxUploadURLDuration:   context.Duration("max-upload-url-duration"),
+				expectedHot:            expectedHot,
+				tools:                  tools,
+				archTools:              archTools,
+				offline:                context.Bool("offline"),
+				wasm:                   wasm,
+				maxLocalSize:           context.Int64("wasm-max-size"),
+				defaultProfile:         context.String("default-profile"),
+				jobWorkers:             context.Int("job-workers"),
+				jobExecutable:          executable,
+				storageQuota:           context.Int64("storage-quota"),
+				sessionQuota:           context.Int("session-quota"),
+				smtpAddr:               context.String("smtp"),
+				smtpUser:               context.String("smtp-user"),
+				smtpPassword:           context.String("smtp-password"),
+				mailFrom:               context.String("report-from"),
+				auditLog:               audit,
+				announcement:           announcement{Text: context.String("announcement"), Maintenance: context.Bool("maintenance")},
+				slowRequest:            context.Duration("slow-request"),
+				fetchHosts:             fetchHosts,
+				fetchTimeout:           context.Duration("fetch-timeout"),
+				rescanInterval:         context.Duration("rescan-interval"),
+				sizeScreen:             sizeScreener{context.Int64("upload-max-expanded-size"), context.Float64("upload-max-ratio")},
+			})
+			var gaugeInterval time.Duration
+			if stats != nil {
+				gaugeInterval = context.Duration("statsd-interval")
+			}
+			s.start(gaugeInterval)
+			logger.Printf("listen on addr %s", listenAddr)
 			return s.Run()
 		},
+		Commands: []*cli.Command{
+			reportCommand,
+			pushCommand,
+			agentCommand,
+			gateCommand,
+			importSymbolsCommand,
+			adminCommand,
+			targetsCommand,
+			checkConfigCommand,
+			jobWorkerCommand,
+			sandboxCommand,
+		},
+		Before: loadConfigFlag,
 	}
 	if err := a.Run(os.Args); err != nil {
 		panic(err)
 	}
 }
 
-const rootTemplate = `<!doctype html>
+// writeRootIndex writes the root page: the profiles of all roots r is
+// authorized for by directory, with links opening them, so users don't need
+// to know their names. Archived profiles are left to /profiles.
+func (s *server) writeRootIndex(w http.ResponseWriter, r *http.Request) {
+	prefs, err := s.requestPrefs(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	type entry struct {
+		// Dir is set on the first profile of a directory.
+		Dir, Name, URL, Size, ModTime string
+		ref                           string
+	}
+	var entries []entry
+	for _, root := range append([]*profileRoot{s.defaultRoot}, s.roots...) {
+		if !root.authorized(r) {
+			continue
+		}
+		files, err := root.listProfiles(s.allowedExtensions)
+		if err != nil {
+			s.logger.Printf("%s list %s: %v", requestID(r.Context()), root.path, err)
+			continue
+		}
+		for _, f := range files {
+			if strings.HasPrefix(f.name, archiveDir+"/") {
+				continue
+			}
+			ref := root.reference(f.name)
+			entries = append(entries, entry{
+				Name:    path.Base(ref),
+				URL:     "/?profile=" + url.QueryEscape(ref),
+				Size:    prefs.bytes(f.size),
+				ModTime: prefs.timestamp(f.modTime),
+				ref:     ref,
+			})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		di, dj := path.Dir(entries[i].ref), path.Dir(entries[j].ref)
+		if di != dj {
+			return di < dj
+		}
+		return entries[i].ref < entries[j].ref
+	})
+	for i := range entries {
+		if dir := path.Dir(entries[i].ref); i == 0 || dir != path.Dir(entries[i-1].ref) {
+			entries[i].Dir = strings.TrimPrefix(dir+"/", "./")
+			if entries[i].Dir == "" {
+				entries[i].Dir = "/"
+			}
+		}
+	}
+	page := struct {
+		Profiles   []entry
+		UploadForm template.HTML
+	}{Profiles: entries}
+	if s.allowUpload {
+		page.UploadForm = template.HTML(uploadForm)
+	}
+	if err := rootTemplate.Execute(w, page); err != nil {
+		s.logger.Printf("%s index: %v", requestID(r.Context()), err)
+	}
+}
+
+var rootTemplate = template.Must(template.New("root").Parse(`<!doctype html>
 <html>
-<head><title>PProf Web Interface</title></head>
+<head><title>PProf Web Interface</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin: 1em 0; }
+td, th { border: 1px solid #ccc; padding: 2px 8px; text-align: left; }
+td.dir { background: #f4f4f4; font-weight: bold; }
+td.size { text-align: right; }
+</style>
+</head>
 <body>
 <h1>PProf Web Interface</h1>
-<p>View a profile by calling <a href="http://localhost:8080?profile=profile_example.pb.gz">localhost:8080?profile=your_profile_file.pb.gz</a></p>
-
+<p>Open a profile below, or with <a href="/?profile=profile_example.pb.gz">?profile=your_profile_file.pb.gz</a>.
+<a href="/profiles">Manage the stored profiles</a> or
+<a href="/capture-snippet">generate a command capturing and uploading a profile</a>.</p>
+{{.UploadForm}}
+<table>
+<tr><th>Profile</th><th>Size</th><th>Modified</th></tr>
+{{range .Profiles}}{{if .Dir}}<tr><td class="dir" colspan="3">{{.Dir}}</td></tr>
+{{end}}<tr><td><a href="{{.URL}}">{{.Name}}</a></td><td class="size">{{.Size}}</td><td>{{.ModTime}}</td></tr>
+{{else}}<tr><td colspan="3">No profiles are stored.</td></tr>
+{{end}}</table>
 </body>
 </html>
+`))
+
+// uploadForm is added to the root page if uploads are allowed: it posts a
+// profile chosen or dropped anywhere on the page to /upload.
+const uploadForm = `<form id="upload" method="post" action="/upload" enctype="multipart/form-data">
+<p>Or open a profile from your computer: <input type="file" name="file" required> <button type="submit">Upload</button>
+(or drop it on this page)</p>
+</form>
+<script>
+document.addEventListener('dragover', function(e) { e.preventDefault(); });
+document.addEventListener('drop', function(e) {
+  e.preventDefault();
+  var form = document.getElementById('upload');
+  if (e.dataTransfer.files.length) { form.file.files = e.dataTransfer.files; form.submit(); }
+});
+</script>
 `
 
 // Mostly copied from https://github.com/google/pprof/blob/master/internal/driver/flags.go
@@ -327,19 +1861,21 @@ func (p *pprofFlags) Parse(usage func()) []string {
 	return args
 }
 
-// fakeUI implements pprof's driver.UI.
-type fakeUI struct{}
+// fakeUI implements pprof's driver.UI, logging the messages of pprof.
+type fakeUI struct {
+	logger *log.Logger
+}
 
 func (*fakeUI) ReadLine(prompt string) (string, error) { return "", io.EOF }
 
-func (*fakeUI) Print(args ...interface{}) {
+func (u *fakeUI) Print(args ...interface{}) {
 	msg := fmt.Sprint(args...)
-	log.Println(msg)
+	u.logger.Println(msg)
 }
 
-func (*fakeUI) PrintErr(args ...interface{}) {
+func (u *fakeUI) PrintErr(args ...interface{}) {
 	msg := fmt.Sprint(args...)
-	log.Println(msg)
+	u.logger.Println(msg)
 }
 
 func (*fakeUI) IsTerminal() bool {
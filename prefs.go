@@ -0,0 +1,321 @@
+package pprofweb
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// prefsCookie keeps the display preferences of a browser.
+const prefsCookie = "pprofweb_prefs"
+
+// prefsCookieAge is how long browsers keep the display preferences.
+const prefsCookieAge = 365 * 24 * time.Hour
+
+// Values of the display preferences.
+var (
+	byteUnits    = []string{"iec", "si", "bytes"}
+	timeUnits    = []string{"auto", "ms", "s"}
+	numberFormat = []string{"plain", "grouped"}
+)
+
+// displayPrefs are the units, number formatting, and time zone of values and
+// timestamps shown on the pages of pprofweb. The pprof web UI has its own
+// units, set per session with ?unit=.
+type displayPrefs struct {
+	// byteUnits is iec (KiB, MiB), si (kB, MB), or bytes.
+	byteUnits string
+	// timeUnits is auto (like 1.5s or 20ms), ms, or s.
+	timeUnits string
+	// grouped separates thousands with commas.
+	grouped  bool
+	location *time.Location
+	// chart is the rendering of the chart page of sessions, see charts.
+	chart string
+}
+
+// defaultPrefs format the output of the command line tools.
+var defaultPrefs = &displayPrefs{byteUnits: "iec", timeUnits: "auto", location: time.UTC, chart: "icicle"}
+
+// The names of the preferences in query parameters and in the
+// cookie.
+const (
+	prefByteUnits = "byte_units"
+	prefTimeUnits = "time_units"
+	prefNumbers   = "numbers"
+	prefTimeZone  = "tz"
+	prefChart     = "chart"
+)
+
+// apply overrides the preferences set in values and returns an error for
+// invalid values.
+func (d *displayPrefs) apply(values url.Values) error {
+	if v := values.Get(prefByteUnits); v != "" {
+		if !contains(byteUnits, v) {
+			return fmt.Errorf("%s must be one of %s", prefByteUnits, strings.Join(byteUnits, ", "))
+		}
+		d.byteUnits = v
+	}
+	if v := values.Get(prefTimeUnits); v != "" {
+		if !contains(timeUnits, v) {
+			return fmt.Errorf("%s must be one of %s", prefTimeUnits, strings.Join(timeUnits, ", "))
+		}
+		d.timeUnits = v
+	}
+	if v := values.Get(prefNumbers); v != "" {
+		if !contains(numberFormat, v) {
+			return fmt.Errorf("%s must be one of %s", prefNumbers, strings.Join(numberFormat, ", "))
+		}
+		d.grouped = v == "grouped"
+	}
+	if v := values.Get(prefTimeZone); v != "" {
+		loc, err := time.LoadLocation(v)
+		if err != nil {
+			return fmt.Errorf("%s: %w", prefTimeZone, err)
+		}
+		d.location = loc
+	}
+	if v := values.Get(prefChart); v != "" {
+		if !contains(charts, v) {
+			return fmt.Errorf("%s must be one of %s", prefChart, strings.Join(charts, ", "))
+		}
+		d.chart = v
+	}
+	return nil
+}
+
+// values returns the preferences as they are stored in the cookie.
+func (d *displayPrefs) values() url.Values {
+	numbers := "plain"
+	if d.grouped {
+		numbers = "grouped"
+	}
+	return url.Values{
+		prefByteUnits: {d.byteUnits},
+		prefTimeUnits: {d.timeUnits},
+		prefNumbers:   {numbers},
+		prefTimeZone:  {d.location.String()},
+		prefChart:     {d.chart},
+	}
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// requestPrefs returns the display preferences of r: the deployment defaults,
+// overridden by the cookie of the browser, overridden by the query parameters.
+// Invalid preferences of the cookie are ignored; invalid query parameters are
+// returned as an error.
+func (s *server) requestPrefs(r *http.Request) (*displayPrefs, error) {
+	prefs := *s.displayPrefs
+	if c, err := r.Cookie(prefsCookie); err == nil {
+		if values, err := url.ParseQuery(c.Value); err == nil {
+			saved := prefs
+			if err := saved.apply(values); err == nil {
+				prefs = saved
+			}
+		}
+	}
+	if err := prefs.apply(r.URL.Query()); err != nil {
+		return nil, err
+	}
+	return &prefs, nil
+}
+
+// value formats a sample value in its unit.
+func (d *displayPrefs) value(v int64, unit string) string {
+	switch unit {
+	case "nanoseconds":
+		return d.duration(v)
+	case "bytes":
+		return d.bytes(v)
+	}
+	return d.number(strconv.FormatInt(v, 10))
+}
+
+// duration formats nanoseconds.
+func (d *displayPrefs) duration(v int64) string {
+	switch d.timeUnits {
+	case "ms":
+		return d.number(strconv.FormatFloat(float64(v)/1e6, 'f', 2, 64)) + "ms"
+	case "s":
+		return d.number(strconv.FormatFloat(float64(v)/1e9, 'f', 3, 64)) + "s"
+	}
+	return time.Duration(v).String()
+}
+
+// bytes formats a number of bytes.
+func (d *displayPrefs) bytes(v int64) string {
+	switch d.byteUnits {
+	case "si":
+		a := abs64(v)
+		if a < 1000 {
+			return fmt.Sprintf("%dB", v)
+		}
+		div, exp := int64(1000), 0
+		for n := a / 1000; n >= 1000; n /= 1000 {
+			div *= 1000
+			exp++
+		}
+		return fmt.Sprintf("%.1f%cB", float64(v)/float64(div), "kMGTPE"[exp])
+	case "bytes":
+		return d.number(strconv.FormatInt(v, 10)) + "B"
+	}
+	return formatBytes(v)
+}
+
+// number separates the thousands of the integer part of the formatted number
+// n if the numbers are grouped.
+func (d *displayPrefs) number(n string) string {
+	if !d.grouped {
+		return n
+	}
+	sign := ""
+	if strings.HasPrefix(n, "-") {
+		sign, n = "-", n[1:]
+	}
+	digits := len(n)
+	if i := strings.IndexByte(n, '.'); i >= 0 {
+		digits = i
+	}
+	var b strings.Builder
+	b.WriteString(sign)
+	for i := 0; i < digits; i++ {
+		if i > 0 && (digits-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteByte(n[i])
+	}
+	b.WriteString(n[digits:])
+	return b.String()
+}
+
+// change formats the change from base to head with its percentage.
+func (d *displayPrefs) change(base, head int64, unit string) string {
+	delta := head - base
+	sign := "+"
+	if delta < 0 {
+		sign = "-"
+	}
+	change := sign + d.value(abs64(delta), unit)
+	if base != 0 {
+		change += fmt.Sprintf(", %+.1f%%", 100*float64(delta)/float64(base))
+	}
+	return change
+}
+
+// timestamp formats t in the time zone of the preferences.
+func (d *displayPrefs) timestamp(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.In(d.location).Format("2006-01-02 15:04:05 MST")
+}
+
+// captureTime returns the time p was captured at, or the zero time if the
+// profile doesn't say.
+func captureTime(p *profile.Profile) time.Time {
+	if p.TimeNanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, p.TimeNanos)
+}
+
+// preferencesHandler shows the display preferences of the browser with GET
+// /preferences and saves them in a cookie with POST.
+func (s *server) preferencesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		prefs := *s.displayPrefs
+		if err := prefs.apply(r.PostForm); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     prefsCookie,
+			Value:    prefs.values().Encode(),
+			Path:     "/",
+			MaxAge:   int(prefsCookieAge / time.Second),
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+		http.Redirect(w, r, "/preferences", http.StatusSeeOther)
+		return
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	prefs, err := s.requestPrefs(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	type option struct {
+		Value    string
+		Selected bool
+	}
+	options := func(values []string, selected string) []option {
+		var opts []option
+		for _, v := range values {
+			opts = append(opts, option{v, v == selected})
+		}
+		return opts
+	}
+	current := prefs.values()
+	if err := preferencesTemplate.Execute(w, struct {
+		ByteUnits []option
+		TimeUnits []option
+		Numbers   []option
+		TimeZone  string
+		Charts    []option
+		Example   string
+		Now       string
+	}{
+		options(byteUnits, prefs.byteUnits),
+		options(timeUnits, prefs.timeUnits),
+		options(numberFormat, current.Get(prefNumbers)),
+		prefs.location.String(),
+		options(charts, prefs.chart),
+		prefs.value(1234567890, "bytes") + ", " + prefs.value(1234567890, "nanoseconds") + ", " + prefs.value(1234567, "count"),
+		prefs.timestamp(time.Now()),
+	}); err != nil {
+		s.logger.Printf("%s preferences: %v", requestID(r.Context()), err)
+	}
+}
+
+var preferencesTemplate = template.Must(template.New("preferences").Parse(`<!doctype html>
+<html>
+<head><title>pprofweb preferences</title></head>
+<body style="font-family:sans-serif">
+<h1>Display preferences</h1>
+<p>Examples: {{.Example}}; now is {{.Now}}.</p>
+<form method="post">
+<p><label>Bytes <select name="byte_units">{{range .ByteUnits}}<option{{if .Selected}} selected{{end}}>{{.Value}}</option>{{end}}</select></label></p>
+<p><label>Durations <select name="time_units">{{range .TimeUnits}}<option{{if .Selected}} selected{{end}}>{{.Value}}</option>{{end}}</select></label></p>
+<p><label>Numbers <select name="numbers">{{range .Numbers}}<option{{if .Selected}} selected{{end}}>{{.Value}}</option>{{end}}</select></label></p>
+<p><label>Time zone <input name="tz" value="{{.TimeZone}}" placeholder="UTC, Local, or e.g. Europe/Berlin"></label></p>
+<p><label>Stack chart <select name="chart">{{range .Charts}}<option{{if .Selected}} selected{{end}}>{{.Value}}</option>{{end}}</select></label></p>
+<p><input type="submit" value="Save"></p>
+</form>
+</body>
+</html>
+`))
@@ -0,0 +1,129 @@
+package pprofweb
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultUploadURLDuration is the validity of pre-signed upload URLs without
+// the expires_in query parameter.
+const defaultUploadURLDuration = time.Hour
+
+// uploadURLResponse is the JSON response of POST /api/v1/upload-urls.
+type uploadURLResponse struct {
+	// URL accepts one upload of the profile with POST until Expires.
+	URL     string    `json:"url"`
+	Profile string    `json:"profile"`
+	Expires time.Time `json:"expires"`
+}
+
+// uploadSignature returns the signature of the upload of the profile name
+// of the root rootName that expires at the unix time expires.
+func (s *server) uploadSignature(rootName, name, expires string) string {
+	mac := hmac.New(sha256.New, s.signingKey)
+	fmt.Fprintf(mac, "upload\x00%s\x00%s\x00%s", rootName, name, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validUploadSignature returns the root of r if it is an unexpired upload
+// with a valid signature, else nil. The signature covers the root the upload
+// resolves to, e.g. by the Host header, and the name of the profile, which
+// can only be stored once, like S3 pre-signed URLs with a fixed key.
+func (s *server) validUploadSignature(r *http.Request) *profileRoot {
+	if r.URL.Path != "/api/v1/profiles" || r.Method != http.MethodPost {
+		return nil
+	}
+	query := r.URL.Query()
+	sig, expires := query.Get("sig"), query.Get("expires")
+	if sig == "" || query.Get("name") == "" {
+		return nil
+	}
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().After(time.Unix(unix, 0)) {
+		return nil
+	}
+	root, name := s.resolveRoot(r, uploadRef(query))
+	want := s.uploadSignature(root.name, name, expires)
+	if !hmac.Equal([]byte(sig), []byte(want)) {
+		return nil
+	}
+	return root
+}
+
+// uploadURLsHandler mints a pre-signed URL for one upload with
+// POST /api/v1/upload-urls?name=prod/cpu.pb.gz[&expires_in=30m], so CI jobs
+// can upload without the credentials of the API. Like uploads, it requires
+// the uploader role and the root's token; name is generated if empty.
+func (s *server) uploadURLsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.allowUpload {
+		http.Error(w, "uploads are disabled", http.StatusForbidden)
+		return
+	}
+	if !s.requireRole(w, r, uploaderRole) {
+		return
+	}
+	query := r.URL.Query()
+	validity := defaultUploadURLDuration
+	if v := query.Get("expires_in"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "expires_in must be a positive duration like 30m", http.StatusBadRequest)
+			return
+		}
+		validity = d
+	}
+	if validity > s.maxUploadURLDuration {
+		http.Error(w, fmt.Sprintf("expires_in must be at most %s", s.maxUploadURLDuration), http.StatusBadRequest)
+		return
+	}
+
+	root, name := s.resolveRoot(r, uploadRef(query))
+	if !requireAuth(w, r, root) {
+		return
+	}
+	if !hasAllowedExtension(name, s.allowedExtensions) && !(s.viewcore != "" && isCoreDump(name)) {
+		http.Error(w, "file extension is not allowed", http.StatusBadRequest)
+		return
+	}
+	if reservedName(name) {
+		http.Error(w, "profiles can't be uploaded to "+trashDir+" or "+uploadsDir, http.StatusBadRequest)
+		return
+	}
+
+	resp := s.signUploadURL(r, root, name, validity)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// signUploadURL returns a pre-signed URL for one upload of the profile name
+// of root valid for validity.
+func (s *server) signUploadURL(r *http.Request, root *profileRoot, name string, validity time.Duration) uploadURLResponse {
+	expires := time.Now().Add(validity).Truncate(time.Second)
+	unix := strconv.FormatInt(expires.Unix(), 10)
+	ref := root.reference(name)
+	signed := url.Values{
+		"name":    {ref},
+		"expires": {unix},
+		"sig":     {s.uploadSignature(root.name, name, unix)},
+	}
+	s.logger.Printf("%s signed an upload URL for %s valid until %s", requestID(r.Context()), ref, expires.UTC().Format(time.RFC3339))
+	return uploadURLResponse{
+		URL:     strings.TrimSuffix(s.publicURL, "/") + "/api/v1/profiles?" + signed.Encode(),
+		Profile: ref,
+		Expires: expires,
+	}
+}
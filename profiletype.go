@@ -0,0 +1,87 @@
+package pprofweb
+
+import (
+	"path"
+	"strings"
+
+	"github.com/google/pprof/profile"
+)
+
+// profileType is the kind of a profile, e.g. a CPU or heap profile.
+type profileType string
+
+const (
+	unknownProfile      profileType = ""
+	cpuProfile          profileType = "cpu"
+	heapProfile         profileType = "heap"
+	goroutineProfile    profileType = "goroutine"
+	mutexProfile        profileType = "mutex"
+	blockProfile        profileType = "block"
+	threadcreateProfile profileType = "threadcreate"
+	// wallProfile is wall clock time, on and off CPU, e.g. from fgprof.
+	wallProfile profileType = "wall"
+)
+
+// typeDefaults are the session defaults for a profile type.
+type typeDefaults struct {
+	title       string
+	sampleIndex string
+	unit        string
+	view        string
+}
+
+var profileTypeDefaults = map[profileType]typeDefaults{
+	unknownProfile:      {title: "Profile", view: "graph"},
+	cpuProfile:          {title: "CPU profile", sampleIndex: "cpu", unit: "ms", view: "flamegraph"},
+	heapProfile:         {title: "Heap profile", sampleIndex: "inuse_space", unit: "MB", view: "flamegraph"},
+	goroutineProfile:    {title: "Goroutine profile", view: "top"},
+	mutexProfile:        {title: "Mutex profile", sampleIndex: "delay", unit: "ms", view: "top"},
+	blockProfile:        {title: "Block profile", sampleIndex: "delay", unit: "ms", view: "top"},
+	threadcreateProfile: {title: "Thread creation profile", view: "top"},
+	wallProfile:         {title: "Wall clock profile", sampleIndex: "time", unit: "ms", view: "flamegraph"},
+}
+
+// detectProfileType returns the type of p from its sample and period types.
+// Block and mutex profiles of the Go runtime have identical types, so name,
+// the file name of the profile, is used to tell them apart.
+func detectProfileType(p *profile.Profile, name string) profileType {
+	has := func(sampleType string) bool {
+		return sampleIndexByName(p, sampleType) >= 0
+	}
+	periodType := ""
+	if p.PeriodType != nil {
+		periodType = p.PeriodType.Type
+	}
+
+	switch {
+	case periodType == "cpu" || has("cpu"):
+		return cpuProfile
+	case periodType == "wallclock" || periodType == "time":
+		return wallProfile
+	case has("inuse_space") || has("alloc_space") || periodType == "space":
+		return heapProfile
+	case periodType == "goroutine" || has("goroutine") || has("goroutines"):
+		return goroutineProfile
+	case periodType == "threadcreate" || has("threadcreate"):
+		return threadcreateProfile
+	case has("contentions") || has("delay"):
+		if strings.Contains(strings.ToLower(path.Base(name)), "block") {
+			return blockProfile
+		}
+		return mutexProfile
+	}
+	return unknownProfile
+}
+
+// title returns a human readable name of the type.
+func (t profileType) title() string {
+	return profileTypeDefaults[t].title
+}
+
+// tag returns the name of the type for metrics.
+func (t profileType) tag() string {
+	if t == unknownProfile {
+		return "unknown"
+	}
+	return string(t)
+}
@@ -0,0 +1,138 @@
+package pprofweb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/urfave/cli/v2"
+)
+
+var pushCommand = &cli.Command{
+	Name:      "push",
+	Usage:     "upload a profile from stdin and print its URL",
+	UsageText: "pprofweb push --server https://pprofweb.internal [--token secret] < profile.pb.gz",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "server",
+			Required: true,
+			Usage:    "URL of the pprofweb server",
+		},
+		&cli.StringFlag{
+			Name:    "token",
+			EnvVars: []string{"PPROFWEB_TOKEN"},
+			Usage:   "token of the profile root",
+		},
+		&cli.StringFlag{
+			Name:  "root",
+			Usage: "name of the profile root to store the profile in",
+		},
+		&cli.StringFlag{
+			Name:  "name",
+			Usage: "file name of the profile in the root, e.g. api/cpu.pb.gz; generated by default",
+		},
+		&cli.StringFlag{
+			Name:  "metrics",
+			Usage: "JSON file of runtime metrics of the profiled process to attach, e.g. {\"gogc\":\"100\",\"gomaxprocs\":8}",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		var metrics []byte
+		if path := context.String("metrics"); path != "" {
+			var err error
+			if metrics, err = os.ReadFile(path); err != nil {
+				return err
+			}
+		}
+		resp, err := pushProfile(context.String("server"), context.String("token"), context.String("root"),
+			context.String("name"), os.Stdin)
+		if err != nil {
+			return err
+		}
+		if metrics != nil {
+			if err := pushRuntimeMetrics(context.String("server"), context.String("token"), resp.Profile, metrics); err != nil {
+				return err
+			}
+		}
+		fmt.Println(resp.URL)
+		return nil
+	},
+}
+
+// pushProfile uploads the profile read from body to the server at serverURL.
+// The URL of the response is absolute.
+func pushProfile(serverURL, token, root, name string, body io.Reader) (*uploadResponse, error) {
+	base, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, err
+	}
+	query := url.Values{}
+	if root != "" {
+		query.Set("root", root)
+	}
+	if name != "" {
+		query.Set("name", name)
+	}
+	uploadURL := base.ResolveReference(&url.URL{Path: "/api/v1/profiles", RawQuery: query.Encode()})
+
+	req, err := http.NewRequest(http.MethodPost, uploadURL.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	httpResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusCreated {
+		msg, _ := io.ReadAll(io.LimitReader(httpResp.Body, 4096))
+		return nil, fmt.Errorf("upload failed: %s: %s", httpResp.Status, apiErrorMessage(msg))
+	}
+
+	resp := &uploadResponse{}
+	if err := json.NewDecoder(httpResp.Body).Decode(resp); err != nil {
+		return nil, fmt.Errorf("upload response: %w", err)
+	}
+	profileURL, err := url.Parse(resp.URL)
+	if err != nil {
+		return nil, err
+	}
+	resp.URL = base.ResolveReference(profileURL).String()
+	return resp, nil
+}
+
+// pushRuntimeMetrics attaches the JSON of runtime metrics to the stored
+// profile ref of the server at serverURL.
+func pushRuntimeMetrics(serverURL, token, ref string, metrics []byte) error {
+	base, err := url.Parse(serverURL)
+	if err != nil {
+		return err
+	}
+	metricsURL := base.ResolveReference(&url.URL{Path: "/api/v1/profiles/metrics", RawQuery: url.Values{"profile": {ref}}.Encode()})
+	req, err := http.NewRequest(http.MethodPut, metricsURL.String(), bytes.NewReader(metrics))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("attaching runtime metrics failed: %s: %s", resp.Status, apiErrorMessage(msg))
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package pprofweb
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// storageCacheDuration is how long the storage of a root is cached before
+// its profiles are listed again. Uploads add to the cached value.
+const storageCacheDuration = time.Minute
+
+// quotaRetryAfter is the Retry-After of responses rejected by the session
+// quota.
+const quotaRetryAfter = time.Minute
+
+// storageCache caches the bytes of the profiles stored in each root.
+type storageCache struct {
+	mu       sync.Mutex
+	bytes    map[*profileRoot]int64
+	computed map[*profileRoot]time.Time
+}
+
+func newStorageCache() *storageCache {
+	return &storageCache{bytes: make(map[*profileRoot]int64), computed: make(map[*profileRoot]time.Time)}
+}
+
+// storageUsed returns the bytes of the profiles stored in root.
+func (s *server) storageUsed(root *profileRoot) (int64, error) {
+	c := s.storage
+	c.mu.Lock()
+	if time.Since(c.computed[root]) < storageCacheDuration {
+		defer c.mu.Unlock()
+		return c.bytes[root], nil
+	}
+	c.mu.Unlock()
+
+	files, err := root.listProfiles(s.allowedExtensions)
+	if err != nil {
+		return 0, err
+	}
+	var used int64
+	for _, f := range files {
+		used += f.size
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.bytes[root] = used
+	c.computed[root] = time.Now()
+	return used, nil
+}
+
+// storageAdded adds size bytes stored in root to its cached storage.
+func (s *server) storageAdded(root *profileRoot, size int64) {
+	s.storage.mu.Lock()
+	defer s.storage.mu.Unlock()
+	if _, ok := s.storage.computed[root]; ok {
+		s.storage.bytes[root] += size
+	}
+}
+
+// sessionsUsed returns the number of loaded sessions of root.
+func (s *server) sessionsUsed(root *profileRoot) int {
+	s.pprofHandlerMutex.RLock()
+	defer s.pprofHandlerMutex.RUnlock()
+	n := 0
+	for _, h := range s.pprofHandler {
+		if h.root == root {
+			n++
+		}
+	}
+	return n
+}
+
+// quotas returns the storage quota in bytes and the session quota of root,
+// its own or else those of the server; 0 is unlimited.
+func (s *server) quotas(root *profileRoot) (int64, int) {
+	storage, sessions := root.storageQuota, root.sessionQuota
+	if storage == 0 {
+		storage = s.storageQuota
+	}
+	if sessions == 0 {
+		sessions = s.sessionQuota
+	}
+	return storage, sessions
+}
+
+// quotaStatus is the usage and remaining quota of a tenant, a root, in
+// responses of GET /api/v1/quota.
+type quotaStatus struct {
+	Tenant       string `json:"tenant"`
+	StorageBytes int64  `json:"storage_bytes"`
+	Sessions     int    `json:"sessions"`
+	// The quotas and the remaining usage are omitted if unlimited.
+	StorageQuota      int64  `json:"storage_quota,omitempty"`
+	StorageRemaining  *int64 `json:"storage_remaining,omitempty"`
+	SessionQuota      int    `json:"session_quota,omitempty"`
+	SessionsRemaining *int   `json:"sessions_remaining,omitempty"`
+}
+
+// quotaStatus returns the usage and quota of root.
+func (s *server) quotaStatus(root *profileRoot) quotaStatus {
+	q := quotaStatus{Tenant: tenantName(root), Sessions: s.sessionsUsed(root)}
+	used, err := s.storageUsed(root)
+	if err != nil {
+		s.logger.Printf("quota: list %s: %v", root.path, err)
+	}
+	q.StorageBytes = used
+	q.StorageQuota, q.SessionQuota = s.quotas(root)
+	if q.StorageQuota > 0 {
+		remaining := q.StorageQuota - q.StorageBytes
+		if remaining < 0 {
+			remaining = 0
+		}
+		q.StorageRemaining = &remaining
+	}
+	if q.SessionQuota > 0 {
+		remaining := q.SessionQuota - q.Sessions
+		if remaining < 0 {
+			remaining = 0
+		}
+		q.SessionsRemaining = &remaining
+	}
+	return q
+}
+
+// setQuotaHeaders adds the usage and remaining quota of root to the headers
+// of w, so clients can throttle themselves before their requests are
+// rejected.
+func (s *server) setQuotaHeaders(w http.ResponseWriter, root *profileRoot) quotaStatus {
+	q := s.quotaStatus(root)
+	h := w.Header()
+	h.Set("X-Quota-Storage-Used", strconv.FormatInt(q.StorageBytes, 10))
+	h.Set("X-Quota-Sessions-Used", strconv.Itoa(q.Sessions))
+	if q.StorageRemaining != nil {
+		h.Set("X-Quota-Storage-Limit", strconv.FormatInt(q.StorageQuota, 10))
+		h.Set("X-Quota-Storage-Remaining", strconv.FormatInt(*q.StorageRemaining, 10))
+	}
+	if q.SessionsRemaining != nil {
+		h.Set("X-Quota-Sessions-Limit", strconv.Itoa(q.SessionQuota))
+		h.Set("X-Quota-Sessions-Remaining", strconv.Itoa(*q.SessionsRemaining))
+	}
+	return q
+}
+
+// checkStorageQuota writes a 507 response and returns false if storing size
+// more bytes in root exceeds its storage quota.
+func (s *server) checkStorageQuota(w http.ResponseWriter, root *profileRoot, size int64) bool {
+	q := s.setQuotaHeaders(w, root)
+	if q.StorageRemaining == nil || size <= *q.StorageRemaining {
+		return true
+	}
+	s.stats.Count("quota.storage_exceeded", 1, "tenant:"+q.Tenant)
+	httpErrorCode(w, fmt.Sprintf("storage quota of %s exceeded: %s of %s used", q.Tenant,
+		formatBytes(q.StorageBytes), formatBytes(q.StorageQuota)), "storage_quota_exceeded", http.StatusInsufficientStorage)
+	return false
+}
+
+// checkSessionQuota writes a 429 response and returns false if root has as
+// many loaded sessions as its session quota allows.
+func (s *server) checkSessionQuota(w http.ResponseWriter, root *profileRoot) bool {
+	q := s.setQuotaHeaders(w, root)
+	if q.SessionsRemaining == nil || *q.SessionsRemaining > 0 {
+		return true
+	}
+	s.stats.Count("quota.sessions_exceeded", 1, "tenant:"+q.Tenant)
+	w.Header().Set("Retry-After", strconv.Itoa(int(quotaRetryAfter/time.Second)))
+	httpErrorCode(w, fmt.Sprintf("session quota of %s exceeded: %d sessions are loaded; retry when one expires",
+		q.Tenant, q.Sessions), "session_quota_exceeded", http.StatusTooManyRequests)
+	return false
+}
+
+// quotaHandler serves GET /api/v1/quota, the usage and quota of the roots
+// the request is authorized for as JSON quotaStatus.
+func (s *server) quotaHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+	statuses := []quotaStatus{}
+	for _, root := range append([]*profileRoot{s.defaultRoot}, s.roots...) {
+		if root.authorized(r) {
+			statuses = append(statuses, s.quotaStatus(root))
+		}
+	}
+	writeJSON(w, statuses)
+}
@@ -0,0 +1,85 @@
+package pprofweb
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parseTrustedProxies parses CIDRs like 10.0.0.0/8 or single addresses of
+// reverse proxies whose forwarding headers are trusted.
+func parseTrustedProxies(defs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, def := range defs {
+		def = strings.TrimSpace(def)
+		if def == "" {
+			continue
+		}
+		if !strings.Contains(def, "/") {
+			ip := net.ParseIP(def)
+			if ip == nil {
+				return nil, fmt.Errorf("trusted proxy %q: invalid IP address", def)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(def)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q: %w", def, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func (s *server) isTrustedProxy(ip net.IP) bool {
+	for _, ipNet := range s.trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client of r. Behind trusted proxies it
+// is the right most address of X-Forwarded-For that is not a trusted proxy,
+// or X-Real-IP. Forwarding headers of other peers are ignored, since clients
+// can set them to anything.
+func (s *server) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !s.isTrustedProxy(ip) {
+		return host
+	}
+
+	// every proxy appends the address it received the request from
+	forwarded := strings.Join(r.Header.Values("X-Forwarded-For"), ",")
+	if forwarded != "" {
+		hops := strings.Split(forwarded, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := net.ParseIP(strings.TrimSpace(hops[i]))
+			if hop == nil {
+				// garbage: don't trust anything left of it
+				break
+			}
+			ip = hop
+			if !s.isTrustedProxy(hop) {
+				return hop.String()
+			}
+		}
+		// all hops are trusted proxies: the left most is the client
+		return ip.String()
+	}
+	if realIP := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); realIP != nil {
+		return realIP.String()
+	}
+	return host
+}
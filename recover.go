@@ -0,0 +1,31 @@
+package pprofweb
+
+import (
+	"net/http"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// recoverPanic returns a handler that answers requests panicking in handler
+// with an internal server error instead of dropping the connection. The
+// panic and its stack are logged with the route, e.g. the session id.
+func (s *server) recoverPanic(route string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				// used to abort the response on purpose
+				panic(err)
+			}
+			s.logger.Printf("%s panic serving %s %s: %v\n%s", requestID(r.Context()), route, r.URL, err, debug.Stack())
+			s.stats.Count("http.panics", 1, "route:"+route)
+			atomic.AddInt64(&s.counters.panics, 1)
+			// fails silently if the handler wrote the header already
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+		}()
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,117 @@
+package pprofweb
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// relabelConfig is a rule of the relabel_configs of a Prometheus scrape
+// config, with the actions replace, keep, drop, labelmap, labeldrop, and
+// labelkeep.
+type relabelConfig struct {
+	SourceLabels []string `yaml:"source_labels"`
+	Separator    *string  `yaml:"separator"`
+	Regex        *string  `yaml:"regex"`
+	TargetLabel  string   `yaml:"target_label"`
+	Replacement  *string  `yaml:"replacement"`
+	Action       string   `yaml:"action"`
+
+	regex *regexp.Regexp
+}
+
+// compile checks the rule and fills in the defaults of Prometheus.
+func (c *relabelConfig) compile() error {
+	if c.Action == "" {
+		c.Action = "replace"
+	}
+	if c.Separator == nil {
+		separator := ";"
+		c.Separator = &separator
+	}
+	if c.Replacement == nil {
+		replacement := "$1"
+		c.Replacement = &replacement
+	}
+	expr := "(.*)"
+	if c.Regex != nil {
+		expr = *c.Regex
+	}
+	// regexps of Prometheus are anchored
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return fmt.Errorf("relabel regex %q: %w", expr, err)
+	}
+	c.regex = re
+	switch c.Action {
+	case "replace":
+		if c.TargetLabel == "" {
+			return fmt.Errorf("relabel action replace requires target_label")
+		}
+	case "keep", "drop", "labelmap", "labeldrop", "labelkeep":
+	default:
+		return fmt.Errorf("unsupported relabel action %q", c.Action)
+	}
+	return nil
+}
+
+// relabel applies the rules to labels in order. It returns nil if a rule
+// drops the target.
+func relabel(labels map[string]string, rules []*relabelConfig) map[string]string {
+	for _, rule := range rules {
+		values := make([]string, len(rule.SourceLabels))
+		for i, name := range rule.SourceLabels {
+			values[i] = labels[name]
+		}
+		value := strings.Join(values, *rule.Separator)
+		switch rule.Action {
+		case "keep":
+			if !rule.regex.MatchString(value) {
+				return nil
+			}
+		case "drop":
+			if rule.regex.MatchString(value) {
+				return nil
+			}
+		case "replace":
+			match := rule.regex.FindStringSubmatchIndex(value)
+			if match == nil {
+				continue
+			}
+			target := string(rule.regex.ExpandString(nil, rule.TargetLabel, value, match))
+			replaced := string(rule.regex.ExpandString(nil, *rule.Replacement, value, match))
+			if replaced == "" {
+				delete(labels, target)
+			} else {
+				labels[target] = replaced
+			}
+		case "labelmap":
+			names := make([]string, 0, len(labels))
+			for name := range labels {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				if match := rule.regex.FindStringSubmatchIndex(name); match != nil {
+					labels[string(rule.regex.ExpandString(nil, *rule.Replacement, name, match))] = labels[name]
+				}
+			}
+		case "labeldrop", "labelkeep":
+			for name := range labels {
+				if rule.regex.MatchString(name) == (rule.Action == "labeldrop") {
+					delete(labels, name)
+				}
+			}
+		}
+	}
+	return labels
+}
+
+// invalidLabelChars are replaced by underscores in the names of labels of
+// discovered metadata, like Prometheus does.
+var invalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+func sanitizeLabelName(name string) string {
+	return invalidLabelChars.ReplaceAllString(name, "_")
+}
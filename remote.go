@@ -0,0 +1,158 @@
+package pprofweb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// parseFetchHosts checks the hosts profiles may be fetched from with ?url=:
+// host names, host:port, or *.domain for its subdomains.
+func parseFetchHosts(defs []string) ([]string, error) {
+	hosts := make([]string, 0, len(defs))
+	for _, def := range defs {
+		host := strings.ToLower(strings.TrimSpace(def))
+		if host == "" || strings.Contains(host, "/") || strings.Count(strings.TrimPrefix(host, "*."), "*") > 0 {
+			return nil, fmt.Errorf("invalid fetch host %q: expected host, host:port, or *.domain", def)
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+// fetchAllowed reports whether the URL u may be fetched from: its scheme is
+// http or https and its host matches one of hosts.
+func fetchAllowed(u *url.URL, hosts []string) bool {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+	hostname, host := strings.ToLower(u.Hostname()), strings.ToLower(u.Host)
+	for _, allowed := range hosts {
+		switch {
+		case strings.HasPrefix(allowed, "*."):
+			if strings.HasSuffix(hostname, allowed[1:]) {
+				return true
+			}
+		case strings.Contains(allowed, ":") && net.ParseIP(allowed) == nil:
+			if host == allowed {
+				return true
+			}
+		case hostname == allowed:
+			return true
+		}
+	}
+	return false
+}
+
+// errFetchDenied is returned for URLs, or redirects to them, whose host isn't
+// allowed by --fetch-host.
+var errFetchDenied = errors.New("fetching from this host is not allowed")
+
+// fetchRemoteProfile fetches the profile at rawURL, which must be allowed by
+// fetchHosts, as are the redirects it follows, within fetchTimeout and
+// maxUploadSize. Errors are *statusErrors.
+func (s *server) fetchRemoteProfile(ctx context.Context, rawURL string) ([]byte, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return nil, &statusError{http.StatusBadRequest, "invalid url"}
+	}
+	if !fetchAllowed(u, s.fetchHosts) {
+		return nil, &statusError{http.StatusForbidden, errFetchDenied.Error()}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, &statusError{http.StatusBadRequest, "invalid url"}
+	}
+	client := &http.Client{
+		Timeout: s.fetchTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			if !fetchAllowed(req.URL, s.fetchHosts) {
+				return errFetchDenied
+			}
+			return nil
+		},
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		s.stats.Count("profile.fetch_errors", 1)
+		if errors.Is(err, errFetchDenied) {
+			return nil, &statusError{http.StatusForbidden, "redirected to a host fetching from is not allowed"}
+		}
+		s.logger.Printf("%s fetch %s: %v", requestID(ctx), u.Redacted(), err)
+		return nil, &statusError{http.StatusBadGateway, fmt.Sprintf("could not fetch %s", u.Redacted())}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		s.stats.Count("profile.fetch_errors", 1)
+		return nil, &statusError{http.StatusBadGateway, fmt.Sprintf("fetching %s failed: %s", u.Redacted(), resp.Status)}
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, s.maxUploadSize+1))
+	if err != nil {
+		s.stats.Count("profile.fetch_errors", 1)
+		s.logger.Printf("%s fetch %s: %v", requestID(ctx), u.Redacted(), err)
+		return nil, &statusError{http.StatusBadGateway, fmt.Sprintf("could not fetch %s", u.Redacted())}
+	}
+	if int64(len(data)) > s.maxUploadSize {
+		return nil, &statusError{http.StatusRequestEntityTooLarge, fmt.Sprintf("profile is larger than %s", formatBytes(s.maxUploadSize))}
+	}
+	s.stats.Timing("profile.fetch", time.Since(start))
+	err = s.screen(ctx, u.Redacted(), bytes.NewReader(data), int64(len(data)))
+	if errors.Is(err, ErrRejected) {
+		return nil, &statusError{http.StatusUnprocessableEntity, err.Error()}
+	}
+	if err != nil {
+		return nil, &statusError{http.StatusServiceUnavailable, "could not screen the profile"}
+	}
+	return data, nil
+}
+
+// openRemoteProfile serves /?url=, fetching the profile at the URL and
+// opening a session for it without storing it. The session uses the
+// settings of the default root, whose token is required.
+func (s *server) openRemoteProfile(w http.ResponseWriter, r *http.Request, rawURL string, opts *sessionOptions) {
+	if len(s.fetchHosts) == 0 {
+		http.Error(w, "fetching profiles is disabled: set --fetch-host", http.StatusForbidden)
+		return
+	}
+	root := s.defaultRoot
+	if !requireAuth(w, r, root) {
+		return
+	}
+	data, err := s.fetchRemoteProfile(r.Context(), rawURL)
+	if err != nil {
+		writeLoadError(w, r, root, err)
+		return
+	}
+	p, err := parseProfileData(data)
+	if err != nil {
+		s.stats.Count("profile.parse_errors", 1)
+		http.Error(w, fmt.Sprintf("could not parse profile: %v", err), http.StatusBadRequest)
+		return
+	}
+	u, _ := url.Parse(rawURL)
+	id := uuid.New().String()
+	if g := requestGuest(r.Context()); g != nil {
+		g.allowSession(id)
+	}
+	opts.unstored = true
+	sessionPath, err := s.newSession(id, root, u.Redacted(), p, opts)
+	if err != nil {
+		s.logger.Printf("%s pprof error: %+v", requestID(r.Context()), err)
+		http.Error(w, "pprof error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, sessionPath, http.StatusSeeOther)
+}
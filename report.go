@@ -0,0 +1,195 @@
+package pprofweb
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/pprof/driver"
+	"github.com/google/pprof/profile"
+	"github.com/urfave/cli/v2"
+)
+
+var reportCommand = &cli.Command{
+	Name:  "report",
+	Usage: "generate top tables and flamegraphs for all profiles matching a glob",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "glob",
+			Required: true,
+			Usage:    "glob of the profiles to report on, e.g. 'profiles/*.pb.gz'",
+		},
+		&cli.StringFlag{
+			Name:  "format",
+			Value: "html",
+			Usage: "report format: html or json",
+		},
+		&cli.PathFlag{
+			Name:  "out",
+			Value: "reports",
+			Usage: "directory the reports are written to",
+		},
+		&cli.IntFlag{
+			Name:  "top",
+			Value: 50,
+			Usage: "number of functions in the top table of json reports, 0 for all",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		matches, err := filepath.Glob(context.String("glob"))
+		if err != nil {
+			return err
+		}
+		if len(matches) == 0 {
+			return fmt.Errorf("no profiles match %q", context.String("glob"))
+		}
+
+		var write func(out, name, profilePath string) error
+		switch format := context.String("format"); format {
+		case "html":
+			write = writeHTMLReport
+		case "json":
+			top := context.Int("top")
+			write = func(out, name, profilePath string) error {
+				return writeJSONReport(out, name, profilePath, top)
+			}
+		default:
+			return fmt.Errorf("unknown format %q", format)
+		}
+
+		out := context.String("out")
+		if err := os.MkdirAll(out, 0o755); err != nil {
+			return err
+		}
+		var entries []reportIndexEntry
+		for _, match := range matches {
+			name := reportName(match)
+			logger.Printf("report %s", match)
+			if err := write(out, name, match); err != nil {
+				return fmt.Errorf("%s: %w", match, err)
+			}
+			entries = append(entries, reportIndexEntry{Profile: match, Name: name})
+		}
+		return writeReportIndex(out, context.String("format"), entries)
+	},
+}
+
+type reportIndexEntry struct {
+	Profile string `json:"profile"`
+	Name    string `json:"name"`
+}
+
+// profileReport is the content of a json report.
+type profileReport struct {
+	Profile    string     `json:"profile"`
+	SampleType string     `json:"sample_type"`
+	Unit       string     `json:"unit"`
+	Total      int64      `json:"total"`
+	Top        []topEntry `json:"top"`
+	FlameGraph *flameNode `json:"flamegraph"`
+}
+
+// reportName returns a file name prefix for the report of the profile at path.
+func reportName(path string) string {
+	name := filepath.ToSlash(filepath.Clean(path))
+	name = strings.TrimLeft(strings.ReplaceAll(name, "../", ""), "/")
+	return strings.ReplaceAll(name, "/", "_")
+}
+
+func writeJSONReport(out, name, profilePath string, top int) error {
+	p, err := parseProfileFile(profilePath)
+	if err != nil {
+		return err
+	}
+	if len(p.SampleType) == 0 {
+		return fmt.Errorf("profile has no sample types")
+	}
+	sampleIndex := defaultSampleIndex(p)
+	table := topTable(p, sampleIndex)
+	if top > 0 && len(table) > top {
+		table = table[:top]
+	}
+	report := profileReport{
+		Profile:    profilePath,
+		SampleType: p.SampleType[sampleIndex].Type,
+		Unit:       p.SampleType[sampleIndex].Unit,
+		Total:      sampleTotal(p, sampleIndex),
+		Top:        table,
+		FlameGraph: buildFlameGraph(p, sampleIndex),
+	}
+	return writeJSONFile(filepath.Join(out, name+".json"), report)
+}
+
+// writeHTMLReport renders the top and flamegraph pages of the pprof web UI
+// for the profile without starting a server.
+func writeHTMLReport(out, name, profilePath string) error {
+	fetcher := func(src string, duration, timeout time.Duration) (*profile.Profile, string, error) {
+		p, err := parseProfileFile(profilePath)
+		return p, "", err
+	}
+	var handlers map[string]http.Handler
+	httpServer := func(args *driver.HTTPServerArgs) error {
+		handlers = args.Handlers
+		return nil
+	}
+	if err := startPprof(name, fetcher, httpServer, nil, nil, logger); err != nil {
+		return err
+	}
+
+	for _, view := range []string{"top", "flamegraph"} {
+		handler, ok := handlers["/"+view]
+		if !ok {
+			return fmt.Errorf("pprof has no %s view", view)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/"+view, nil))
+		if rec.Code != http.StatusOK {
+			return fmt.Errorf("rendering %s: %s", view, strings.TrimSpace(rec.Body.String()))
+		}
+		if err := os.WriteFile(filepath.Join(out, name+"."+view+".html"), rec.Body.Bytes(), 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeReportIndex(out, format string, entries []reportIndexEntry) error {
+	if format == "json" {
+		return writeJSONFile(filepath.Join(out, "index.json"), entries)
+	}
+	f, err := os.Create(filepath.Join(out, "index.html"))
+	if err != nil {
+		return err
+	}
+	if err := reportIndexTemplate.Execute(f, entries); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+var reportIndexTemplate = template.Must(template.New("index").Parse(`<!doctype html>
+<html>
+<head><title>PProf Reports</title></head>
+<body>
+<h1>PProf Reports</h1>
+<table>
+{{range .}}<tr><td>{{.Profile}}</td><td><a href="{{.Name}}.top.html">top</a></td><td><a href="{{.Name}}.flamegraph.html">flamegraph</a></td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
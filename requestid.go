@@ -0,0 +1,111 @@
+package pprofweb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLen limits the length of request ids accepted from clients.
+const maxRequestIDLen = 128
+
+type requestIDKey struct{}
+
+// requestID returns the id of the request of ctx, or "" outside of requests.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// validRequestID reports whether id is short and printable so it can be
+// logged and echoed safely.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// withRequestID assigns every request the id of its X-Request-ID header, or a
+// new one, returns it in the X-Request-ID response header, and appends it to
+// plain text error pages so users can report it.
+func withRequestID(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.New().String()
+		}
+		w.Header().Set(requestIDHeader, id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+
+		rw := &errorPageWriter{ResponseWriter: w, api: isAPIRequest(r)}
+		handler.ServeHTTP(rw, r)
+		switch {
+		case rw.isErrorPage && rw.api:
+			rw.writeAPIError(id)
+		case rw.isErrorPage:
+			fmt.Fprintf(w, "request id: %s\n", id)
+		}
+	})
+}
+
+// errorPageWriter detects the plain text error pages written by http.Error.
+// The errors of the API are buffered to be rewritten as JSON.
+type errorPageWriter struct {
+	http.ResponseWriter
+	api         bool
+	wroteHeader bool
+	isErrorPage bool
+	status      int
+	code        string
+	body        bytes.Buffer
+}
+
+func (e *errorPageWriter) WriteHeader(status int) {
+	if !e.wroteHeader {
+		e.wroteHeader = true
+		header := e.Header()
+		e.isErrorPage = status >= http.StatusBadRequest &&
+			strings.HasPrefix(header.Get("Content-Type"), "text/plain") &&
+			header.Get("Content-Encoding") == ""
+		e.status = status
+		e.code = header.Get(errorCodeHeader)
+		header.Del(errorCodeHeader)
+		if e.isErrorPage {
+			// the body grows
+			header.Del("Content-Length")
+			if e.api {
+				header.Set("Content-Type", "application/json")
+			}
+		}
+	}
+	e.ResponseWriter.WriteHeader(status)
+}
+
+// Flush implements http.Flusher for streaming responses.
+func (e *errorPageWriter) Flush() {
+	if f, ok := e.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (e *errorPageWriter) Write(p []byte) (int, error) {
+	if !e.wroteHeader {
+		e.WriteHeader(http.StatusOK)
+	}
+	if e.isErrorPage && e.api {
+		return e.body.Write(p)
+	}
+	return e.ResponseWriter.Write(p)
+}
@@ -0,0 +1,185 @@
+package pprofweb
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// scannedFile is the size and modification time of a file of root when it
+// was last seen, to tell if it changed.
+type scannedFile struct {
+	root    *profileRoot
+	size    int64
+	modTime time.Time
+}
+
+// storageScan is the index of the stored profiles of the periodic re-scan,
+// for roots written to by other systems without notifications.
+type storageScan struct {
+	mu sync.Mutex
+	// files are the files of all roots by path; nil until the first scan.
+	files map[string]scannedFile
+	// errs are the errors of the roots that failed the last scan, done at
+	// scanned.
+	errs    map[*profileRoot]error
+	scanned time.Time
+	// indexes are the entries of the index files of the roots as last read
+	// or written, to write them only when they change.
+	indexes map[*profileRoot]map[string]indexEntry
+}
+
+// indexed records entries as the contents of the index file of root.
+func (x *storageScan) indexed(root *profileRoot, entries map[string]indexEntry) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.indexes == nil {
+		x.indexes = make(map[*profileRoot]map[string]indexEntry)
+	}
+	x.indexes[root] = entries
+}
+
+// indexChanged reports whether entries differ from the index file of root.
+func (x *storageScan) indexChanged(root *profileRoot, entries map[string]indexEntry) bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	old, ok := x.indexes[root]
+	return !ok || !sameIndex(old, entries)
+}
+
+// seen records the file f of root, e.g. stored by an upload, so the next
+// scan doesn't publish it again.
+func (x *storageScan) seen(root *profileRoot, f profileFile) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.files != nil {
+		x.files[f.path] = scannedFile{root, f.size, f.modTime}
+	}
+}
+
+// scanTotals are the profiles of a root in the index of the last scan.
+type scanTotals struct {
+	files int
+	bytes int64
+	err   error
+}
+
+// totals returns the number and size of the indexed profiles of each root,
+// and when the roots were last scanned, zero before the first scan.
+func (x *storageScan) totals() (map[*profileRoot]scanTotals, time.Time) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	totals := make(map[*profileRoot]scanTotals)
+	for _, f := range x.files {
+		t := totals[f.root]
+		t.files++
+		t.bytes += f.size
+		totals[f.root] = t
+	}
+	for root, err := range x.errs {
+		t := totals[root]
+		t.err = err
+		totals[root] = t
+	}
+	return totals, x.scanned
+}
+
+// runRescan re-scans the roots every interval.
+func (s *server) runRescan(interval time.Duration) {
+	s.rescan()
+	for range time.Tick(interval) {
+		s.rescan()
+	}
+}
+
+// rescan lists the profiles of all roots and indexes the new and changed
+// ones by their size and modification time: it hashes them for
+// /api/v1/blobs/, detects their type and version, and publishes them to the
+// profile feed. The first scan only indexes the existing profiles. It writes
+// the index files of the roots that changed and refreshes the cached storage
+// of the roots.
+func (s *server) rescan() {
+	start := time.Now()
+	x := s.scan
+	x.mu.Lock()
+	first := x.files == nil
+	previous := make(map[string]scannedFile, len(x.files))
+	for path, f := range x.files {
+		previous[path] = f
+	}
+	x.mu.Unlock()
+
+	files := make(map[string]scannedFile, len(previous))
+	errs := make(map[*profileRoot]error)
+	discovered := 0
+	for _, root := range append([]*profileRoot{s.defaultRoot}, s.roots...) {
+		list, err := root.listProfiles(s.allowedExtensions)
+		if err != nil {
+			s.stats.Count("storage.scan_errors", 1)
+			s.logger.Printf("scan %s: %v", root.path, err)
+			errs[root] = err
+			// keep the index of the root for the next scan
+			for path, f := range previous {
+				if f.root == root {
+					files[path] = f
+				}
+			}
+			continue
+		}
+		var used int64
+		for _, f := range list {
+			used += f.size
+			files[f.path] = scannedFile{root, f.size, f.modTime}
+			if old, ok := previous[f.path]; ok && old.size == f.size && old.modTime.Equal(f.modTime) {
+				continue
+			}
+			sum := ""
+			err := root.fetch(context.Background(), f)
+			if err == nil {
+				sum, err = s.blobs.sum(f)
+			}
+			if err != nil {
+				s.logger.Printf("scan %s: %v", f.path, err)
+			}
+			if _, err := s.versions.lookup(f.path, f.modTime); err != nil {
+				s.logger.Printf("scan %s: %v", f.path, err)
+			}
+			if !first {
+				discovered++
+				s.publishProfile(root, f, sum, "scan", "")
+			}
+		}
+		if entries := s.indexEntries(root, list); x.indexChanged(root, entries) {
+			if err := root.writeIndex(entries); err != nil {
+				s.logger.Printf("scan %s: %v", root.filePath(indexFile), err)
+			} else {
+				x.indexed(root, entries)
+			}
+		}
+		s.storage.mu.Lock()
+		s.storage.bytes[root] = used
+		s.storage.computed[root] = time.Now()
+		s.storage.mu.Unlock()
+		s.stats.Gauge("storage.bytes", float64(used), "tenant:"+tenantName(root))
+	}
+
+	x.mu.Lock()
+	// keep the files stored by uploads during the scan
+	for path, f := range x.files {
+		if _, ok := previous[path]; !ok {
+			if _, ok := files[path]; !ok {
+				files[path] = f
+			}
+		}
+	}
+	x.files, x.errs, x.scanned = files, errs, start
+	x.mu.Unlock()
+
+	d := time.Since(start)
+	s.stats.Timing("storage.scan", d)
+	s.stats.Count("storage.scan_discovered", int64(discovered))
+	s.stats.Gauge("storage.files", float64(len(files)))
+	if discovered > 0 || first {
+		s.logger.Printf("scanned %d profiles in %s, %d new or changed", len(files), d.Round(time.Millisecond), discovered)
+	}
+}
@@ -0,0 +1,371 @@
+package pprofweb
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// uploadsDir is the directory of a root the data of resumable uploads is
+// written to, so completed uploads are moved into place without copying.
+const uploadsDir = ".uploads"
+
+// resumableUploadIdle is how long resumable uploads without a chunk are
+// kept.
+const resumableUploadIdle = 24 * time.Hour
+
+// resumableUpload is a profile uploaded in chunks with
+// POST /api/v1/uploads and PATCH /api/v1/uploads/<id>. The protocol follows
+// tus (https://tus.io): chunks are appended at Upload-Offset, and
+// interrupted chunks are resumed at the offset HEAD returns.
+type resumableUpload struct {
+	id   string
+	root *profileRoot
+	name string
+	// size and sum are the size and hex SHA-256 hash of the complete upload
+	// declared by the client.
+	size int64
+	sum  string
+
+	mu       sync.Mutex
+	offset   int64
+	hash     hash.Hash
+	lastUsed time.Time
+	// done is set when the upload is complete or aborted.
+	done bool
+}
+
+// dataPath returns the path the data of u is written to.
+func (u *resumableUpload) dataPath() string {
+	return u.root.filePath(path.Join(uploadsDir, u.id))
+}
+
+// resumableUploads are the unfinished resumable uploads by id. They are kept
+// in memory, so uploads can't be resumed after a restart.
+type resumableUploads struct {
+	mu      sync.Mutex
+	uploads map[string]*resumableUpload
+}
+
+func newResumableUploads() *resumableUploads {
+	return &resumableUploads{uploads: make(map[string]*resumableUpload)}
+}
+
+// add registers u and removes the uploads idle for resumableUploadIdle.
+func (x *resumableUploads) add(u *resumableUpload) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for id, upload := range x.uploads {
+		upload.mu.Lock()
+		if time.Since(upload.lastUsed) > resumableUploadIdle {
+			upload.done = true
+			os.Remove(upload.dataPath())
+			delete(x.uploads, id)
+		}
+		upload.mu.Unlock()
+	}
+	x.uploads[u.id] = u
+}
+
+func (x *resumableUploads) get(id string) *resumableUpload {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.uploads[id]
+}
+
+func (x *resumableUploads) remove(id string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	delete(x.uploads, id)
+}
+
+// resumableUploadStatus is the JSON response to creating a resumable upload.
+type resumableUploadStatus struct {
+	ID string `json:"id"`
+	// URL is the path chunks are sent to with PATCH.
+	URL     string `json:"url"`
+	Profile string `json:"profile"`
+	Offset  int64  `json:"offset"`
+	Size    int64  `json:"size"`
+}
+
+// resumableUploadsHandler creates resumable uploads with
+// POST /api/v1/uploads?name=perf/cpu.pb.gz&size=<bytes>&sha256=<hex> and
+// handles their chunks below /api/v1/uploads/<id>: HEAD returns the offset
+// to continue at, PATCH appends a chunk, and DELETE aborts the upload. name
+// and root select the profile like uploads; creating requires the uploader
+// role and the root's token.
+func (s *server) resumableUploadsHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.allowUpload {
+		http.Error(w, "uploads are disabled", http.StatusForbidden)
+		return
+	}
+	if !s.requireRole(w, r, uploaderRole) {
+		return
+	}
+	w.Header().Set("Tus-Resumable", "1.0.0")
+	id := strings.TrimPrefix(r.URL.Path, "/api/v1/uploads")
+	id = strings.TrimPrefix(id, "/")
+	if id == "" {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+			return
+		}
+		s.createResumableUpload(w, r)
+		return
+	}
+
+	u := s.resumableUploads.get(id)
+	if u == nil {
+		http.Error(w, "upload not found", http.StatusNotFound)
+		return
+	}
+	if !requireAuth(w, r, u.root) {
+		return
+	}
+	switch r.Method {
+	case http.MethodHead:
+		u.mu.Lock()
+		offset := u.offset
+		u.mu.Unlock()
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(u.size, 10))
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPatch:
+		s.appendChunk(w, r, u)
+	case http.MethodDelete:
+		u.mu.Lock()
+		u.done = true
+		os.Remove(u.dataPath())
+		u.mu.Unlock()
+		s.resumableUploads.remove(u.id)
+		s.logger.Printf("%s aborted upload %s of %s", requestID(r.Context()), u.id, u.root.filePath(u.name))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "HEAD, PATCH, DELETE")
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *server) createResumableUpload(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	size, err := strconv.ParseInt(query.Get("size"), 10, 64)
+	if err != nil || size <= 0 {
+		http.Error(w, "size must be the size of the profile in bytes", http.StatusBadRequest)
+		return
+	}
+	if size > s.maxResumableUploadSize {
+		http.Error(w, fmt.Sprintf("size must be at most %d bytes", s.maxResumableUploadSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	sum := strings.ToLower(query.Get("sha256"))
+	if !validBlobSum(sum) {
+		http.Error(w, "sha256 must be the hex SHA-256 hash of the profile", http.StatusBadRequest)
+		return
+	}
+
+	ref := query.Get("name")
+	if ref == "" {
+		ref = path.Join("uploads", time.Now().UTC().Format("2006-01-02"), uuid.New().String()+".pb.gz")
+	}
+	if rootName := query.Get("root"); rootName != "" {
+		ref = rootName + "/" + ref
+	}
+	root, name := s.resolveRoot(r, ref)
+	if !requireAuth(w, r, root) {
+		return
+	}
+	if !hasAllowedExtension(name, s.allowedExtensions) && !(s.viewcore != "" && isCoreDump(name)) {
+		http.Error(w, "file extension is not allowed", http.StatusBadRequest)
+		return
+	}
+	if reservedName(name) {
+		http.Error(w, "profiles can't be uploaded to "+trashDir+" or "+uploadsDir, http.StatusBadRequest)
+		return
+	}
+	if _, err := os.Lstat(root.filePath(name)); err == nil {
+		http.Error(w, "profile exists", http.StatusConflict)
+		return
+	}
+	if !s.checkStorageQuota(w, root, size) {
+		return
+	}
+
+	u := &resumableUpload{
+		id:       uuid.New().String(),
+		root:     root,
+		name:     path.Clean(strings.TrimPrefix(name, "/")),
+		size:     size,
+		sum:      sum,
+		hash:     sha256.New(),
+		lastUsed: time.Now(),
+	}
+	if err := createFile(u.dataPath(), func(io.Writer) error { return nil }); err != nil {
+		s.logger.Printf("%s create upload %s: %v", requestID(r.Context()), u.dataPath(), err)
+		http.Error(w, "could not create upload", http.StatusInternalServerError)
+		return
+	}
+	s.resumableUploads.add(u)
+	s.logger.Printf("%s started upload %s of %s (%s)", requestID(r.Context()), u.id, root.filePath(name), formatBytes(size))
+
+	status := resumableUploadStatus{
+		ID:      u.id,
+		URL:     "/api/v1/uploads/" + u.id,
+		Profile: root.reference(u.name),
+		Size:    size,
+	}
+	w.Header().Set("Location", status.URL)
+	w.Header().Set("Upload-Offset", "0")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(status)
+}
+
+// appendChunk appends the body of r at the Upload-Offset of the request to
+// u. Without an Upload-Checksum header, the received part of an interrupted
+// chunk is kept; with one, a chunk is only kept if it is complete and
+// matches. The last chunk stores the profile if the hash of the upload
+// matches.
+func (s *server) appendChunk(w http.ResponseWriter, r *http.Request, u *resumableUpload) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "Upload-Offset is required", http.StatusBadRequest)
+		return
+	}
+	var chunkSum []byte
+	if checksum := r.Header.Get("Upload-Checksum"); checksum != "" {
+		fields := strings.Fields(checksum)
+		if len(fields) == 2 && fields[0] == "sha256" {
+			chunkSum, err = base64.StdEncoding.DecodeString(fields[1])
+		}
+		if len(chunkSum) != sha256.Size || err != nil {
+			http.Error(w, "Upload-Checksum must be sha256 and the base64 hash of the chunk", http.StatusBadRequest)
+			return
+		}
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.done {
+		http.Error(w, "upload not found", http.StatusNotFound)
+		return
+	}
+	if offset != u.offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(u.offset, 10))
+		http.Error(w, fmt.Sprintf("Upload-Offset must be %d", u.offset), http.StatusConflict)
+		return
+	}
+	u.lastUsed = time.Now()
+
+	f, err := os.OpenFile(u.dataPath(), os.O_WRONLY, 0)
+	if err != nil {
+		s.logger.Printf("%s upload %s: %v", requestID(r.Context()), u.id, err)
+		http.Error(w, "could not write upload", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Seek(u.offset, io.SeekStart); err != nil {
+		s.logger.Printf("%s upload %s: %v", requestID(r.Context()), u.id, err)
+		http.Error(w, "could not write upload", http.StatusInternalServerError)
+		return
+	}
+	// the hash state before the chunk, to drop a chunk that doesn't match
+	// its checksum
+	state, err := u.hash.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		panic(err)
+	}
+	chunkHash := sha256.New()
+	n, copyErr := io.Copy(io.MultiWriter(f, u.hash, chunkHash), io.LimitReader(r.Body, u.size-u.offset+1))
+	var reject string
+	switch {
+	case u.offset+n > u.size:
+		reject = "chunk exceeds the size of the upload"
+	case chunkSum != nil && copyErr != nil:
+		reject = fmt.Sprintf("could not read chunk: %v", copyErr)
+	case chunkSum != nil && string(chunkHash.Sum(nil)) != string(chunkSum):
+		reject = "chunk does not match Upload-Checksum"
+	}
+	if reject != "" {
+		if err := f.Truncate(u.offset); err != nil {
+			s.logger.Printf("%s upload %s: %v", requestID(r.Context()), u.id, err)
+		}
+		if err := u.hash.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+			panic(err)
+		}
+		w.Header().Set("Upload-Offset", strconv.FormatInt(u.offset, 10))
+		http.Error(w, reject, http.StatusBadRequest)
+		return
+	}
+	u.offset += n
+	if copyErr != nil {
+		// the client resumes at the offset returned by HEAD
+		s.logger.Printf("%s upload %s interrupted at %d: %v", requestID(r.Context()), u.id, u.offset, copyErr)
+		return
+	}
+	if u.offset < u.size {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(u.offset, 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// complete
+	u.done = true
+	s.resumableUploads.remove(u.id)
+	f.Close()
+	if sum := hex.EncodeToString(u.hash.Sum(nil)); sum != u.sum {
+		os.Remove(u.dataPath())
+		s.logger.Printf("%s upload %s: hash %s does not match %s", requestID(r.Context()), u.id, sum, u.sum)
+		http.Error(w, fmt.Sprintf("SHA-256 hash of the upload is %s, not %s", sum, u.sum), http.StatusUnprocessableEntity)
+		return
+	}
+	if !s.screenFile(w, r, u.root.reference(u.name), u.dataPath()) {
+		os.Remove(u.dataPath())
+		return
+	}
+	filePath := u.root.filePath(u.name)
+	if err := os.MkdirAll(filepath.Dir(filePath), 0o755); err != nil {
+		os.Remove(u.dataPath())
+		s.logger.Printf("%s upload %s: %v", requestID(r.Context()), u.id, err)
+		http.Error(w, "could not store profile", http.StatusInternalServerError)
+		return
+	}
+	// link fails instead of replacing a profile stored meanwhile
+	if err := os.Link(u.dataPath(), filePath); err != nil {
+		os.Remove(u.dataPath())
+		if os.IsExist(err) {
+			http.Error(w, "profile exists", http.StatusConflict)
+			return
+		}
+		s.logger.Printf("%s upload %s: %v", requestID(r.Context()), u.id, err)
+		http.Error(w, "could not store profile", http.StatusInternalServerError)
+		return
+	}
+	os.Remove(u.dataPath())
+	if f, err := u.root.stat(u.name); err == nil {
+		s.blobs.add(f, u.sum)
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.offset, 10))
+	s.uploaded(w, r, u.root, u.name)
+}
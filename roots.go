@@ -0,0 +1,344 @@
+package pprofweb
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// profileRoot is a directory of profiles. Besides the default root given with
+// --profiles, named roots can be configured with --root so one process can
+// serve the profiles of several environments.
+type profileRoot struct {
+	name string
+	path string
+	// validDuration is how long a profile of this root stays loaded without activity.
+	validDuration time.Duration
+	// maxLifetime is how long a profile of this root stays loaded at most,
+	// regardless of activity. 0 is no limit.
+	maxLifetime time.Duration
+	// host selects this root if requests are made for this hostname.
+	host string
+	// token is required as bearer token or basic auth password if set.
+	token string
+	// storageQuota limits the bytes of the stored profiles and sessionQuota
+	// the loaded sessions; 0 uses the quotas of the server.
+	storageQuota int64
+	sessionQuota int
+	// storage stores the profiles of the root, its directory if nil. Roots
+	// of buckets cache their profiles in the directory path.
+	storage profileStorage
+	// logger logs the errors of the storage that don't fail its operations,
+	// the logger of the server; the package logger if nil, e.g. for the
+	// admin commands.
+	logger *log.Logger
+}
+
+// profileStorage stores the profiles of a root. Profiles are read and
+// written at their local paths, which fetch and save keep in sync with the
+// storage.
+type profileStorage interface {
+	// list returns all profiles with one of the extensions.
+	list(extensions []string) ([]profileFile, error)
+	// stat returns the profile name; the error wraps os.ErrNotExist if it
+	// doesn't exist.
+	stat(name string) (profileFile, error)
+	// fetch makes the profile f readable at f.path.
+	fetch(ctx context.Context, f profileFile) error
+	// save stores the profile name written to its local path. Unless
+	// replace is set, the error wraps os.ErrExist if it is stored already.
+	save(ctx context.Context, name string, replace bool) error
+	// discard deletes the profile f from the storage, besides its local path.
+	discard(ctx context.Context, f profileFile) error
+	// trash returns the files of the trash, named
+	// .trash/<unix nanoseconds of the deletion>/<name>.
+	trash() ([]profileFile, error)
+}
+
+// parseProfileRoot parses a root definition of the form
+// name=path[;valid=duration][;lifetime=duration][;host=hostname][;token=secret]
+// [;storage-quota=bytes][;session-quota=n].
+func parseProfileRoot(def string, defaultValid, defaultLifetime time.Duration) (*profileRoot, error) {
+	parts := strings.Split(def, ";")
+	name, rootPath := splitKeyValue(parts[0])
+	if name == "" || rootPath == "" {
+		return nil, fmt.Errorf("invalid root %q: expected name=path", def)
+	}
+	if strings.Contains(name, "/") {
+		return nil, fmt.Errorf("invalid root %q: name must not contain /", def)
+	}
+
+	root := &profileRoot{
+		name:          name,
+		path:          rootPath,
+		validDuration: defaultValid,
+		maxLifetime:   defaultLifetime,
+	}
+	for _, option := range parts[1:] {
+		key, value := splitKeyValue(option)
+		switch key {
+		case "valid":
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid root %q: %w", def, err)
+			}
+			root.validDuration = d
+		case "lifetime":
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid root %q: %w", def, err)
+			}
+			root.maxLifetime = d
+		case "host":
+			root.host = strings.ToLower(value)
+		case "token":
+			root.token = value
+		case "storage-quota":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid root %q: storage-quota must be a number of bytes", def)
+			}
+			root.storageQuota = n
+		case "session-quota":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid root %q: session-quota must be a number", def)
+			}
+			root.sessionQuota = n
+		default:
+			return nil, fmt.Errorf("invalid root %q: unknown option %q", def, key)
+		}
+	}
+	return root, nil
+}
+
+func splitKeyValue(s string) (string, string) {
+	i := strings.Index(s, "=")
+	if i < 0 {
+		return strings.TrimSpace(s), ""
+	}
+	return strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:])
+}
+
+// filePath returns the path of the profile name inside the root. name can't
+// escape the root directory.
+func (root *profileRoot) filePath(name string) string {
+	return filepath.Join(root.path, filepath.Clean("/"+name))
+}
+
+// authorized reports whether r carries the token of the root or is of a
+// logged in user, whose access authenticate limited, a guest with profiles or
+// sessions of the root, or signed for the root.
+func (root *profileRoot) authorized(r *http.Request) bool {
+	if root.token == "" || requestUser(r.Context()) != nil || signedRoot(r.Context()) == root {
+		return true
+	}
+	if g := requestGuest(r.Context()); g != nil {
+		return g.allowsRoot(root)
+	}
+	return root.authorizedToken(requestToken(r))
+}
+
+// authorizedToken reports whether token is the token of the root.
+func (root *profileRoot) authorizedToken(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(root.token)) == 1
+}
+
+// requireAuth writes a 401 response if r is not authorized for root and
+// reports whether the request may continue.
+func requireAuth(w http.ResponseWriter, r *http.Request, root *profileRoot) bool {
+	if root.authorized(r) {
+		return true
+	}
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", "pprofweb "+root.name))
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+// resolveRoot selects the root for the profile reference name. A root is
+// selected by the hostname of the request or by the first path element of
+// name; otherwise the default root is used. It returns the root and the name
+// relative to it.
+func (s *server) resolveRoot(r *http.Request, name string) (*profileRoot, string) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	for _, root := range s.roots {
+		if root.host != "" && root.host == host {
+			return root, name
+		}
+	}
+
+	trimmed := strings.TrimPrefix(name, "/")
+	if i := strings.Index(trimmed, "/"); i > 0 {
+		for _, root := range s.roots {
+			if root.name == trimmed[:i] {
+				return root, trimmed[i+1:]
+			}
+		}
+	}
+	return s.defaultRoot, name
+}
+
+// profileFile is a profile found in a root.
+type profileFile struct {
+	// name is the slash separated path relative to the root.
+	name    string
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// logf logs to the logger of the root.
+func (root *profileRoot) logf(format string, args ...interface{}) {
+	if root.logger != nil {
+		root.logger.Printf(format, args...)
+	} else {
+		logger.Printf(format, args...)
+	}
+}
+
+// files returns the storage of the profiles of the root.
+func (root *profileRoot) files() profileStorage {
+	if root.storage != nil {
+		return root.storage
+	}
+	return dirStorage{root}
+}
+
+// listProfiles returns all files below the root with one of the extensions.
+func (root *profileRoot) listProfiles(extensions []string) ([]profileFile, error) {
+	return root.files().list(extensions)
+}
+
+// stat returns the profile file name of the root.
+func (root *profileRoot) stat(name string) (profileFile, error) {
+	return root.files().stat(name)
+}
+
+// fetch makes the profile f of the root readable at f.path, e.g. by
+// downloading it from its bucket.
+func (root *profileRoot) fetch(ctx context.Context, f profileFile) error {
+	return root.files().fetch(ctx, f)
+}
+
+// dirStorage stores the profiles in the directory of the root.
+type dirStorage struct {
+	root *profileRoot
+}
+
+// list logs and skips the files and directories below the root it can't
+// read, so they don't hide the other profiles.
+func (d dirStorage) list(extensions []string) ([]profileFile, error) {
+	root := d.root
+	var files []profileFile
+	err := filepath.Walk(root.path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == root.path {
+				return err
+			}
+			root.logf("list %s: %v", path, err)
+			return nil
+		}
+		if info.IsDir() && (path == filepath.Join(root.path, trashDir) || path == filepath.Join(root.path, uploadsDir)) {
+			return filepath.SkipDir
+		}
+		if info.IsDir() || !hasAllowedExtension(info.Name(), extensions) {
+			return nil
+		}
+		rel, err := filepath.Rel(root.path, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, profileFile{
+			name:    filepath.ToSlash(rel),
+			path:    path,
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+		return nil
+	})
+	return files, err
+}
+
+func (d dirStorage) stat(name string) (profileFile, error) {
+	filePath := d.root.filePath(name)
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return profileFile{}, err
+	}
+	return profileFile{
+		name:    path.Clean(strings.TrimPrefix(name, "/")),
+		path:    filePath,
+		size:    info.Size(),
+		modTime: info.ModTime(),
+	}, nil
+}
+
+func (d dirStorage) fetch(ctx context.Context, f profileFile) error { return nil }
+
+func (d dirStorage) save(ctx context.Context, name string, replace bool) error { return nil }
+
+func (d dirStorage) discard(ctx context.Context, f profileFile) error { return nil }
+
+func (d dirStorage) trash() ([]profileFile, error) {
+	root := d.root
+	dir := root.filePath(trashDir)
+	var files []profileFile
+	err := filepath.Walk(dir, func(filePath string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && filePath == dir {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			if filePath == dir {
+				return err
+			}
+			root.logf("list %s: %v", filePath, err)
+			return nil
+		}
+		if info.IsDir() || strings.HasSuffix(filePath, runtimeMetricsSuffix) {
+			return nil
+		}
+		rel, err := filepath.Rel(root.path, filePath)
+		if err != nil {
+			return err
+		}
+		files = append(files, profileFile{
+			name:    filepath.ToSlash(rel),
+			path:    filePath,
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+		return nil
+	})
+	return files, err
+}
+
+// relative returns the name of the file of this root referenced by ref, the
+// inverse of reference.
+func (root *profileRoot) relative(ref string) string {
+	if root.name == "" {
+		return ref
+	}
+	return strings.TrimPrefix(ref, root.name+"/")
+}
+
+// reference returns the value of the profile query parameter that selects
+// the file name of this root.
+func (root *profileRoot) reference(name string) string {
+	if root.name == "" {
+		return name
+	}
+	return root.name + "/" + name
+}
@@ -0,0 +1,192 @@
+package pprofweb
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// runtimeMetricsSuffix is appended to the file name of a profile for the
+// file of its runtime metrics, e.g. cpu.pb.gz.metrics.json.
+const runtimeMetricsSuffix = ".metrics.json"
+
+// maxRuntimeMetricsSize limits the size of the JSON of runtime metrics.
+const maxRuntimeMetricsSize = 64 << 10
+
+// runtimeMetrics describe the environment of the process a profile was
+// captured from, captured alongside the profile. Unknown fields are ignored.
+type runtimeMetrics struct {
+	GoVersion string `json:"go_version,omitempty"`
+	// GOGC is the value of the environment variable or debug.SetGCPercent,
+	// e.g. 100 or off.
+	GOGC       string `json:"gogc,omitempty"`
+	GOMEMLIMIT string `json:"gomemlimit,omitempty"`
+	GOMAXPROCS int    `json:"gomaxprocs,omitempty"`
+	NumCPU     int    `json:"num_cpu,omitempty"`
+	// HeapGoal is /gc/heap/goal:bytes of runtime/metrics.
+	HeapGoal  int64 `json:"heap_goal_bytes,omitempty"`
+	HeapAlloc int64 `json:"heap_alloc_bytes,omitempty"`
+	// Goroutines is /sched/goroutines:goroutines or runtime.NumGoroutine.
+	Goroutines int `json:"goroutines,omitempty"`
+	// Uptime is the seconds the process was running.
+	Uptime int64 `json:"uptime_seconds,omitempty"`
+}
+
+// readRuntimeMetrics returns the runtime metrics of the profile file
+// filePath, or nil if it has none.
+func readRuntimeMetrics(filePath string) (*runtimeMetrics, error) {
+	data, err := os.ReadFile(filePath + runtimeMetricsSuffix)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m runtimeMetrics
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("%s%s: %w", filePath, runtimeMetricsSuffix, err)
+	}
+	return &m, nil
+}
+
+// moveRuntimeMetrics moves the runtime metrics of the profile file from with
+// the profile to to, if it has any.
+func moveRuntimeMetrics(from, to string) error {
+	err := os.Rename(from+runtimeMetricsSuffix, to+runtimeMetricsSuffix)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// removeRuntimeMetrics removes the runtime metrics of the profile file
+// filePath, if it has any.
+func removeRuntimeMetrics(filePath string) error {
+	err := os.Remove(filePath + runtimeMetricsSuffix)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// runtimeMetricsHandler attaches runtime metrics to the stored profile
+// ?profile= with PUT /api/v1/profiles/metrics and a JSON body, replacing
+// earlier ones, and returns them with GET. PUT requires the uploader role and
+// the root's token.
+func (s *server) runtimeMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPut {
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+	ref := r.URL.Query().Get("profile")
+	if ref == "" {
+		http.Error(w, "profile is required", http.StatusBadRequest)
+		return
+	}
+	root, name := s.resolveRoot(r, ref)
+	if !requireAuth(w, r, root) {
+		return
+	}
+	if reservedName(name) || !hasAllowedExtension(name, s.allowedExtensions) {
+		http.Error(w, "profile not found", http.StatusNotFound)
+		return
+	}
+	filePath := root.filePath(name)
+	if _, err := os.Stat(filePath); err != nil {
+		http.Error(w, "profile not found", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		m, err := readRuntimeMetrics(filePath)
+		if err != nil {
+			s.logger.Printf("%s runtime metrics: %v", requestID(r.Context()), err)
+			http.Error(w, "could not read runtime metrics", http.StatusInternalServerError)
+			return
+		}
+		if m == nil {
+			http.Error(w, "profile has no runtime metrics", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, m)
+		return
+	}
+
+	if !s.allowUpload {
+		http.Error(w, "uploads are disabled", http.StatusForbidden)
+		return
+	}
+	if !s.requireRole(w, r, uploaderRole) {
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRuntimeMetricsSize))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not read runtime metrics: %v", err), http.StatusRequestEntityTooLarge)
+		return
+	}
+	var m runtimeMetrics
+	if err := json.Unmarshal(data, &m); err != nil {
+		http.Error(w, fmt.Sprintf("invalid runtime metrics: %v", err), http.StatusBadRequest)
+		return
+	}
+	// store the parsed metrics: sessions show only the known fields
+	if err := os.Remove(filePath + runtimeMetricsSuffix); err != nil && !os.IsNotExist(err) {
+		s.logger.Printf("%s runtime metrics: %v", requestID(r.Context()), err)
+	}
+	if err := createFile(filePath+runtimeMetricsSuffix, func(f io.Writer) error {
+		return json.NewEncoder(f).Encode(m)
+	}); err != nil {
+		s.logger.Printf("%s runtime metrics: %v", requestID(r.Context()), err)
+		http.Error(w, "could not store runtime metrics", http.StatusInternalServerError)
+		return
+	}
+	s.logger.Printf("%s stored runtime metrics of %s", requestID(r.Context()), filePath)
+	writeJSON(w, m)
+}
+
+// runtimeMetricsPanel returns the panel of the session pages showing the
+// runtime metrics m, opened from the banner.
+func runtimeMetricsPanel(m *runtimeMetrics) string {
+	if m == nil {
+		return ""
+	}
+	var rows [][2]string
+	add := func(label, value string) {
+		if value != "" && value != "0" {
+			rows = append(rows, [2]string{label, value})
+		}
+	}
+	add("Go", m.GoVersion)
+	add("GOGC", m.GOGC)
+	add("GOMEMLIMIT", m.GOMEMLIMIT)
+	add("GOMAXPROCS", strconv.Itoa(m.GOMAXPROCS))
+	add("CPUs", strconv.Itoa(m.NumCPU))
+	if m.HeapGoal > 0 {
+		add("Heap goal", formatBytes(m.HeapGoal))
+	}
+	if m.HeapAlloc > 0 {
+		add("Heap allocated", formatBytes(m.HeapAlloc))
+	}
+	add("Goroutines", strconv.Itoa(m.Goroutines))
+	if m.Uptime > 0 {
+		add("Uptime", (time.Duration(m.Uptime) * time.Second).String())
+	}
+
+	var b strings.Builder
+	b.WriteString(`<div id="pprofweb-runtime" style="display:none;position:fixed;bottom:40px;right:8px;z-index:1000;` +
+		`background:#fff;border:1px solid #999;box-shadow:0 4px 16px rgba(0,0,0,.3);padding:8px 12px;font:13px/1.4 sans-serif">` +
+		`<b>Runtime metrics</b><table style="border-collapse:collapse;margin-top:4px">`)
+	for _, row := range rows {
+		fmt.Fprintf(&b, `<tr><td style="padding:0 12px 0 0;color:#666">%s</td><td>%s</td></tr>`,
+			html.EscapeString(row[0]), html.EscapeString(row[1]))
+	}
+	b.WriteString(`</table></div>`)
+	return b.String()
+}
@@ -0,0 +1,378 @@
+package pprofweb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	// s3EventsTimeout limits the requests to S3 and SQS, besides the long
+	// polls of SQS.
+	s3EventsTimeout = 30 * time.Second
+	// s3EventsWait is the long poll of receiving notifications from SQS.
+	s3EventsWait = 20
+	// s3EventsRetry is the pause after receiving from SQS failed.
+	s3EventsRetry = 10 * time.Second
+)
+
+// s3Events copies the profiles created in a bucket into the default root as
+// soon as S3 notifies about them, received by POST /api/v1/s3-events, e.g.
+// through an SNS subscription, or polled from an SQS queue.
+type s3Events struct {
+	bucket string
+	region string
+	// queueURL is the SQS queue receiving the notifications, if any.
+	queueURL string
+	creds    awsCredentials
+	client   *http.Client
+}
+
+// newS3Events returns the ingestion of bucket, with notifications polled from
+// queueURL unless it is empty, with the credentials and region of the
+// environment.
+func newS3Events(bucket, queueURL string) (*s3Events, error) {
+	if bucket == "" || strings.Contains(bucket, "/") {
+		return nil, fmt.Errorf("invalid bucket %q", bucket)
+	}
+	if queueURL != "" {
+		if u, err := url.Parse(queueURL); err != nil || u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf("invalid SQS queue URL %q", queueURL)
+		}
+	}
+	creds, err := awsCredentialsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	region, err := awsRegionFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return &s3Events{bucket: bucket, region: region, queueURL: queueURL, creds: creds,
+		client: &http.Client{Timeout: s3EventsTimeout + s3EventsWait*time.Second}}, nil
+}
+
+// awsEndpoint returns the endpoint of service of the environment, like
+// AWS_ENDPOINT_URL_S3 or AWS_ENDPOINT_URL of the AWS SDKs, e.g. of a local
+// emulator, or "".
+func awsEndpoint(service string) string {
+	if endpoint := os.Getenv("AWS_ENDPOINT_URL_" + strings.ToUpper(service)); endpoint != "" {
+		return strings.TrimSuffix(endpoint, "/")
+	}
+	return strings.TrimSuffix(os.Getenv("AWS_ENDPOINT_URL"), "/")
+}
+
+// s3EventNotification is the part of an S3 event notification used. The
+// test message sent when notifications are configured has no records.
+type s3EventNotification struct {
+	Records []struct {
+		EventName string `json:"eventName"`
+		S3        struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+			Object struct {
+				// Key is URL encoded.
+				Key  string `json:"key"`
+				Size int64  `json:"size"`
+			} `json:"object"`
+		} `json:"s3"`
+	} `json:"Records"`
+}
+
+// snsMessage is the envelope of notifications delivered by SNS, to HTTPS
+// subscriptions or SQS queues without raw message delivery.
+type snsMessage struct {
+	Type         string `json:"Type"`
+	Message      string `json:"Message"`
+	SubscribeURL string `json:"SubscribeURL"`
+}
+
+// s3ObjectURL returns the URL of the object key of bucket in region, or of
+// the bucket if key is empty, at the S3 endpoint of the environment if set.
+func s3ObjectURL(bucket, region, key string) (*url.URL, error) {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = awsEscape(segment)
+	}
+	u := &url.URL{Scheme: "https", Host: bucket + ".s3." + region + ".amazonaws.com", Path: "/" + key, RawPath: "/" + strings.Join(segments, "/")}
+	if endpoint := awsEndpoint("s3"); endpoint != "" {
+		// path style, which emulators and S3-compatible storage support
+		base, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid S3 endpoint: %w", err)
+		}
+		u.Scheme, u.Host = base.Scheme, base.Host
+		u.Path, u.RawPath = "/"+bucket+u.Path, "/"+awsEscape(bucket)+u.RawPath
+	}
+	return u, nil
+}
+
+// getObject downloads the object key of the bucket, at most limit bytes. The
+// error wraps os.ErrNotExist if the object doesn't exist.
+func (x *s3Events) getObject(ctx context.Context, key string, limit int64) ([]byte, error) {
+	u, err := s3ObjectURL(x.bucket, x.region, key)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	signAWSRequest(req, nil, "s3", x.region, x.creds, time.Now())
+	resp, err := x.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("get s3://%s/%s: %w", x.bucket, key, os.ErrNotExist)
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("get s3://%s/%s: %s: %s", x.bucket, key, resp.Status, bytes.TrimSpace(msg))
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("s3://%s/%s is larger than %s", x.bucket, key, formatBytes(limit))
+	}
+	return data, nil
+}
+
+// sqsCall calls the SQS action with the JSON protocol and decodes its
+// response into resp.
+func (x *s3Events) sqsCall(ctx context.Context, action string, params, resp interface{}) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	endpoint := awsEndpoint("sqs")
+	if endpoint == "" {
+		endpoint = "https://sqs." + x.region + ".amazonaws.com"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.0")
+	req.Header.Set("X-Amz-Target", "AmazonSQS."+action)
+	signAWSRequest(req, body, "sqs", x.region, x.creds, time.Now())
+	respBody, err := secretRequest(x.client, req)
+	if err != nil {
+		return fmt.Errorf("sqs %s: %w", action, err)
+	}
+	if resp == nil {
+		return nil
+	}
+	return json.Unmarshal(respBody, resp)
+}
+
+// ingestS3Notification stores the profiles created according to the S3 event
+// notification data, which may be wrapped in an SNS envelope, and returns
+// their references. Profiles stored before, e.g. by a notification delivered
+// twice, are skipped, as are objects of other buckets, deleted objects, and
+// files that aren't profiles. It fails if an object can't be downloaded, so
+// the notification can be retried.
+func (s *server) ingestS3Notification(ctx context.Context, data []byte) ([]string, error) {
+	var envelope snsMessage
+	if err := json.Unmarshal(data, &envelope); err == nil && envelope.Type == "Notification" {
+		data = []byte(envelope.Message)
+	}
+	var notification s3EventNotification
+	if err := json.Unmarshal(data, &notification); err != nil {
+		return nil, &statusError{http.StatusBadRequest, fmt.Sprintf("invalid S3 event notification: %v", err)}
+	}
+	root := s.defaultRoot
+	ingested := []string{}
+	for _, record := range notification.Records {
+		if !strings.HasPrefix(record.EventName, "ObjectCreated:") {
+			continue
+		}
+		if record.S3.Bucket.Name != s.s3Events.bucket {
+			s.logger.Printf("%s s3 event of bucket %s ignored", requestID(ctx), record.S3.Bucket.Name)
+			continue
+		}
+		// keys are encoded like query parameters, with + for spaces
+		key, err := url.QueryUnescape(record.S3.Object.Key)
+		if err != nil {
+			s.logger.Printf("%s s3 event: invalid key %q", requestID(ctx), record.S3.Object.Key)
+			continue
+		}
+		name := path.Clean(strings.TrimPrefix(key, "/"))
+		if reservedName(name) || !hasAllowedExtension(name, s.allowedExtensions) {
+			continue
+		}
+		if record.S3.Object.Size > s.maxUploadSize {
+			s.logger.Printf("%s s3://%s/%s: larger than the maximum upload size", requestID(ctx), s.s3Events.bucket, key)
+			continue
+		}
+		if _, err := root.stat(name); err == nil {
+			continue
+		}
+		object, err := s.s3Events.getObject(ctx, key, s.maxUploadSize)
+		if errors.Is(err, os.ErrNotExist) {
+			// deleted since
+			s.logger.Printf("%s %v", requestID(ctx), err)
+			continue
+		}
+		if err != nil {
+			s.stats.Count("s3_events.errors", 1)
+			return ingested, err
+		}
+		err = s.screen(ctx, "s3://"+s.s3Events.bucket+"/"+key, bytes.NewReader(object), int64(len(object)))
+		if errors.Is(err, ErrRejected) {
+			continue
+		}
+		if err != nil {
+			s.stats.Count("s3_events.errors", 1)
+			return ingested, err
+		}
+		p, err := parseProfileData(object)
+		if err != nil {
+			s.stats.Count("profile.parse_errors", 1)
+			s.logger.Printf("%s s3://%s/%s: could not parse profile: %v", requestID(ctx), s.s3Events.bucket, key, err)
+			continue
+		}
+		if err := storeProfile(root.filePath(name), p); err != nil {
+			if os.IsExist(err) {
+				continue
+			}
+			return ingested, err
+		}
+		if _, err := s.stored(root, name, ""); err != nil {
+			os.Remove(root.filePath(name))
+			if os.IsExist(err) {
+				continue
+			}
+			return ingested, err
+		}
+		s.stats.Count("profiles.s3_ingested", 1)
+		s.logger.Printf("%s ingested s3://%s/%s as %s", requestID(ctx), s.s3Events.bucket, key, root.filePath(name))
+		ingested = append(ingested, root.reference(name))
+	}
+	return ingested, nil
+}
+
+// confirmSNSSubscription confirms the SNS subscription of the message m by
+// visiting its SubscribeURL, which must be of SNS.
+func (x *s3Events) confirmSNSSubscription(ctx context.Context, m *snsMessage) error {
+	u, err := url.Parse(m.SubscribeURL)
+	if err != nil || u.Scheme != "https" || !strings.HasPrefix(u.Hostname(), "sns.") || !strings.HasSuffix(u.Hostname(), ".amazonaws.com") {
+		return fmt.Errorf("invalid SubscribeURL %q", m.SubscribeURL)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	_, err = secretRequest(x.client, req)
+	return err
+}
+
+// s3EventsHandler serves POST /api/v1/s3-events, S3 event notifications of
+// the bucket of --s3-events-bucket as JSON, wrapped by SNS or not, and stores
+// the created profiles. It confirms SNS subscriptions, which can send the
+// token of the default root with basic auth in the URL of the subscription.
+// It requires the uploader role.
+func (s *server) s3EventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.s3Events == nil {
+		http.Error(w, "S3 event ingestion is disabled: set --s3-events-bucket", http.StatusNotFound)
+		return
+	}
+	if !requireAuth(w, r, s.defaultRoot) || !s.requireRole(w, r, uploaderRole) {
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not read notification: %v", err), http.StatusRequestEntityTooLarge)
+		return
+	}
+	var envelope snsMessage
+	if err := json.Unmarshal(data, &envelope); err == nil && envelope.Type == "SubscriptionConfirmation" {
+		if err := s.s3Events.confirmSNSSubscription(r.Context(), &envelope); err != nil {
+			s.logger.Printf("%s confirm SNS subscription: %v", requestID(r.Context()), err)
+			http.Error(w, "could not confirm the subscription", http.StatusBadGateway)
+			return
+		}
+		s.logger.Printf("%s confirmed SNS subscription", requestID(r.Context()))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	ingested, err := s.ingestS3Notification(r.Context(), data)
+	if err != nil {
+		var statusErr *statusError
+		if errors.As(err, &statusErr) {
+			http.Error(w, statusErr.msg, statusErr.code)
+			return
+		}
+		s.logger.Printf("%s s3 event: %v", requestID(r.Context()), err)
+		http.Error(w, "could not ingest profiles", http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, struct {
+		Ingested []string `json:"ingested"`
+	}{ingested})
+}
+
+// runS3Events receives the notifications of the SQS queue of s3Events and
+// ingests them, deleting them from the queue unless they fail, so SQS
+// delivers them again.
+func (s *server) runS3Events() {
+	x := s.s3Events
+	for {
+		var resp struct {
+			Messages []struct {
+				Body          string `json:"Body"`
+				ReceiptHandle string `json:"ReceiptHandle"`
+			} `json:"Messages"`
+		}
+		err := x.sqsCall(context.Background(), "ReceiveMessage", map[string]interface{}{
+			"QueueUrl":            x.queueURL,
+			"MaxNumberOfMessages": 10,
+			"WaitTimeSeconds":     s3EventsWait,
+		}, &resp)
+		if err != nil {
+			s.stats.Count("s3_events.errors", 1)
+			s.logger.Printf("s3 events: %v", err)
+			time.Sleep(s3EventsRetry)
+			continue
+		}
+		for _, m := range resp.Messages {
+			ctx, cancel := context.WithTimeout(context.Background(), s3EventsTimeout)
+			_, err := s.ingestS3Notification(ctx, []byte(m.Body))
+			cancel()
+			var statusErr *statusError
+			if err != nil && !errors.As(err, &statusErr) {
+				s.logger.Printf("s3 events: %v", err)
+				continue
+			}
+			if statusErr != nil {
+				// retrying doesn't fix it
+				s.logger.Printf("s3 events: %v", err)
+			}
+			err = x.sqsCall(context.Background(), "DeleteMessage", map[string]string{
+				"QueueUrl":      x.queueURL,
+				"ReceiptHandle": m.ReceiptHandle,
+			}, nil)
+			if err != nil {
+				s.logger.Printf("s3 events: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,460 @@
+package pprofweb
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// s3StorageTimeout limits the requests to buckets, including downloading and
+// uploading profiles.
+const s3StorageTimeout = 5 * time.Minute
+
+// s3Storage stores the profiles of a root below prefix in an S3 bucket, or a
+// bucket of S3-compatible storage like MinIO with AWS_ENDPOINT_URL_S3.
+// Profiles are downloaded into the cache when they are read.
+type s3Storage struct {
+	bucket string
+	// prefix is empty or ends with a slash.
+	prefix string
+	region string
+	creds  awsCredentials
+	client *http.Client
+	// dir is the directory of the cached profiles, the path of the root.
+	dir   string
+	cache *profileCache
+}
+
+// isBucketPath reports whether the path of a root is a bucket,
+// s3://bucket/prefix/.
+func isBucketPath(rootPath string) bool {
+	return strings.HasPrefix(rootPath, "s3://")
+}
+
+// newS3Storage returns the storage of the bucket s3://bucket/prefix/ with the
+// credentials and region of the environment, cached in dir.
+func newS3Storage(rawURL, dir string, cache *profileCache) (*s3Storage, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "s3" || u.Host == "" || u.RawQuery != "" {
+		return nil, fmt.Errorf("invalid bucket %q: expected s3://bucket/prefix/", rawURL)
+	}
+	prefix := strings.Trim(path.Clean("/"+u.Path), "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	creds, err := awsCredentialsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	region, err := awsRegionFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return &s3Storage{bucket: u.Host, prefix: prefix, region: region, creds: creds,
+		client: &http.Client{Timeout: s3StorageTimeout}, dir: dir, cache: cache}, nil
+}
+
+// openBucketRoots sets up the storage of the roots whose path is a bucket,
+// caching their profiles in cacheDir up to cacheSize bytes in total. The
+// path of these roots becomes their directory in the cache.
+func openBucketRoots(roots []*profileRoot, cacheDir string, cacheSize int64, stats Metrics, logger *log.Logger) error {
+	var cache *profileCache
+	for _, root := range roots {
+		if !isBucketPath(root.path) {
+			continue
+		}
+		if cache == nil {
+			cache = newProfileCache(cacheSize, stats, logger)
+		}
+		b, err := newS3Storage(root.path, "", cache)
+		if err != nil {
+			return err
+		}
+		b.dir = filepath.Join(cacheDir, b.bucket, filepath.FromSlash(b.prefix))
+		if err := os.MkdirAll(b.dir, 0o755); err != nil {
+			return err
+		}
+		cache.addDir(b.dir)
+		root.storage, root.path = b, b.dir
+	}
+	if cache != nil {
+		cache.mu.Lock()
+		cache.evict("")
+		cache.mu.Unlock()
+	}
+	return nil
+}
+
+// url returns the s3:// URL of the object key, for errors.
+func (b *s3Storage) url(key string) string {
+	return "s3://" + b.bucket + "/" + key
+}
+
+// localPath returns the path of the cached profile name.
+func (b *s3Storage) localPath(name string) string {
+	return filepath.Join(b.dir, filepath.Clean("/"+name))
+}
+
+// do sends the signed request method for the object key, or the bucket if
+// key is empty. The error wraps os.ErrNotExist if the object doesn't exist,
+// and os.ErrExist if a precondition of creating it failed.
+func (b *s3Storage) do(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u, err := s3ObjectURL(b.bucket, b.region, key)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = query.Encode()
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), reader)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	signAWSRequest(req, body, "s3", b.region, b.creds, time.Now())
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	op := strings.ToLower(method)
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		resp.Body.Close()
+		return nil, &os.PathError{Op: op, Path: b.url(key), Err: os.ErrNotExist}
+	case resp.StatusCode == http.StatusPreconditionFailed:
+		resp.Body.Close()
+		return nil, &os.PathError{Op: op, Path: b.url(key), Err: os.ErrExist}
+	case resp.StatusCode/100 != 2:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s: %s", op, b.url(key), resp.Status, bytes.TrimSpace(msg))
+	}
+	return resp, nil
+}
+
+// s3ListResult is the part of the response of ListObjectsV2 used.
+type s3ListResult struct {
+	Contents []struct {
+		Key          string
+		LastModified time.Time
+		Size         int64
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (b *s3Storage) list(extensions []string) ([]profileFile, error) {
+	var files []profileFile
+	err := b.listPrefix(b.prefix, func(name string, f profileFile) {
+		if strings.HasSuffix(name, "/") || reservedName(name) || !hasAllowedExtension(path.Base(name), extensions) {
+			return
+		}
+		files = append(files, f)
+	})
+	return files, err
+}
+
+func (b *s3Storage) trash() ([]profileFile, error) {
+	var files []profileFile
+	err := b.listPrefix(b.prefix+trashDir+"/", func(name string, f profileFile) {
+		if !strings.HasSuffix(name, "/") {
+			files = append(files, f)
+		}
+	})
+	return files, err
+}
+
+// listPrefix calls add with the name relative to the root and the file of
+// the objects whose key starts with prefix.
+func (b *s3Storage) listPrefix(prefix string, add func(name string, f profileFile)) error {
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	for {
+		resp, err := b.do(context.Background(), http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("list %s: %w", b.url(prefix), err)
+		}
+		for _, object := range result.Contents {
+			name := strings.TrimPrefix(object.Key, b.prefix)
+			if name == "" {
+				continue
+			}
+			add(name, profileFile{
+				name:    name,
+				path:    b.localPath(name),
+				size:    object.Size,
+				modTime: object.LastModified.Truncate(time.Second),
+			})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+func (b *s3Storage) stat(name string) (profileFile, error) {
+	name = path.Clean("/" + name)[1:]
+	resp, err := b.do(context.Background(), http.MethodHead, b.prefix+name, nil, nil, nil)
+	if err != nil {
+		return profileFile{}, err
+	}
+	resp.Body.Close()
+	modTime, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return profileFile{}, fmt.Errorf("stat %s: invalid Last-Modified: %w", b.url(b.prefix+name), err)
+	}
+	return profileFile{name: name, path: b.localPath(name), size: resp.ContentLength, modTime: modTime}, nil
+}
+
+func (b *s3Storage) fetch(ctx context.Context, f profileFile) error {
+	return b.cache.fetch(f, func(w io.Writer) error {
+		resp, err := b.do(ctx, http.MethodGet, b.prefix+f.name, nil, nil, nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		_, err = io.Copy(w, resp.Body)
+		return err
+	})
+}
+
+// save uploads the profile name, unless the bucket has it already and
+// replace isn't set. The cached file gets the modification time of the
+// object, so it isn't downloaded again.
+func (b *s3Storage) save(ctx context.Context, name string, replace bool) error {
+	name = path.Clean("/" + name)[1:]
+	localPath := b.localPath(name)
+	data, err := os.ReadFile(localPath)
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	if !replace {
+		header.Set("If-None-Match", "*")
+	}
+	resp, err := b.do(ctx, http.MethodPut, b.prefix+name, nil, header, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	f, err := b.stat(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Chtimes(localPath, f.modTime, f.modTime); err != nil {
+		return err
+	}
+	b.cache.mu.Lock()
+	defer b.cache.mu.Unlock()
+	b.cache.touch(localPath, f.size)
+	b.cache.evict(localPath)
+	return nil
+}
+
+func (b *s3Storage) discard(ctx context.Context, f profileFile) error {
+	resp, err := b.do(ctx, http.MethodDelete, b.prefix+f.name, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	b.cache.mu.Lock()
+	b.cache.forget(f.path)
+	b.cache.mu.Unlock()
+	return nil
+}
+
+// profileCache keeps the profiles downloaded from buckets on disk, removing
+// the least recently used ones when they exceed maxSize bytes.
+type profileCache struct {
+	maxSize int64
+	stats   Metrics
+	logger  *log.Logger
+
+	// hits and misses count the fetches since the start of the process for
+	// the status page.
+	hits, misses int64
+
+	mu sync.Mutex
+	// lru are the *cachedProfiles, most recently used first, and entries
+	// their elements by path.
+	lru     *list.List
+	entries map[string]*list.Element
+	size    int64
+	// fetching are closed when the downloads in progress by path are done.
+	fetching map[string]chan struct{}
+}
+
+type cachedProfile struct {
+	path string
+	size int64
+}
+
+func newProfileCache(maxSize int64, stats Metrics, logger *log.Logger) *profileCache {
+	if stats == nil {
+		stats = noMetrics{}
+	}
+	return &profileCache{maxSize: maxSize, stats: stats, logger: logger, lru: list.New(),
+		entries: make(map[string]*list.Element), fetching: make(map[string]chan struct{})}
+}
+
+// addDir adds the profiles cached in dir by earlier runs, the least recently
+// modified as least recently used. Files of the trash and partial uploads,
+// hidden files like the pins, and runtime metrics aren't cached profiles.
+func (c *profileCache) addDir(dir string) {
+	var files []tempFile
+	filepath.Walk(dir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() && (filePath == filepath.Join(dir, trashDir) || filePath == filepath.Join(dir, uploadsDir)) {
+			return filepath.SkipDir
+		}
+		if !info.IsDir() && !strings.HasPrefix(info.Name(), ".") && !strings.HasSuffix(info.Name(), runtimeMetricsSuffix) {
+			files = append(files, tempFile{filePath, info.Size(), info.ModTime()})
+		}
+		return nil
+	})
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, f := range files {
+		c.touch(f.path, f.size)
+	}
+}
+
+// fetch makes f readable at f.path, downloading it with download unless the
+// cached file has its size and modification time.
+func (c *profileCache) fetch(f profileFile, download func(io.Writer) error) error {
+	c.mu.Lock()
+	for {
+		done, ok := c.fetching[f.path]
+		if !ok {
+			break
+		}
+		c.mu.Unlock()
+		<-done
+		c.mu.Lock()
+	}
+	if info, err := os.Stat(f.path); err == nil && info.Size() == f.size && info.ModTime().Equal(f.modTime) {
+		c.touch(f.path, f.size)
+		c.mu.Unlock()
+		atomic.AddInt64(&c.hits, 1)
+		c.stats.Count("profile_cache.hits", 1)
+		return nil
+	}
+	done := make(chan struct{})
+	c.fetching[f.path] = done
+	c.mu.Unlock()
+
+	atomic.AddInt64(&c.misses, 1)
+	c.stats.Count("profile_cache.misses", 1)
+	start := time.Now()
+	err := createCacheFile(f, download)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.fetching, f.path)
+	close(done)
+	if err != nil {
+		return err
+	}
+	c.stats.Timing("profile_cache.fetch", time.Since(start))
+	c.touch(f.path, f.size)
+	c.evict(f.path)
+	return nil
+}
+
+// createCacheFile writes f to f.path with download, replacing the file
+// atomically, with the modification time of f.
+func createCacheFile(f profileFile, download func(io.Writer) error) error {
+	if err := os.MkdirAll(filepath.Dir(f.path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), ".fetch-*")
+	if err != nil {
+		return err
+	}
+	err = tmp.Chmod(0o644)
+	if err == nil {
+		err = download(tmp)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chtimes(tmp.Name(), f.modTime, f.modTime)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), f.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// touch marks the cached file path of size as most recently used. c.mu must
+// be held.
+func (c *profileCache) touch(filePath string, size int64) {
+	if e, ok := c.entries[filePath]; ok {
+		cached := e.Value.(*cachedProfile)
+		c.size += size - cached.size
+		cached.size = size
+		c.lru.MoveToFront(e)
+	} else {
+		c.entries[filePath] = c.lru.PushFront(&cachedProfile{filePath, size})
+		c.size += size
+	}
+	c.stats.Gauge("profile_cache.bytes", float64(c.size))
+}
+
+// forget stops tracking the cached file path, e.g. after it was moved or
+// deleted. c.mu must be held.
+func (c *profileCache) forget(filePath string) {
+	if e, ok := c.entries[filePath]; ok {
+		c.size -= e.Value.(*cachedProfile).size
+		c.lru.Remove(e)
+		delete(c.entries, filePath)
+	}
+}
+
+// evict removes the least recently used files but keep until the cache fits
+// in maxSize. c.mu must be held.
+func (c *profileCache) evict(keep string) {
+	for e := c.lru.Back(); e != nil && c.maxSize > 0 && c.size > c.maxSize; {
+		prev := e.Prev()
+		cached := e.Value.(*cachedProfile)
+		if cached.path != keep {
+			if err := os.Remove(cached.path); err != nil && !os.IsNotExist(err) {
+				c.logger.Printf("profile cache: %v", err)
+			}
+			c.forget(cached.path)
+			c.stats.Count("profile_cache.evicted", 1)
+		}
+		e = prev
+	}
+	c.stats.Gauge("profile_cache.bytes", float64(c.size))
+}
@@ -0,0 +1,161 @@
+package pprofweb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// sandbox runs external converters, e.g. viewcore, graphviz, and the object
+// tools, with resource limits, so a malicious or corrupt input can't hang or
+// exhaust the server. pprof runs the latter via shims, see toolShims.
+type sandbox struct {
+	// timeout limits the wall time of a conversion.
+	timeout time.Duration
+	// memory limits the address space of converters in bytes; 0 is unlimited.
+	memory int64
+	// cpu limits the CPU time of converters; 0 is unlimited.
+	cpu time.Duration
+	// maxOutput limits the output read from converters in bytes.
+	maxOutput int64
+	// isolate runs converters in new user, PID, network, mount, IPC, and UTS
+	// namespaces, so they can't reach the network or other processes.
+	isolate bool
+	// tempDir is the TMPDIR of converters, os.TempDir if empty.
+	tempDir string
+}
+
+var errOutputLimit = errors.New("output exceeds the limit")
+
+func newSandbox(timeout time.Duration, memory int64, cpu time.Duration, maxOutput int64, isolate bool) (*sandbox, error) {
+	if runtime.GOOS == "windows" && (memory > 0 || cpu > 0) {
+		return nil, errors.New("converter memory and CPU limits are not supported on Windows")
+	}
+	if isolate && runtime.GOOS != "linux" {
+		return nil, errors.New("converter isolation requires Linux")
+	}
+	return &sandbox{timeout: timeout, memory: memory, cpu: cpu, maxOutput: maxOutput, isolate: isolate}, nil
+}
+
+// command returns the command running name with args under the limits. The
+// shell sets the limits, then replaces itself with the converter. Converters
+// don't inherit the environment, which may hold secrets.
+func (sb *sandbox) command(name string, args ...string) (*exec.Cmd, error) {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return nil, err
+	}
+	var limits []string
+	if sb.memory > 0 {
+		limits = append(limits, fmt.Sprintf("ulimit -v %d", (sb.memory+1023)/1024))
+	}
+	if sb.cpu > 0 {
+		limits = append(limits, fmt.Sprintf("ulimit -t %d", int64((sb.cpu+time.Second-1)/time.Second)))
+	}
+	var cmd *exec.Cmd
+	if len(limits) == 0 {
+		cmd = exec.Command(path, args...)
+	} else {
+		script := strings.Join(limits, " && ") + ` && exec "$0" "$@"`
+		cmd = exec.Command("/bin/sh", append([]string{"-c", script, path}, args...)...)
+	}
+	tempDir := sb.tempDir
+	if tempDir == "" {
+		tempDir = os.TempDir()
+	}
+	cmd.Env = []string{"PATH=/usr/local/bin:/usr/bin:/bin", "TMPDIR=" + tempDir}
+	cmd.SysProcAttr = sysProcAttr(sb.isolate)
+	return cmd, nil
+}
+
+// output runs name with args and returns its standard output. The converter
+// is killed when ctx is done, the timeout passes, or the output exceeds the
+// limit.
+func (sb *sandbox) output(ctx context.Context, name string, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	err := sb.run(ctx, nil, &stdout, newLimitedWriter(&stderr, 64<<10), name, args...)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// run runs name with args like output, streaming stdin to it and its output
+// to stdout and stderr.
+func (sb *sandbox) run(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+	if sb.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, sb.timeout)
+		defer cancel()
+	}
+	cmd, err := sb.command(name, args...)
+	if err != nil {
+		return err
+	}
+	limited := newLimitedWriter(stdout, sb.maxOutput)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = stdin, limited, stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		killProcess(cmd)
+		<-done
+		err = ctx.Err()
+	case <-limited.exceeded():
+		killProcess(cmd)
+		<-done
+	}
+	select {
+	case <-limited.exceeded():
+		// also if the converter exited first
+		err = errOutputLimit
+	default:
+	}
+	return err
+}
+
+// limitedWriter writes to w, signaling when more than limit bytes are
+// written; the excess is discarded.
+type limitedWriter struct {
+	// w is not embedded: io.Copy would use its ReadFrom, bypassing Write
+	w       io.Writer
+	written int64
+	limit   int64
+	full    chan struct{}
+}
+
+func newLimitedWriter(w io.Writer, limit int64) *limitedWriter {
+	return &limitedWriter{w: w, limit: limit, full: make(chan struct{})}
+}
+
+// exceeded is closed when the limit is exceeded.
+func (b *limitedWriter) exceeded() <-chan struct{} {
+	return b.full
+}
+
+func (b *limitedWriter) Write(p []byte) (int, error) {
+	if b.limit > 0 && b.written+int64(len(p)) > b.limit {
+		select {
+		case <-b.full:
+		default:
+			close(b.full)
+		}
+		return len(p), nil
+	}
+	b.written += int64(len(p))
+	return b.w.Write(p)
+}
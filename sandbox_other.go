@@ -0,0 +1,17 @@
+//go:build !linux
+
+package pprofweb
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// sysProcAttr returns nil: isolation requires Linux, which newSandbox checks.
+func sysProcAttr(isolate bool) *syscall.SysProcAttr {
+	return nil
+}
+
+func killProcess(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
@@ -0,0 +1,160 @@
+package pprofweb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// pprofTools are the programs pprof runs: graphviz, looked up in PATH, and
+// the object tools, looked up in the paths of --tools or PATH.
+var pprofTools = []string{"dot", "llvm-symbolizer", "addr2line", "gaddr2line",
+	"llvm-nm", "nm", "gnm", "llvm-objdump", "objdump", "gobjdump"}
+
+// toolShims are directories of shell scripts named like pprofTools, each
+// running the program it stands for in the sandbox via the sandbox command
+// of the pprofweb executable. pprof can't run programs through the sandbox
+// itself, so the shims take the place of the programs: in front of PATH and
+// in place of the paths of --tools.
+type toolShims struct {
+	sb         *sandbox
+	executable string
+	// dir holds the directories of shims.
+	dir string
+	// dirs are the directories of shims by the path they stand for; "" is
+	// PATH.
+	dirs map[string]string
+}
+
+// newToolShims creates the directory of the shims of the programs of PATH
+// below a new temporary directory.
+func newToolShims(sb *sandbox, executable string) (*toolShims, error) {
+	dir, err := os.MkdirTemp("", "pprofweb-tools-")
+	if err != nil {
+		return nil, err
+	}
+	t := &toolShims{sb: sb, executable: executable, dir: dir, dirs: make(map[string]string)}
+	if _, err := t.shimDir(""); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// pathDir returns the directory of the shims of the programs of PATH, which
+// must be first in PATH.
+func (t *toolShims) pathDir() string {
+	return t.dirs[""]
+}
+
+// shimDir returns the directory of the shims of the programs in the
+// directory path, or in PATH if it is empty, creating it once.
+func (t *toolShims) shimDir(path string) (string, error) {
+	if dir, ok := t.dirs[path]; ok {
+		return dir, nil
+	}
+	dir := filepath.Join(t.dir, strconv.Itoa(len(t.dirs)))
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		return "", err
+	}
+	for _, tool := range pprofTools {
+		program, err := exec.LookPath(filepath.Join(path, tool))
+		if err != nil {
+			continue
+		}
+		if program, err = filepath.Abs(program); err != nil {
+			return "", err
+		}
+		if err := t.writeShim(filepath.Join(dir, tool), program); err != nil {
+			return "", err
+		}
+	}
+	t.dirs[path] = dir
+	return dir, nil
+}
+
+// writeShim writes the shim running program in the sandbox to shim.
+func (t *toolShims) writeShim(shim, program string) error {
+	sb := t.sb
+	args := []string{t.executable, "sandbox",
+		"--timeout", sb.timeout.String(),
+		"--memory", strconv.FormatInt(sb.memory, 10),
+		"--cpu", sb.cpu.String(),
+		"--max-output", strconv.FormatInt(sb.maxOutput, 10),
+		"--temp-dir", sb.tempDir,
+	}
+	if sb.isolate {
+		args = append(args, "--isolate")
+	}
+	args = append(args, "--", program)
+	for i, arg := range args {
+		args[i] = shellQuote(arg)
+	}
+	script := "#!/bin/sh\nexec " + strings.Join(args, " ") + ` "$@"` + "\n"
+	return os.WriteFile(shim, []byte(script), 0o755)
+}
+
+// tools returns the pprof --tools value config with its paths replaced by
+// the directories of their shims. Empty paths stand for PATH and are kept.
+func (t *toolShims) tools(config string) (string, error) {
+	entries := strings.Split(config, ",")
+	for i, entry := range entries {
+		name, path := "", entry
+		if ct := strings.SplitN(entry, ":", 2); len(ct) == 2 {
+			name, path = ct[0], ct[1]
+		}
+		if path == "" {
+			continue
+		}
+		dir, err := t.shimDir(path)
+		if err != nil {
+			return "", err
+		}
+		if entries[i] = dir; name != "" {
+			entries[i] = name + ":" + dir
+		}
+	}
+	return strings.Join(entries, ","), nil
+}
+
+// sandboxCommand runs a program with the limits of the sandbox given by its
+// flags, streaming its input and output, for the shims of toolShims.
+var sandboxCommand = &cli.Command{
+	Name:      "sandbox",
+	Usage:     "run a program of pprof in the converter sandbox for the server",
+	ArgsUsage: "-- program [args...]",
+	Hidden:    true,
+	Flags: []cli.Flag{
+		&cli.DurationFlag{Name: "timeout"},
+		&cli.Int64Flag{Name: "memory"},
+		&cli.DurationFlag{Name: "cpu"},
+		&cli.Int64Flag{Name: "max-output"},
+		&cli.BoolFlag{Name: "isolate"},
+		&cli.PathFlag{Name: "temp-dir"},
+	},
+	Action: func(context *cli.Context) error {
+		if !context.Args().Present() {
+			return cli.Exit("sandbox: program required", 2)
+		}
+		sb, err := newSandbox(context.Duration("timeout"), context.Int64("memory"), context.Duration("cpu"),
+			context.Int64("max-output"), context.Bool("isolate"))
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("sandbox: %v", err), 1)
+		}
+		sb.tempDir = context.Path("temp-dir")
+		err = sb.run(context.Context, os.Stdin, os.Stdout, os.Stderr, context.Args().First(), context.Args().Tail()...)
+		var exit *exec.ExitError
+		if errors.As(err, &exit) {
+			return cli.Exit("", exit.ExitCode())
+		}
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("sandbox: %s: %v", context.Args().First(), err), 1)
+		}
+		return nil
+	},
+}
@@ -0,0 +1,497 @@
+package pprofweb
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultScrapeRefresh is the interval of discovering the targets of scrape
+// configs, like the default refresh_interval of file_sd_configs.
+const defaultScrapeRefresh = 5 * time.Minute
+
+// kubernetesSDRefresh is the interval of listing the pods of
+// kubernetes_sd_configs.
+const kubernetesSDRefresh = time.Minute
+
+// scrapeConfigFile is the subset of a Prometheus configuration file the server
+// discovers targets with, so existing service discovery definitions can be
+// reused.
+type scrapeConfigFile struct {
+	ScrapeConfigs []*scrapeConfig `yaml:"scrape_configs"`
+}
+
+// scrapeConfig is a job of scrape_configs. Of the service discovery
+// mechanisms static_configs, file_sd_configs, and kubernetes_sd_configs of
+// role pod are supported.
+type scrapeConfig struct {
+	JobName             string                `yaml:"job_name"`
+	Scheme              string                `yaml:"scheme"`
+	StaticConfigs       []*targetGroup        `yaml:"static_configs"`
+	FileSDConfigs       []*fileSDConfig       `yaml:"file_sd_configs"`
+	KubernetesSDConfigs []*kubernetesSDConfig `yaml:"kubernetes_sd_configs"`
+	RelabelConfigs      []*relabelConfig      `yaml:"relabel_configs"`
+	BearerTokenFile     string                `yaml:"bearer_token_file"`
+	Authorization       *struct {
+		Type            string `yaml:"type"`
+		CredentialsFile string `yaml:"credentials_file"`
+	} `yaml:"authorization"`
+	TLSConfig *struct {
+		CAFile   string `yaml:"ca_file"`
+		CertFile string `yaml:"cert_file"`
+		KeyFile  string `yaml:"key_file"`
+	} `yaml:"tls_config"`
+
+	credentials *targetCredentials
+}
+
+// targetGroup is a group of static_configs or of the files of
+// file_sd_configs.
+type targetGroup struct {
+	Targets []string          `yaml:"targets" json:"targets"`
+	Labels  map[string]string `yaml:"labels" json:"labels"`
+}
+
+type fileSDConfig struct {
+	Files           []string `yaml:"files"`
+	RefreshInterval string   `yaml:"refresh_interval"`
+}
+
+type kubernetesSDConfig struct {
+	Role       string `yaml:"role"`
+	Namespaces struct {
+		OwnNamespace bool     `yaml:"own_namespace"`
+		Names        []string `yaml:"names"`
+	} `yaml:"namespaces"`
+}
+
+// scrapeDiscovery keeps the targets discovered with scrape configs.
+type scrapeDiscovery struct {
+	configs     []*scrapeConfig
+	defaultRoot *profileRoot
+	roots       []*profileRoot
+	// interval is the shortest refresh_interval of the configs.
+	interval time.Duration
+	logger   *log.Logger
+
+	mu sync.Mutex
+	// targets are the targets of the last successful discovery of each job
+	// by name.
+	targets map[string]map[string]*captureTarget
+}
+
+// loadScrapeConfig reads the Prometheus configuration file at path. The
+// discovered targets are stored in the root named by their label root, the
+// default root if they have none. Failed discoveries are logged to logger.
+func loadScrapeConfig(path string, defaultRoot *profileRoot, roots []*profileRoot, logger *log.Logger) (*scrapeDiscovery, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file scrapeConfigFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("scrape config %s: %w", path, err)
+	}
+	d := &scrapeDiscovery{
+		configs:     file.ScrapeConfigs,
+		defaultRoot: defaultRoot,
+		roots:       roots,
+		interval:    defaultScrapeRefresh,
+		logger:      logger,
+		targets:     make(map[string]map[string]*captureTarget),
+	}
+	jobs := make(map[string]bool)
+	for _, config := range file.ScrapeConfigs {
+		if err := d.compile(config); err != nil {
+			return nil, fmt.Errorf("scrape config %s: job %q: %w", path, config.JobName, err)
+		}
+		if jobs[config.JobName] {
+			return nil, fmt.Errorf("scrape config %s: duplicate job %q", path, config.JobName)
+		}
+		jobs[config.JobName] = true
+	}
+	return d, nil
+}
+
+// compile checks config and fills in the defaults of Prometheus.
+func (d *scrapeDiscovery) compile(config *scrapeConfig) error {
+	if config.JobName == "" {
+		return fmt.Errorf("job_name is required")
+	}
+	if config.Scheme == "" {
+		config.Scheme = "http"
+	}
+	if config.Scheme != "http" && config.Scheme != "https" {
+		return fmt.Errorf("invalid scheme %q", config.Scheme)
+	}
+	for _, rule := range config.RelabelConfigs {
+		if err := rule.compile(); err != nil {
+			return err
+		}
+	}
+	for _, sd := range config.FileSDConfigs {
+		if sd.RefreshInterval == "" {
+			continue
+		}
+		interval, err := time.ParseDuration(sd.RefreshInterval)
+		if err != nil || interval <= 0 {
+			return fmt.Errorf("invalid refresh_interval %q", sd.RefreshInterval)
+		}
+		if interval < d.interval {
+			d.interval = interval
+		}
+	}
+	for _, sd := range config.KubernetesSDConfigs {
+		if sd.Role != "pod" {
+			return fmt.Errorf("unsupported kubernetes_sd_configs role %q: only pod is supported", sd.Role)
+		}
+		// pods come and go faster than files change
+		if d.interval > kubernetesSDRefresh {
+			d.interval = kubernetesSDRefresh
+		}
+	}
+
+	// the credentials are files like in Prometheus
+	config.credentials = &targetCredentials{logger: d.logger}
+	var refs [][2]string
+	if config.BearerTokenFile != "" {
+		refs = append(refs, [2]string{"bearer", config.BearerTokenFile})
+	}
+	if config.Authorization != nil {
+		if config.Authorization.Type != "" && config.Authorization.Type != "Bearer" {
+			return fmt.Errorf("unsupported authorization type %q", config.Authorization.Type)
+		}
+		if config.Authorization.CredentialsFile != "" {
+			refs = append(refs, [2]string{"bearer", config.Authorization.CredentialsFile})
+		}
+	}
+	if config.TLSConfig != nil {
+		refs = append(refs,
+			[2]string{"ca", config.TLSConfig.CAFile},
+			[2]string{"cert", config.TLSConfig.CertFile},
+			[2]string{"key", config.TLSConfig.KeyFile})
+	}
+	for _, ref := range refs {
+		if ref[1] == "" {
+			continue
+		}
+		if _, err := config.credentials.setCredential(ref[0], "file:"+ref[1]); err != nil {
+			return err
+		}
+	}
+	return config.credentials.validate()
+}
+
+// target returns the discovered target called name.
+func (d *scrapeDiscovery) target(name string) (*captureTarget, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, targets := range d.targets {
+		if target, ok := targets[name]; ok {
+			return target, true
+		}
+	}
+	return nil, false
+}
+
+// list returns the discovered targets sorted by name.
+func (d *scrapeDiscovery) list() []*captureTarget {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var list []*captureTarget
+	for _, targets := range d.targets {
+		for _, target := range targets {
+			list = append(list, target)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	return list
+}
+
+// run discovers the targets every interval.
+func (d *scrapeDiscovery) run() {
+	for {
+		d.refresh()
+		time.Sleep(d.interval)
+	}
+}
+
+// refresh discovers the targets of all jobs. A job that fails keeps the
+// targets of its last successful discovery.
+func (d *scrapeDiscovery) refresh() {
+	for _, config := range d.configs {
+		targets, err := d.discover(config)
+		if err != nil {
+			d.logger.Printf("scrape config job %s: %v", config.JobName, err)
+			continue
+		}
+		d.mu.Lock()
+		d.targets[config.JobName] = targets
+		d.mu.Unlock()
+	}
+}
+
+// discover returns the targets of the job of config by name.
+func (d *scrapeDiscovery) discover(config *scrapeConfig) (map[string]*captureTarget, error) {
+	var groups []*targetGroup
+	groups = append(groups, config.StaticConfigs...)
+	for _, sd := range config.FileSDConfigs {
+		fileGroups, err := readFileSD(sd.Files)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, fileGroups...)
+	}
+
+	var discovered []map[string]string
+	for _, group := range groups {
+		for _, address := range group.Targets {
+			labels := make(map[string]string, len(group.Labels)+1)
+			for name, value := range group.Labels {
+				labels[name] = value
+			}
+			labels["__address__"] = address
+			discovered = append(discovered, labels)
+		}
+	}
+	for _, sd := range config.KubernetesSDConfigs {
+		pods, err := discoverKubernetesPods(sd)
+		if err != nil {
+			return nil, err
+		}
+		discovered = append(discovered, pods...)
+	}
+
+	targets := make(map[string]*captureTarget)
+	for _, labels := range discovered {
+		labels["job"] = config.JobName
+		if _, ok := labels["__scheme__"]; !ok {
+			labels["__scheme__"] = config.Scheme
+		}
+		labels = relabel(labels, config.RelabelConfigs)
+		if labels == nil || labels["__address__"] == "" {
+			continue
+		}
+		target, err := d.newTarget(config, labels)
+		if err != nil {
+			d.logger.Printf("scrape config job %s: %v", config.JobName, err)
+			continue
+		}
+		if other, ok := targets[target.name]; ok {
+			// like Prometheus, the ports of a pod relabeled to the same
+			// address are one target
+			if other.url.String() != target.url.String() {
+				d.logger.Printf("scrape config job %s: duplicate target %s", config.JobName, target.name)
+			}
+			continue
+		}
+		targets[target.name] = target
+	}
+	return targets, nil
+}
+
+// invalidTargetNameChars are replaced in the names of discovered targets,
+// which are part of the URLs of the API.
+var invalidTargetNameChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// newTarget returns the target of the relabeled labels. Its name is the
+// label name, else job-instance; its service the label service, else the
+// job.
+func (d *scrapeDiscovery) newTarget(config *scrapeConfig, labels map[string]string) (*captureTarget, error) {
+	address := labels["__address__"]
+	u, err := url.Parse(labels["__scheme__"] + "://" + address)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid target address %q", address)
+	}
+	if labels["instance"] == "" {
+		labels["instance"] = address
+	}
+	name := labels["name"]
+	if name == "" {
+		name = config.JobName + "-" + labels["instance"]
+	}
+	name = strings.Trim(invalidTargetNameChars.ReplaceAllString(name, "-"), "-")
+	target := &captureTarget{name: name, url: u, root: d.defaultRoot, service: config.JobName, credentials: config.credentials}
+	if service := labels["service"]; service != "" {
+		target.service = service
+	}
+	if rootName := labels["root"]; rootName != "" {
+		target.root = nil
+		for _, root := range d.roots {
+			if root.name == rootName {
+				target.root = root
+			}
+		}
+		if target.root == nil {
+			return nil, fmt.Errorf("target %s: unknown root %q", name, rootName)
+		}
+	}
+	return target, nil
+}
+
+// readFileSD reads the target groups of the files matching the patterns, in
+// the YAML or JSON format of file_sd_configs.
+func readFileSD(patterns []string) ([]*targetGroup, error) {
+	var groups []*targetGroup
+	for _, pattern := range patterns {
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range paths {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			var fileGroups []*targetGroup
+			// YAML is a superset of JSON
+			if err := yaml.Unmarshal(data, &fileGroups); err != nil {
+				return nil, fmt.Errorf("file_sd %s: %w", path, err)
+			}
+			groups = append(groups, fileGroups...)
+		}
+	}
+	return groups, nil
+}
+
+// kubernetesPodList is the part of the response of the pods API used for
+// discovery.
+type kubernetesPodList struct {
+	Items []struct {
+		Metadata struct {
+			Name        string            `json:"name"`
+			Namespace   string            `json:"namespace"`
+			UID         string            `json:"uid"`
+			Labels      map[string]string `json:"labels"`
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+		Spec struct {
+			NodeName   string `json:"nodeName"`
+			Containers []struct {
+				Name  string `json:"name"`
+				Image string `json:"image"`
+				Ports []struct {
+					Name          string `json:"name"`
+					ContainerPort int    `json:"containerPort"`
+					Protocol      string `json:"protocol"`
+				} `json:"ports"`
+			} `json:"containers"`
+		} `json:"spec"`
+		Status struct {
+			Phase      string `json:"phase"`
+			PodIP      string `json:"podIP"`
+			HostIP     string `json:"hostIP"`
+			Conditions []struct {
+				Type   string `json:"type"`
+				Status string `json:"status"`
+			} `json:"conditions"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+// discoverKubernetesPods lists the pods of the namespaces of sd with the
+// service account of the server. Like Prometheus, it returns a target for
+// every port of every container, or for the container if it has none, with
+// the __meta_kubernetes_pod_* labels.
+func discoverKubernetesPods(sd *kubernetesSDConfig) ([]map[string]string, error) {
+	namespaces := sd.Namespaces.Names
+	if sd.Namespaces.OwnNamespace {
+		ns, err := kubernetesNamespace()
+		if err != nil {
+			return nil, err
+		}
+		namespaces = append(namespaces, ns)
+	}
+	var apiPaths []string
+	for _, ns := range namespaces {
+		apiPaths = append(apiPaths, "/api/v1/namespaces/"+url.PathEscape(ns)+"/pods")
+	}
+	if len(apiPaths) == 0 {
+		apiPaths = []string{"/api/v1/pods"}
+	}
+
+	var discovered []map[string]string
+	for _, apiPath := range apiPaths {
+		data, err := kubernetesGet(apiPath)
+		if err != nil {
+			return nil, err
+		}
+		var pods kubernetesPodList
+		if err := json.Unmarshal(data, &pods); err != nil {
+			return nil, fmt.Errorf("pods %s: %w", apiPath, err)
+		}
+		for _, pod := range pods.Items {
+			if pod.Status.PodIP == "" {
+				continue
+			}
+			podLabels := map[string]string{
+				"__meta_kubernetes_namespace":     pod.Metadata.Namespace,
+				"__meta_kubernetes_pod_name":      pod.Metadata.Name,
+				"__meta_kubernetes_pod_uid":       pod.Metadata.UID,
+				"__meta_kubernetes_pod_ip":        pod.Status.PodIP,
+				"__meta_kubernetes_pod_host_ip":   pod.Status.HostIP,
+				"__meta_kubernetes_pod_node_name": pod.Spec.NodeName,
+				"__meta_kubernetes_pod_phase":     pod.Status.Phase,
+				"__meta_kubernetes_pod_ready":     "unknown",
+			}
+			for _, condition := range pod.Status.Conditions {
+				if condition.Type == "Ready" {
+					podLabels["__meta_kubernetes_pod_ready"] = strings.ToLower(condition.Status)
+				}
+			}
+			for name, value := range pod.Metadata.Labels {
+				podLabels["__meta_kubernetes_pod_label_"+sanitizeLabelName(name)] = value
+				podLabels["__meta_kubernetes_pod_labelpresent_"+sanitizeLabelName(name)] = "true"
+			}
+			for name, value := range pod.Metadata.Annotations {
+				podLabels["__meta_kubernetes_pod_annotation_"+sanitizeLabelName(name)] = value
+				podLabels["__meta_kubernetes_pod_annotationpresent_"+sanitizeLabelName(name)] = "true"
+			}
+			for _, container := range pod.Spec.Containers {
+				containerLabels := map[string]string{
+					"__address__":                           pod.Status.PodIP,
+					"__meta_kubernetes_pod_container_name":  container.Name,
+					"__meta_kubernetes_pod_container_image": container.Image,
+				}
+				if len(container.Ports) == 0 {
+					discovered = append(discovered, mergeLabels(podLabels, containerLabels))
+					continue
+				}
+				for _, port := range container.Ports {
+					portNumber := strconv.Itoa(port.ContainerPort)
+					portLabels := mergeLabels(podLabels, containerLabels)
+					portLabels["__address__"] = net.JoinHostPort(pod.Status.PodIP, portNumber)
+					portLabels["__meta_kubernetes_pod_container_port_name"] = port.Name
+					portLabels["__meta_kubernetes_pod_container_port_number"] = portNumber
+					portLabels["__meta_kubernetes_pod_container_port_protocol"] = port.Protocol
+					discovered = append(discovered, portLabels)
+				}
+			}
+		}
+	}
+	return discovered, nil
+}
+
+// mergeLabels returns a new label set with the labels of all sets, the later
+// sets taking precedence.
+func mergeLabels(sets ...map[string]string) map[string]string {
+	merged := make(map[string]string)
+	for _, labels := range sets {
+		for name, value := range labels {
+			merged[name] = value
+		}
+	}
+	return merged
+}
@@ -0,0 +1,122 @@
+package pprofweb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// screenRatioMinSize is the decompressed size below which the compression
+// ratio of uploads isn't limited, since small repetitive profiles compress
+// well.
+const screenRatioMinSize = 16 << 20
+
+// maxScreenedLayers limits the nested compression screened, e.g. of a gzip
+// profile recompressed with zstd.
+const maxScreenedLayers = 3
+
+// sizeScreener rejects uploads that are compression bombs: that decompress
+// to more than maxExpanded bytes, or to more than maxRatio times their size.
+// 0 disables a limit. Uncompressed uploads are limited by the upload size.
+type sizeScreener struct {
+	maxExpanded int64
+	maxRatio    float64
+}
+
+func (sc sizeScreener) Screen(ctx context.Context, name string, size int64, r io.Reader) error {
+	limit := sc.maxExpanded
+	if sc.maxRatio > 0 {
+		ratioLimit := int64(sc.maxRatio * float64(size))
+		if ratioLimit < screenRatioMinSize {
+			ratioLimit = screenRatioMinSize
+		}
+		if limit == 0 || ratioLimit < limit {
+			limit = ratioLimit
+		}
+	}
+	if limit == 0 {
+		return nil
+	}
+	layers := 0
+	for ; layers < maxScreenedLayers; layers++ {
+		d, compressed, err := decompressStream(r)
+		if err != nil {
+			// invalid compression is reported by parsing
+			return nil
+		}
+		defer d.Close()
+		r = d
+		if !compressed {
+			break
+		}
+	}
+	if layers == 0 {
+		return nil
+	}
+	// read errors are reported by parsing, after at most n bytes
+	n, _ := io.Copy(io.Discard, io.LimitReader(r, limit+1))
+	if sc.maxExpanded > 0 && n > sc.maxExpanded {
+		return fmt.Errorf("%w: decompresses to more than %s", ErrRejected, formatBytes(sc.maxExpanded))
+	}
+	if sc.maxRatio > 0 && n > screenRatioMinSize && float64(n) > sc.maxRatio*float64(size) {
+		return fmt.Errorf("%w: decompresses to more than %g times its size", ErrRejected, sc.maxRatio)
+	}
+	return nil
+}
+
+// screen runs the size screen and the screeners of WithScreener on the
+// profile name of size bytes in data, e.g. an upload, before it is stored or
+// parsed. The error wraps ErrRejected if a screener rejects it.
+func (s *server) screen(ctx context.Context, name string, data io.ReaderAt, size int64) error {
+	for _, sc := range append([]Screener{s.sizeScreen}, s.screeners...) {
+		start := time.Now()
+		err := sc.Screen(ctx, name, size, io.NewSectionReader(data, 0, size))
+		s.stats.Timing("upload.screen", time.Since(start))
+		switch {
+		case errors.Is(err, ErrRejected):
+			s.stats.Count("upload.rejected", 1)
+			s.logger.Printf("%s rejected upload %s: %v", requestID(ctx), name, err)
+			return err
+		case err != nil:
+			s.stats.Count("upload.screen_errors", 1)
+			s.logger.Printf("%s screen %s: %v", requestID(ctx), name, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// screenUpload screens the upload name like screen. It responds with the
+// error if a screener rejects it, or fails, and reports whether the upload
+// may continue.
+func (s *server) screenUpload(w http.ResponseWriter, r *http.Request, name string, data io.ReaderAt, size int64) bool {
+	err := s.screen(r.Context(), name, data, size)
+	switch {
+	case errors.Is(err, ErrRejected):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return false
+	case err != nil:
+		http.Error(w, "could not screen upload", http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
+// screenFile screens the upload name stored at filePath like screenUpload.
+func (s *server) screenFile(w http.ResponseWriter, r *http.Request, name, filePath string) bool {
+	f, err := os.Open(filePath)
+	if err == nil {
+		defer f.Close()
+		var info os.FileInfo
+		if info, err = f.Stat(); err == nil {
+			return s.screenUpload(w, r, name, f, info.Size())
+		}
+	}
+	s.logger.Printf("%s screen %s: %v", requestID(r.Context()), name, err)
+	http.Error(w, "could not store profile", http.StatusInternalServerError)
+	return false
+}
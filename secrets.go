@@ -0,0 +1,399 @@
+package pprofweb
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// secretRefresh is how long resolved secrets are used before they are
+// resolved again, so rotated secrets are picked up without a restart.
+const secretRefresh = 5 * time.Minute
+
+// secretTimeout limits the requests to secret stores.
+const secretTimeout = 10 * time.Second
+
+// kubernetesServiceAccount is the directory of the credentials of pods.
+const kubernetesServiceAccount = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// secretResolvers resolve the references of secrets by their scheme, the
+// text up to the first colon.
+var secretResolvers = map[string]func(ref string) ([]byte, error){
+	// env:NAME
+	"env": func(ref string) ([]byte, error) {
+		value := os.Getenv(ref)
+		if value == "" {
+			return nil, fmt.Errorf("environment variable %s is not set", ref)
+		}
+		return []byte(value), nil
+	},
+	// file:/path
+	"file":   os.ReadFile,
+	"vault":  resolveVaultSecret,
+	"aws-sm": resolveAWSSecret,
+	"k8s":    resolveKubernetesSecret,
+}
+
+// secret is a reference to a secret in a store, resolved when it is used,
+// e.g. vault:secret/data/pprof#token.
+type secret struct {
+	ref     string
+	resolve func(ref string) ([]byte, error)
+	// logger logs the refreshes that fail and keep the previous value.
+	logger *log.Logger
+
+	mu       sync.Mutex
+	value    []byte
+	resolved time.Time
+}
+
+// parseSecret parses the reference ref of a secret, scheme:reference.
+func parseSecret(ref string, logger *log.Logger) (*secret, error) {
+	i := strings.Index(ref, ":")
+	if i < 0 {
+		return nil, fmt.Errorf("secret %q: expected scheme:reference with scheme env, file, vault, aws-sm, or k8s", ref)
+	}
+	resolve, ok := secretResolvers[ref[:i]]
+	if !ok {
+		return nil, fmt.Errorf("secret %q: unknown scheme %q", ref, ref[:i])
+	}
+	return &secret{ref: ref, resolve: resolve, logger: logger}, nil
+}
+
+// get returns the value of the secret, resolved at most secretRefresh ago.
+// If resolving fails, the last value is kept so an unavailable store
+// doesn't break captures until the secret is rotated.
+func (s *secret) get() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.value != nil && time.Since(s.resolved) < secretRefresh {
+		return s.value, nil
+	}
+	value, err := s.resolve(s.ref[strings.Index(s.ref, ":")+1:])
+	if err != nil {
+		if s.value != nil {
+			s.logger.Printf("secret %s: %v; using the previous value", s.ref, err)
+			return s.value, nil
+		}
+		return nil, fmt.Errorf("secret %s: %w", s.ref, err)
+	}
+	s.value, s.resolved = value, time.Now()
+	return value, nil
+}
+
+// splitSecretField splits a reference like path#field.
+func splitSecretField(ref string) (string, string) {
+	if i := strings.LastIndex(ref, "#"); i >= 0 {
+		return ref[:i], ref[i+1:]
+	}
+	return ref, ""
+}
+
+// secretField returns field of the JSON object data, or data if field is
+// empty.
+func secretField(data []byte, field string) ([]byte, error) {
+	if field == "" {
+		return data, nil
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, fmt.Errorf("field %s of a secret that isn't a JSON object", field)
+	}
+	value, ok := fields[field].(string)
+	if !ok {
+		return nil, fmt.Errorf("no field %s", field)
+	}
+	return []byte(value), nil
+}
+
+// secretRequest sends req and returns the body of its successful response.
+func secretRequest(client *http.Client, req *http.Request) ([]byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return body, nil
+}
+
+// resolveVaultSecret reads the field of the secret at the path of a
+// reference like secret/data/pprof#token from Vault at VAULT_ADDR with
+// VAULT_TOKEN. KV version 2 secrets are read from their data.
+func resolveVaultSecret(ref string) ([]byte, error) {
+	addr, token := os.Getenv("VAULT_ADDR"), os.Getenv("VAULT_TOKEN")
+	if addr == "" || token == "" {
+		return nil, errors.New("VAULT_ADDR and VAULT_TOKEN are required")
+	}
+	secretPath, field := splitSecretField(ref)
+	if field == "" {
+		return nil, errors.New("expected path#field")
+	}
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(addr, "/")+"/v1/"+strings.TrimPrefix(secretPath, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	body, err := secretRequest(&http.Client{Timeout: secretTimeout}, req)
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(resp.Data)
+	if err != nil {
+		return nil, err
+	}
+	if nested, ok := resp.Data["data"]; ok && resp.Data["metadata"] != nil {
+		data = nested
+	}
+	return secretField(data, field)
+}
+
+// resolveAWSSecret reads the secret of a reference like prod/pprof#token,
+// its name or ARN and optionally a field of its JSON value, from AWS Secrets
+// Manager with the credentials and region of the environment.
+func resolveAWSSecret(ref string) ([]byte, error) {
+	creds, err := awsCredentialsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	region, err := awsRegionFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	id, field := splitSecretField(ref)
+	body, err := json.Marshal(map[string]string{"SecretId": id})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, "https://secretsmanager."+region+".amazonaws.com/", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	signAWSRequest(req, body, "secretsmanager", region, creds, time.Now())
+	respBody, err := secretRequest(&http.Client{Timeout: secretTimeout}, req)
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		SecretString *string `json:"SecretString"`
+		SecretBinary []byte  `json:"SecretBinary"`
+	}
+	if err := json.Unmarshal(respBody, &resp); err != nil {
+		return nil, err
+	}
+	if resp.SecretString == nil {
+		return secretField(resp.SecretBinary, field)
+	}
+	return secretField([]byte(*resp.SecretString), field)
+}
+
+// resolveKubernetesSecret reads the key of the secret of a reference like
+// namespace/name#key, or name#key in the namespace of the pod, from the API
+// server of the cluster with the service account of the pod.
+func resolveKubernetesSecret(ref string) ([]byte, error) {
+	name, key := splitSecretField(ref)
+	if key == "" {
+		return nil, errors.New("expected namespace/name#key")
+	}
+	namespace := ""
+	if i := strings.Index(name, "/"); i >= 0 {
+		namespace, name = name[:i], name[i+1:]
+	} else {
+		var err error
+		namespace, err = kubernetesNamespace()
+		if err != nil {
+			return nil, err
+		}
+	}
+	body, err := kubernetesGet("/api/v1/namespaces/" + url.PathEscape(namespace) + "/secrets/" + url.PathEscape(name))
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Data map[string]string `json:"data"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	value, ok := resp.Data[key]
+	if !ok {
+		return nil, fmt.Errorf("no key %s", key)
+	}
+	return base64.StdEncoding.DecodeString(value)
+}
+
+// kubernetesNamespace returns the namespace of the pod.
+func kubernetesNamespace() (string, error) {
+	ns, err := os.ReadFile(kubernetesServiceAccount + "/namespace")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(ns)), nil
+}
+
+// kubernetesGet returns the response to a GET of apiPath from the API server
+// of the cluster, authenticated with the service account of the pod.
+func kubernetesGet(apiPath string) ([]byte, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a Kubernetes cluster")
+	}
+	token, err := os.ReadFile(kubernetesServiceAccount + "/token")
+	if err != nil {
+		return nil, err
+	}
+	ca, err := os.ReadFile(kubernetesServiceAccount + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("invalid CA certificate of the service account")
+	}
+	client := &http.Client{
+		Timeout:   secretTimeout,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+	}
+	req, err := http.NewRequest(http.MethodGet, "https://"+net.JoinHostPort(host, port)+apiPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	return secretRequest(client, req)
+}
+
+// targetCredentials authenticate the requests to the pprof endpoints of a
+// target with secrets: a bearer token, and a client certificate and key and
+// a CA certificate for TLS. A nil *targetCredentials sends none.
+type targetCredentials struct {
+	bearer, cert, key, ca *secret
+	// logger is the logger of the secrets.
+	logger *log.Logger
+
+	mu        sync.Mutex
+	transport *http.Transport
+	created   time.Time
+}
+
+// empty reports whether c has no secrets.
+func (c *targetCredentials) empty() bool {
+	return c == nil || (c.bearer == nil && c.cert == nil && c.key == nil && c.ca == nil)
+}
+
+// roundTripper returns the transport of the requests, configured with the
+// current certificates.
+func (c *targetCredentials) roundTripper() (http.RoundTripper, error) {
+	if c == nil || (c.cert == nil && c.ca == nil) {
+		return http.DefaultTransport, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.transport != nil && time.Since(c.created) < secretRefresh {
+		return c.transport, nil
+	}
+	config := &tls.Config{}
+	if c.cert != nil {
+		certPEM, err := c.cert.get()
+		if err != nil {
+			return nil, err
+		}
+		keyPEM, err := c.key.get()
+		if err != nil {
+			return nil, err
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if c.ca != nil {
+		caPEM, err := c.ca.get()
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, errors.New("invalid CA certificate")
+		}
+	}
+	if c.transport != nil {
+		c.transport.CloseIdleConnections()
+	}
+	c.transport = http.DefaultTransport.(*http.Transport).Clone()
+	c.transport.TLSClientConfig = config
+	c.created = time.Now()
+	return c.transport, nil
+}
+
+// authorize adds the bearer token to req.
+func (c *targetCredentials) authorize(req *http.Request) error {
+	if c == nil || c.bearer == nil {
+		return nil
+	}
+	token, err := c.bearer.get()
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	return nil
+}
+
+// setCredential sets the secret of the credential option key of a target,
+// bearer, cert, key, or ca, and reports whether key is one.
+func (c *targetCredentials) setCredential(key, ref string) (bool, error) {
+	var dst **secret
+	switch key {
+	case "bearer":
+		dst = &c.bearer
+	case "cert":
+		dst = &c.cert
+	case "key":
+		dst = &c.key
+	case "ca":
+		dst = &c.ca
+	default:
+		return false, nil
+	}
+	s, err := parseSecret(ref, c.logger)
+	if err != nil {
+		return true, err
+	}
+	*dst = s
+	return true, nil
+}
+
+// validate checks that a client certificate comes with its key.
+func (c *targetCredentials) validate() error {
+	if (c.cert == nil) != (c.key == nil) {
+		return errors.New("cert and key are required together")
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package pprofweb
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// versionLabel is the sample label carrying the version of the program.
+const versionLabel = "version"
+
+// semver is a semantic version like v1.2.3-rc.1+build.
+type semver struct {
+	major, minor, patch int
+	// pre are the dot separated identifiers of the pre-release.
+	pre []string
+}
+
+// parseSemver parses a semantic version with an optional v prefix. Build
+// metadata is ignored.
+func parseSemver(s string) (semver, bool) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if i := strings.Index(s, "+"); i >= 0 {
+		s = s[:i]
+	}
+	var v semver
+	if i := strings.Index(s, "-"); i >= 0 {
+		v.pre = strings.Split(s[i+1:], ".")
+		s = s[:i]
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return semver{}, false
+	}
+	numbers := make([]int, 3)
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return semver{}, false
+		}
+		numbers[i] = n
+	}
+	v.major, v.minor, v.patch = numbers[0], numbers[1], numbers[2]
+	return v, true
+}
+
+// compare returns -1, 0, or 1 if v is lower, equal, or higher than o by the
+// precedence of semantic versioning: pre-releases are lower than the release.
+func (v semver) compare(o semver) int {
+	for _, d := range []int{v.major - o.major, v.minor - o.minor, v.patch - o.patch} {
+		if d != 0 {
+			return sign(d)
+		}
+	}
+	switch {
+	case len(v.pre) == 0 && len(o.pre) == 0:
+		return 0
+	case len(v.pre) == 0:
+		return 1
+	case len(o.pre) == 0:
+		return -1
+	}
+	for i := 0; i < len(v.pre) && i < len(o.pre); i++ {
+		a, aErr := strconv.Atoi(v.pre[i])
+		b, bErr := strconv.Atoi(o.pre[i])
+		switch {
+		case aErr == nil && bErr == nil:
+			if a != b {
+				return sign(a - b)
+			}
+		case aErr == nil:
+			// numeric identifiers are lower than alphanumeric ones
+			return -1
+		case bErr == nil:
+			return 1
+		default:
+			if c := strings.Compare(v.pre[i], o.pre[i]); c != 0 {
+				return c
+			}
+		}
+	}
+	return sign(len(v.pre) - len(o.pre))
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
+
+// profileVersion returns the most common value of the version label of the
+// samples of p, or "".
+func profileVersion(p *profile.Profile) string {
+	counts := make(map[string]int)
+	best := ""
+	for _, s := range p.Sample {
+		for _, v := range s.Label[versionLabel] {
+			counts[v]++
+			if counts[v] > counts[best] || (counts[v] == counts[best] && v < best) {
+				best = v
+			}
+		}
+	}
+	return best
+}
+
+// versionEntry is the version and type of a profile file with modTime.
+type versionEntry struct {
+	modTime time.Time
+	version string
+	typ     profileType
+}
+
+// versionIndex caches the versions of profile files by path. A nil index
+// parses the files every time.
+type versionIndex struct {
+	mu      sync.Mutex
+	entries map[string]versionEntry
+}
+
+func newVersionIndex() *versionIndex {
+	return &versionIndex{entries: make(map[string]versionEntry)}
+}
+
+func (x *versionIndex) lookup(path string, modTime time.Time) (versionEntry, error) {
+	if x != nil {
+		x.mu.Lock()
+		e, ok := x.entries[path]
+		x.mu.Unlock()
+		if ok && e.modTime.Equal(modTime) {
+			return e, nil
+		}
+	}
+	p, err := parseProfileFile(path)
+	if err != nil {
+		return versionEntry{}, err
+	}
+	e := versionEntry{modTime: modTime, version: profileVersion(p), typ: detectProfileType(p, path)}
+	if x != nil {
+		x.mu.Lock()
+		x.entries[path] = e
+		x.mu.Unlock()
+	}
+	return e, nil
+}
+
+// add caches the entry e of the file path, e.g. from the index of its root.
+func (x *versionIndex) add(path string, e versionEntry) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.entries[path] = e
+}
+
+// cached returns the entry of the file path if it was parsed since modTime.
+func (x *versionIndex) cached(path string, modTime time.Time) (versionEntry, bool) {
+	if x == nil {
+		return versionEntry{}, false
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	e, ok := x.entries[path]
+	return e, ok && e.modTime.Equal(modTime)
+}
+
+// previousRelease returns the profile of the previous release of head, the
+// profile headName of root: of the profiles in the same directory of the
+// same type, the one with the highest release version lower than the version
+// label of head. Pre-releases are not baselines. Profiles of buckets are
+// only fetched if their version isn't indexed.
+func (x *versionIndex) previousRelease(ctx context.Context, root *profileRoot, headName string, head *profile.Profile, extensions []string) (profileFile, string, error) {
+	headVersion := profileVersion(head)
+	if headVersion == "" {
+		return profileFile{}, "", fmt.Errorf("head has no %s label to find the previous release", versionLabel)
+	}
+	hv, ok := parseSemver(headVersion)
+	if !ok {
+		return profileFile{}, "", fmt.Errorf("head version %q is not a semantic version", headVersion)
+	}
+	headType := detectProfileType(head, headName)
+
+	files, err := root.listProfiles(extensions)
+	if err != nil {
+		return profileFile{}, "", err
+	}
+	dir := path.Dir(headName)
+	var bestFile profileFile
+	var bestVersion string
+	var best semver
+	for _, f := range files {
+		if path.Dir(f.name) != dir || f.name == headName {
+			continue
+		}
+		e, ok := x.cached(f.path, f.modTime)
+		if !ok {
+			if err := root.fetch(ctx, f); err != nil {
+				continue
+			}
+			if e, err = x.lookup(f.path, f.modTime); err != nil {
+				continue
+			}
+		}
+		if e.typ != headType {
+			continue
+		}
+		v, ok := parseSemver(e.version)
+		if !ok || len(v.pre) > 0 || v.compare(hv) >= 0 {
+			continue
+		}
+		if bestVersion == "" || v.compare(best) > 0 {
+			bestFile, bestVersion, best = f, e.version, v
+		}
+	}
+	if bestVersion == "" {
+		return profileFile{}, "", fmt.Errorf("no profile of a release before %s next to the head", headVersion)
+	}
+	return bestFile, bestVersion, nil
+}
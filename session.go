@@ -0,0 +1,356 @@
+package pprofweb
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/google/pprof/profile"
+	"github.com/google/uuid"
+)
+
+// pprofViews maps the views of the pprof web UI to their paths below the
+// session.
+var pprofViews = map[string]string{
+	"graph":      "",
+	"top":        "top",
+	"flamegraph": "flamegraph",
+	"peek":       "peek",
+	"source":     "source",
+	"disasm":     "disasm",
+}
+
+// granularities are the values of pprof's granularity option.
+var granularities = []string{"functions", "filefunctions", "files", "lines", "addresses"}
+
+// sessionInfo describes the profile loaded in a session.
+type sessionInfo struct {
+	// profileName is the reference the profile was opened with.
+	profileName string
+	profileType profileType
+	// urlDefaults are pprof web UI URL parameters added to requests that
+	// don't set them.
+	urlDefaults url.Values
+	// links are related sessions, e.g. the off-CPU profile of the same capture.
+	links []sessionLink
+	// combined is set if the profile isn't stored but combined of others.
+	combined bool
+	// insights are the findings of heuristics about the profile.
+	insights []insight
+	// runtimeMetrics were captured with the profile, if any.
+	runtimeMetrics *runtimeMetrics
+	// details are shown on the build info page.
+	details *profileDetails
+	// expectedHot is set if the service of the profile has a list of
+	// expected hot functions.
+	expectedHot bool
+	// args are the additional pprof flags the session was started with.
+	args []string
+	// base is the profile the session compares the profile to, with
+	// pprof's -base, or -diff_base if diffBase is set, and baseName its
+	// reference.
+	base     *profile.Profile
+	baseName string
+	diffBase bool
+}
+
+// sessionLink is a link to a session shown on the pages of related sessions.
+type sessionLink struct {
+	label string
+	id    string
+}
+
+// sessionOptions configures a new pprof session.
+type sessionOptions struct {
+	// view is the view of the pprof web UI users land on.
+	view        string
+	granularity string
+	sampleIndex string
+	unit        string
+	// args are additional command line flags for pprof. pprof keeps them in a
+	// process wide configuration, so they must be the same for all sessions,
+	// except for --tools.
+	args []string
+	// arch overrides the architecture of the binary of the profile for the
+	// object tools.
+	arch string
+	// dropFrames removes matching functions and their callees from the stacks
+	// unless they match keepFrames, like the fields of profile.proto.
+	dropFrames *regexp.Regexp
+	keepFrames *regexp.Regexp
+	// nodeCount, nodeFraction, and edgeFraction prune the graph view like
+	// pprof's options of the same names; 0 is pprof's default.
+	nodeCount    int
+	nodeFraction float64
+	edgeFraction float64
+	// unstored is set for profiles that aren't stored in the root of the
+	// session, e.g. fetched from a URL.
+	unstored bool
+	// baseRef is the reference of the profile to compare to, subtracting
+	// it, or showing the changes relative to it if diffBase is set; base is
+	// the profile once it is loaded.
+	baseRef  string
+	diffBase bool
+	base     *profile.Profile
+}
+
+// parseSessionOptions returns the options of a new session from the
+// deployment defaults, overridden by the query parameters view, granularity,
+// drop_frames, keep_frames, node_count, node_fraction, and edge_fraction.
+// Empty drop_frames disables the default rule. base or diff_base select a
+// profile to compare to.
+func (s *server) parseSessionOptions(query url.Values) (*sessionOptions, error) {
+	opts := &sessionOptions{
+		view:         s.defaultView,
+		granularity:  s.defaultGranularity,
+		args:         s.pprofArgs,
+		nodeCount:    s.nodeCount,
+		nodeFraction: s.nodeFraction,
+		edgeFraction: s.edgeFraction,
+	}
+	if view := query.Get("view"); view != "" {
+		opts.view = view
+	}
+	opts.arch = query.Get("arch")
+	if opts.view != "" {
+		if err := validateView(opts.view); err != nil {
+			return nil, err
+		}
+	}
+
+	if g := query.Get("granularity"); g != "" {
+		opts.granularity = g
+	}
+	if opts.granularity != "" {
+		if err := validateGranularity(opts.granularity); err != nil {
+			return nil, err
+		}
+	}
+
+	dropFrames, keepFrames := s.dropFrames, s.keepFrames
+	if _, ok := query["drop_frames"]; ok {
+		dropFrames = query.Get("drop_frames")
+	}
+	if _, ok := query["keep_frames"]; ok {
+		keepFrames = query.Get("keep_frames")
+	}
+	var err error
+	if opts.dropFrames, err = compileFrameRule(dropFrames); err != nil {
+		return nil, fmt.Errorf("drop_frames: %w", err)
+	}
+	if opts.keepFrames, err = compileFrameRule(keepFrames); err != nil {
+		return nil, fmt.Errorf("keep_frames: %w", err)
+	}
+
+	if n := query.Get("node_count"); n != "" {
+		if opts.nodeCount, err = strconv.Atoi(n); err != nil {
+			return nil, fmt.Errorf("node_count: %w", err)
+		}
+	}
+	if f := query.Get("node_fraction"); f != "" {
+		if opts.nodeFraction, err = strconv.ParseFloat(f, 64); err != nil {
+			return nil, fmt.Errorf("node_fraction: %w", err)
+		}
+	}
+	if f := query.Get("edge_fraction"); f != "" {
+		if opts.edgeFraction, err = strconv.ParseFloat(f, 64); err != nil {
+			return nil, fmt.Errorf("edge_fraction: %w", err)
+		}
+	}
+	if err := validateGraphOptions(opts.nodeCount, opts.nodeFraction, opts.edgeFraction); err != nil {
+		return nil, err
+	}
+	opts.baseRef = query.Get("base")
+	if diffBase := query.Get("diff_base"); diffBase != "" {
+		if opts.baseRef != "" {
+			return nil, errors.New("base and diff_base can't both be set")
+		}
+		opts.baseRef, opts.diffBase = diffBase, true
+	}
+	return opts, nil
+}
+
+// validateGraphOptions checks the options pruning the graph view: a node
+// count that isn't negative and fractions of the total between 0 and 1.
+func validateGraphOptions(nodeCount int, nodeFraction, edgeFraction float64) error {
+	if nodeCount < 0 {
+		return fmt.Errorf("node_count %d is negative", nodeCount)
+	}
+	if nodeFraction < 0 || nodeFraction > 1 {
+		return fmt.Errorf("node_fraction %g is not between 0 and 1", nodeFraction)
+	}
+	if edgeFraction < 0 || edgeFraction > 1 {
+		return fmt.Errorf("edge_fraction %g is not between 0 and 1", edgeFraction)
+	}
+	return nil
+}
+
+// compileFrameRule compiles the regexp rule matching entire function names.
+// It returns nil for an empty rule.
+func compileFrameRule(rule string) (*regexp.Regexp, error) {
+	if rule == "" {
+		return nil, nil
+	}
+	return regexp.Compile("^(" + rule + ")$")
+}
+
+// pruneFrames applies the frame filtering rules to p.
+func (o *sessionOptions) pruneFrames(p *profile.Profile) {
+	if o.dropFrames != nil {
+		p.Prune(o.dropFrames, o.keepFrames)
+	}
+}
+
+// applyProfileType fills the options that were not set with the defaults of
+// the profile type t of p.
+func (o *sessionOptions) applyProfileType(t profileType, p *profile.Profile) {
+	defaults := profileTypeDefaults[t]
+	if o.view == "" {
+		o.view = defaults.view
+	}
+	if o.unit == "" {
+		o.unit = defaults.unit
+	}
+	// respect the sample type the profile asks for, e.g. alloc_space for
+	// allocs profiles
+	if o.sampleIndex == "" && p.DefaultSampleType == "" && sampleIndexByName(p, defaults.sampleIndex) >= 0 {
+		o.sampleIndex = defaults.sampleIndex
+	}
+}
+
+// urlDefaults returns the pprof web UI URL parameters for the per session
+// options.
+func (o *sessionOptions) urlDefaults() url.Values {
+	values := url.Values{}
+	if o.granularity != "" {
+		values.Set("g", o.granularity)
+	}
+	if o.sampleIndex != "" {
+		values.Set("si", o.sampleIndex)
+	}
+	if o.unit != "" {
+		values.Set("unit", o.unit)
+	}
+	if o.nodeCount > 0 {
+		values.Set("n", strconv.Itoa(o.nodeCount))
+	}
+	if o.nodeFraction > 0 {
+		values.Set("nf", strconv.FormatFloat(o.nodeFraction, 'g', -1, 64))
+	}
+	if o.edgeFraction > 0 {
+		values.Set("ef", strconv.FormatFloat(o.edgeFraction, 'g', -1, 64))
+	}
+	return values
+}
+
+// withQueryDefaults adds the parameters of defaults that are missing from
+// the query of requests to handler.
+func withQueryDefaults(handler http.Handler, defaults url.Values) http.Handler {
+	if len(defaults) == 0 {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		for key, values := range defaults {
+			if _, ok := query[key]; !ok {
+				query[key] = values
+			}
+		}
+		r2 := new(http.Request)
+		*r2 = *r
+		u := *r.URL
+		u.RawQuery = query.Encode()
+		r2.URL = &u
+		handler.ServeHTTP(w, r2)
+	})
+}
+
+// switchSampleType serves GET pprofWebPath/id/sample?si=&view=, switching the
+// session id to the sample type si: it starts a session of the same profile
+// and options showing si by default, redirects to its page view with the
+// remaining query parameters, and ends the old session unless sessions link
+// to it. The switched session starts outside servePprof, which holds
+// pprofHandlerMutex while serving.
+func (s *server) switchSampleType(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	si, view := query.Get("si"), query.Get("view")
+	query.Del("si")
+	query.Del("view")
+	if strings.Contains(view, "/") || view == ".." {
+		http.Error(w, "invalid view", http.StatusBadRequest)
+		return
+	}
+
+	s.pprofHandlerMutex.RLock()
+	h, ok := s.pprofHandler[id]
+	s.pprofHandlerMutex.RUnlock()
+	if !ok {
+		http.Error(w, "profile handler not loaded", http.StatusNotFound)
+		return
+	}
+	if !requireAuth(w, r, h.root) {
+		return
+	}
+	if sampleIndexByName(h.profile, si) < 0 {
+		http.Error(w, fmt.Sprintf("profile has no sample type %q", si), http.StatusBadRequest)
+		return
+	}
+	linked := len(h.info.links) > 0
+	if !s.checkMaintenance(w) || (linked && !s.checkSessionQuota(w, h.root)) {
+		return
+	}
+
+	info := *h.info
+	info.urlDefaults = url.Values{}
+	for k, v := range h.info.urlDefaults {
+		info.urlDefaults[k] = v
+	}
+	info.urlDefaults.Set("si", si)
+	newID := uuid.New().String()
+	if g := requestGuest(r.Context()); g != nil {
+		g.allowSession(newID)
+	}
+	// pprof modifies the profiles of sessions
+	if err := s.startSession(newID, h.root, h.profile.Copy(), &info, h.info.args); err != nil {
+		s.logger.Printf("%s pprof error: %+v", requestID(r.Context()), err)
+		http.Error(w, "pprof error", http.StatusInternalServerError)
+		return
+	}
+	s.logger.Printf("%s session %s: sample type %s in session %s", requestID(r.Context()), id, si, newID)
+	if !linked {
+		s.pprofHandlerMutex.Lock()
+		if s.pprofHandler[id] == h {
+			s.endSession(id, h)
+		}
+		s.pprofHandlerMutex.Unlock()
+	}
+	target := pprofWebPath + newID + "/" + view
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
+func validateView(view string) error {
+	if _, ok := pprofViews[view]; !ok {
+		return fmt.Errorf("unknown view %q", view)
+	}
+	return nil
+}
+
+func validateGranularity(granularity string) error {
+	for _, g := range granularities {
+		if g == granularity {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown granularity %q", granularity)
+}
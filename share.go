@@ -0,0 +1,114 @@
+package pprofweb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// maxShareRecipients limits the recipients of a share email.
+const maxShareRecipients = 10
+
+// shareEmailRequest is the JSON body of POST /api/v1/share-email: the
+// recipients and the guest link they get.
+type shareEmailRequest struct {
+	guestLinkRequest
+	To []string `json:"to"`
+	// Message is added to the email, e.g. what to look at.
+	Message string `json:"message"`
+}
+
+// shareEmailHandler serves POST /api/v1/share-email: it creates a guest link
+// for the profiles and sessions of the request and emails it to the
+// recipients, for teams that don't share links in chat. The grant is
+// recorded in the audit log.
+func (s *server) shareEmailHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.smtpAddr == "" {
+		http.Error(w, "sharing via email is disabled: start the server with --smtp", http.StatusNotImplemented)
+		return
+	}
+	if !s.mayCreateGuestLinks(w, r) {
+		return
+	}
+	// forms of other sites can't post JSON
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+	var req shareEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(req.To) == 0 || len(req.To) > maxShareRecipients {
+		http.Error(w, fmt.Sprintf("share with 1 to %d recipients", maxShareRecipients), http.StatusBadRequest)
+		return
+	}
+	to := make([]string, len(req.To))
+	for i, addr := range req.To {
+		parsed, err := mail.ParseAddress(addr)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid recipient %q: %v", addr, err), http.StatusBadRequest)
+			return
+		}
+		to[i] = parsed.Address
+	}
+
+	g, ok := s.newGuestLink(w, r, req.guestLinkRequest)
+	if !ok {
+		return
+	}
+	link := strings.TrimSuffix(s.publicURL, "/") + "/guest/" + g.token
+	if err := s.sendShareEmail(g, to, link, req); err != nil {
+		s.guests.revoke(g.token)
+		s.logger.Printf("%s share email to %s: %v", requestID(r.Context()), strings.Join(to, ", "), err)
+		http.Error(w, "could not send the email", http.StatusBadGateway)
+		return
+	}
+	s.stats.Count("share.email", 1)
+	s.audit(r, auditEvent{Action: "share-email", Recipients: to, Profiles: req.Profiles, Sessions: req.Sessions, Expires: &g.expires})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(guestLinkResponse{URL: "/guest/" + g.token, Expires: g.expires})
+}
+
+// sendShareEmail emails the guest link g at link to the recipients to.
+func (s *server) sendShareEmail(g *guestLink, to []string, link string, req shareEmailRequest) error {
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "%s shared with you on pprofweb:\r\n\r\n", g.creator)
+	for _, ref := range req.Profiles {
+		fmt.Fprintf(&body, "  profile %s\r\n", ref)
+	}
+	s.pprofHandlerMutex.RLock()
+	for _, id := range req.Sessions {
+		if handler, ok := s.pprofHandler[id]; ok {
+			fmt.Fprintf(&body, "  session of %s\r\n", handler.info.profileName)
+		}
+	}
+	s.pprofHandlerMutex.RUnlock()
+	if req.Message != "" {
+		fmt.Fprintf(&body, "\r\n%s\r\n", strings.ReplaceAll(strings.ReplaceAll(req.Message, "\r\n", "\n"), "\n", "\r\n"))
+	}
+	fmt.Fprintf(&body, "\r\nOpen: %s\r\n\r\nAnyone with the link can open it until %s.\r\n",
+		link, g.expires.UTC().Format("2006-01-02 15:04 MST"))
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.mailFrom)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", g.creator+" shared a profile on pprofweb"))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.Write(body.Bytes())
+	return sendMail(s.smtpAddr, s.smtpUser, s.smtpPassword, s.mailFrom, to, msg.Bytes())
+}
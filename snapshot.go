@@ -0,0 +1,84 @@
+package pprofweb
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// snapshotHandler returns the handler of GET <session>/snapshot?view=top,
+// which downloads the page of the view of the session with info as a single
+// HTML file, for tickets where the server may not be reachable later. The
+// other query parameters, e.g. si, focus, or tf, select the state of the view
+// like on its page. pages serves the pages of the session without the
+// elements added for the server, which need it.
+func (s *server) snapshotHandler(id string, info *sessionInfo, pages http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+			return
+		}
+		query := r.URL.Query()
+		view := query.Get("view")
+		if view == "" {
+			view = "graph"
+		}
+		viewPath, ok := pprofViews[view]
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown view %q", view), http.StatusBadRequest)
+			return
+		}
+		query.Del("view")
+
+		r2 := new(http.Request)
+		*r2 = *r
+		u := *r.URL
+		u.Path = pprofWebPath + id + "/" + viewPath
+		u.RawQuery = query.Encode()
+		r2.URL = &u
+		rec := &bufferedResponse{header: make(http.Header), status: http.StatusOK}
+		pages.ServeHTTP(rec, r2)
+		contentType := rec.header.Get("Content-Type")
+		if contentType == "" {
+			contentType = http.DetectContentType(rec.body.Bytes())
+		}
+		if rec.status != http.StatusOK || !strings.HasPrefix(contentType, "text/html") {
+			http.Error(w, fmt.Sprintf("could not export the %s view: %s", view, strings.TrimSpace(rec.body.String())), http.StatusBadRequest)
+			return
+		}
+
+		// links of the page lead to the live session as long as it exists
+		sessionURL := strings.TrimSuffix(s.publicURL, "/") + pprofWebPath + id + "/"
+		page := rec.body.Bytes()
+		if i := bytes.Index(page, []byte("<head>")); i >= 0 {
+			i += len("<head>")
+			page = append(page[:i:i], append([]byte(`<base href="`+html.EscapeString(sessionURL)+`">`), page[i:]...)...)
+		}
+		page = insertBeforeBodyEnd(page, []byte(snapshotNote(info, view, query, time.Now())))
+
+		name := exportName(info.profileName) + "-" + view + ".html"
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+		w.Header().Set("Content-Length", strconv.Itoa(len(page)))
+		w.Write(page)
+	})
+}
+
+// snapshotNote returns the badge of an exported page telling where and when
+// it is from.
+func snapshotNote(info *sessionInfo, view string, query url.Values, exported time.Time) string {
+	state := ""
+	if len(query) > 0 {
+		state = " ?" + query.Encode()
+	}
+	return fmt.Sprintf(`<div style="position:fixed;bottom:8px;right:8px;z-index:1000;background:#333;color:#fff;`+
+		`padding:4px 8px;border-radius:4px;font:13px sans-serif;opacity:0.9">`+
+		`Snapshot of the %s view of <b>%s</b> %s%s, exported %s from pprofweb</div>`,
+		html.EscapeString(view), html.EscapeString(info.profileType.title()), html.EscapeString(info.profileName),
+		html.EscapeString(state), exported.UTC().Format("2006-01-02 15:04 MST"))
+}
@@ -0,0 +1,112 @@
+package pprofweb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"strings"
+)
+
+// defaultProfileExtensions are the file name suffixes accepted without looking
+// at the file contents.
+var defaultProfileExtensions = []string{".pb.gz", ".pb", ".pprof", ".prof"}
+
+// sniffLen is the number of bytes read from the start of a file to decide if
+// it looks like a profile.
+const sniffLen = 512
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// hasAllowedExtension reports whether name ends with one of the extensions,
+// optionally followed by a compressed extension.
+func hasAllowedExtension(name string, extensions []string) bool {
+	name = trimCompressedExtension(name)
+	for _, ext := range extensions {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// sniffProfileFile reports whether the file at path looks like a pprof profile
+// by inspecting its first bytes.
+func sniffProfileFile(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, sniffLen)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	return looksLikeProfile(buf[:n]), nil
+}
+
+// looksLikeProfile reports whether data is compressed, a text goroutine dump,
+// or starts with a plausible sequence of fields of the profile.proto Profile
+// message.
+func looksLikeProfile(data []byte) bool {
+	if bytes.HasPrefix(data, gzipMagic) || isCompressed(data) || isGoroutineDump(data) || isGoroutineCount(data) {
+		return true
+	}
+	return probeProfileProto(data)
+}
+
+// probeProfileProto walks the protobuf fields in data and checks that every
+// field number and wire type matches the Profile message. data may be a
+// truncated prefix of the message: a field running past its end is accepted.
+func probeProfileProto(data []byte) bool {
+	fields := 0
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return fields > 0 && n == 0
+		}
+		data = data[n:]
+		field, wireType := tag>>3, tag&7
+
+		switch {
+		case field >= 1 && field <= 6 || field == 11:
+			// repeated messages, the string table, and period_type: length
+			// delimited
+			if wireType != 2 {
+				return false
+			}
+		case field >= 7 && field <= 14:
+			// int64 scalars; comment (13) may also be packed
+			if wireType != 0 && !(field == 13 && wireType == 2) {
+				return false
+			}
+		default:
+			return false
+		}
+		fields++
+
+		if wireType == 0 {
+			_, n := binary.Uvarint(data)
+			if n < 0 {
+				return false
+			}
+			if n == 0 {
+				return true
+			}
+			data = data[n:]
+			continue
+		}
+
+		length, n := binary.Uvarint(data)
+		if n < 0 {
+			return false
+		}
+		if n == 0 || uint64(len(data)-n) < length {
+			return true
+		}
+		data = data[n+int(length):]
+	}
+	return fields > 0
+}
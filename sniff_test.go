@@ -0,0 +1,47 @@
+package pprofweb
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/pprof/profile"
+)
+
+func TestProbeProfileProto(t *testing.T) {
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}},
+		PeriodType: &profile.ValueType{Type: "cpu", Unit: "nanoseconds"},
+		Period:     10000000,
+		Comments:   []string{"comment"},
+		Sample:     []*profile.Sample{{Value: []int64{1}}},
+	}
+	var encoded bytes.Buffer
+	if err := p.WriteUncompressed(&encoded); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"encoded profile", encoded.Bytes(), true},
+		{"truncated profile", encoded.Bytes()[:encoded.Len()/2], true},
+		{"sample_type", []byte{0x0a, 0x02, 0x08, 0x01}, true},
+		{"period_type", []byte{0x5a, 0x04, 0x08, 0x01, 0x10, 0x02}, true},
+		{"period_type and period", []byte{0x5a, 0x02, 0x08, 0x01, 0x60, 0x64}, true},
+		{"packed comment", []byte{0x6a, 0x02, 0x01, 0x02}, true},
+		{"field running past the end", []byte{0x0a, 0x10, 0x01}, true},
+		{"empty", nil, false},
+		{"period_type as varint", []byte{0x58, 0x01}, false},
+		{"string_table as varint", []byte{0x30, 0x01}, false},
+		{"period as length delimited", []byte{0x62, 0x01, 0x00}, false},
+		{"unknown field", []byte{0x78, 0x01}, false},
+		{"text", []byte("hello world"), false},
+	}
+	for _, test := range tests {
+		if got := probeProfileProto(test.data); got != test.want {
+			t.Errorf("%s: probeProfileProto(% x) = %v, want %v", test.name, test.data, got, test.want)
+		}
+	}
+}
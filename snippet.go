@@ -0,0 +1,186 @@
+package pprofweb
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultSnippetDuration is the validity of the upload URL of generated
+// capture commands.
+const defaultSnippetDuration = 24 * time.Hour
+
+// shellQuote quotes s as a single argument of a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// captureURL returns the URL of the profile type t of the net/http/pprof
+// handlers of target.
+func captureURL(target *url.URL, t string, seconds int) string {
+	ref := &url.URL{Path: path.Join(target.Path, "/debug/pprof", pprofEndpoints[t])}
+	if t == "cpu" {
+		ref.RawQuery = "seconds=" + strconv.Itoa(seconds)
+	}
+	return target.ResolveReference(ref).String()
+}
+
+// snippetHandler serves a form at GET /capture-snippet generating curl and
+// wget commands that capture a profile of a service and upload it with a
+// pre-signed URL, for teams to try pprofweb without setting up credentials.
+// The form takes the target URL, the profile type, the seconds of CPU
+// profiles, the service name, and the root.
+func (s *server) snippetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.allowUpload {
+		http.Error(w, "uploads are disabled", http.StatusForbidden)
+		return
+	}
+	if !s.requireRole(w, r, uploaderRole) {
+		return
+	}
+	query := r.URL.Query()
+	data := struct {
+		Target, Type, Service, Root string
+		Seconds                     int
+		Types, Roots                []string
+		Error                       string
+		Command                     *captureCommand
+	}{
+		Target:  query.Get("target"),
+		Type:    query.Get("type"),
+		Service: query.Get("service"),
+		Root:    query.Get("root"),
+		Seconds: 30,
+	}
+	for t := range pprofEndpoints {
+		data.Types = append(data.Types, t)
+	}
+	sort.Strings(data.Types)
+	for _, root := range s.roots {
+		if root.authorized(r) {
+			data.Roots = append(data.Roots, root.name)
+		}
+	}
+	if data.Type == "" {
+		data.Type = "cpu"
+	}
+
+	if n, err := strconv.Atoi(query.Get("seconds")); err == nil {
+		data.Seconds = n
+	}
+	if data.Target != "" {
+		var err error
+		data.Command, err = s.captureCommand(r, data.Target, data.Type, data.Seconds, data.Service, data.Root)
+		if err != nil {
+			data.Error = err.Error()
+		}
+	}
+	if err := snippetTemplate.Execute(w, data); err != nil {
+		s.logger.Printf("%s capture snippet: %v", requestID(r.Context()), err)
+	}
+}
+
+// captureCommand are the commands capturing a profile and uploading it with
+// a pre-signed URL.
+type captureCommand struct {
+	// Profile is the reference the profile is stored as.
+	Profile string
+	Curl    string
+	Wget    string
+	// Expires is the formatted expiry of the upload URL.
+	Expires string
+}
+
+// captureCommand returns the commands capturing the profile type t of the
+// service at rawTarget into root rootName.
+func (s *server) captureCommand(r *http.Request, rawTarget, t string, seconds int, service, rootName string) (*captureCommand, error) {
+	target, err := url.Parse(rawTarget)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return nil, fmt.Errorf("the target must be an http or https URL like http://localhost:6060")
+	}
+	if _, ok := pprofEndpoints[t]; !ok {
+		return nil, fmt.Errorf("unknown profile type %q", t)
+	}
+	if seconds < 1 || time.Duration(seconds)*time.Second > maxCaptureDuration {
+		return nil, fmt.Errorf("seconds must be between 1 and %d", int(maxCaptureDuration/time.Second))
+	}
+	if service == "" {
+		service = target.Hostname()
+	}
+	if strings.Contains(service, "/") || service == "." || service == ".." {
+		return nil, fmt.Errorf("the service name must not contain /")
+	}
+	ref := capturedProfileName(service, t, time.Now())
+	if rootName != "" {
+		ref = rootName + "/" + ref
+	}
+	root, name := s.resolveRoot(r, ref)
+	if !root.authorized(r) {
+		return nil, fmt.Errorf("unauthorized for root %q", rootName)
+	}
+
+	validity := defaultSnippetDuration
+	if validity > s.maxUploadURLDuration {
+		validity = s.maxUploadURLDuration
+	}
+	signed := s.signUploadURL(r, root, name, validity)
+	source := shellQuote(captureURL(target, t, seconds))
+	prefs, err := s.requestPrefs(r)
+	if err != nil {
+		prefs = s.displayPrefs
+	}
+	return &captureCommand{
+		Profile: signed.Profile,
+		Curl:    "curl -sSf " + source + " | curl -sSf --data-binary @- " + shellQuote(signed.URL),
+		Wget: "wget -qO /tmp/pprofweb.pb.gz " + source +
+			" && wget -qO- --post-file=/tmp/pprofweb.pb.gz " + shellQuote(signed.URL),
+		Expires: prefs.timestamp(signed.Expires),
+	}, nil
+}
+
+var snippetTemplate = template.Must(template.New("snippet").Parse(`<!doctype html>
+<html>
+<head><title>pprofweb capture command</title>
+<style>
+body { font-family: sans-serif; }
+pre { background: #f4f4f4; padding: 8px; white-space: pre-wrap; word-break: break-all; }
+label { display: block; margin: 4px 0; }
+.error { color: #c00; }
+</style>
+</head>
+<body>
+<h1>Capture a profile</h1>
+<p>Generates a command that captures a profile of a Go service serving
+<a href="https://pkg.go.dev/net/http/pprof">net/http/pprof</a> and uploads it
+here without credentials.</p>
+<form method="get">
+<label>Target <input name="target" size="40" placeholder="http://localhost:6060" value="{{.Target}}"></label>
+<label>Profile <select name="type">{{range .Types}}<option{{if eq . $.Type}} selected{{end}}>{{.}}</option>{{end}}</select></label>
+<label>Seconds (CPU profiles) <input name="seconds" type="number" min="1" value="{{.Seconds}}"></label>
+<label>Service <input name="service" placeholder="hostname of the target" value="{{.Service}}"></label>
+{{if .Roots}}<label>Root <select name="root"><option value="">default</option>{{range .Roots}}<option{{if eq . $.Root}} selected{{end}}>{{.}}</option>{{end}}</select></label>{{end}}
+<button>Generate</button>
+</form>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+{{with .Command}}
+<h2>curl</h2>
+<pre>{{.Curl}}</pre>
+<h2>wget</h2>
+<pre>{{.Wget}}</pre>
+<p>The profile is stored as <a href="/?profile={{.Profile}}">{{.Profile}}</a>. The
+command uploads one profile until {{.Expires}}; generate a new one for the next
+capture, or use <code>pprofweb push</code> or <code>pprofweb agent</code> with a token.</p>
+{{end}}
+</body>
+</html>
+`))
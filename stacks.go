@@ -0,0 +1,257 @@
+package pprofweb
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/google/pprof/profile"
+)
+
+// topEntry is one row of a top table: the value of samples with the function
+// as leaf (flat) and with the function anywhere on the stack (cum).
+type topEntry struct {
+	Name string `json:"name"`
+	Flat int64  `json:"flat"`
+	Cum  int64  `json:"cum"`
+}
+
+// flameNode is a node of a flame graph: the total value of all stacks with
+// the prefix up to this node.
+type flameNode struct {
+	Name     string       `json:"name"`
+	Value    int64        `json:"value"`
+	Children []*flameNode `json:"children,omitempty"`
+
+	childByName map[string]*flameNode
+}
+
+// defaultSampleIndex returns the index of the sample type pprof shows by
+// default: the profile's default sample type or else the last one.
+func defaultSampleIndex(p *profile.Profile) int {
+	if p.DefaultSampleType != "" {
+		if i := sampleIndexByName(p, p.DefaultSampleType); i >= 0 {
+			return i
+		}
+	}
+	return len(p.SampleType) - 1
+}
+
+// selectSampleIndex returns the index of the sample type name, the default
+// sample type if name is empty.
+func selectSampleIndex(p *profile.Profile, name string) (int, error) {
+	if len(p.SampleType) == 0 {
+		return 0, fmt.Errorf("profile has no sample types")
+	}
+	if name == "" {
+		return defaultSampleIndex(p), nil
+	}
+	i := sampleIndexByName(p, name)
+	if i < 0 {
+		return 0, fmt.Errorf("profile has no sample type %q", name)
+	}
+	return i, nil
+}
+
+// sampleIndexByName returns the index of the sample type name or -1.
+func sampleIndexByName(p *profile.Profile, name string) int {
+	for i, st := range p.SampleType {
+		if st.Type == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// sampleFrames returns the function names of the stack of s from the root to
+// the leaf, including inlined functions.
+func sampleFrames(s *profile.Sample) []string {
+	var frames []string
+	for i := len(s.Location) - 1; i >= 0; i-- {
+		loc := s.Location[i]
+		if len(loc.Line) == 0 {
+			frames = append(frames, fmt.Sprintf("0x%x", loc.Address))
+			continue
+		}
+		for j := len(loc.Line) - 1; j >= 0; j-- {
+			name := "?"
+			if loc.Line[j].Function != nil {
+				name = loc.Line[j].Function.Name
+			}
+			frames = append(frames, name)
+		}
+	}
+	return frames
+}
+
+// sampleTotal returns the sum of the values at sampleIndex.
+func sampleTotal(p *profile.Profile, sampleIndex int) int64 {
+	var total int64
+	for _, s := range p.Sample {
+		total += s.Value[sampleIndex]
+	}
+	return total
+}
+
+// topTable returns the flat and cumulative value per function, ordered by
+// flat value.
+func topTable(p *profile.Profile, sampleIndex int) []topEntry {
+	entries := make(map[string]*topEntry)
+	entry := func(name string) *topEntry {
+		e, ok := entries[name]
+		if !ok {
+			e = &topEntry{Name: name}
+			entries[name] = e
+		}
+		return e
+	}
+
+	for _, s := range p.Sample {
+		v := s.Value[sampleIndex]
+		frames := sampleFrames(s)
+		if len(frames) == 0 {
+			continue
+		}
+		entry(frames[len(frames)-1]).Flat += v
+		// count recursive functions only once per sample
+		seen := make(map[string]bool, len(frames))
+		for _, name := range frames {
+			if !seen[name] {
+				seen[name] = true
+				entry(name).Cum += v
+			}
+		}
+	}
+
+	table := make([]topEntry, 0, len(entries))
+	for _, e := range entries {
+		table = append(table, *e)
+	}
+	sort.Slice(table, func(i, j int) bool {
+		if table[i].Flat != table[j].Flat {
+			return table[i].Flat > table[j].Flat
+		}
+		if table[i].Cum != table[j].Cum {
+			return table[i].Cum > table[j].Cum
+		}
+		return table[i].Name < table[j].Name
+	})
+	return table
+}
+
+// buildFlameGraph merges the stacks of all samples into a tree with children
+// ordered by value.
+func buildFlameGraph(p *profile.Profile, sampleIndex int) *flameNode {
+	root := &flameNode{Name: "root"}
+	for _, s := range p.Sample {
+		v := s.Value[sampleIndex]
+		node := root
+		node.Value += v
+		for _, name := range sampleFrames(s) {
+			node = node.child(name)
+			node.Value += v
+		}
+	}
+	root.sort()
+	return root
+}
+
+func (n *flameNode) child(name string) *flameNode {
+	if c, ok := n.childByName[name]; ok {
+		return c
+	}
+	if n.childByName == nil {
+		n.childByName = make(map[string]*flameNode)
+	}
+	c := &flameNode{Name: name}
+	n.childByName[name] = c
+	n.Children = append(n.Children, c)
+	return c
+}
+
+func (n *flameNode) sort() {
+	sort.Slice(n.Children, func(i, j int) bool {
+		if n.Children[i].Value != n.Children[j].Value {
+			return n.Children[i].Value > n.Children[j].Value
+		}
+		return n.Children[i].Name < n.Children[j].Name
+	})
+	for _, c := range n.Children {
+		c.sort()
+	}
+}
+
+// topDelta is the change of the values of a function between a base and a
+// head profile.
+type topDelta struct {
+	Name     string `json:"name"`
+	BaseFlat int64  `json:"base_flat"`
+	HeadFlat int64  `json:"head_flat"`
+	BaseCum  int64  `json:"base_cum"`
+	HeadCum  int64  `json:"head_cum"`
+}
+
+// flatDelta returns the change of the flat value.
+func (d topDelta) flatDelta() int64 {
+	return d.HeadFlat - d.BaseFlat
+}
+
+// diffTop joins two top tables by function name, ordered by the largest
+// absolute change of the flat value.
+func diffTop(base, head []topEntry) []topDelta {
+	deltas := make(map[string]*topDelta)
+	delta := func(name string) *topDelta {
+		d, ok := deltas[name]
+		if !ok {
+			d = &topDelta{Name: name}
+			deltas[name] = d
+		}
+		return d
+	}
+	for _, e := range base {
+		d := delta(e.Name)
+		d.BaseFlat, d.BaseCum = e.Flat, e.Cum
+	}
+	for _, e := range head {
+		d := delta(e.Name)
+		d.HeadFlat, d.HeadCum = e.Flat, e.Cum
+	}
+
+	table := make([]topDelta, 0, len(deltas))
+	for _, d := range deltas {
+		table = append(table, *d)
+	}
+	sort.Slice(table, func(i, j int) bool {
+		di, dj := abs64(table[i].flatDelta()), abs64(table[j].flatDelta())
+		if di != dj {
+			return di > dj
+		}
+		return table[i].Name < table[j].Name
+	})
+	return table
+}
+
+func abs64(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// formatValue formats a sample value in its unit for humans.
+func formatValue(v int64, unit string) string {
+	return defaultPrefs.value(v, unit)
+}
+
+func formatBytes(v int64) string {
+	const unit = 1024
+	a := abs64(v)
+	if a < unit {
+		return fmt.Sprintf("%dB", v)
+	}
+	div, exp := int64(unit), 0
+	for n := a / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(v)/float64(div), "KMGTPE"[exp])
+}
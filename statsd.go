@@ -0,0 +1,83 @@
+package pprofweb
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// statsdClient sends metrics to a statsd or DogStatsD agent over UDP. The
+// methods of a nil client do nothing, so metrics can be recorded
+// unconditionally.
+type statsdClient struct {
+	conn   net.Conn
+	prefix string
+	// tags are DogStatsD tags added to every metric. Plain statsd has no tags:
+	// they are only sent if dogStatsD is set.
+	tags      []string
+	dogStatsD bool
+}
+
+// newStatsdClient returns a client sending to the agent at addr host:port.
+func newStatsdClient(addr, prefix string, tags []string, dogStatsD bool) (*statsdClient, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("statsd %s: %w", addr, err)
+	}
+	return &statsdClient{conn: conn, prefix: prefix, tags: tags, dogStatsD: dogStatsD}, nil
+}
+
+// Count adds delta to the counter name.
+func (c *statsdClient) Count(name string, delta int64, tags ...string) {
+	c.send(name, fmt.Sprintf("%d|c", delta), tags)
+}
+
+// Gauge sets the gauge name to value.
+func (c *statsdClient) Gauge(name string, value float64, tags ...string) {
+	c.send(name, strconv.FormatFloat(value, 'f', -1, 64)+"|g", tags)
+}
+
+// Timing records the duration d in the timer name.
+func (c *statsdClient) Timing(name string, d time.Duration, tags ...string) {
+	c.send(name, strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', -1, 64)+"|ms", tags)
+}
+
+func (c *statsdClient) send(name, value string, tags []string) {
+	if c == nil {
+		return
+	}
+	var b strings.Builder
+	b.WriteString(c.prefix)
+	b.WriteString(name)
+	b.WriteString(":")
+	b.WriteString(value)
+	if c.dogStatsD && len(c.tags)+len(tags) > 0 {
+		b.WriteString("|#")
+		b.WriteString(strings.Join(append(append([]string(nil), c.tags...), tags...), ","))
+	}
+	// losing metrics is better than blocking requests: ignore errors
+	c.conn.Write([]byte(b.String()))
+}
+
+// reportGauges periodically sends the number of sessions, the memory and
+// goroutines of the process, and the requests in flight.
+func (s *server) reportGauges(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.pprofHandlerMutex.RLock()
+		sessions := len(s.pprofHandler)
+		s.pprofHandlerMutex.RUnlock()
+
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+		s.stats.Gauge("sessions.active", float64(sessions))
+		s.stats.Gauge("memory.heap_alloc_bytes", float64(mem.HeapAlloc))
+		s.stats.Gauge("memory.sys_bytes", float64(mem.Sys))
+		s.stats.Gauge("goroutines", float64(runtime.NumGoroutine()))
+		s.reportRequestGauges()
+	}
+}
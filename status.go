@@ -0,0 +1,221 @@
+package pprofweb
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"runtime"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// processStart is used for the uptime on the status page.
+var processStart = time.Now()
+
+// serverCounters count events since the start of the process for the status
+// page.
+type serverCounters struct {
+	sessionsStarted int64
+	sessionsExpired int64
+	parseErrors     int64
+	panics          int64
+	slowRequests    int64
+}
+
+type statusSession struct {
+	ID      string
+	Profile string
+	Type    string
+	Root    string
+}
+
+type statusRoot struct {
+	Name     string
+	Path     string
+	Profiles int
+	Size     string
+	Error    string
+}
+
+// statusCache is the hit rate of a cache since the start of the process.
+type statusCache struct {
+	Name    string
+	Hits    int64
+	Misses  int64
+	HitRate string
+}
+
+type statusPage struct {
+	Uptime          time.Duration
+	GoVersion       string
+	Goroutines      int
+	HeapAlloc       string
+	Sys             string
+	NumGC           uint32
+	SessionsStarted int64
+	SessionsExpired int64
+	ParseErrors     int64
+	Panics          int64
+	InFlight        int
+	Routes          []routeCount
+	SlowRequests    int64
+	SlowRequest     time.Duration
+	TempFiles       int
+	TempSize        string
+	TempRemoved     int64
+	Sessions        []statusSession
+	Caches          []statusCache
+	// Scanned is the time of the last re-scan of the roots, zero if they
+	// weren't scanned yet.
+	Scanned time.Time
+	Roots   []statusRoot
+}
+
+// statusHandler serves an overview of the process, its sessions, its caches,
+// and the profile roots for operators. It requires the admin role. The
+// profiles of the roots are counted by the last re-scan, since listing
+// buckets on every request is slow.
+func (s *server) statusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.requireRole(w, r, adminRole) {
+		return
+	}
+
+	prefs, err := s.requestPrefs(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	page := statusPage{
+		Uptime:          time.Since(processStart).Round(time.Second),
+		GoVersion:       runtime.Version(),
+		Goroutines:      runtime.NumGoroutine(),
+		HeapAlloc:       prefs.bytes(int64(mem.HeapAlloc)),
+		Sys:             prefs.bytes(int64(mem.Sys)),
+		NumGC:           mem.NumGC,
+		SessionsStarted: atomic.LoadInt64(&s.counters.sessionsStarted),
+		SessionsExpired: atomic.LoadInt64(&s.counters.sessionsExpired),
+		ParseErrors:     atomic.LoadInt64(&s.counters.parseErrors),
+		Panics:          atomic.LoadInt64(&s.counters.panics),
+		SlowRequests:    atomic.LoadInt64(&s.counters.slowRequests),
+		SlowRequest:     s.slowRequest,
+	}
+	page.InFlight, page.Routes = s.requests.snapshot()
+	if s.temp != nil {
+		var size int64
+		page.TempFiles, size, page.TempRemoved = s.temp.usage()
+		page.TempSize = prefs.bytes(size)
+	}
+
+	s.pprofHandlerMutex.RLock()
+	for id, handler := range s.pprofHandler {
+		session := statusSession{
+			ID:      id,
+			Profile: handler.info.profileName,
+			Type:    handler.info.profileType.title(),
+			Root:    handler.root.name,
+		}
+		// don't reveal the profiles of protected roots
+		if handler.root.token != "" {
+			session.ID, session.Profile = "", "(protected)"
+		}
+		page.Sessions = append(page.Sessions, session)
+	}
+	s.pprofHandlerMutex.RUnlock()
+	sort.Slice(page.Sessions, func(i, j int) bool {
+		return page.Sessions[i].Profile < page.Sessions[j].Profile
+	})
+
+	if c := s.profileCache(); c != nil {
+		page.Caches = append(page.Caches, cacheStatus("Bucket profiles", atomic.LoadInt64(&c.hits), atomic.LoadInt64(&c.misses)))
+	}
+
+	var totals map[*profileRoot]scanTotals
+	totals, page.Scanned = s.scan.totals()
+	if !page.Scanned.IsZero() {
+		for _, root := range append([]*profileRoot{s.defaultRoot}, s.roots...) {
+			t := totals[root]
+			status := statusRoot{Name: root.name, Path: root.path, Profiles: t.files, Size: prefs.bytes(t.bytes)}
+			if t.err != nil {
+				status.Error = t.err.Error()
+			}
+			page.Roots = append(page.Roots, status)
+		}
+	}
+
+	if err := statusTemplate.Execute(w, page); err != nil {
+		s.logger.Printf("%s status: %v", requestID(r.Context()), err)
+	}
+}
+
+// profileCache returns the cache of the roots in buckets, nil without them.
+func (s *server) profileCache() *profileCache {
+	for _, root := range append([]*profileRoot{s.defaultRoot}, s.roots...) {
+		if b, ok := root.storage.(*s3Storage); ok {
+			return b.cache
+		}
+	}
+	return nil
+}
+
+func cacheStatus(name string, hits, misses int64) statusCache {
+	c := statusCache{Name: name, Hits: hits, Misses: misses, HitRate: "-"}
+	if hits+misses > 0 {
+		c.HitRate = fmt.Sprintf("%.1f%%", 100*float64(hits)/float64(hits+misses))
+	}
+	return c
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!doctype html>
+<html>
+<head><title>pprofweb status</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+td, th { border: 1px solid #ccc; padding: 2px 8px; text-align: left; }
+</style>
+</head>
+<body>
+<h1>pprofweb status</h1>
+<h2>Process</h2>
+<table>
+<tr><th>Uptime</th><td>{{.Uptime}}</td></tr>
+<tr><th>Go version</th><td>{{.GoVersion}}</td></tr>
+<tr><th>Goroutines</th><td>{{.Goroutines}}</td></tr>
+<tr><th>Heap</th><td>{{.HeapAlloc}}</td></tr>
+<tr><th>Memory from OS</th><td>{{.Sys}}</td></tr>
+<tr><th>GC cycles</th><td>{{.NumGC}}</td></tr>
+<tr><th>Sessions started</th><td>{{.SessionsStarted}}</td></tr>
+<tr><th>Sessions expired</th><td>{{.SessionsExpired}}</td></tr>
+<tr><th>Parse errors</th><td>{{.ParseErrors}}</td></tr>
+<tr><th>Panics</th><td>{{.Panics}}</td></tr>
+<tr><th>Requests in flight</th><td>{{.InFlight}}{{range .Routes}}{{if .InFlight}}<br>{{.Route}}: {{.InFlight}}{{end}}{{end}}</td></tr>
+<tr><th>Slow requests</th><td>{{.SlowRequests}}{{if .SlowRequest}} over {{.SlowRequest}}{{end}}</td></tr>
+<tr><th>Temporary files</th><td>{{.TempFiles}} ({{.TempSize}}), {{.TempRemoved}} removed</td></tr>
+</table>
+<h2>Sessions ({{len .Sessions}})</h2>
+<table>
+<tr><th>Profile</th><th>Type</th><th>Root</th></tr>
+{{range .Sessions}}<tr><td>{{if .ID}}<a href="/pprofweb/{{.ID}}/">{{.Profile}}</a>{{else}}{{.Profile}}{{end}}</td><td>{{.Type}}</td><td>{{.Root}}</td></tr>
+{{end}}</table>
+{{if .Caches}}<h2>Caches</h2>
+<table>
+<tr><th>Cache</th><th>Hits</th><th>Misses</th><th>Hit rate</th></tr>
+{{range .Caches}}<tr><td>{{.Name}}</td><td>{{.Hits}}</td><td>{{.Misses}}</td><td>{{.HitRate}}</td></tr>
+{{end}}</table>
+{{end}}<h2>Storage</h2>
+{{if .Scanned.IsZero}}<p>The roots weren't scanned yet; set --rescan-interval to count their profiles.</p>
+{{else}}<p>As of the re-scan at {{.Scanned.Format "2006-01-02 15:04:05"}}.</p>
+<table>
+<tr><th>Root</th><th>Path</th><th>Profiles</th><th>Size</th><th>Error</th></tr>
+{{range .Roots}}<tr><td>{{.Name}}</td><td>{{.Path}}</td><td>{{.Profiles}}</td><td>{{.Size}}</td><td>{{.Error}}</td></tr>
+{{end}}</table>
+{{end}}</body>
+</html>
+`))
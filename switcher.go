@@ -0,0 +1,233 @@
+package pprofweb
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// profileListing is an entry of GET /api/v1/profiles.
+type profileListing struct {
+	Profile string    `json:"profile"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	// URL opens a new session of the profile.
+	URL string `json:"url"`
+}
+
+// sessionListing is an entry of GET /api/v1/sessions.
+type sessionListing struct {
+	ID      string `json:"id"`
+	Profile string `json:"profile"`
+	Type    string `json:"type"`
+	URL     string `json:"url"`
+}
+
+// listProfilesHandler responds with the profiles of all roots the request is
+// authorized for, newest first. The modification times are in the time zone
+// of the display preferences. The ETag of the listing changes with the
+// profiles, so requests with If-None-Match get 304 Not Modified until then.
+func (s *server) listProfilesHandler(w http.ResponseWriter, r *http.Request) {
+	prefs, err := s.requestPrefs(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	listings := []profileListing{}
+	for _, root := range append([]*profileRoot{s.defaultRoot}, s.roots...) {
+		if !root.authorized(r) {
+			continue
+		}
+		files, err := root.listProfiles(s.allowedExtensions)
+		if err != nil {
+			s.logger.Printf("%s list %s: %v", requestID(r.Context()), root.path, err)
+			continue
+		}
+		for _, f := range files {
+			ref := root.reference(f.name)
+			listings = append(listings, profileListing{
+				Profile: ref,
+				Size:    f.size,
+				ModTime: f.modTime.In(prefs.location),
+				URL:     "/?profile=" + url.QueryEscape(ref),
+			})
+		}
+	}
+	sort.SliceStable(listings, func(i, j int) bool {
+		return listings[i].ModTime.After(listings[j].ModTime)
+	})
+
+	// pollers get a 304 until a profile is added, changed, or removed
+	h := sha256.New()
+	io.WriteString(h, prefs.location.String())
+	for _, l := range listings {
+		fmt.Fprintf(h, "\n%s %d %d", l.Profile, l.Size, l.ModTime.UnixNano())
+	}
+	etag := `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeJSON(w, listings)
+}
+
+// endSessionHandler ends the session of DELETE /api/v1/sessions/{id}.
+func (s *server) endSessionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", http.MethodDelete)
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/api/v1/sessions/")
+	s.pprofHandlerMutex.Lock()
+	defer s.pprofHandlerMutex.Unlock()
+	handler, ok := s.pprofHandler[id]
+	if !ok {
+		http.Error(w, "profile handler not loaded", http.StatusNotFound)
+		return
+	}
+	if !requireAuth(w, r, handler.root) || !s.requireRole(w, r, adminRole) {
+		return
+	}
+	s.logger.Printf("%s ending session %s", requestID(r.Context()), id)
+	s.endSession(id, handler)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listSessionsHandler responds with the loaded sessions of the roots the
+// request is authorized for.
+func (s *server) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	listings := []sessionListing{}
+	s.pprofHandlerMutex.RLock()
+	for id, handler := range s.pprofHandler {
+		if !handler.root.authorized(r) {
+			continue
+		}
+		listings = append(listings, sessionListing{
+			ID:      id,
+			Profile: handler.info.profileName,
+			Type:    handler.info.profileType.title(),
+			URL:     pprofWebPath + id + "/",
+		})
+	}
+	s.pprofHandlerMutex.RUnlock()
+	sort.Slice(listings, func(i, j int) bool {
+		return listings[i].Profile < listings[j].Profile
+	})
+	writeJSON(w, listings)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// quickSwitcher is a command palette opened with Ctrl+K (Cmd+K) on session
+// pages. It jumps by fuzzy name to the views of the session, the loaded
+// sessions, and the stored profiles.
+const quickSwitcher = `<div id="pprofweb-switcher" style="display:none;position:fixed;top:15%;left:50%;transform:translateX(-50%);` +
+	`width:600px;max-width:90%;z-index:1001;background:#fff;border:1px solid #999;box-shadow:0 4px 16px rgba(0,0,0,.3);font:14px sans-serif">` +
+	`<input id="pprofweb-switcher-input" autocomplete="off" placeholder="Jump to a view, session, or profile" ` +
+	`style="width:100%;box-sizing:border-box;padding:8px;font-size:16px;border:0;border-bottom:1px solid #ccc">` +
+	`<div id="pprofweb-switcher-list" style="max-height:400px;overflow:auto"></div></div>
+<script>
+(function() {
+  var box = document.getElementById('pprofweb-switcher');
+  var input = document.getElementById('pprofweb-switcher-input');
+  var list = document.getElementById('pprofweb-switcher-list');
+  var session = location.pathname.split('/').slice(0, 3).join('/') + '/';
+  var views = {graph: '', top: 'top', flamegraph: 'flamegraph', peek: 'peek', source: 'source', disasm: 'disasm'};
+  var items = null, matches = [], selected = 0;
+
+  function load() {
+    items = [];
+    Object.keys(views).forEach(function(v) {
+      items.push({kind: 'view', name: v, url: session + views[v] + location.search});
+    });
+    [['/api/v1/sessions', 'session'], ['/api/v1/profiles', 'profile']].forEach(function(api) {
+      fetch(api[0]).then(function(r) { return r.json(); }).then(function(entries) {
+        entries.forEach(function(e) { items.push({kind: api[1], name: e.profile, url: e.url}); });
+        update();
+      });
+    });
+  }
+
+  // score returns the number of skipped characters matching query as a
+  // subsequence of name, or -1 if it doesn't match.
+  function score(query, name) {
+    name = name.toLowerCase();
+    var skipped = 0, j = 0;
+    for (var i = 0; i < query.length; i++) {
+      var k = name.indexOf(query[i], j);
+      if (k < 0) return -1;
+      skipped += k - j;
+      j = k + 1;
+    }
+    return skipped;
+  }
+
+  function update() {
+    var query = input.value.toLowerCase().replace(/\s+/g, '');
+    matches = [];
+    items.forEach(function(item) {
+      var s = score(query, item.name);
+      if (s >= 0) matches.push({item: item, score: s});
+    });
+    matches.sort(function(a, b) { return a.score - b.score; });
+    matches = matches.slice(0, 50);
+    selected = Math.min(selected, Math.max(matches.length - 1, 0));
+    list.innerHTML = '';
+    matches.forEach(function(m, i) {
+      var row = document.createElement('div');
+      row.style.cssText = 'padding:4px 8px;cursor:pointer;' + (i === selected ? 'background:#def' : '');
+      var kind = document.createElement('span');
+      kind.style.cssText = 'color:#888;display:inline-block;width:70px';
+      kind.textContent = m.item.kind;
+      row.appendChild(kind);
+      row.appendChild(document.createTextNode(m.item.name));
+      row.onclick = function() { location.href = m.item.url; };
+      list.appendChild(row);
+    });
+  }
+
+  function toggle(show) {
+    box.style.display = show ? 'block' : 'none';
+    if (show) {
+      if (items === null) load();
+      input.value = '';
+      selected = 0;
+      update();
+      input.focus();
+    }
+  }
+
+  document.addEventListener('keydown', function(e) {
+    if ((e.ctrlKey || e.metaKey) && e.key === 'k') {
+      e.preventDefault();
+      toggle(box.style.display === 'none');
+      return;
+    }
+    if (box.style.display === 'none') return;
+    if (e.key === 'Escape') {
+      toggle(false);
+    } else if (e.key === 'ArrowDown' || e.key === 'ArrowUp') {
+      e.preventDefault();
+      selected = Math.max(0, Math.min(matches.length - 1, selected + (e.key === 'ArrowDown' ? 1 : -1)));
+      update();
+    } else if (e.key === 'Enter' && matches[selected]) {
+      location.href = matches[selected].item.url;
+    }
+  });
+  input.addEventListener('input', function() { selected = 0; update(); });
+})();
+</script>
+`
@@ -0,0 +1,153 @@
+package pprofweb
+
+import (
+	"archive/tar"
+	"debug/elf"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/urfave/cli/v2"
+)
+
+var importSymbolsCommand = &cli.Command{
+	Name:      "import-symbols",
+	Usage:     "import a tarball of binaries and debug info built on a connected machine into the --binaries directory",
+	UsageText: "pprofweb import-symbols --binaries /srv/binaries symbols.tar.gz",
+	Flags: []cli.Flag{
+		&cli.PathFlag{
+			Name:     "binaries",
+			Required: true,
+			EnvVars:  []string{"PPROF_BINARY_PATH"},
+			Usage:    "directory of the binaries searched by the server; the first of a search path",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		if context.NArg() != 1 {
+			return errors.New("expected the path of one bundle, or - for stdin")
+		}
+		dir := filepath.SplitList(context.String("binaries"))[0]
+		in := io.Reader(os.Stdin)
+		if path := context.Args().First(); path != "-" {
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			in = f
+		}
+		imported, err := importSymbols(dir, in, func(name, stored string) {
+			fmt.Fprintf(context.App.Writer, "%s -> %s\n", name, stored)
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(context.App.Writer, "imported %d files into %s\n", imported, dir)
+		return nil
+	},
+}
+
+// importSymbols extracts the files of the tar archive read from in, which may
+// be compressed, into dir where pprof finds them: ELF files with a GNU build
+// ID at dir/<build id>/<name>, other files at dir/<name>.
+// The directories of the archive are ignored, so a bundle may use any layout,
+// e.g. the .build-id tree of debuginfod. It calls stored for each file and
+// returns the number of files imported.
+func importSymbols(dir string, in io.Reader, stored func(name, path string)) (int, error) {
+	r, _, err := decompressStream(in)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return 0, err
+	}
+	imported := 0
+	archive := tar.NewReader(r)
+	for {
+		h, err := archive.Next()
+		if err == io.EOF {
+			return imported, nil
+		}
+		if err != nil {
+			return imported, fmt.Errorf("could not read bundle: %w", err)
+		}
+		name := filepath.Base(h.Name)
+		if h.Typeflag != tar.TypeReg || name == ".." || name == "." || name == string(filepath.Separator) {
+			continue
+		}
+		path, err := importSymbolFile(dir, name, archive)
+		if err != nil {
+			return imported, fmt.Errorf("%s: %w", h.Name, err)
+		}
+		stored(h.Name, path)
+		imported++
+	}
+}
+
+// importSymbolFile stores the file name read from r in dir, by its build ID
+// if it has one, replacing an earlier copy. It returns the stored path.
+func importSymbolFile(dir, name string, r io.Reader) (string, error) {
+	tmp, err := os.CreateTemp(dir, ".import-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, name)
+	if buildID := elfBuildID(tmp.Name()); buildID != "" {
+		path = filepath.Join(dir, buildID, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return "", err
+		}
+	}
+	return path, os.Rename(tmp.Name(), path)
+}
+
+// elfBuildID returns the GNU build ID of the ELF file at path as pprof
+// matches it with the build IDs of mappings, or an empty string if it has
+// none.
+func elfBuildID(path string) string {
+	f, err := elf.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	for _, s := range f.Sections {
+		if s.Type != elf.SHT_NOTE {
+			continue
+		}
+		data, err := s.Data()
+		if err != nil {
+			continue
+		}
+		// notes are a name size, a descriptor size, a type, and the padded
+		// name and descriptor
+		for len(data) >= 12 {
+			nameSize, descSize, noteType := f.ByteOrder.Uint32(data), f.ByteOrder.Uint32(data[4:]), f.ByteOrder.Uint32(data[8:])
+			nameEnd := 12 + (uint64(nameSize)+3)&^3
+			descEnd := nameEnd + (uint64(descSize)+3)&^3
+			if descEnd > uint64(len(data)) {
+				break
+			}
+			if noteType == 3 && string(data[12:12+nameSize]) == "GNU\x00" {
+				return hex.EncodeToString(data[nameEnd : nameEnd+uint64(descSize)])
+			}
+			data = data[descEnd:]
+		}
+	}
+	return ""
+}
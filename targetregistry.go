@@ -0,0 +1,344 @@
+package pprofweb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// targetTestTimeout limits the requests of POST /api/v1/targets/{name}/test.
+const targetTestTimeout = 10 * time.Second
+
+// targetRegistry keeps the targets added with POST /api/v1/targets, in the
+// file path if it is set so they survive restarts.
+type targetRegistry struct {
+	path string
+
+	mu      sync.RWMutex
+	targets map[string]*captureTarget
+}
+
+// loadTargetRegistry reads the definitions of the targets stored in the JSON
+// file path, if it exists, like parseCaptureTarget.
+func loadTargetRegistry(path string, defaultRoot *profileRoot, roots []*profileRoot, logger *log.Logger) (*targetRegistry, error) {
+	x := &targetRegistry{path: path, targets: make(map[string]*captureTarget)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return x, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var defs []string
+	if err := json.Unmarshal(data, &defs); err != nil {
+		return nil, fmt.Errorf("targets file %s: %w", path, err)
+	}
+	for _, def := range defs {
+		target, err := parseCaptureTarget(def, defaultRoot, roots, logger)
+		if err != nil {
+			return nil, fmt.Errorf("targets file %s: %w", path, err)
+		}
+		x.targets[target.name] = target
+	}
+	return x, nil
+}
+
+func (x *targetRegistry) get(name string) (*captureTarget, bool) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	target, ok := x.targets[name]
+	return target, ok
+}
+
+func (x *targetRegistry) list() []*captureTarget {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	var list []*captureTarget
+	for _, target := range x.targets {
+		list = append(list, target)
+	}
+	return list
+}
+
+// add registers target unless a target has its name and stores the
+// registry.
+func (x *targetRegistry) add(target *captureTarget) (bool, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if _, ok := x.targets[target.name]; ok {
+		return false, nil
+	}
+	x.targets[target.name] = target
+	if err := x.saveLocked(); err != nil {
+		delete(x.targets, target.name)
+		return false, err
+	}
+	return true, nil
+}
+
+// remove removes the target name and stores the registry.
+func (x *targetRegistry) remove(name string) (bool, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	target, ok := x.targets[name]
+	if !ok {
+		return false, nil
+	}
+	delete(x.targets, name)
+	if err := x.saveLocked(); err != nil {
+		x.targets[name] = target
+		return false, err
+	}
+	return true, nil
+}
+
+func (x *targetRegistry) saveLocked() error {
+	if x.path == "" {
+		return nil
+	}
+	defs := []string{}
+	for _, target := range x.targets {
+		defs = append(defs, target.definition)
+	}
+	sort.Strings(defs)
+	data, err := json.MarshalIndent(defs, "", "  ")
+	if err != nil {
+		return err
+	}
+	// replace the file atomically so a crash doesn't lose all targets
+	tmp := x.path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, x.path)
+}
+
+// addTargetRequest is the JSON body of POST /api/v1/targets.
+type addTargetRequest struct {
+	// Definition is in the format of --target, e.g.
+	// api=http://api:6060;root=prod.
+	Definition string `json:"definition"`
+}
+
+// addTargetHandler serves POST /api/v1/targets for admins: it registers the
+// target of the addTargetRequest and responds with its targetInfo.
+func (s *server) addTargetHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireRole(w, r, adminRole) {
+		return
+	}
+	var req addTargetRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	target, err := parseCaptureTarget(req.Definition, s.defaultRoot, s.roots, s.logger)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// the secrets would be sent to a URL of the client's choice, e.g. with
+	// bearer=file:/etc/shadow by test
+	if !target.credentials.empty() {
+		httpErrorCode(w, "targets with credentials can only be defined with --target", "target_credentials", http.StatusBadRequest)
+		return
+	}
+	if _, ok := s.targets[target.name]; ok {
+		httpErrorCode(w, fmt.Sprintf("target %s exists", target.name), "target_exists", http.StatusConflict)
+		return
+	}
+	added, err := s.registry.add(target)
+	if err != nil {
+		s.logger.Printf("%s add target %s: %v", requestID(r.Context()), target.name, err)
+		http.Error(w, "could not store the target", http.StatusInternalServerError)
+		return
+	}
+	if !added {
+		httpErrorCode(w, fmt.Sprintf("target %s exists", target.name), "target_exists", http.StatusConflict)
+		return
+	}
+	s.audit(r, auditEvent{Action: "target-add", Target: target.name, Path: target.url.Redacted()})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(newTargetInfo(target, "api"))
+}
+
+// removeTargetHandler serves DELETE /api/v1/targets/{name} for admins. Only
+// targets added with the API can be removed.
+func (s *server) removeTargetHandler(w http.ResponseWriter, r *http.Request, name string) {
+	if !s.requireRole(w, r, adminRole) {
+		return
+	}
+	if _, ok := s.targets[name]; ok {
+		httpErrorCode(w, fmt.Sprintf("target %s is defined by --target", name), "static_target", http.StatusConflict)
+		return
+	}
+	removed, err := s.registry.remove(name)
+	if err != nil {
+		s.logger.Printf("%s remove target %s: %v", requestID(r.Context()), name, err)
+		http.Error(w, "could not store the targets", http.StatusInternalServerError)
+		return
+	}
+	if !removed {
+		http.Error(w, "unknown target", http.StatusNotFound)
+		return
+	}
+	s.audit(r, auditEvent{Action: "target-remove", Target: name})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// targetTestResult is the JSON response of POST /api/v1/targets/{name}/test.
+type targetTestResult struct {
+	Target   string `json:"target"`
+	Duration int64  `json:"duration_ms"`
+}
+
+// testTargetHandler serves POST /api/v1/targets/{name}/test: it fetches the
+// pprof index of the target with its credentials to check that it can be
+// captured.
+func (s *server) testTargetHandler(w http.ResponseWriter, r *http.Request, target *captureTarget) {
+	if !requireAuth(w, r, target.root) || !s.requireRole(w, r, uploaderRole) {
+		return
+	}
+	start := time.Now()
+	if _, err := fetchPprof(target.url, target.credentials, "", "", targetTestTimeout); err != nil {
+		httpErrorCode(w, fmt.Sprintf("target %s unreachable: %v", target.name, err), "target_unreachable", http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, targetTestResult{Target: target.name, Duration: time.Since(start).Milliseconds()})
+}
+
+var targetsCommand = &cli.Command{
+	Name:      "targets",
+	Usage:     "list, add, remove, and test the targets of a pprofweb server",
+	UsageText: "pprofweb targets --server https://pprofweb.internal [--token secret] list|add|remove|test",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "server",
+			Required: true,
+			Usage:    "URL of the pprofweb server, with user:password@ for LDAP users",
+		},
+		&cli.StringFlag{
+			Name:    "token",
+			EnvVars: []string{"PPROFWEB_TOKEN"},
+			Usage:   "admin token to add and remove targets, or the token of their root",
+		},
+	},
+	Subcommands: []*cli.Command{
+		{
+			Name:  "list",
+			Usage: "print the targets",
+			Action: func(context *cli.Context) error {
+				var list []targetInfo
+				if err := callAPI(context, http.MethodGet, "/api/v1/targets", nil, &list); err != nil {
+					return err
+				}
+				w := tabwriter.NewWriter(context.App.Writer, 0, 0, 2, ' ', 0)
+				fmt.Fprintln(w, "NAME\tURL\tROOT\tSERVICE\tSOURCE")
+				for _, t := range list {
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", t.Name, t.URL, t.Root, t.Service, t.Source)
+				}
+				return w.Flush()
+			},
+		},
+		{
+			Name:      "add",
+			Usage:     "add a target in the format of --target, stored in the --targets-file of the server",
+			ArgsUsage: "'name=url[;root=name][;service=dir][;bearer=secret]...'",
+			Action: func(context *cli.Context) error {
+				if context.NArg() != 1 {
+					return fmt.Errorf("expected the definition of the target")
+				}
+				var info targetInfo
+				if err := callAPI(context, http.MethodPost, "/api/v1/targets", addTargetRequest{context.Args().First()}, &info); err != nil {
+					return err
+				}
+				fmt.Fprintf(context.App.Writer, "added %s: %s\n", info.Name, info.URL)
+				return nil
+			},
+		},
+		{
+			Name:      "remove",
+			Usage:     "remove a target added with add",
+			ArgsUsage: "name",
+			Action: func(context *cli.Context) error {
+				if context.NArg() != 1 {
+					return fmt.Errorf("expected the name of the target")
+				}
+				name := context.Args().First()
+				if err := callAPI(context, http.MethodDelete, "/api/v1/targets/"+name, nil, nil); err != nil {
+					return err
+				}
+				fmt.Fprintf(context.App.Writer, "removed %s\n", name)
+				return nil
+			},
+		},
+		{
+			Name:      "test",
+			Usage:     "check that the server can reach the pprof endpoints of a target",
+			ArgsUsage: "name",
+			Action: func(context *cli.Context) error {
+				if context.NArg() != 1 {
+					return fmt.Errorf("expected the name of the target")
+				}
+				var result targetTestResult
+				path := "/api/v1/targets/" + context.Args().First() + "/test"
+				if err := callAPI(context, http.MethodPost, path, nil, &result); err != nil {
+					return err
+				}
+				fmt.Fprintf(context.App.Writer, "%s: ok in %dms\n", result.Target, result.Duration)
+				return nil
+			},
+		},
+	},
+}
+
+// callAPI sends a request with the JSON of body to the API path of the
+// server of the flags of context and decodes the JSON response into out.
+func callAPI(context *cli.Context, method, path string, body, out interface{}) error {
+	base, err := url.Parse(context.String("server"))
+	if err != nil {
+		return err
+	}
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, base.ResolveReference(&url.URL{Path: path}).String(), reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token := context.String("token"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("%s %s failed: %s: %s", method, path, resp.Status, apiErrorMessage(msg))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,422 @@
+package pprofweb
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/google/uuid"
+)
+
+// pprofEndpoints maps the capturable profile types to the net/http/pprof
+// endpoints of targets.
+var pprofEndpoints = map[string]string{
+	"cpu":          "profile",
+	"heap":         "heap",
+	"allocs":       "allocs",
+	"goroutine":    "goroutine",
+	"block":        "block",
+	"mutex":        "mutex",
+	"threadcreate": "threadcreate",
+}
+
+// maxCaptureDuration limits the duration of CPU profiles captured by the
+// server.
+const maxCaptureDuration = 5 * time.Minute
+
+// captureTarget is a registered service serving net/http/pprof that the
+// server can capture profiles of.
+type captureTarget struct {
+	name string
+	url  *url.URL
+	// root stores the captured profiles below service.
+	root    *profileRoot
+	service string
+	// credentials authenticate the requests to the target.
+	credentials *targetCredentials
+	// definition is the definition it was parsed from, if any.
+	definition string
+}
+
+// parseCaptureTarget parses a target definition like
+// "api=http://api:6060;root=prod;service=api-server". root is the name of one
+// of roots, the default root if empty. service defaults to the target name.
+// bearer, cert, key, and ca are the secrets of the credentials of the target,
+// e.g. bearer=vault:secret/data/api#pprof-token, resolved when it is
+// captured. Secrets that fail to refresh are logged to logger.
+func parseCaptureTarget(def string, defaultRoot *profileRoot, roots []*profileRoot, logger *log.Logger) (*captureTarget, error) {
+	parts := strings.Split(def, ";")
+	name, rawURL := splitKeyValue(parts[0])
+	if name == "" || rawURL == "" {
+		return nil, fmt.Errorf("target %q: expected name=url", def)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("target %q: invalid URL %q", def, rawURL)
+	}
+	target := &captureTarget{name: name, url: u, root: defaultRoot, service: name, credentials: &targetCredentials{logger: logger}, definition: def}
+	for _, option := range parts[1:] {
+		key, value := splitKeyValue(option)
+		switch key {
+		case "root":
+			target.root = nil
+			for _, root := range roots {
+				if root.name == value {
+					target.root = root
+				}
+			}
+			if target.root == nil {
+				return nil, fmt.Errorf("target %q: unknown root %q", def, value)
+			}
+		case "service":
+			target.service = value
+		default:
+			ok, err := target.credentials.setCredential(key, value)
+			if err != nil {
+				return nil, fmt.Errorf("target %q: %w", def, err)
+			}
+			if !ok {
+				return nil, fmt.Errorf("target %q: unknown option %q", def, key)
+			}
+		}
+	}
+	if err := target.credentials.validate(); err != nil {
+		return nil, fmt.Errorf("target %q: %w", def, err)
+	}
+	return target, nil
+}
+
+// fetchPprofProfile captures the profile type t of the service at target
+// with credentials. CPU profiles take duration.
+func fetchPprofProfile(target *url.URL, credentials *targetCredentials, t string, duration time.Duration) ([]byte, error) {
+	endpoint, ok := pprofEndpoints[t]
+	if !ok {
+		return nil, fmt.Errorf("unknown profile type %q", t)
+	}
+	query := ""
+	timeout := 30 * time.Second
+	if t == "cpu" {
+		query = "seconds=" + strconv.Itoa(int(duration/time.Second))
+		timeout += duration
+	}
+	return fetchPprof(target, credentials, endpoint, query, timeout)
+}
+
+// fetchPprof fetches the net/http/pprof endpoint of the service at target
+// with the query and credentials.
+func fetchPprof(target *url.URL, credentials *targetCredentials, endpoint, query string, timeout time.Duration) ([]byte, error) {
+	ref := &url.URL{Path: path.Join(target.Path, "/debug/pprof", endpoint), RawQuery: query}
+	transport, err := credentials.roundTripper()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodGet, target.ResolveReference(ref).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := credentials.authorize(req); err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: timeout, Transport: transport}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("capture failed: %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// target returns the target called name, of --target, added with the API,
+// or discovered with the scrape config.
+func (s *server) target(name string) (*captureTarget, bool) {
+	if target, ok := s.targets[name]; ok {
+		return target, true
+	}
+	if target, ok := s.registry.get(name); ok {
+		return target, true
+	}
+	if s.scrape != nil {
+		return s.scrape.target(name)
+	}
+	return nil, false
+}
+
+// targetInfo is an entry of GET /api/v1/targets.
+type targetInfo struct {
+	Name    string `json:"name"`
+	URL     string `json:"url"`
+	Root    string `json:"root"`
+	Service string `json:"service"`
+	// Source is flag, api, or discovered.
+	Source string `json:"source"`
+}
+
+func newTargetInfo(target *captureTarget, source string) targetInfo {
+	return targetInfo{Name: target.name, URL: target.url.Redacted(), Root: target.root.name, Service: target.service, Source: source}
+}
+
+// targetListHandler serves GET /api/v1/targets: the targets of the roots the
+// request is authorized for, including the discovered ones, sorted by name.
+// POST adds a target, see addTargetHandler.
+func (s *server) targetListHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		s.addTargetHandler(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.requireRole(w, r, viewerRole) {
+		return
+	}
+	// earlier sources take precedence, like in target
+	seen := make(map[string]bool)
+	list := []targetInfo{}
+	add := func(targets []*captureTarget, source string) {
+		for _, target := range targets {
+			if seen[target.name] {
+				continue
+			}
+			seen[target.name] = true
+			if target.root.authorized(r) {
+				list = append(list, newTargetInfo(target, source))
+			}
+		}
+	}
+	var static []*captureTarget
+	for _, target := range s.targets {
+		static = append(static, target)
+	}
+	add(static, "flag")
+	add(s.registry.list(), "api")
+	if s.scrape != nil {
+		add(s.scrape.list(), "discovered")
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	writeJSON(w, list)
+}
+
+// capturedProfileName returns the name of a profile of type t captured at now.
+// The file name carries the type: block and mutex profiles can only be told
+// apart by name.
+func capturedProfileName(service, t string, now time.Time) string {
+	return path.Join(service, t, t+"-"+now.UTC().Format("20060102T150405Z")+".pb.gz")
+}
+
+// targetsHandler serves POST /api/v1/targets/{name}/capture?type=cpu&seconds=30:
+// it captures a profile of the target, stores it, and responds with the path
+// of a new session of it. GET /api/v1/targets/{name}/watch samples the
+// target for its watch page, see watchHandler, and POST
+// /api/v1/targets/{name}/delta compares a new CPU profile with the previous
+// one, see deltaHandler. /api/v1/targets/{name}/debug/pprof/ proxies the
+// pprof endpoints of the target, see targetProxyHandler. POST
+// /api/v1/targets/{name}/test checks that the target is reachable and DELETE
+// /api/v1/targets/{name} removes a target added with the API, see
+// targetregistry.go.
+func (s *server) targetsHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/targets/"), "/")
+	if len(parts) >= 4 && parts[1] == "debug" && parts[2] == "pprof" {
+		target, ok := s.target(parts[0])
+		if !ok {
+			http.Error(w, "unknown target", http.StatusNotFound)
+			return
+		}
+		s.targetProxyHandler(w, r, target, strings.Join(parts[3:], "/"))
+		return
+	}
+	if len(parts) == 1 && r.Method == http.MethodDelete {
+		s.removeTargetHandler(w, r, parts[0])
+		return
+	}
+	if len(parts) != 2 || (parts[1] != "capture" && parts[1] != "watch" && parts[1] != "delta" && parts[1] != "test") {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	target, ok := s.target(parts[0])
+	if !ok {
+		http.Error(w, "unknown target", http.StatusNotFound)
+		return
+	}
+	switch parts[1] {
+	case "watch":
+		s.watchSampleHandler(w, r, target)
+		return
+	case "delta":
+		s.deltaHandler(w, r, target)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+	if parts[1] == "test" {
+		s.testTargetHandler(w, r, target)
+		return
+	}
+	if !requireAuth(w, r, target.root) || !s.requireRole(w, r, uploaderRole) || !s.checkMaintenance(w) {
+		return
+	}
+
+	query := r.URL.Query()
+	t := query.Get("type")
+	if t == "" {
+		t = "cpu"
+	}
+	if _, ok := pprofEndpoints[t]; !ok {
+		http.Error(w, fmt.Sprintf("unknown profile type %q", t), http.StatusBadRequest)
+		return
+	}
+	duration, ok := captureDuration(w, query)
+	if !ok {
+		return
+	}
+	opts, err := s.parseSessionOptions(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name, p, sum, ok := s.captureTarget(w, r, target, t, duration)
+	if !ok {
+		return
+	}
+	ref := target.root.reference(name)
+	sessionPath, err := s.newSession(uuid.New().String(), target.root, ref, p, opts)
+	if err != nil {
+		s.logger.Printf("%s pprof error: %+v", requestID(r.Context()), err)
+		http.Error(w, "pprof error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(uploadResponse{Profile: ref, URL: sessionPath, SHA256: sum})
+}
+
+// captureDuration returns the duration of CPU profiles of the seconds of
+// query, 30 by default, or writes a 400 response and returns false.
+func captureDuration(w http.ResponseWriter, query url.Values) (time.Duration, bool) {
+	seconds := query.Get("seconds")
+	if seconds == "" {
+		return 30 * time.Second, true
+	}
+	n, err := strconv.Atoi(seconds)
+	if err != nil || n <= 0 || time.Duration(n)*time.Second > maxCaptureDuration {
+		http.Error(w, fmt.Sprintf("seconds must be between 1 and %d", int(maxCaptureDuration/time.Second)),
+			http.StatusBadRequest)
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// captureTarget captures the profile type t of target and stores it like
+// the agent does. It returns the name of the stored profile in the root of
+// target, the profile, and its hash, or writes an error response and returns
+// false.
+func (s *server) captureTarget(w http.ResponseWriter, r *http.Request, target *captureTarget, t string, duration time.Duration) (string, *profile.Profile, string, bool) {
+	now := time.Now()
+	s.logger.Printf("%s capturing %s of target %s", requestID(r.Context()), t, target.name)
+	data, err := fetchPprofProfile(target.url, target.credentials, t, duration)
+	if err != nil {
+		s.logger.Printf("%s capture %s of %s: %v", requestID(r.Context()), t, target.name, err)
+		http.Error(w, fmt.Sprintf("capture failed: %v", err), http.StatusBadGateway)
+		return "", nil, "", false
+	}
+	p, err := parseProfileData(data)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not parse profile: %v", err), http.StatusBadGateway)
+		return "", nil, "", false
+	}
+	name := capturedProfileName(target.service, t, now)
+	if err := storeProfile(target.root.filePath(name), p); err != nil {
+		if os.IsExist(err) {
+			http.Error(w, "a profile of this type was captured at the same time", http.StatusConflict)
+			return "", nil, "", false
+		}
+		s.logger.Printf("%s store %s: %v", requestID(r.Context()), name, err)
+		http.Error(w, "could not store profile", http.StatusInternalServerError)
+		return "", nil, "", false
+	}
+	sum, err := s.stored(target.root, name, target.name)
+	if err != nil {
+		s.saveFailed(w, r, target.root, name, err)
+		return "", nil, "", false
+	}
+	s.stats.Count("profiles.captured", 1, "profile_type:"+t)
+	return name, p, sum, true
+}
+
+// deltaResponse is the JSON response of POST /api/v1/targets/{name}/delta.
+type deltaResponse struct {
+	// Profile and Base are the references of the new and the previous CPU
+	// profile; Base is empty for the first capture.
+	Profile string `json:"profile"`
+	Base    string `json:"base,omitempty"`
+	// URL is the path of the diff of the profiles, or of a session of the
+	// new profile without a previous one.
+	URL string `json:"url"`
+}
+
+// deltaHandler serves POST /api/v1/targets/{name}/delta?seconds=30: it
+// captures a CPU profile of the target, stores it, and responds with the
+// diff page comparing it with the previous CPU profile of the service, to
+// see what changed since, e.g., before a deploy.
+func (s *server) deltaHandler(w http.ResponseWriter, r *http.Request, target *captureTarget) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireAuth(w, r, target.root) || !s.requireRole(w, r, uploaderRole) || !s.checkMaintenance(w) {
+		return
+	}
+	duration, ok := captureDuration(w, r.URL.Query())
+	if !ok {
+		return
+	}
+	opts, err := s.parseSessionOptions(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// the previous capture is the newest before this one
+	base, err := s.newestProfile(target.root, target.service+"/cpu/")
+	if err != nil {
+		// the first capture
+		base = ""
+	}
+	name, p, _, ok := s.captureTarget(w, r, target, "cpu", duration)
+	if !ok {
+		return
+	}
+	resp := deltaResponse{Profile: target.root.reference(name)}
+	if base != "" {
+		resp.Base = target.root.reference(base)
+		resp.URL = "/diff?" + url.Values{"base": {resp.Base}, "head": {resp.Profile}}.Encode()
+	} else {
+		resp.URL, err = s.newSession(uuid.New().String(), target.root, resp.Profile, p, opts)
+		if err != nil {
+			s.logger.Printf("%s pprof error: %+v", requestID(r.Context()), err)
+			http.Error(w, "pprof error", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
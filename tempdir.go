@@ -0,0 +1,140 @@
+package pprofweb
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tempCollectInterval is how often temporary files are collected.
+const tempCollectInterval = 5 * time.Minute
+
+// tempMinAge protects files from the size limit while they are likely still
+// being written, e.g. graphviz output of a running request.
+const tempMinAge = time.Minute
+
+// tempDir is the directory of the temporary files of the child processes of
+// the server, e.g. converters. It is passed to them as TMPDIR, so files
+// orphaned by crashed conversions are collected periodically.
+type tempDir struct {
+	path    string
+	maxAge  time.Duration
+	maxSize int64
+	stats   Metrics
+	logger  *log.Logger
+
+	// removed counts the files removed by collections.
+	removed int64
+
+	mu sync.Mutex
+	// files and size are the totals of the last collection.
+	files int
+	size  int64
+}
+
+// newTempDir creates the temp directory path. The environment of the process
+// isn't changed, since the server may be embedded in another program.
+func newTempDir(path string, maxAge time.Duration, maxSize int64, stats Metrics, logger *log.Logger) (*tempDir, error) {
+	if err := os.MkdirAll(path, 0o700); err != nil {
+		return nil, err
+	}
+	if stats == nil {
+		stats = noMetrics{}
+	}
+	return &tempDir{path: path, maxAge: maxAge, maxSize: maxSize, stats: stats, logger: logger}, nil
+}
+
+// run collects temporary files every interval.
+func (t *tempDir) run(interval time.Duration) {
+	t.collect()
+	for range time.Tick(interval) {
+		t.collect()
+	}
+}
+
+type tempFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// collect removes files older than maxAge, then the oldest files until the
+// total size is below maxSize, and empty directories.
+func (t *tempDir) collect() {
+	now := time.Now()
+	var files []tempFile
+	var dirs []string
+	filepath.Walk(t.path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// files may disappear while walking
+			return nil
+		}
+		if path == t.path {
+			return nil
+		}
+		if info.IsDir() {
+			dirs = append(dirs, path)
+			return nil
+		}
+		files = append(files, tempFile{path, info.Size(), info.ModTime()})
+		return nil
+	})
+
+	var kept []tempFile
+	var size int64
+	for _, f := range files {
+		if t.maxAge > 0 && now.Sub(f.modTime) > t.maxAge {
+			t.remove(f.path)
+			continue
+		}
+		kept = append(kept, f)
+		size += f.size
+	}
+	if t.maxSize > 0 && size > t.maxSize {
+		sort.Slice(kept, func(i, j int) bool { return kept[i].modTime.Before(kept[j].modTime) })
+		remaining := kept[:0]
+		for _, f := range kept {
+			if size > t.maxSize && now.Sub(f.modTime) > tempMinAge {
+				t.remove(f.path)
+				size -= f.size
+				continue
+			}
+			remaining = append(remaining, f)
+		}
+		kept = remaining
+	}
+	// remove the deepest directories first; removing non-empty ones fails
+	sort.Slice(dirs, func(i, j int) bool { return len(dirs[i]) > len(dirs[j]) })
+	for _, dir := range dirs {
+		if info, err := os.Stat(dir); err == nil && now.Sub(info.ModTime()) > tempMinAge {
+			os.Remove(dir)
+		}
+	}
+
+	t.mu.Lock()
+	t.files, t.size = len(kept), size
+	t.mu.Unlock()
+	t.stats.Gauge("temp.files", float64(len(kept)))
+	t.stats.Gauge("temp.bytes", float64(size))
+}
+
+func (t *tempDir) remove(path string) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		t.logger.Printf("temp dir: %v", err)
+		return
+	}
+	atomic.AddInt64(&t.removed, 1)
+	t.stats.Count("temp.removed", 1)
+}
+
+// usage returns the number and size of the temporary files at the last
+// collection and the number of files removed.
+func (t *tempDir) usage() (int, int64, int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.files, t.size, atomic.LoadInt64(&t.removed)
+}
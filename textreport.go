@@ -0,0 +1,189 @@
+package pprofweb
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/google/pprof/profile"
+)
+
+// defaultTextRows limits the rows of plain text reports without n.
+const defaultTextRows = 100
+
+// textReportHandler returns the handler of GET <session>/text?report=top,
+// which reports the profile p of the session with info as plain text: the
+// top table, or the heaviest stacks with report=traces. It needs neither
+// graphviz nor JavaScript, for constrained environments. si selects the
+// sample type and n the number of rows.
+func (s *server) textReportHandler(info *sessionInfo, p *profile.Profile) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+			return
+		}
+		s.writeTextReport(w, r, info, p, "")
+	})
+}
+
+// writeTextReport writes the plain text report selected by the query of r
+// after the note, if any.
+func (s *server) writeTextReport(w http.ResponseWriter, r *http.Request, info *sessionInfo, p *profile.Profile, note string) {
+	query := r.URL.Query()
+	si := query.Get("si")
+	if si == "" {
+		si = info.urlDefaults.Get("si")
+	}
+	sampleIndex, err := selectSampleIndex(p, si)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rows := defaultTextRows
+	if n := query.Get("n"); n != "" {
+		rows, err = strconv.Atoi(n)
+		if err != nil || rows <= 0 {
+			http.Error(w, "n must be a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+	prefs, err := s.requestPrefs(r)
+	if err != nil {
+		prefs = s.displayPrefs
+	}
+
+	var b bytes.Buffer
+	if note != "" {
+		fmt.Fprintf(&b, "%s\n\n", note)
+	}
+	st := p.SampleType[sampleIndex]
+	fmt.Fprintf(&b, "%s %s, %s (%s)\n\n", info.profileType.title(), info.profileName, st.Type, st.Unit)
+	switch report := query.Get("report"); report {
+	case "", "top":
+		writeTextTop(&b, prefs, topTable(p, sampleIndex), sampleTotal(p, sampleIndex), st.Unit, rows)
+	case "traces":
+		writeTextTraces(&b, prefs, p, sampleIndex, st.Unit, rows)
+	default:
+		http.Error(w, fmt.Sprintf("unknown report %q: use top or traces", report), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(b.Bytes())
+}
+
+// writeTextTop writes the first rows of the top table like pprof -top.
+func writeTextTop(w io.Writer, prefs *displayPrefs, table []topEntry, total int64, unit string, rows int) {
+	share := func(v int64) string {
+		if total == 0 {
+			return ""
+		}
+		return fmt.Sprintf("%.2f%%", 100*float64(v)/float64(total))
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "flat\tflat%\tsum%\tcum\tcum%\t")
+	var sum int64
+	for i, e := range table {
+		if i == rows {
+			break
+		}
+		sum += e.Flat
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t  %s\n", prefs.value(e.Flat, unit), share(e.Flat), share(sum),
+			prefs.value(e.Cum, unit), share(e.Cum), e.Name)
+	}
+	tw.Flush()
+	if len(table) > rows {
+		fmt.Fprintf(w, "\n%d of %d functions shown\n", rows, len(table))
+	}
+}
+
+// writeTextTraces writes the heaviest distinct stacks, leaf first like
+// pprof -traces.
+func writeTextTraces(w io.Writer, prefs *displayPrefs, p *profile.Profile, sampleIndex int, unit string, rows int) {
+	type trace struct {
+		frames []string
+		value  int64
+	}
+	traces := make(map[string]*trace)
+	for _, s := range p.Sample {
+		frames := sampleFrames(s)
+		key := strings.Join(frames, "\n")
+		t, ok := traces[key]
+		if !ok {
+			t = &trace{frames: frames}
+			traces[key] = t
+		}
+		t.value += s.Value[sampleIndex]
+	}
+	sorted := make([]*trace, 0, len(traces))
+	for _, t := range traces {
+		if t.value != 0 {
+			sorted = append(sorted, t)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].value != sorted[j].value {
+			return abs64(sorted[i].value) > abs64(sorted[j].value)
+		}
+		return strings.Join(sorted[i].frames, "\n") < strings.Join(sorted[j].frames, "\n")
+	})
+
+	const separator = "-----------+-------------------------------------------------------\n"
+	for i, t := range sorted {
+		if i == rows {
+			fmt.Fprintf(w, "%s\n%d of %d stacks shown\n", separator, rows, len(sorted))
+			return
+		}
+		io.WriteString(w, separator)
+		value := prefs.value(t.value, unit)
+		for j := len(t.frames) - 1; j >= 0; j-- {
+			fmt.Fprintf(w, "%10s   %s\n", value, t.frames[j])
+			value = ""
+		}
+	}
+	io.WriteString(w, separator)
+}
+
+// textFallback serves the pages of views of the session with info by
+// handler, falling back to the plain text top report if one fails on the
+// server, e.g. the graph without graphviz installed, rather than showing a
+// broken page.
+func (s *server) textFallback(handler http.Handler, id string, info *sessionInfo, p *profile.Profile) http.Handler {
+	views := make(map[string]string)
+	for view, viewPath := range pprofViews {
+		views[pprofWebPath+id+"/"+viewPath] = view
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		view, ok := views[r.URL.Path]
+		if !ok || r.Method != http.MethodGet {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		rec := &bufferedResponse{header: make(http.Header), status: http.StatusOK}
+		handler.ServeHTTP(rec, r)
+		if rec.status < http.StatusInternalServerError {
+			for k, v := range rec.header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(rec.status)
+			w.Write(rec.body.Bytes())
+			return
+		}
+		s.logger.Printf("%s %s view of session %s failed, falling back to text: %s",
+			requestID(r.Context()), view, id, strings.TrimSpace(rec.body.String()))
+		note := fmt.Sprintf("The %s view is not available: %s\nThis is the plain text top report; %stext?report=traces has the stacks.",
+			view, strings.TrimSpace(rec.body.String()), pprofWebPath+id+"/")
+		query := r.URL.Query()
+		query.Set("report", "top")
+		r2 := new(http.Request)
+		*r2 = *r
+		u := *r.URL
+		u.RawQuery = query.Encode()
+		r2.URL = &u
+		s.writeTextReport(w, r2, info, p, note)
+	})
+}
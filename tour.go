@@ -0,0 +1,78 @@
+package pprofweb
+
+// sessionTour explains the pprof web UI to users who never used pprof: a
+// tour of a few steps opens on the first visit of a session page and from the
+// ? button. Closing it is remembered in local storage.
+const sessionTour = `<div id="pprofweb-tour" style="display:none;position:fixed;top:0;left:0;right:0;bottom:0;z-index:1003;background:rgba(0,0,0,.4)">` +
+	`<div style="position:absolute;top:15%;left:50%;transform:translateX(-50%);width:560px;max-width:90%;background:#fff;` +
+	`border-radius:6px;box-shadow:0 4px 16px rgba(0,0,0,.3);padding:16px 20px;font:14px/1.5 sans-serif">` +
+	`<h3 style="margin:0 0 8px"></h3><div></div>` +
+	`<p style="margin:12px 0 0;text-align:right"><span style="color:#888;float:left"></span>` +
+	`<button data-step="-1">Back</button> <button data-step="1">Next</button> <button data-step="0">Close</button></p></div></div>` +
+	`<button id="pprofweb-tour-open" title="How to read this profile" style="position:fixed;bottom:8px;left:8px;z-index:1000;` +
+	`width:28px;height:28px;border-radius:14px;border:0;background:#333;color:#fff;font:bold 14px sans-serif;opacity:0.9;cursor:pointer">?</button>
+<script>
+(function() {
+  var steps = [
+    ['Reading a profile',
+     'A profile counts where a program spent a resource, like CPU time or allocated memory, by the stacks of function calls. ' +
+     'The <b>View</b> menu switches between the <b>Graph</b> of callers and callees, the <b>Top</b> table of functions, ' +
+     'the <b>Flame Graph</b>, and the <b>Source</b> of the functions. The <b>Sample</b> menu selects what is counted, e.g. ' +
+     'allocated objects or bytes.'],
+    ['Flat and cum',
+     '<b>flat</b> is the value of a function itself, <b>cum</b> (cumulative) includes all functions it calls. ' +
+     'A function with a large cum but a small flat is slow because of its callees: look at them. ' +
+     'A large flat is spent in the function\'s own code. The percentages are shares of the total of the profile.'],
+    ['Flame graph',
+     'Each box is a function, as wide as its cum value. Callees are drawn below their callers, starting with the root at the top. ' +
+     'Hover a box for its values, click it to zoom in on its stacks, and click a caller above it to zoom out. ' +
+     'The search box highlights the functions matching a regular expression.'],
+    ['Focus and ignore',
+     'The search box and the <b>Refine</b> menu filter the samples by regular expressions of function names, also as URL parameters:' +
+     '<ul style="margin:4px 0;padding-left:20px">' +
+     '<li><b>focus</b> (<code>f=</code>) keeps the stacks through a matching function</li>' +
+     '<li><b>ignore</b> (<code>i=</code>) drops the stacks through a matching function</li>' +
+     '<li><b>hide</b> (<code>h=</code>) removes matching functions and counts their values for the caller; <b>show</b> (<code>s=</code>) keeps only matching ones</li>' +
+     '<li><b>show from</b> (<code>sf=</code>) cuts the stacks above the first matching function</li>' +
+     '<li><code>tf=key=value</code> keeps the samples with a tag, e.g. <code>tf=state=chan+receive</code></li></ul>' +
+     'For example <code>?f=http.*ServeHTTP&amp;i=runtime</code>. <b>Reset</b> clears all filters.'],
+    ['pprofweb',
+     'The badge at the bottom right shows the type of the profile, switches between related views, and downloads exports. ' +
+     'Ctrl+K (Cmd+K) jumps to another view, session, or profile. The <b>?</b> button at the bottom left opens this tour again.']
+  ];
+  var key = 'pprofweb-tour-seen';
+  var box = document.getElementById('pprofweb-tour');
+  var step = 0;
+
+  function show(i) {
+    step = i;
+    box.querySelector('h3').textContent = steps[i][0];
+    box.querySelector('h3').nextSibling.innerHTML = steps[i][1];
+    box.querySelector('p span').textContent = (i + 1) + ' of ' + steps.length;
+    box.querySelector('[data-step="-1"]').disabled = i === 0;
+    box.querySelector('[data-step="1"]').disabled = i === steps.length - 1;
+    box.style.display = 'block';
+  }
+
+  function close() {
+    box.style.display = 'none';
+    try { localStorage.setItem(key, '1'); } catch (e) {}
+  }
+
+  box.querySelectorAll('button').forEach(function(b) {
+    b.onclick = function() {
+      var d = +b.getAttribute('data-step');
+      if (d === 0) close(); else show(step + d);
+    };
+  });
+  box.onclick = function(e) { if (e.target === box) close(); };
+  document.addEventListener('keydown', function(e) {
+    if (box.style.display === 'block' && e.key === 'Escape') close();
+  });
+  document.getElementById('pprofweb-tour-open').onclick = function() { show(0); };
+  var seen = true;
+  try { seen = localStorage.getItem(key) === '1'; } catch (e) {}
+  if (!seen) show(location.pathname.match(/\/flamegraph$/) ? 2 : 0);
+})();
+</script>
+`
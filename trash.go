@@ -0,0 +1,287 @@
+package pprofweb
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// trashDir is the directory of a root deleted profiles are moved to. Deleted
+// profiles are stored as <unix nanoseconds of the deletion>/<name>, so a
+// profile deleted twice is kept twice.
+const trashDir = ".trash"
+
+// trashPurgeInterval is how often expired profiles are removed from the
+// trash.
+const trashPurgeInterval = time.Hour
+
+// reservedName reports whether the slash separated name of a root is in its
+// trash or partial uploads, which aren't served as profiles.
+func reservedName(name string) bool {
+	name = path.Clean("/" + name)
+	for _, dir := range []string{trashDir, uploadsDir} {
+		if name == "/"+dir || strings.HasPrefix(name, "/"+dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// trashedProfile is a deleted profile in the trash of a root.
+type trashedProfile struct {
+	// ID is the reference of the profile in the trash for restore and purge.
+	ID string `json:"id"`
+	// Profile is the reference the profile is restored to.
+	Profile string    `json:"profile"`
+	Size    int64     `json:"size"`
+	Deleted time.Time `json:"deleted"`
+	// file is the file in the trash directory.
+	file profileFile
+}
+
+// parseTrashName splits the name of a file in the trash directory into the
+// deletion time and the name of the profile.
+func parseTrashName(name string) (time.Time, string, error) {
+	i := strings.Index(name, "/")
+	if i < 0 {
+		return time.Time{}, "", fmt.Errorf("invalid trash entry %q", name)
+	}
+	nanos, err := strconv.ParseInt(name[:i], 10, 64)
+	if err != nil {
+		return time.Time{}, "", fmt.Errorf("invalid trash entry %q", name)
+	}
+	return time.Unix(0, nanos), name[i+1:], nil
+}
+
+// trashPath returns the path the profile name of root is moved to when it is
+// deleted at now.
+func (root *profileRoot) trashPath(name string, now time.Time) string {
+	name = path.Clean(strings.TrimPrefix(name, "/"))
+	return root.filePath(path.Join(trashDir, strconv.FormatInt(now.UnixNano(), 10), name))
+}
+
+// trashProfile moves the profile name of root to its trash, which is in the
+// storage of the root, e.g. its bucket.
+func (s *server) trashProfile(r *http.Request, root *profileRoot, name string) error {
+	f, err := root.stat(name)
+	if err == nil {
+		err = root.fetch(r.Context(), f)
+	}
+	if err != nil {
+		return err
+	}
+	filePath := f.path
+	trashed := root.trashPath(name, time.Now())
+	if err := os.MkdirAll(filepath.Dir(trashed), 0o755); err != nil {
+		return err
+	}
+	if err := os.Rename(filePath, trashed); err != nil {
+		s.logger.Printf("%s trash %s: %v", requestID(r.Context()), filePath, err)
+		return err
+	}
+	rel, err := filepath.Rel(root.path, trashed)
+	if err == nil {
+		err = root.files().save(r.Context(), filepath.ToSlash(rel), false)
+	}
+	if err != nil {
+		s.logger.Printf("%s trash %s: %v", requestID(r.Context()), filePath, err)
+		os.Rename(trashed, filePath)
+		return err
+	}
+	if err := root.files().discard(r.Context(), f); err != nil {
+		s.logger.Printf("%s trash %s: %v", requestID(r.Context()), filePath, err)
+		os.Rename(trashed, filePath)
+		root.files().discard(r.Context(), profileFile{name: filepath.ToSlash(rel), path: trashed})
+		return err
+	}
+	if err := moveRuntimeMetrics(filePath, trashed); err != nil {
+		s.logger.Printf("%s trash %s: %v", requestID(r.Context()), filePath, err)
+	}
+	s.logger.Printf("%s moved %s to the trash", requestID(r.Context()), filePath)
+	return nil
+}
+
+// listTrash returns the profiles in the trash of root, latest deletions
+// first.
+func (root *profileRoot) listTrash() ([]trashedProfile, error) {
+	files, err := root.files().trash()
+	var trashed []trashedProfile
+	for _, f := range files {
+		rel := strings.TrimPrefix(f.name, trashDir+"/")
+		deleted, name, err := parseTrashName(rel)
+		if err != nil {
+			continue
+		}
+		trashed = append(trashed, trashedProfile{
+			ID:      root.reference(rel),
+			Profile: root.reference(name),
+			Size:    f.size,
+			Deleted: deleted,
+			file:    f,
+		})
+	}
+	sort.SliceStable(trashed, func(i, j int) bool {
+		return trashed[i].Deleted.After(trashed[j].Deleted)
+	})
+	return trashed, err
+}
+
+// restoreProfile moves the profile id of the trash of root back and returns
+// its name.
+func (s *server) restoreProfile(r *http.Request, root *profileRoot, id string) (string, error) {
+	id = path.Clean(strings.TrimPrefix(id, "/"))
+	_, name, err := parseTrashName(id)
+	if err != nil {
+		return "", err
+	}
+	t, err := root.stat(path.Join(trashDir, id))
+	if err == nil {
+		err = root.fetch(r.Context(), t)
+	}
+	if err != nil {
+		return "", err
+	}
+	trashed, restored := t.path, root.filePath(name)
+	if _, err := root.stat(name); err == nil {
+		return "", fmt.Errorf("%s exists", name)
+	}
+	if err := os.MkdirAll(filepath.Dir(restored), 0o755); err != nil {
+		return "", err
+	}
+	if err := os.Rename(trashed, restored); err != nil {
+		s.logger.Printf("%s restore %s: %v", requestID(r.Context()), trashed, err)
+		return "", err
+	}
+	if err := root.files().save(r.Context(), name, false); err != nil {
+		s.logger.Printf("%s restore %s: %v", requestID(r.Context()), trashed, err)
+		os.Rename(restored, trashed)
+		return "", err
+	}
+	if err := root.files().discard(r.Context(), t); err != nil {
+		// restored, but also kept in the trash
+		s.logger.Printf("%s restore %s: %v", requestID(r.Context()), trashed, err)
+	}
+	if err := moveRuntimeMetrics(trashed, restored); err != nil {
+		s.logger.Printf("%s restore %s: %v", requestID(r.Context()), trashed, err)
+	}
+	removeEmptyDirs(root.filePath(trashDir))
+	s.logger.Printf("%s restored %s", requestID(r.Context()), restored)
+	return name, nil
+}
+
+// purgeProfile permanently deletes the profile id of the trash of root.
+func (s *server) purgeProfile(r *http.Request, root *profileRoot, id string) error {
+	id = path.Clean(strings.TrimPrefix(id, "/"))
+	if _, _, err := parseTrashName(id); err != nil {
+		return err
+	}
+	t, err := root.stat(path.Join(trashDir, id))
+	if err != nil {
+		return err
+	}
+	if err := s.purgeTrashed(r.Context(), root, t); err != nil {
+		return err
+	}
+	removeEmptyDirs(root.filePath(trashDir))
+	s.logger.Printf("%s purged %s", requestID(r.Context()), t.path)
+	return nil
+}
+
+// purgeTrashed deletes the file f of the trash of root from its storage and
+// its local path.
+func (s *server) purgeTrashed(ctx context.Context, root *profileRoot, f profileFile) error {
+	if err := root.files().discard(ctx, f); err != nil {
+		return err
+	}
+	if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := removeRuntimeMetrics(f.path); err != nil {
+		s.logger.Printf("purge %s: %v", f.path, err)
+	}
+	return nil
+}
+
+// runTrash removes profiles deleted longer than the trash retention ago from
+// the trash of all roots every interval.
+func (s *server) runTrash(interval time.Duration) {
+	s.purgeExpiredTrash()
+	for range time.Tick(interval) {
+		s.purgeExpiredTrash()
+	}
+}
+
+// purgeExpiredTrash removes profiles deleted longer than the trash retention
+// ago.
+func (s *server) purgeExpiredTrash() {
+	for _, root := range append([]*profileRoot{s.defaultRoot}, s.roots...) {
+		trashed, err := root.listTrash()
+		if err != nil {
+			s.logger.Printf("trash of %s: %v", root.path, err)
+			continue
+		}
+		removed := 0
+		for _, t := range trashed {
+			if time.Since(t.Deleted) < s.trashRetention {
+				continue
+			}
+			if err := s.purgeTrashed(context.Background(), root, t.file); err != nil {
+				s.logger.Printf("trash of %s: %v", root.path, err)
+				continue
+			}
+			removed++
+		}
+		if removed > 0 {
+			removeEmptyDirs(root.filePath(trashDir))
+			s.logger.Printf("purged %d expired profiles from the trash of %s", removed, root.path)
+		}
+	}
+}
+
+// removeEmptyDirs removes the empty directories below and including dir.
+func removeEmptyDirs(dir string) {
+	var dirs []string
+	filepath.Walk(dir, func(filePath string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			dirs = append(dirs, filePath)
+		}
+		return nil
+	})
+	// children first
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Remove(dirs[i])
+	}
+}
+
+// trashHandler lists the trash of all roots the request is authorized for
+// with GET /api/v1/trash. It requires the admin role. Restore and purge are
+// bulk actions.
+func (s *server) trashHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.requireRole(w, r, adminRole) {
+		return
+	}
+	trashed := []trashedProfile{}
+	for _, root := range append([]*profileRoot{s.defaultRoot}, s.roots...) {
+		if !root.authorized(r) {
+			continue
+		}
+		t, err := root.listTrash()
+		if err != nil {
+			s.logger.Printf("%s trash of %s: %v", requestID(r.Context()), root.path, err)
+			continue
+		}
+		trashed = append(trashed, t...)
+	}
+	writeJSON(w, trashed)
+}
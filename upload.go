@@ -0,0 +1,448 @@
+package pprofweb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/google/uuid"
+)
+
+// profilesHandler lists profiles on GET, stores them on POST, and deletes
+// them on DELETE.
+func (s *server) profilesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.listProfilesHandler(w, r)
+	case http.MethodPost:
+		s.uploadHandler(w, r)
+	case http.MethodDelete:
+		s.deleteHandler(w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+	}
+}
+
+// uploadResponse is the JSON response to a successful upload.
+type uploadResponse struct {
+	// Profile is the reference of the stored profile for ?profile=.
+	Profile string `json:"profile"`
+	// URL is the path of the server that opens the profile.
+	URL string `json:"url"`
+	// SHA256 is the hash of the stored file for /api/v1/blobs/.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// uploadHandler stores the profile in the request body. The query parameter
+// name is the reference to store it as, e.g. prod/api/cpu.pb.gz; root selects
+// a root for a generated name. The root's token is required.
+func (s *server) uploadHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.allowUpload {
+		http.Error(w, "uploads are disabled", http.StatusForbidden)
+		return
+	}
+	if !s.requireRole(w, r, uploaderRole) {
+		return
+	}
+
+	root, name := s.resolveRoot(r, uploadRef(r.URL.Query()))
+	if !requireAuth(w, r, root) {
+		return
+	}
+	isCore := s.viewcore != "" && isCoreDump(name)
+	if !isCore && !hasAllowedExtension(name, s.allowedExtensions) {
+		http.Error(w, "file extension is not allowed", http.StatusBadRequest)
+		return
+	}
+	if reservedName(name) {
+		http.Error(w, "profiles can't be uploaded to "+trashDir+" or "+uploadsDir, http.StatusBadRequest)
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.maxUploadSize))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not read profile: %v", err), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !s.checkStorageQuota(w, root, int64(len(data))) {
+		return
+	}
+	if !s.screenUpload(w, r, root.reference(name), bytes.NewReader(data), int64(len(data))) {
+		return
+	}
+	if isCore {
+		// core dumps are analyzed when they are opened
+		if !bytes.HasPrefix(data, elfMagic) {
+			http.Error(w, "core dump is not an ELF file", http.StatusBadRequest)
+			return
+		}
+		s.storeUpload(w, r, root, name, func(f io.Writer) error {
+			_, err := f.Write(data)
+			return err
+		})
+		return
+	}
+	start := time.Now()
+	p, err := parseProfileData(data)
+	s.stats.Timing("profile.parse", time.Since(start))
+	if err != nil {
+		s.stats.Count("profile.parse_errors", 1)
+		atomic.AddInt64(&s.counters.parseErrors, 1)
+		http.Error(w, fmt.Sprintf("could not parse profile: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	s.storeUpload(w, r, root, name, p.Write)
+}
+
+// uploadRef returns the reference to store an upload as: the parameter name,
+// else a generated name in uploads/, in the root named by the parameter
+// root.
+func uploadRef(query url.Values) string {
+	ref := query.Get("name")
+	if ref == "" {
+		ref = path.Join("uploads", time.Now().UTC().Format("2006-01-02"), uuid.New().String()+".pb.gz")
+	}
+	if rootName := query.Get("root"); rootName != "" {
+		ref = rootName + "/" + ref
+	}
+	return ref
+}
+
+// maxFormField limits the form fields of /upload besides the profile.
+const maxFormField = 4096
+
+// maxFormOverhead limits the bytes of the form of /upload besides the
+// profile: the other fields and the headers of the parts.
+const maxFormOverhead = 1 << 20
+
+// crossSiteRequest reports whether a browser sent r from another site, e.g.
+// a form of a malicious page submitted with the credentials of the user.
+// Browsers send Sec-Fetch-Site, or at least Origin with POST requests;
+// requests without them, e.g. by curl, aren't cross-site.
+func crossSiteRequest(r *http.Request) bool {
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+		return site != "same-origin" && site != "none"
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	return err != nil || u.Host != r.Host
+}
+
+// formUploadHandler serves POST /upload, a multipart form with the profile in
+// the field file, e.g. from the form of the root page or curl -F
+// file=@cpu.pb.gz. It stores the profile like uploadHandler, opens a session
+// for it, and redirects to the session. The other fields and the query
+// parameters are name and root like for uploadHandler and the options of the
+// session, e.g. view. Forms posted by browsers from other sites are rejected,
+// since browsers send the credentials of the user with them.
+func (s *server) formUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+	if crossSiteRequest(r) {
+		httpErrorCode(w, "cross-site form uploads are forbidden", "cross_site", http.StatusForbidden)
+		return
+	}
+	if !s.allowUpload {
+		http.Error(w, "uploads are disabled", http.StatusForbidden)
+		return
+	}
+	if !s.requireRole(w, r, uploaderRole) || !s.checkMaintenance(w) {
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxUploadSize+maxFormOverhead)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "expected a multipart form", http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	var data []byte
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not read form: %v", err), http.StatusBadRequest)
+			return
+		}
+		if part.FormName() == "file" {
+			data, err = io.ReadAll(io.LimitReader(part, s.maxUploadSize+1))
+			if err == nil && int64(len(data)) > s.maxUploadSize {
+				err = fmt.Errorf("larger than %s", formatBytes(s.maxUploadSize))
+			}
+			if err != nil {
+				http.Error(w, fmt.Sprintf("could not read profile: %v", err), http.StatusRequestEntityTooLarge)
+				return
+			}
+			continue
+		}
+		value, err := io.ReadAll(io.LimitReader(part, maxFormField))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not read form: %v", err), http.StatusBadRequest)
+			return
+		}
+		if part.FormName() != "" && len(value) > 0 {
+			query.Set(part.FormName(), string(value))
+		}
+	}
+	if data == nil {
+		http.Error(w, "missing file", http.StatusBadRequest)
+		return
+	}
+
+	root, name := s.resolveRoot(r, uploadRef(query))
+	if !requireAuth(w, r, root) {
+		return
+	}
+	if !hasAllowedExtension(name, s.allowedExtensions) {
+		http.Error(w, "file extension is not allowed", http.StatusBadRequest)
+		return
+	}
+	if reservedName(name) {
+		http.Error(w, "profiles can't be uploaded to "+trashDir+" or "+uploadsDir, http.StatusBadRequest)
+		return
+	}
+	opts, err := s.parseSessionOptions(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !s.checkStorageQuota(w, root, int64(len(data))) || !s.checkSessionQuota(w, root) {
+		return
+	}
+	if !s.screenUpload(w, r, root.reference(name), bytes.NewReader(data), int64(len(data))) {
+		return
+	}
+	start := time.Now()
+	p, err := parseProfileData(data)
+	s.stats.Timing("profile.parse", time.Since(start))
+	if err != nil {
+		s.stats.Count("profile.parse_errors", 1)
+		atomic.AddInt64(&s.counters.parseErrors, 1)
+		http.Error(w, fmt.Sprintf("could not parse profile: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := storeProfile(root.filePath(name), p); err != nil {
+		if os.IsExist(err) {
+			http.Error(w, "profile exists", http.StatusConflict)
+			return
+		}
+		s.logger.Printf("%s store %s: %v", requestID(r.Context()), name, err)
+		http.Error(w, "could not store profile", http.StatusInternalServerError)
+		return
+	}
+	if _, err := s.stored(root, name, ""); err != nil {
+		s.saveFailed(w, r, root, name, err)
+		return
+	}
+	s.stats.Count("profiles.uploaded", 1)
+	s.logger.Printf("%s uploaded %s", requestID(r.Context()), root.filePath(name))
+
+	id := uuid.New().String()
+	if g := requestGuest(r.Context()); g != nil {
+		g.allowSession(id)
+	}
+	sessionPath, err := s.newSession(id, root, root.reference(name), p, opts)
+	if err != nil {
+		s.logger.Printf("%s pprof error: %+v", requestID(r.Context()), err)
+		http.Error(w, "pprof error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, sessionPath, http.StatusSeeOther)
+}
+
+// deleteHandler deletes the profile ?profile=. It requires the admin role and
+// the root's token.
+func (s *server) deleteHandler(w http.ResponseWriter, r *http.Request) {
+	ref := r.URL.Query().Get("profile")
+	if ref == "" {
+		http.Error(w, "missing profile", http.StatusBadRequest)
+		return
+	}
+	root, name := s.resolveRoot(r, ref)
+	if !requireAuth(w, r, root) || !s.requireRole(w, r, adminRole) {
+		return
+	}
+	if err := s.removeProfile(r, root, name); err != nil {
+		switch {
+		case err == errNotProfile:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case err == errPinned:
+			http.Error(w, err.Error(), http.StatusConflict)
+		case os.IsNotExist(err):
+			http.Error(w, "profile not found", http.StatusNotFound)
+		default:
+			http.Error(w, "could not delete profile", http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// errNotProfile is returned for operations on files that aren't profiles.
+var errNotProfile = errors.New("not a profile")
+
+// removeProfile moves the profile name of root to the trash, or deletes it if
+// the trash is disabled. Pinned profiles are kept.
+func (s *server) removeProfile(r *http.Request, root *profileRoot, name string) error {
+	if !hasAllowedExtension(name, s.allowedExtensions) && !strings.HasSuffix(name, coreExtension) {
+		return errNotProfile
+	}
+	if reservedName(name) {
+		return os.ErrNotExist
+	}
+	if pinned, err := root.pinned(name); pinned {
+		if err != nil {
+			s.logger.Printf("%s delete %s: %v", requestID(r.Context()), name, err)
+		}
+		return errPinned
+	}
+	if s.trashRetention > 0 {
+		return s.trashProfile(r, root, name)
+	}
+	f, err := root.stat(name)
+	if err != nil {
+		return err
+	}
+	filePath := f.path
+	// profiles of buckets may not be downloaded
+	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		s.logger.Printf("%s delete %s: %v", requestID(r.Context()), filePath, err)
+		return err
+	}
+	if err := root.files().discard(r.Context(), f); err != nil {
+		s.logger.Printf("%s delete %s: %v", requestID(r.Context()), filePath, err)
+		return err
+	}
+	if err := removeRuntimeMetrics(filePath); err != nil {
+		s.logger.Printf("%s delete %s: %v", requestID(r.Context()), filePath, err)
+	}
+	s.logger.Printf("%s deleted %s", requestID(r.Context()), filePath)
+	return nil
+}
+
+// storeUpload creates the file name in root with write and responds with its
+// reference.
+func (s *server) storeUpload(w http.ResponseWriter, r *http.Request, root *profileRoot, name string,
+	write func(io.Writer) error) {
+	if err := createFile(root.filePath(name), write); err != nil {
+		if os.IsExist(err) {
+			http.Error(w, "profile exists", http.StatusConflict)
+			return
+		}
+		s.logger.Printf("%s store %s: %v", requestID(r.Context()), name, err)
+		http.Error(w, "could not store profile", http.StatusInternalServerError)
+		return
+	}
+	s.uploaded(w, r, root, name)
+}
+
+// uploaded counts the new profile name of root and responds with its
+// reference.
+func (s *server) uploaded(w http.ResponseWriter, r *http.Request, root *profileRoot, name string) {
+	sum, err := s.stored(root, name, "")
+	if err != nil {
+		s.saveFailed(w, r, root, name, err)
+		return
+	}
+	s.stats.Count("profiles.uploaded", 1)
+	s.logger.Printf("%s uploaded %s", requestID(r.Context()), root.filePath(name))
+
+	ref := root.reference(name)
+	resp := uploadResponse{
+		Profile: ref,
+		URL:     "/?profile=" + url.QueryEscape(ref),
+		SHA256:  sum,
+	}
+	s.setQuotaHeaders(w, root)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// stored saves the new profile name of root to its storage, counts it for
+// usage reports, publishes it to the profile feed, and returns its hash for
+// /api/v1/blobs/. target is the target it was captured of, empty for
+// uploads. The error of saving wraps os.ErrExist if the storage has the
+// profile already.
+func (s *server) stored(root *profileRoot, name, target string) (string, error) {
+	if err := root.files().save(context.Background(), name, false); err != nil {
+		return "", err
+	}
+	f, err := root.stat(name)
+	if err != nil {
+		s.logger.Printf("stat %s: %v", name, err)
+		return "", nil
+	}
+	s.usage.ingested(root, f.size)
+	s.storageAdded(root, f.size)
+	sum, err := s.blobs.sum(f)
+	if err != nil {
+		s.logger.Printf("hash %s: %v", f.path, err)
+	}
+	s.scan.seen(root, f)
+	source := "upload"
+	if target != "" {
+		source = "capture"
+	}
+	s.publishProfile(root, f, sum, source, target)
+	return sum, nil
+}
+
+// saveFailed removes the new profile name of root that couldn't be saved to
+// its storage and responds with err.
+func (s *server) saveFailed(w http.ResponseWriter, r *http.Request, root *profileRoot, name string, err error) {
+	os.Remove(root.filePath(name))
+	if os.IsExist(err) {
+		http.Error(w, "profile exists", http.StatusConflict)
+		return
+	}
+	s.logger.Printf("%s save %s: %v", requestID(r.Context()), name, err)
+	http.Error(w, "could not store profile", http.StatusInternalServerError)
+}
+
+// storeProfile writes p gzip compressed to the new file filePath.
+func storeProfile(filePath string, p *profile.Profile) error {
+	return createFile(filePath, p.Write)
+}
+
+// createFile creates the new file filePath and its directory and writes its
+// contents with write. The file is removed if writing fails.
+func createFile(filePath string, write func(io.Writer) error) error {
+	if err := os.MkdirAll(filepath.Dir(filePath), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	err = write(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(filePath)
+	}
+	return err
+}
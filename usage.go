@@ -0,0 +1,267 @@
+package pprofweb
+
+import (
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// usageTopViewers is the number of viewers listed per tenant.
+const usageTopViewers = 10
+
+// usageSaveInterval is how often changed usage is written to the usage file.
+const usageSaveInterval = time.Minute
+
+// tenantUsage is the usage of a tenant, a profile root, in a month.
+type tenantUsage struct {
+	ProfilesIngested int64 `json:"profiles_ingested"`
+	BytesIngested    int64 `json:"bytes_ingested"`
+	SessionsCreated  int64 `json:"sessions_created"`
+	// Viewers counts the requests to sessions per user or client address.
+	Viewers map[string]int64 `json:"viewers"`
+}
+
+// usageTracker counts the usage of every tenant per month, e.g. for
+// chargeback. If path is set, the counts are kept in this JSON file.
+type usageTracker struct {
+	path   string
+	logger *log.Logger
+
+	mu sync.Mutex
+	// months maps months like 2006-01 to the usage per tenant.
+	months map[string]map[string]*tenantUsage
+	dirty  bool
+}
+
+// newUsageTracker returns a tracker loading and saving the counts at path,
+// or keeping them in memory if path is empty. Failed saves are logged to
+// logger.
+func newUsageTracker(path string, logger *log.Logger) (*usageTracker, error) {
+	u := &usageTracker{path: path, logger: logger, months: make(map[string]map[string]*tenantUsage)}
+	if path == "" {
+		return u, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return u, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &u.months); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// tenantName returns the tenant of root.
+func tenantName(root *profileRoot) string {
+	if root.name == "" {
+		return "default"
+	}
+	return root.name
+}
+
+// update calls f with the usage of the tenant of root in the current month.
+func (u *usageTracker) update(root *profileRoot, f func(*tenantUsage)) {
+	month := time.Now().UTC().Format("2006-01")
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	tenants, ok := u.months[month]
+	if !ok {
+		tenants = make(map[string]*tenantUsage)
+		u.months[month] = tenants
+	}
+	usage, ok := tenants[tenantName(root)]
+	if !ok {
+		usage = &tenantUsage{Viewers: make(map[string]int64)}
+		tenants[tenantName(root)] = usage
+	}
+	f(usage)
+	u.dirty = true
+}
+
+// ingested counts a profile of size bytes stored in root.
+func (u *usageTracker) ingested(root *profileRoot, size int64) {
+	u.update(root, func(usage *tenantUsage) {
+		usage.ProfilesIngested++
+		usage.BytesIngested += size
+	})
+}
+
+// sessionCreated counts a session of a profile of root.
+func (u *usageTracker) sessionCreated(root *profileRoot) {
+	u.update(root, func(usage *tenantUsage) {
+		usage.SessionsCreated++
+	})
+}
+
+// viewed counts a request of viewer to a session of a profile of root.
+func (u *usageTracker) viewed(root *profileRoot, viewer string) {
+	u.update(root, func(usage *tenantUsage) {
+		usage.Viewers[viewer]++
+	})
+}
+
+// run periodically saves changed counts to the usage file.
+func (u *usageTracker) run() {
+	for range time.Tick(usageSaveInterval) {
+		if err := u.save(); err != nil {
+			u.logger.Printf("usage: %v", err)
+		}
+	}
+}
+
+func (u *usageTracker) save() error {
+	u.mu.Lock()
+	if !u.dirty || u.path == "" {
+		u.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(u.months)
+	u.dirty = false
+	u.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// replace the file atomically so a crash doesn't lose all counts
+	tmp := u.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, u.path)
+}
+
+// viewerName identifies the user of r for usage reports: the basic auth
+// user if set, otherwise the client address.
+func (s *server) viewerName(r *http.Request) string {
+	if user, _, ok := r.BasicAuth(); ok && user != "" {
+		return user
+	}
+	return s.clientIP(r)
+}
+
+// usageViewer is a viewer in a usage report.
+type usageViewer struct {
+	Name     string `json:"name"`
+	Requests int64  `json:"requests"`
+}
+
+// usageReportEntry is the usage of a tenant in a usage report.
+type usageReportEntry struct {
+	Tenant           string        `json:"tenant"`
+	ProfilesIngested int64         `json:"profiles_ingested"`
+	BytesIngested    int64         `json:"bytes_ingested"`
+	SessionsCreated  int64         `json:"sessions_created"`
+	StoredProfiles   int           `json:"stored_profiles"`
+	StorageBytes     int64         `json:"storage_bytes"`
+	TopViewers       []usageViewer `json:"top_viewers"`
+}
+
+// usageReport returns the usage of all tenants in month, with the current
+// storage of the roots.
+func (s *server) usageReport(month string) []usageReportEntry {
+	s.usage.mu.Lock()
+	var entries []usageReportEntry
+	for _, root := range append([]*profileRoot{s.defaultRoot}, s.roots...) {
+		entry := usageReportEntry{Tenant: tenantName(root), TopViewers: []usageViewer{}}
+		if usage, ok := s.usage.months[month][entry.Tenant]; ok {
+			entry.ProfilesIngested = usage.ProfilesIngested
+			entry.BytesIngested = usage.BytesIngested
+			entry.SessionsCreated = usage.SessionsCreated
+			for name, requests := range usage.Viewers {
+				entry.TopViewers = append(entry.TopViewers, usageViewer{name, requests})
+			}
+		}
+		entries = append(entries, entry)
+	}
+	s.usage.mu.Unlock()
+
+	for i, root := range append([]*profileRoot{s.defaultRoot}, s.roots...) {
+		entry := &entries[i]
+		sort.Slice(entry.TopViewers, func(a, b int) bool {
+			if entry.TopViewers[a].Requests != entry.TopViewers[b].Requests {
+				return entry.TopViewers[a].Requests > entry.TopViewers[b].Requests
+			}
+			return entry.TopViewers[a].Name < entry.TopViewers[b].Name
+		})
+		if len(entry.TopViewers) > usageTopViewers {
+			entry.TopViewers = entry.TopViewers[:usageTopViewers]
+		}
+		files, err := root.listProfiles(s.allowedExtensions)
+		if err != nil {
+			s.logger.Printf("usage: list %s: %v", root.path, err)
+		}
+		entry.StoredProfiles = len(files)
+		for _, f := range files {
+			entry.StorageBytes += f.size
+		}
+	}
+	return entries
+}
+
+// usageHandler serves the usage report of ?month=2006-01 (the current month
+// by default) as HTML, or as JSON below /api/.
+func (s *server) usageHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireRole(w, r, adminRole) {
+		return
+	}
+	prefs, err := s.requestPrefs(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	month := r.URL.Query().Get("month")
+	if month == "" {
+		month = time.Now().UTC().Format("2006-01")
+	}
+	if _, err := time.Parse("2006-01", month); err != nil {
+		http.Error(w, "month must be like 2006-01", http.StatusBadRequest)
+		return
+	}
+	entries := s.usageReport(month)
+
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		writeJSON(w, struct {
+			Month   string             `json:"month"`
+			Tenants []usageReportEntry `json:"tenants"`
+		}{month, entries})
+		return
+	}
+	// the preferences of the request format the values
+	t := template.Must(usageTemplate.Clone()).Funcs(template.FuncMap{"bytes": prefs.bytes})
+	if err := t.Execute(w, struct {
+		Month   string
+		Tenants []usageReportEntry
+	}{month, entries}); err != nil {
+		s.logger.Printf("%s usage: %v", requestID(r.Context()), err)
+	}
+}
+
+var usageTemplate = template.Must(template.New("usage").Funcs(template.FuncMap{"bytes": formatBytes}).Parse(`<!doctype html>
+<html>
+<head><title>pprofweb usage {{.Month}}</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 2px 8px; text-align: left; vertical-align: top; }
+</style>
+</head>
+<body>
+<h1>Usage {{.Month}}</h1>
+<form><input name="month" value="{{.Month}}" placeholder="2006-01"> <button>Show</button></form>
+<table>
+<tr><th>Tenant</th><th>Profiles ingested</th><th>Ingested</th><th>Sessions</th><th>Stored profiles</th><th>Storage</th><th>Top viewers (requests)</th></tr>
+{{range .Tenants}}<tr><td>{{.Tenant}}</td><td>{{.ProfilesIngested}}</td><td>{{bytes .BytesIngested}}</td><td>{{.SessionsCreated}}</td><td>{{.StoredProfiles}}</td><td>{{bytes .StorageBytes}}</td>
+<td>{{range .TopViewers}}{{.Name}} ({{.Requests}})<br>{{end}}</td></tr>
+{{end}}</table>
+<p>Stored profiles and storage are current, not as of the end of the month.</p>
+</body>
+</html>
+`))
@@ -0,0 +1,185 @@
+package pprofweb
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/google/pprof/profile"
+)
+
+// minCPUSamples is the number of samples below which CPU profiles are too
+// noisy to draw conclusions from.
+const minCPUSamples = 100
+
+// stackDepthLimits are the depths at which profilers cut stacks, e.g. 32 for
+// heap profiles and 64 for CPU profiles of the Go runtime.
+var stackDepthLimits = []int{32, 64, 128}
+
+// diagnostic is a finding of POST /api/v1/validate.
+type diagnostic struct {
+	// Severity is error, warning, or info.
+	Severity string `json:"severity"`
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+}
+
+// validationReport is the response of POST /api/v1/validate.
+type validationReport struct {
+	// Valid is false if the profile can't be shown.
+	Valid       bool         `json:"valid"`
+	Type        string       `json:"type,omitempty"`
+	SampleTypes []string     `json:"sample_types,omitempty"`
+	Samples     int          `json:"samples"`
+	Diagnostics []diagnostic `json:"diagnostics"`
+}
+
+func (v *validationReport) add(severity, code, format string, args ...interface{}) {
+	if severity == "error" {
+		v.Valid = false
+	}
+	v.Diagnostics = append(v.Diagnostics, diagnostic{severity, code, fmt.Sprintf(format, args...)})
+}
+
+// validateProfile parses data and reports problems of the profile that make
+// views empty or misleading.
+func validateProfile(data []byte, name string) *validationReport {
+	v := &validationReport{Valid: true, Diagnostics: []diagnostic{}}
+	if len(data) == 0 {
+		v.add("error", "empty", "the file is empty")
+		return v
+	}
+	p, err := parseProfileData(data)
+	if err != nil {
+		if looksLikeProfile(data) {
+			v.add("error", "parse_error", "could not parse the profile, it may be truncated: %v", err)
+		} else {
+			v.add("error", "not_a_profile", "not a pprof profile or goroutine dump: %v", err)
+		}
+		return v
+	}
+	if err := p.CheckValid(); err != nil {
+		v.add("error", "invalid", "the profile is inconsistent: %v", err)
+		return v
+	}
+
+	t := detectProfileType(p, name)
+	v.Type = t.tag()
+	for _, st := range p.SampleType {
+		v.SampleTypes = append(v.SampleTypes, st.Type+"/"+st.Unit)
+	}
+	v.Samples = len(p.Sample)
+	if len(p.Sample) == 0 {
+		v.add("error", "no_samples", "the profile has no samples, so all views are empty")
+		return v
+	}
+
+	nonZero := false
+	for _, s := range p.Sample {
+		for _, value := range s.Value {
+			if value != 0 {
+				nonZero = true
+			}
+		}
+	}
+	if !nonZero {
+		v.add("error", "zero_values", "all sample values are zero, so all views are empty")
+	}
+
+	if t == cpuProfile {
+		if p.DurationNanos <= 0 {
+			v.add("warning", "zero_duration", "the CPU profile has no duration, so rates can't be computed")
+		}
+		if p.Period <= 0 {
+			v.add("warning", "zero_period", "the CPU profile has no sampling period")
+		}
+		if i := sampleIndexByName(p, "samples"); i >= 0 {
+			if n := sampleTotal(p, i); n < minCPUSamples {
+				v.add("warning", "low_sample_count",
+					"only %d CPU samples: capture longer or under load for meaningful results", n)
+			}
+		}
+	} else if len(p.Sample) < 10 {
+		v.add("info", "few_samples", "only %d samples", len(p.Sample))
+	}
+	if p.TimeNanos == 0 {
+		v.add("info", "no_timestamp", "the profile has no capture time")
+	}
+
+	diagnoseSymbols(v, p)
+	diagnoseStacks(v, p)
+	return v
+}
+
+// diagnoseSymbols reports locations without mappings or function names.
+func diagnoseSymbols(v *validationReport, p *profile.Profile) {
+	unsymbolized, unmapped := 0, 0
+	for _, loc := range p.Location {
+		if len(loc.Line) == 0 {
+			unsymbolized++
+			if loc.Mapping == nil {
+				unmapped++
+			}
+		}
+	}
+	if len(p.Location) == 0 {
+		return
+	}
+	if unmapped > 0 {
+		v.add("warning", "missing_mappings",
+			"%d of %d locations have neither function names nor a mapping, so they can't be symbolized", unmapped, len(p.Location))
+	}
+	if unsymbolized > unmapped {
+		v.add("warning", "unsymbolized",
+			"%d of %d locations have no function names: add the binaries to --binaries or symbolize when capturing",
+			unsymbolized-unmapped, len(p.Location))
+	}
+}
+
+// diagnoseStacks reports samples without stacks and stacks cut at a depth
+// limit of the profiler.
+func diagnoseStacks(v *validationReport, p *profile.Profile) {
+	empty, maxDepth := 0, 0
+	depths := make(map[int]int)
+	for _, s := range p.Sample {
+		depth := len(s.Location)
+		if depth == 0 {
+			empty++
+		}
+		depths[depth]++
+		if depth > maxDepth {
+			maxDepth = depth
+		}
+	}
+	if empty > 0 {
+		v.add("warning", "empty_stacks", "%d of %d samples have no stack", empty, len(p.Sample))
+	}
+	for _, limit := range stackDepthLimits {
+		if maxDepth == limit && depths[limit] > 0 {
+			v.add("warning", "truncated_stacks",
+				"%d samples have exactly %d frames, the limit of the profiler: their stacks are likely truncated, "+
+					"so roots in flamegraphs are missing", depths[limit], limit)
+		}
+	}
+}
+
+// validateHandler serves POST /api/v1/validate: it checks the profile in the
+// request body, e.g. from a capture pipeline, without storing it. ?name= is
+// the file name, which helps telling block and mutex profiles apart.
+func (s *server) validateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.maxUploadSize))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not read profile: %v", err), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !s.screenUpload(w, r, r.URL.Query().Get("name"), bytes.NewReader(data), int64(len(data))) {
+		return
+	}
+	writeJSON(w, validateProfile(data, r.URL.Query().Get("name")))
+}
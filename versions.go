@@ -0,0 +1,294 @@
+package pprofweb
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultVersionFunctions is the number of functions of a version matrix.
+const defaultVersionFunctions = 20
+
+// versionBuild is a column of a version matrix: a profile of a build.
+type versionBuild struct {
+	// Version is the version label of the profile, or its reference if it
+	// has none.
+	Version string `json:"version"`
+	Profile string `json:"profile"`
+	Total   int64  `json:"total"`
+}
+
+// versionRow is a function of a version matrix with its value and share of
+// the total in every build.
+type versionRow struct {
+	Function string    `json:"function"`
+	Values   []int64   `json:"values"`
+	Shares   []float64 `json:"shares"`
+	// Regression is the version the share of the function grew the most
+	// in, from the build before, and Increase the growth of the share;
+	// empty if it never grew.
+	Regression string  `json:"regression,omitempty"`
+	Increase   float64 `json:"increase,omitempty"`
+}
+
+// versionMatrix is the JSON response of GET /api/v1/versions.
+type versionMatrix struct {
+	SampleType string `json:"sample_type"`
+	Unit       string `json:"unit"`
+	// Value is flat or cum.
+	Value     string         `json:"value"`
+	Builds    []versionBuild `json:"builds"`
+	Functions []versionRow   `json:"functions"`
+}
+
+// buildVersionMatrix returns the n functions with the highest share in any
+// of the builds, highest first, from the top tables of the builds. cum
+// selects the cumulative values instead of the flat ones.
+func buildVersionMatrix(builds []versionBuild, tables [][]topEntry, cum bool, n int) []versionRow {
+	rows := make(map[string]*versionRow)
+	for i, table := range tables {
+		for _, e := range table {
+			row := rows[e.Name]
+			if row == nil {
+				row = &versionRow{Function: e.Name, Values: make([]int64, len(builds)), Shares: make([]float64, len(builds))}
+				rows[e.Name] = row
+			}
+			row.Values[i] = e.Flat
+			if cum {
+				row.Values[i] = e.Cum
+			}
+			if builds[i].Total != 0 {
+				row.Shares[i] = float64(row.Values[i]) / float64(builds[i].Total)
+			}
+		}
+	}
+	peak := func(r *versionRow) float64 {
+		max := 0.0
+		for _, share := range r.Shares {
+			if share > max {
+				max = share
+			}
+		}
+		return max
+	}
+	sorted := make([]*versionRow, 0, len(rows))
+	for _, row := range rows {
+		sorted = append(sorted, row)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if pi, pj := peak(sorted[i]), peak(sorted[j]); pi != pj {
+			return pi > pj
+		}
+		return sorted[i].Function < sorted[j].Function
+	})
+	if n > 0 && len(sorted) > n {
+		sorted = sorted[:n]
+	}
+	matrix := make([]versionRow, 0, len(sorted))
+	for _, row := range sorted {
+		for i := 1; i < len(row.Shares); i++ {
+			if increase := row.Shares[i] - row.Shares[i-1]; increase > row.Increase {
+				row.Regression, row.Increase = builds[i].Version, increase
+			}
+		}
+		matrix = append(matrix, *row)
+	}
+	return matrix
+}
+
+// versionsHandler serves the matrix of the top functions of the profiles of
+// GET /versions?profile=a&profile=b..., profiles of builds of the same
+// program, by their share of the total in every build, to find the release a
+// function got more expensive in. The builds are ordered by their version
+// label if all are semantic versions, else by capture time like other series.
+// ?si= selects the sample type, ?value=cum the cumulative values instead of
+// flat, and ?n= the number of functions (default 20, all with n=0).
+// /api/v1/versions returns it as JSON.
+func (s *server) versionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	n := defaultVersionFunctions
+	if v := query.Get("n"); v != "" {
+		var err error
+		n, err = strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "n must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+	}
+	value := query.Get("value")
+	if value == "" {
+		value = "flat"
+	}
+	if value != "flat" && value != "cum" {
+		http.Error(w, "value must be flat or cum", http.StatusBadRequest)
+		return
+	}
+	prefs, err := s.requestPrefs(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	refs := query["profile"]
+	if len(refs) < 2 {
+		http.Error(w, "at least two profile parameters are required", http.StatusBadRequest)
+		return
+	}
+	if len(refs) > maxSeriesProfiles {
+		http.Error(w, fmt.Sprintf("at most %d profiles can be compared", maxSeriesProfiles), http.StatusBadRequest)
+		return
+	}
+	var profiles []seriesProfile
+	for _, ref := range refs {
+		_, name, p, ok := s.openProfile(w, r, ref)
+		if !ok {
+			return
+		}
+		profiles = append(profiles, seriesProfile{name, p})
+	}
+	t := detectProfileType(profiles[0].p, profiles[0].name)
+	for _, o := range profiles[1:] {
+		if pt := detectProfileType(o.p, o.name); pt != t {
+			http.Error(w, fmt.Sprintf("%s is a %s, not a %s", o.name, strings.ToLower(pt.title()), strings.ToLower(t.title())),
+				http.StatusBadRequest)
+			return
+		}
+	}
+	versions := make(map[string]semver, len(profiles))
+	allVersioned, allTimed := true, true
+	for _, o := range profiles {
+		v, ok := parseSemver(profileVersion(o.p))
+		versions[o.name] = v
+		allVersioned = allVersioned && ok
+		allTimed = allTimed && o.p.TimeNanos != 0
+	}
+	switch {
+	case allVersioned:
+		sort.SliceStable(profiles, func(i, j int) bool {
+			return versions[profiles[i].name].compare(versions[profiles[j].name]) < 0
+		})
+	case allTimed:
+		sort.SliceStable(profiles, func(i, j int) bool {
+			return profiles[i].p.TimeNanos < profiles[j].p.TimeNanos
+		})
+	}
+
+	matrix := versionMatrix{Value: value}
+	var tables [][]topEntry
+	for _, o := range profiles {
+		sampleIndex, err := selectSampleIndex(o.p, query.Get("si"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("%s: %v", o.name, err), http.StatusBadRequest)
+			return
+		}
+		matrix.SampleType = o.p.SampleType[sampleIndex].Type
+		matrix.Unit = o.p.SampleType[sampleIndex].Unit
+		version := profileVersion(o.p)
+		if version == "" {
+			version = o.name
+		}
+		matrix.Builds = append(matrix.Builds, versionBuild{Version: version, Profile: o.name, Total: sampleTotal(o.p, sampleIndex)})
+		tables = append(tables, topTable(o.p, sampleIndex))
+	}
+	matrix.Functions = buildVersionMatrix(matrix.Builds, tables, value == "cum", n)
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		writeJSON(w, matrix)
+		return
+	}
+
+	type cell struct {
+		Value, Share string
+		// Heat is the opacity of the background, the share relative to the
+		// highest share of the matrix.
+		Heat       string
+		Regression bool
+	}
+	type row struct {
+		Function, Regression string
+		Cells                []cell
+	}
+	page := struct {
+		SampleType, Value, OtherValue, OtherValueURL string
+		Builds                                       []versionBuild
+		BuildURLs, Totals                            []string
+		Rows                                         []row
+		Columns                                      int
+	}{SampleType: matrix.SampleType, Value: value, Builds: matrix.Builds, Columns: len(matrix.Builds) + 2}
+	for _, b := range matrix.Builds {
+		page.BuildURLs = append(page.BuildURLs, "/?"+url.Values{"profile": {b.Profile}, "si": {matrix.SampleType}}.Encode())
+		page.Totals = append(page.Totals, prefs.value(b.Total, matrix.Unit))
+	}
+	other := url.Values{}
+	for k, v := range query {
+		other[k] = v
+	}
+	page.OtherValue = "cum"
+	if value == "cum" {
+		page.OtherValue = "flat"
+	}
+	other.Set("value", page.OtherValue)
+	page.OtherValueURL = "/versions?" + other.Encode()
+	highest := 0.0
+	for _, f := range matrix.Functions {
+		for _, share := range f.Shares {
+			if share > highest {
+				highest = share
+			}
+		}
+	}
+	for _, f := range matrix.Functions {
+		rw := row{Function: f.Function}
+		if f.Regression != "" {
+			rw.Regression = fmt.Sprintf("%s (+%.1f%%)", f.Regression, 100*f.Increase)
+		}
+		for i, share := range f.Shares {
+			heat := 0.0
+			if highest > 0 {
+				heat = share / highest
+			}
+			rw.Cells = append(rw.Cells, cell{
+				Value:      prefs.value(f.Values[i], matrix.Unit),
+				Share:      fmt.Sprintf("%.1f%%", 100*share),
+				Heat:       strconv.FormatFloat(heat, 'f', 2, 64),
+				Regression: f.Regression != "" && f.Regression == matrix.Builds[i].Version,
+			})
+		}
+		page.Rows = append(page.Rows, rw)
+	}
+	if err := versionsTemplate.Execute(w, page); err != nil {
+		s.logger.Printf("%s versions: %v", requestID(r.Context()), err)
+	}
+}
+
+var versionsTemplate = template.Must(template.New("versions").Parse(`<!doctype html>
+<html>
+<head><title>pprofweb versions</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin: 1em 0; }
+td, th { border: 1px solid #ccc; padding: 2px 8px; text-align: left; }
+td.share { text-align: right; }
+td.regression { outline: 2px solid #000; outline-offset: -2px; font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>Versions: {{.SampleType}} ({{.Value}})</h1>
+<p>The share of the total of the functions most expensive in any build, by
+version. The outlined cell of a function is the build its share grew the
+most in. Show <a href="{{.OtherValueURL}}">{{.OtherValue}}</a> values.</p>
+<table>
+<tr><th>Function</th>{{range $i, $b := .Builds}}<th><a href="{{index $.BuildURLs $i}}" title="{{$b.Profile}}">{{$b.Version}}</a></th>{{end}}<th>Grew most in</th></tr>
+<tr><td><i>total</i></td>{{range .Totals}}<td class="share">{{.}}</td>{{end}}<td></td></tr>
+{{range .Rows}}<tr><td>{{.Function}}</td>{{range .Cells}}<td class="share{{if .Regression}} regression{{end}}" title="{{.Value}}" style="background: rgba(220, 60, 40, {{.Heat}})">{{.Share}}</td>{{end}}<td>{{.Regression}}</td></tr>
+{{else}}<tr><td colspan="{{.Columns}}">The profiles have no samples.</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
@@ -0,0 +1,118 @@
+package pprofweb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/google/pprof/profile"
+)
+
+// coreExtension marks Go core dumps, which are converted to heap profiles
+// with viewcore.
+const coreExtension = ".core"
+
+var elfMagic = []byte("\x7fELF")
+
+// isCoreDump reports whether name is the name of a core dump.
+func isCoreDump(name string) bool {
+	return strings.HasSuffix(name, coreExtension)
+}
+
+// findBinary returns the path of the executable exe in the colon separated
+// search path binaries. exe can't escape the directories.
+func findBinary(binaries, exe string) (string, error) {
+	for _, dir := range filepath.SplitList(binaries) {
+		if dir == "" {
+			continue
+		}
+		p := filepath.Join(dir, filepath.Clean("/"+exe))
+		if info, err := os.Stat(p); err == nil && !info.IsDir() {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("executable %q not found in binaries search path", exe)
+}
+
+// coreHeapProfile runs viewcore in sb on the core dump at corePath of the
+// program exe and converts the histogram of live heap objects by type into a
+// heap profile. exe is looked up in binaries; if empty, viewcore uses the path
+// recorded in the core dump.
+func coreHeapProfile(ctx context.Context, sb *sandbox, viewcore, binaries, corePath, exe string) (*profile.Profile, error) {
+	args := []string{corePath}
+	if exe != "" {
+		exePath, err := findBinary(binaries, exe)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "--exe", exePath)
+	}
+	args = append(args, "histogram")
+
+	out, err := sb.output(ctx, viewcore, args...)
+	if err != nil {
+		return nil, fmt.Errorf("viewcore: %w", err)
+	}
+	return parseViewcoreHistogram(out)
+}
+
+// parseViewcoreHistogram converts the output of viewcore histogram, lines of
+// "count size bytes type" after a header, into a heap profile with one sample
+// per type and size class. The stack of a sample is the type followed by the
+// size class, so flamegraphs group objects by type.
+func parseViewcoreHistogram(out []byte) (*profile.Profile, error) {
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{
+			{Type: "inuse_objects", Unit: "count"},
+			{Type: "inuse_space", Unit: "bytes"},
+		},
+		PeriodType: &profile.ValueType{Type: "space", Unit: "bytes"},
+		Period:     1,
+	}
+	locations := make(map[string]*profile.Location)
+	location := func(name string) *profile.Location {
+		if loc, ok := locations[name]; ok {
+			return loc
+		}
+		fn := &profile.Function{ID: uint64(len(p.Function) + 1), Name: name, SystemName: name}
+		p.Function = append(p.Function, fn)
+		loc := &profile.Location{ID: uint64(len(p.Location) + 1), Line: []profile.Line{{Function: fn}}}
+		p.Location = append(p.Location, loc)
+		locations[name] = loc
+		return loc
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		count, err1 := strconv.ParseInt(fields[0], 10, 64)
+		size, err2 := strconv.ParseInt(fields[1], 10, 64)
+		total, err3 := strconv.ParseInt(fields[2], 10, 64)
+		if err1 != nil || err2 != nil || err3 != nil {
+			// the header
+			continue
+		}
+		typeName := strings.Join(fields[3:], " ")
+		p.Sample = append(p.Sample, &profile.Sample{
+			// leaf first
+			Location: []*profile.Location{location(fmt.Sprintf("%s (%d bytes)", typeName, size)), location(typeName)},
+			Value:    []int64{count, total},
+			NumLabel: map[string][]int64{"bytes": {size}},
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(p.Sample) == 0 {
+		return nil, fmt.Errorf("viewcore histogram is empty")
+	}
+	return p, p.CheckValid()
+}
@@ -0,0 +1,326 @@
+package pprofweb
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// watchTimeout limits fetching a sample of a watched target.
+const watchTimeout = 10 * time.Second
+
+// minWatchInterval is the shortest interval between samples of a target and
+// type; watchers polling faster share the last sample.
+const minWatchInterval = time.Second
+
+// defaultWatchInterval and maxWatchInterval are the seconds between samples
+// of watch pages without interval and the largest interval.
+const (
+	defaultWatchInterval = 5
+	maxWatchInterval     = 60
+)
+
+// watchValue is a headline number of a sample, e.g. the goroutines in a
+// state.
+type watchValue struct {
+	Name  string  `json:"name"`
+	Value float64 `json:"value"`
+	// Unit is bytes or count.
+	Unit string `json:"unit"`
+}
+
+// watchSample is the JSON response of GET /api/v1/targets/{name}/watch.
+type watchSample struct {
+	Time   time.Time    `json:"time"`
+	Type   string       `json:"type"`
+	Values []watchValue `json:"values"`
+}
+
+// watchSamplers take a lightweight sample of the profile type of a target.
+var watchSamplers = map[string]func(target *captureTarget) ([]watchValue, error){
+	"goroutine": sampleGoroutines,
+	"heap":      sampleHeap,
+}
+
+// sampleGoroutines counts the goroutines of target in total and by state,
+// most frequent first, from its text goroutine dump.
+func sampleGoroutines(target *captureTarget) ([]watchValue, error) {
+	data, err := fetchPprof(target.url, target.credentials, "goroutine", "debug=2", watchTimeout)
+	if err != nil {
+		return nil, err
+	}
+	p, err := parseProfileData(data)
+	if err != nil {
+		return nil, err
+	}
+	var total float64
+	states := make(map[string]float64)
+	for _, s := range p.Sample {
+		state := "unknown"
+		if l := s.Label["state"]; len(l) > 0 {
+			state = l[0]
+		}
+		states[state] += float64(s.Value[0])
+		total += float64(s.Value[0])
+	}
+	values := make([]watchValue, 0, len(states))
+	for state, n := range states {
+		values = append(values, watchValue{Name: state, Value: n, Unit: "count"})
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if values[i].Value != values[j].Value {
+			return values[i].Value > values[j].Value
+		}
+		return values[i].Name < values[j].Name
+	})
+	return append([]watchValue{{Name: "total", Value: total, Unit: "count"}}, values...), nil
+}
+
+// sampleHeap returns the bytes and objects in use of the heap profile of
+// target.
+func sampleHeap(target *captureTarget) ([]watchValue, error) {
+	data, err := fetchPprof(target.url, target.credentials, "heap", "", watchTimeout)
+	if err != nil {
+		return nil, err
+	}
+	p, err := parseProfileData(data)
+	if err != nil {
+		return nil, err
+	}
+	space, ok := typeTotal("inuse_space")(p)
+	if !ok {
+		return nil, fmt.Errorf("not a heap profile")
+	}
+	objects, _ := typeTotal("inuse_objects")(p)
+	return []watchValue{
+		{Name: "in use", Value: space, Unit: "bytes"},
+		{Name: "objects in use", Value: objects, Unit: "count"},
+	}, nil
+}
+
+// watchCache keeps the last sample of each target and type.
+type watchCache struct {
+	mu      sync.Mutex
+	samples map[string]*watchSample
+}
+
+func newWatchCache() *watchCache {
+	return &watchCache{samples: make(map[string]*watchSample)}
+}
+
+// sample returns a sample of the type t of target, the last one if it is
+// more recent than minWatchInterval.
+func (c *watchCache) sample(target *captureTarget, t string) (*watchSample, error) {
+	key := target.name + "/" + t
+	c.mu.Lock()
+	last, ok := c.samples[key]
+	c.mu.Unlock()
+	if ok && time.Since(last.Time) < minWatchInterval {
+		return last, nil
+	}
+	values, err := watchSamplers[t](target)
+	if err != nil {
+		return nil, err
+	}
+	sample := &watchSample{Time: time.Now(), Type: t, Values: values}
+	c.mu.Lock()
+	c.samples[key] = sample
+	c.mu.Unlock()
+	return sample, nil
+}
+
+// watchType returns the watched profile type of the query of r, goroutine by
+// default, or writes a 400 response and returns false.
+func watchType(w http.ResponseWriter, r *http.Request) (string, bool) {
+	t := r.URL.Query().Get("type")
+	if t == "" {
+		t = "goroutine"
+	}
+	if _, ok := watchSamplers[t]; !ok {
+		http.Error(w, fmt.Sprintf("unknown type %q: watch goroutine or heap", t), http.StatusBadRequest)
+		return "", false
+	}
+	return t, true
+}
+
+// watchSampleHandler serves GET /api/v1/targets/{name}/watch?type=goroutine,
+// a sample of the live target as JSON watchSample.
+func (s *server) watchSampleHandler(w http.ResponseWriter, r *http.Request, target *captureTarget) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireAuth(w, r, target.root) || !s.requireRole(w, r, viewerRole) {
+		return
+	}
+	t, ok := watchType(w, r)
+	if !ok {
+		return
+	}
+	sample, err := s.watches.sample(target, t)
+	if err != nil {
+		s.logger.Printf("%s watch %s of %s: %v", requestID(r.Context()), t, target.name, err)
+		http.Error(w, fmt.Sprintf("sample failed: %v", err), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, sample)
+}
+
+// watchHandler serves GET /targets/{name}/watch?type=goroutine&interval=5, a
+// page charting the goroutines by state or the heap in use of the live
+// target, sampled every interval seconds while it is open, with buttons to
+// capture a full profile into storage and to compare a new CPU profile with
+// the previous one.
+func (s *server) watchHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/targets/"), "/")
+	if len(parts) != 2 || parts[1] != "watch" {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	target, ok := s.target(parts[0])
+	if !ok {
+		http.Error(w, "unknown target", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireAuth(w, r, target.root) || !s.requireRole(w, r, viewerRole) {
+		return
+	}
+	t, ok := watchType(w, r)
+	if !ok {
+		return
+	}
+	interval := defaultWatchInterval
+	if v := r.URL.Query().Get("interval"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxWatchInterval {
+			http.Error(w, fmt.Sprintf("interval must be between 1 and %d seconds", maxWatchInterval), http.StatusBadRequest)
+			return
+		}
+		interval = n
+	}
+	types := make([]string, 0, len(watchSamplers))
+	for other := range watchSamplers {
+		types = append(types, other)
+	}
+	sort.Strings(types)
+
+	if err := watchTemplate.Execute(w, struct {
+		Target, Type string
+		Types        []string
+		Interval     int
+		SampleURL    string
+		CaptureURL   string
+		DeltaURL     string
+	}{
+		Target:     target.name,
+		Type:       t,
+		Types:      types,
+		Interval:   interval,
+		SampleURL:  "/api/v1/targets/" + url.PathEscape(target.name) + "/watch?type=" + t,
+		CaptureURL: "/api/v1/targets/" + url.PathEscape(target.name) + "/capture?type=" + t,
+		DeltaURL:   "/api/v1/targets/" + url.PathEscape(target.name) + "/delta?seconds=30",
+	}); err != nil {
+		s.logger.Printf("%s watch: %v", requestID(r.Context()), err)
+	}
+}
+
+var watchTemplate = template.Must(template.New("watch").Parse(`<!doctype html>
+<html>
+<head><title>pprofweb watch {{.Target}}</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 2px 8px; text-align: left; }
+td.value { text-align: right; }
+</style>
+</head>
+<body>
+<h1>Watching {{.Type}} of {{.Target}}</h1>
+<p>{{range .Types}}{{if eq . $.Type}}<b>{{.}}</b>{{else}}<a href="?type={{.}}&amp;interval={{$.Interval}}">{{.}}</a>{{end}} {{end}}
+| sampled every {{.Interval}}s while this page is open
+| <button id="snapshot">Snapshot full profile</button>
+<button id="delta" title="capture a CPU profile and compare it with the previous capture">Capture 30s CPU and compare</button>
+<span id="status"></span></p>
+<svg id="chart" width="800" height="240" style="border:1px solid #ccc"></svg>
+<table id="values"></table>
+<script>
+(function() {
+  const sampleURL = {{.SampleURL}}, captureURL = {{.CaptureURL}}, deltaURL = {{.DeltaURL}}, interval = {{.Interval}} * 1000;
+  const colors = ['#333', '#c33', '#36c', '#393', '#f90', '#909', '#099', '#999'];
+  const maxPoints = 120, maxSeries = colors.length;
+  const history = [];
+  const status = document.getElementById('status');
+  function format(v, unit) {
+    if (unit !== 'bytes') return Math.round(v).toLocaleString();
+    const units = ['B', 'KiB', 'MiB', 'GiB', 'TiB'];
+    let i = 0;
+    while (Math.abs(v) >= 1024 && i < units.length - 1) { v /= 1024; i++; }
+    return v.toFixed(i ? 1 : 0) + ' ' + units[i];
+  }
+  function render() {
+    const last = history[history.length - 1];
+    const names = last.values.slice(0, maxSeries).map(v => v.name);
+    let max = 0;
+    history.forEach(s => s.values.forEach(v => { if (names.includes(v.name) && v.value > max) max = v.value; }));
+    const svg = document.getElementById('chart'), w = svg.width.baseVal.value, h = svg.height.baseVal.value;
+    svg.innerHTML = names.map((name, i) => {
+      const points = history.map((s, j) => {
+        const v = s.values.find(v => v.name === name);
+        const x = history.length > 1 ? w * j / (history.length - 1) : 0;
+        const y = h - 2 - (max > 0 && v ? (h - 4) * v.value / max : 0);
+        return x.toFixed(1) + ',' + y.toFixed(1);
+      }).join(' ');
+      return '<polyline fill="none" stroke-width="1.5" stroke="' + colors[i] + '" points="' + points + '"/>';
+    }).join('');
+    const table = document.getElementById('values');
+    table.innerHTML = '';
+    last.values.forEach((v, i) => {
+      const row = table.insertRow();
+      const swatch = row.insertCell();
+      if (i < maxSeries) swatch.style.background = colors[i];
+      row.insertCell().textContent = v.name;
+      const value = row.insertCell();
+      value.className = 'value';
+      value.textContent = format(v.value, v.unit);
+    });
+  }
+  function poll() {
+    fetch(sampleURL).then(r => r.ok ? r.json() : r.text().then(t => { throw new Error(t); })).then(sample => {
+      history.push(sample);
+      if (history.length > maxPoints) history.shift();
+      status.textContent = 'last sample ' + new Date(sample.time).toLocaleTimeString();
+      render();
+    }).catch(e => { status.textContent = e.message; });
+  }
+  document.getElementById('snapshot').onclick = function() {
+    this.disabled = true;
+    status.textContent = 'capturing...';
+    fetch(captureURL, {method: 'POST'}).then(r => r.ok ? r.json() : r.text().then(t => { throw new Error(t); })).then(uploaded => {
+      window.open(uploaded.url, '_blank');
+      status.textContent = 'stored ' + uploaded.profile;
+    }).catch(e => { status.textContent = e.message; }).finally(() => { this.disabled = false; });
+  };
+  document.getElementById('delta').onclick = function() {
+    this.disabled = true;
+    status.textContent = 'capturing 30s of CPU...';
+    fetch(deltaURL, {method: 'POST'}).then(r => r.ok ? r.json() : r.text().then(t => { throw new Error(t); })).then(delta => {
+      location.href = delta.url;
+    }).catch(e => { status.textContent = e.message; this.disabled = false; });
+  };
+  poll();
+  setInterval(poll, interval);
+})();
+</script>
+</body>
+</html>
+`))